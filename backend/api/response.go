@@ -34,6 +34,16 @@ func GetUsername(c *gin.Context) (string, bool) {
 	return uname, ok
 }
 
+// GetSessionID 从上下文获取当前登录会话ID
+func GetSessionID(c *gin.Context) (string, bool) {
+	sid, exists := c.Get("session_id")
+	if !exists {
+		return "", false
+	}
+	id, ok := sid.(string)
+	return id, ok
+}
+
 // ExtractToken 从请求头提取 token
 func ExtractToken(c *gin.Context) string {
 	token := c.GetHeader("Authorization")
@@ -48,6 +58,11 @@ func RespondError(c *gin.Context, statusCode int, message string) {
 	c.JSON(statusCode, gin.H{"success": false, "message": message})
 }
 
+// RespondValidationError 返回 400 和逐个字段的校验错误
+func RespondValidationError(c *gin.Context, message string, errors interface{}) {
+	c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": message, "errors": errors})
+}
+
 // RespondSuccess 返回成功响应
 func RespondSuccess(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
@@ -10,6 +10,70 @@ type ModelConfig struct {
 	ApiKey  string `json:"apikey"`
 	BaseURL string `json:"baseurl"`
 	Model   string `json:"model"`
+	// RepairAttempts 生成的行程校验不通过时重新生成的最多次数，默认 2，负数表示不重试
+	RepairAttempts int `json:"repairAttempts"`
+}
+
+// JWTKeyConfig JWT 签名密钥，id 写入 token 头部的 kid
+type JWTKeyConfig struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`      // HS256（默认）、RS256 或 EdDSA
+	Secret         string `json:"secret"`         // HS256 密钥
+	SecretEnv      string `json:"secretEnv"`      // 从该环境变量读取 HS256 密钥
+	PrivateKeyFile string `json:"privateKeyFile"` // RS256/EdDSA 的 PEM 私钥
+	PublicKeyFile  string `json:"publicKeyFile"`  // 只有公钥的密钥仅用于验证已签发的 token
+}
+
+// AuthConfig 认证配置
+type AuthConfig struct {
+	AccessTokenMinutes int            `json:"accessTokenMinutes"` // access token 有效期，默认 15
+	RefreshTokenDays   int            `json:"refreshTokenDays"`   // refresh token 有效期，默认 30
+	Keys               []JWTKeyConfig `json:"keys"`               // 签名和验证密钥
+	SigningKey         string         `json:"signingKey"`         // 签名使用的密钥 id，默认第一个可签名的密钥
+	EphemeralKey       bool           `json:"ephemeralKey"`       // 未配置密钥时使用进程内随机密钥，仅用于本地开发
+	ResetTokenMinutes  int            `json:"resetTokenMinutes"`  // 密码重置令牌有效期，默认 30
+	Lockout            LockoutConfig  `json:"lockout"`            // 登录失败锁定
+	Registration       PolicyConfig   `json:"registration"`       // 用户名和密码规则
+	TOTPIssuer         string         `json:"totpIssuer"`         // 身份验证器应用中显示的服务名称，默认 AI Travel Planner
+}
+
+// LockoutConfig 登录失败锁定配置，为 0 的项使用默认值
+type LockoutConfig struct {
+	UserAttempts      int `json:"userAttempts"`      // 同一用户名允许连续失败的次数，默认 5
+	IPAttempts        int `json:"ipAttempts"`        // 同一 IP 允许连续失败的次数，默认 20
+	BaseDelaySeconds  int `json:"baseDelaySeconds"`  // 首次锁定时长，之后逐次翻倍，默认 30
+	MaxDelayMinutes   int `json:"maxDelayMinutes"`   // 最长锁定时长，默认 15
+	ResetAfterMinutes int `json:"resetAfterMinutes"` // 多久没有新的失败后计数清零，默认 60
+}
+
+// PolicyConfig 用户名和密码规则，为 0 或空的项使用默认值
+type PolicyConfig struct {
+	UsernameMinLength     int      `json:"usernameMinLength"`     // 用户名最少字符数，默认 3
+	UsernameMaxLength     int      `json:"usernameMaxLength"`     // 用户名最多字符数，默认 32
+	UsernamePattern       string   `json:"usernamePattern"`       // 用户名正则，默认字母或数字开头，只含字母、数字、_ . -
+	ReservedUsernames     []string `json:"reservedUsernames"`     // 追加的保留用户名，不区分大小写
+	PasswordMinLength     int      `json:"passwordMinLength"`     // 密码最少字符数，默认 8
+	PasswordMinClasses    int      `json:"passwordMinClasses"`    // 密码至少包含几类字符（小写、大写、数字、符号），默认 2
+	BreachedPasswordsFile string   `json:"breachedPasswordsFile"` // 泄露密码列表，每行一个明文密码或 SHA-1（可带 :次数）
+}
+
+// NotifierConfig 通知渠道配置
+type NotifierConfig struct {
+	Driver     string `json:"driver"`     // outbox（默认）：写入本地文件，不会真正送达
+	OutboxPath string `json:"outboxPath"` // 发件箱文件路径，默认 logs/outbox.jsonl
+}
+
+// OIDCConfig OpenID Connect 单点登录配置，issuer 为空时不启用
+type OIDCConfig struct {
+	Issuer          string   `json:"issuer"`          // 身份提供方地址，端点从 <issuer>/.well-known/openid-configuration 发现
+	ClientID        string   `json:"clientId"`        // 在身份提供方注册的客户端 ID
+	ClientSecret    string   `json:"clientSecret"`    // 客户端密钥
+	ClientSecretEnv string   `json:"clientSecretEnv"` // 从该环境变量读取客户端密钥
+	RedirectURL     string   `json:"redirectUrl"`     // 回调地址，即 <后端地址>/api/auth/oidc/callback
+	Scopes          []string `json:"scopes"`          // 默认 openid profile email
+	UsernameClaim   string   `json:"usernameClaim"`   // 首次登录创建用户时用户名取自该 claim，默认 preferred_username
+	DisableSignup   bool     `json:"disableSignup"`   // 为 true 时不自动创建用户，只允许已关联的身份登录
+	FrontendURL     string   `json:"frontendUrl"`     // 登录完成后跳转的前端地址，令牌放在 URL 片段中；为空时回调直接返回 JSON
 }
 
 type AppConfig struct {
@@ -17,7 +81,27 @@ type AppConfig struct {
 		Host string `json:"host"`
 		Port int    `json:"port"`
 	} `json:"server"`
-	Redis struct {
+	Storage struct {
+		Driver string `json:"driver"` // redis（默认）、sqlite 或 memory
+		Path   string `json:"path"`   // sqlite 数据库文件路径
+	} `json:"storage"`
+	Trash struct {
+		RetentionDays        int `json:"retentionDays"`        // 回收站保留天数，默认 30
+		PurgeIntervalMinutes int `json:"purgeIntervalMinutes"` // 过期清理间隔，默认 60
+	} `json:"trash"`
+	Integrity struct {
+		IntervalMinutes int  `json:"intervalMinutes"` // 一致性检查间隔，默认 1440（每天），小于 0 时关闭
+		Repair          bool `json:"repair"`          // 定时检查时是否自动修复
+	} `json:"integrity"`
+	Jobs struct {
+		Workers        int `json:"workers"`        // 同时执行的后台任务数，默认 2
+		QueueSize      int `json:"queueSize"`      // 等待执行的任务数上限，默认 100
+		RetentionHours int `json:"retentionHours"` // 结束的任务保留时长，默认 168（7 天）
+	} `json:"jobs"`
+	Auth     AuthConfig     `json:"auth"`
+	Notifier NotifierConfig `json:"notifier"`
+	OIDC     OIDCConfig     `json:"oidc"`
+	Redis    struct {
 		Addr     string `json:"addr"`
 		Password string `json:"password"`
 		DB       int    `json:"db"`
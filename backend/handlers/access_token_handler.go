@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAccessTokenRequest 创建个人访问令牌请求结构，expiresInDays 为 0 时使用默认有效期
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+// ListAccessTokensHandler 列出当前用户未过期的个人访问令牌
+func (h *Handler) ListAccessTokensHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	tokens, err := h.stores.AccessTokens.ListAccessTokens(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list access tokens for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取访问令牌失败")
+		return
+	}
+	out := make([]*service.AccessTokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, t.Info())
+	}
+	api.RespondSuccess(c, out)
+}
+
+// CreateAccessTokenHandler 创建个人访问令牌，令牌明文只在响应中返回这一次
+func (h *Handler) CreateAccessTokenHandler(c *gin.Context) {
+	var req CreateAccessTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !service.ValidAccessTokenName(req.Name) || req.ExpiresInDays < 0 {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+	maxDays := int(service.MaxAccessTokenTTL / (24 * time.Hour))
+	if req.ExpiresInDays > maxDays {
+		api.RespondError(c, http.StatusBadRequest, fmt.Sprintf("有效期最长 %d 天", maxDays))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	token, t, err := service.CreateAccessToken(ctx, h.stores.AccessTokens, user, req.Name, req.Scopes, ttl)
+	if errors.Is(err, service.ErrInvalidScope) {
+		api.RespondError(c, http.StatusBadRequest, "未知的权限，可用权限："+strings.Join(service.AccessTokenScopes, ", "))
+		return
+	}
+	if errors.Is(err, service.ErrTooManyAccessTokens) {
+		api.RespondError(c, http.StatusConflict, fmt.Sprintf("最多只能创建 %d 个访问令牌", service.MaxAccessTokensPerUser))
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to create access token for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "创建访问令牌失败")
+		return
+	}
+
+	service.LogInfo("User %s created access token %s (%s) with scopes %v", user.Username, t.ID, t.Name, t.Scopes)
+	c.JSON(http.StatusCreated, gin.H{"success": true, "data": gin.H{"token": token, "accessToken": t.Info()}})
+}
+
+// RevokeAccessTokenHandler 撤销当前用户的个人访问令牌
+func (h *Handler) RevokeAccessTokenHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	err := h.stores.AccessTokens.DeleteAccessToken(ctx, username, id)
+	if errors.Is(err, service.ErrAccessTokenNotFound) {
+		api.RespondError(c, http.StatusNotFound, "访问令牌不存在")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to revoke access token %s for user %s: %v", id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "撤销访问令牌失败")
+		return
+	}
+
+	service.LogInfo("User %s revoked access token %s", username, id)
+	api.RespondSuccess(c, gin.H{"message": "已撤销"})
+}
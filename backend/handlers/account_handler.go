@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// maxImportArchiveSize 导入归档的上传大小上限
+const maxImportArchiveSize = 32 << 20
+
+// currentUser 获取当前登录用户的记录，失败时已写入错误响应
+func (h *Handler) currentUser(ctx context.Context, c *gin.Context) (*service.UserRecord, bool) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return nil, false
+	}
+	user, err := h.stores.Users.GetUser(ctx, username)
+	if err != nil {
+		service.LogError("Failed to get user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return nil, false
+	}
+	if user == nil {
+		api.RespondError(c, http.StatusUnauthorized, "用户不存在")
+		return nil, false
+	}
+	return user, true
+}
+
+// ExportAccountHandler 导出当前用户的全部数据为 zip 归档
+func (h *Handler) ExportAccountHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	// 先写入缓冲区，导出失败时仍能返回 JSON 错误
+	var buf bytes.Buffer
+	if err := service.ExportAccount(ctx, h.stores, user, &buf); err != nil {
+		service.LogError("Failed to export account %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "导出失败")
+		return
+	}
+
+	filename := fmt.Sprintf("travel-planner-%s-%s.zip", user.Username, time.Now().Format("20060102"))
+	service.LogInfo("User %s exported account archive (%d bytes)", user.Username, buf.Len())
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+// ImportAccountHandler 从导出的归档恢复数据到当前用户
+// 归档可以作为 multipart 表单的 file 字段或直接作为请求体上传；
+// 查询参数 conflict=skip|replace|duplicate 指定与已有记录冲突时的处理方式
+func (h *Handler) ImportAccountHandler(c *gin.Context) {
+	conflict, err := service.ParseImportConflict(c.Query("conflict"))
+	if err != nil {
+		api.RespondError(c, http.StatusBadRequest, "conflict 参数只能为 skip、replace 或 duplicate")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 60*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportArchiveSize)
+	var src io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			api.RespondError(c, http.StatusBadRequest, "缺少归档文件")
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			api.RespondError(c, http.StatusBadRequest, "读取归档失败")
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		api.RespondError(c, http.StatusRequestEntityTooLarge, "归档文件过大或读取失败")
+		return
+	}
+
+	report, err := service.ImportAccount(ctx, h.stores, user, bytes.NewReader(data), int64(len(data)), conflict)
+	if errors.Is(err, service.ErrInvalidArchive) {
+		service.LogWarn("User %s uploaded invalid archive: %v", user.Username, err)
+		api.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// 导入中途失败时已写入的记录保留，返回已完成部分的统计
+		service.LogError("Failed to import archive for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "导入失败",
+			"data":    report,
+		})
+		return
+	}
+
+	service.LogInfo("User %s imported archive from %s (trips: %d, diaries: %d, expenses: %d)",
+		user.Username, report.Source, report.Trips.Imported, report.Diaries.Imported, report.Expenses.Imported)
+	api.RespondSuccess(c, report)
+}
+
+// DeleteAccountRequest 注销账户请求，需要再次输入密码确认。单点登录创建的账户没有可用的密码，
+// 关联了外部身份的账户可以改为输入两步验证码，或重新登录后直接注销
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// DeleteAccountHandler 注销当前用户并删除其全部数据，返回删除报告
+func (h *Handler) DeleteAccountHandler(c *gin.Context) {
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 60*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	// 密码和验证码的确认失败与登录共用计数，不能在会话中无限次猜测
+	if !h.checkReauthAllowed(ctx, c, user.Username) {
+		return
+	}
+	sessionID, _ := api.GetSessionID(c)
+	err := service.ConfirmAccountDeletion(ctx, h.stores, user, sessionID, req.Password, req.Code)
+	switch {
+	case errors.Is(err, service.ErrIncorrectPassword):
+		service.LogWarn("Account deletion for user %s rejected: wrong password", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+		api.RespondError(c, http.StatusForbidden, "密码错误")
+		return
+	case errors.Is(err, service.ErrPasswordRequired):
+		api.RespondError(c, http.StatusBadRequest, "请输入密码确认注销")
+		return
+	case errors.Is(err, service.ErrReauthRequired):
+		api.RespondError(c, http.StatusForbidden, "请重新登录或输入两步验证码后再注销")
+		return
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		service.LogWarn("Account deletion for user %s rejected: wrong two-factor code", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+	}
+	if h.respondTwoFactorError(c, user.Username, err) {
+		return
+	}
+
+	report, err := h.stores.Users.DeleteUser(ctx, user.Username)
+	if errors.Is(err, service.ErrUserNotFound) {
+		api.RespondError(c, http.StatusNotFound, "用户不存在")
+		return
+	}
+	if err != nil {
+		// 用户记录已删除但清理中途失败时，返回已完成部分的报告
+		service.LogError("Failed to delete account %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": "注销失败",
+			"data":    report,
+		})
+		return
+	}
+	if !report.Verified {
+		service.LogWarn("Account %s deleted with remaining data: %v", user.Username, report.Remaining)
+	}
+
+	service.LogInfo("User %s (ID: %d) deleted account: %v", user.Username, user.ID, report.Removed)
+	api.RespondSuccess(c, report)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// loginTestSession 为用户创建会话并返回 access token
+func loginTestSession(t *testing.T, h *Handler, u *service.UserRecord) string {
+	t.Helper()
+	pair, err := service.StartSession(context.Background(), h.stores.Sessions, u, service.DeviceInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	return pair.AccessToken
+}
+
+// linkTestIdentity 为用户关联外部身份，模拟单点登录创建的账户
+func linkTestIdentity(t *testing.T, h *Handler, u *service.UserRecord) {
+	t.Helper()
+	err := h.stores.Identities.CreateIdentity(context.Background(), &service.ExternalIdentity{
+		Issuer: "https://idp.example.com", Subject: "sub-" + u.Username, UserID: u.ID, Username: u.Username, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("CreateIdentity: %v", err)
+	}
+}
+
+func TestDeleteAccountRequiresPassword(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+
+	// 没有关联外部身份的账户只能用密码确认，刚登录也不行
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token, map[string]string{}); w.Code != http.StatusBadRequest {
+		t.Fatalf("delete without password = %d; want 400", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+		DeleteAccountRequest{Code: "123456"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("delete with only a code = %d; want 400", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+		DeleteAccountRequest{Password: "wrong"}); w.Code != http.StatusForbidden {
+		t.Fatalf("delete with wrong password = %d; want 403", w.Code)
+	}
+	if w, resp := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+		DeleteAccountRequest{Password: "correct-password"}); w.Code != http.StatusOK {
+		t.Fatalf("delete = %d %v; want 200", w.Code, resp)
+	}
+	if got, _ := h.stores.Users.GetUser(context.Background(), "alice"); got != nil {
+		t.Fatal("account still exists after deletion")
+	}
+}
+
+func TestDeleteAccountLinkedIdentity(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "random-never-shown")
+	linkTestIdentity(t, h, u)
+	token := loginTestSession(t, h, u)
+
+	// 会话早于重新认证的时限：需要重新登录或输入验证码
+	saved := service.ReauthWindow
+	service.ReauthWindow = -time.Second
+	w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token, map[string]string{})
+	service.ReauthWindow = saved
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("delete from a stale session = %d; want 403", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+		DeleteAccountRequest{Code: "123456"}); w.Code != http.StatusConflict {
+		t.Fatalf("delete with a code but no two-factor = %d; want 409", w.Code)
+	}
+	if got, _ := h.stores.Users.GetUser(context.Background(), "alice"); got == nil {
+		t.Fatal("account was deleted without re-authentication")
+	}
+
+	// 刚刚重新登录的会话可以直接注销
+	token = loginTestSession(t, h, u)
+	if w, resp := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token, map[string]string{}); w.Code != http.StatusOK {
+		t.Fatalf("delete after a fresh sign-in = %d %v; want 200", w.Code, resp)
+	}
+	if got, _ := h.stores.Users.GetUser(context.Background(), "alice"); got != nil {
+		t.Fatal("account still exists after deletion")
+	}
+}
+
+// enableTestTwoFactor 直接在存储中为用户启用两步验证
+func enableTestTwoFactor(t *testing.T, h *Handler, u *service.UserRecord) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := service.BeginTwoFactorSetup(ctx, h.stores.TwoFactor, u); err != nil {
+		t.Fatalf("BeginTwoFactorSetup: %v", err)
+	}
+	_, err := h.stores.TwoFactor.UpdateTwoFactor(ctx, u.Username, func(tf *service.TwoFactor) error {
+		tf.Enabled = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateTwoFactor: %v", err)
+	}
+}
+
+func TestDeleteAccountLockout(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	linkTestIdentity(t, h, u)
+	enableTestTwoFactor(t, h, u)
+	token := loginTestSession(t, h, u)
+	saved := service.ReauthWindow
+	service.ReauthWindow = -time.Second
+	t.Cleanup(func() { service.ReauthWindow = saved })
+
+	// 猜测验证码与登录失败共用计数，锁定后正确的密码也不能确认注销
+	for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+		if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+			DeleteAccountRequest{Code: "000000"}); w.Code != http.StatusBadRequest {
+			t.Fatalf("delete with wrong code %d = %d; want 400", i+1, w.Code)
+		}
+	}
+	w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token, DeleteAccountRequest{Code: "000000"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("locking delete = %d; want 429 with Retry-After", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/account", "10.0.0.1", token,
+		DeleteAccountRequest{Password: "correct-password"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("delete while locked = %d; want 429", w.Code)
+	}
+	if got, _ := h.stores.Users.GetUser(context.Background(), "alice"); got == nil {
+		t.Fatal("account was deleted while locked")
+	}
+}
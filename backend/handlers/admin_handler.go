@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SetRoleRequest 修改用户角色请求结构
+type SetRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// ListUsersHandler 列出全部用户
+func (h *Handler) ListUsersHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	users, err := h.stores.Users.ListUsers(ctx)
+	if err != nil {
+		service.LogError("Failed to list users: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "获取用户列表失败")
+		return
+	}
+	out := make([]*service.AdminUser, 0, len(users))
+	for _, u := range users {
+		out = append(out, service.NewAdminUser(u))
+	}
+	api.RespondSuccess(c, out)
+}
+
+// GetUserHandler 查看单个用户及其数据量
+func (h *Handler) GetUserHandler(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	u, err := h.stores.Users.GetUser(ctx, username)
+	if err != nil {
+		service.LogError("Failed to get user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if u == nil {
+		api.RespondError(c, http.StatusNotFound, "用户不存在")
+		return
+	}
+	usage, err := service.GetUserUsage(ctx, h.stores, u)
+	if err != nil {
+		service.LogError("Failed to get usage of user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "统计用户数据失败")
+		return
+	}
+	out := service.NewAdminUser(u)
+	out.Usage = usage
+	api.RespondSuccess(c, out)
+}
+
+// SetUserRoleHandler 修改用户角色，用户的全部会话随之撤销；管理员不能修改自己的角色
+func (h *Handler) SetUserRoleHandler(c *gin.Context) {
+	var req SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+	admin, _ := api.GetUsername(c)
+	username := c.Param("username")
+	if username == admin {
+		api.RespondError(c, http.StatusBadRequest, "不能修改自己的角色")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	u, err := service.SetUserRole(ctx, h.stores, username, req.Role)
+	if errors.Is(err, service.ErrInvalidRole) {
+		api.RespondError(c, http.StatusBadRequest, "未知的角色")
+		return
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		api.RespondError(c, http.StatusNotFound, "用户不存在")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to set role of user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "修改角色失败")
+		return
+	}
+
+	service.LogInfo("Admin %s set role of user %s to %s", admin, username, u.Role)
+	api.RespondSuccess(c, service.NewAdminUser(u))
+}
+
+// DisableUserHandler 停用账户并撤销其全部会话；管理员不能停用自己
+func (h *Handler) DisableUserHandler(c *gin.Context) {
+	h.setUserDisabled(c, true)
+}
+
+// EnableUserHandler 重新启用账户
+func (h *Handler) EnableUserHandler(c *gin.Context) {
+	h.setUserDisabled(c, false)
+}
+
+func (h *Handler) setUserDisabled(c *gin.Context, disabled bool) {
+	admin, _ := api.GetUsername(c)
+	username := c.Param("username")
+	if disabled && username == admin {
+		api.RespondError(c, http.StatusBadRequest, "不能停用自己的账户")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	u, revoked, err := service.SetUserDisabled(ctx, h.stores, username, disabled)
+	if errors.Is(err, service.ErrUserNotFound) {
+		api.RespondError(c, http.StatusNotFound, "用户不存在")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to set disabled=%t for user %s: %v", disabled, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "操作失败")
+		return
+	}
+
+	service.LogInfo("Admin %s set disabled=%t for user %s (%d sessions revoked)", admin, disabled, username, revoked)
+	api.RespondSuccess(c, gin.H{"user": service.NewAdminUser(u), "revoked": revoked})
+}
+
+// ResetTwoFactorHandler 为丢失身份验证器和恢复码的用户关闭两步验证
+func (h *Handler) ResetTwoFactorHandler(c *gin.Context) {
+	admin, _ := api.GetUsername(c)
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	tf, err := h.stores.TwoFactor.GetTwoFactor(ctx, username)
+	if err != nil {
+		service.LogError("Failed to get two-factor settings of user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if tf == nil {
+		api.RespondError(c, http.StatusNotFound, "该用户未设置两步验证")
+		return
+	}
+	if err := h.stores.TwoFactor.DeleteTwoFactor(ctx, username); err != nil {
+		service.LogError("Failed to reset two-factor settings of user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "操作失败")
+		return
+	}
+
+	service.LogInfo("Admin %s reset two-factor authentication of user %s", admin, username)
+	api.RespondSuccess(c, gin.H{"message": "已关闭该用户的两步验证"})
+}
+
+// SystemUsageHandler 查看系统整体的用户数和数据量
+func (h *Handler) SystemUsageHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	usage, err := service.GetSystemUsage(ctx, h.stores)
+	if err != nil {
+		service.LogError("Failed to get system usage: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "统计系统数据失败")
+		return
+	}
+	api.RespondSuccess(c, usage)
+}
+
+// ListLockoutsHandler 列出登录失败记录，?locked=true 时只返回仍在锁定期的记录
+func (h *Handler) ListLockoutsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	lockouts, err := service.ListLoginLockouts(ctx, h.stores.LoginAttempts, c.Query("locked") == "true")
+	if err != nil {
+		service.LogError("Failed to list login lockouts: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "获取登录锁定失败")
+		return
+	}
+	api.RespondSuccess(c, lockouts)
+}
+
+// ClearLockoutHandler 解除登录锁定，key 为 user:<用户名> 或 ip:<地址>，重置密码申请的限制加 reset: 前缀
+func (h *Handler) ClearLockoutHandler(c *gin.Context) {
+	admin, _ := api.GetUsername(c)
+	key := c.Param("key")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := h.stores.LoginAttempts.ClearLoginAttempts(ctx, key); err != nil {
+		service.LogError("Failed to clear login attempts %s: %v", key, err)
+		api.RespondError(c, http.StatusInternalServerError, "解除锁定失败")
+		return
+	}
+
+	service.LogInfo("Admin %s cleared login attempts %s", admin, key)
+	api.RespondSuccess(c, gin.H{"message": "已解除锁定"})
+}
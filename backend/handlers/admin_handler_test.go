@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// mustCreateTestAdmin 创建管理员账户
+func mustCreateTestAdmin(t *testing.T, h *Handler, username string) *service.UserRecord {
+	t.Helper()
+	mustCreateTestUser(t, h, username, "correct-password")
+	u, err := service.SetUserRole(context.Background(), h.stores, username, service.RoleAdmin)
+	if err != nil {
+		t.Fatalf("SetUserRole(%q): %v", username, err)
+	}
+	return u
+}
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	h, r := newTestHandler(t)
+	mustCreateTestAdmin(t, h, "root")
+	user := loginTestSession(t, h, mustCreateTestUser(t, h, "alice", "correct-password"))
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/api/admin/users"},
+		{http.MethodGet, "/api/admin/users/root"},
+		{http.MethodPut, "/api/admin/users/root/role"},
+		{http.MethodPost, "/api/admin/users/root/disable"},
+		{http.MethodPost, "/api/admin/users/root/enable"},
+		{http.MethodDelete, "/api/admin/users/root/2fa"},
+		{http.MethodGet, "/api/admin/usage"},
+		{http.MethodGet, "/api/admin/lockouts"},
+		{http.MethodDelete, "/api/admin/lockouts/user:root"},
+	}
+	for _, rt := range routes {
+		if w, _ := doJSON(t, r, rt.method, rt.path, "10.0.0.1", user, SetRoleRequest{Role: service.RoleUser}); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s as a user = %d; want 403", rt.method, rt.path, w.Code)
+		}
+		if w, _ := doJSON(t, r, rt.method, rt.path, "10.0.0.1", "", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token = %d; want 401", rt.method, rt.path, w.Code)
+		}
+	}
+	if u, _ := h.stores.Users.GetUser(context.Background(), "root"); u == nil || u.Role != service.RoleAdmin || u.Disabled {
+		t.Fatalf("root after forbidden requests = %+v; want an enabled admin", u)
+	}
+
+	// 个人访问令牌不能访问管理接口
+	pat, _, err := service.CreateAccessToken(context.Background(), h.stores.AccessTokens, mustCreateTestAdmin(t, h, "ops"), "ci", []string{"account:read"}, 0)
+	if err != nil {
+		t.Fatalf("CreateAccessToken: %v", err)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/admin/users", "10.0.0.1", pat, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("admin route with an access token = %d; want 403", w.Code)
+	}
+}
+
+func TestAdminCannotDemoteOrDisableSelf(t *testing.T) {
+	h, r := newTestHandler(t)
+	root := loginTestSession(t, h, mustCreateTestAdmin(t, h, "root"))
+
+	if w, _ := doJSON(t, r, http.MethodPut, "/api/admin/users/root/role", "10.0.0.1", root, SetRoleRequest{Role: service.RoleUser}); w.Code != http.StatusBadRequest {
+		t.Fatalf("demote self = %d; want 400", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/admin/users/root/disable", "10.0.0.1", root, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("disable self = %d; want 400", w.Code)
+	}
+	if u, _ := h.stores.Users.GetUser(context.Background(), "root"); u == nil || u.Role != service.RoleAdmin || u.Disabled {
+		t.Fatalf("last admin = %+v; want an enabled admin", u)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/admin/users", "10.0.0.1", root, nil); w.Code != http.StatusOK {
+		t.Fatalf("admin session after refused self changes = %d; want 200", w.Code)
+	}
+}
+
+func TestDisabledUserRejected(t *testing.T) {
+	h, r := newTestHandler(t)
+	root := loginTestSession(t, h, mustCreateTestAdmin(t, h, "root"))
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	session := loginTestSession(t, h, u)
+	pat, _, err := service.CreateAccessToken(context.Background(), h.stores.AccessTokens, u, "ci", []string{"trips:read"}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateAccessToken: %v", err)
+	}
+
+	w, resp := doJSON(t, r, http.MethodPost, "/api/admin/users/alice/disable", "10.0.0.1", root, nil)
+	data, _ := resp["data"].(map[string]interface{})
+	if w.Code != http.StatusOK || data["revoked"] != float64(1) {
+		t.Fatalf("disable = %d %v; want 1 session revoked", w.Code, resp)
+	}
+
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", session, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("session of a disabled user = %d; want 401", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/trips", "10.0.0.1", pat, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("access token of a disabled user = %d; want 401", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusForbidden {
+		t.Fatalf("login of a disabled user = %d; want 403", w.Code)
+	}
+
+	// 重新启用后可以登录，之前的访问令牌也恢复可用
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/admin/users/alice/enable", "10.0.0.1", root, nil); w.Code != http.StatusOK {
+		t.Fatalf("enable = %d; want 200", w.Code)
+	}
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusOK || resp["token"] == nil {
+		t.Fatalf("login after enable = %d %v; want 200 with a token", w.Code, resp)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/trips", "10.0.0.1", pat, nil); w.Code != http.StatusOK {
+		t.Fatalf("access token after enable = %d; want 200", w.Code)
+	}
+}
@@ -2,7 +2,10 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"example.com/travel_planner/backend/api"
@@ -16,22 +19,46 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
-// LoginResponse 登录响应结构
+// RegisterRequest 注册请求结构，字段在 service.Credentials 中逐项校验
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResponse 登录响应结构，token 为 access token，过期后用 refreshToken 换取新的令牌。
+// 启用了两步验证时不返回令牌，而是返回 twoFactorRequired 和用于第二步的 challenge
 type LoginResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Token   string `json:"token,omitempty"`
-	User    *User  `json:"user,omitempty"`
+	Success            bool   `json:"success"`
+	Message            string `json:"message"`
+	Token              string `json:"token,omitempty"`
+	RefreshToken       string `json:"refreshToken,omitempty"`
+	ExpiresIn          int    `json:"expiresIn,omitempty"` // access token 有效秒数
+	User               *User  `json:"user,omitempty"`
+	TwoFactorRequired  bool   `json:"twoFactorRequired,omitempty"`
+	Challenge          string `json:"challenge,omitempty"`
+	ChallengeExpiresIn int    `json:"challengeExpiresIn,omitempty"` // challenge 有效秒数
+}
+
+// RefreshRequest 刷新令牌请求结构
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// LogoutRequest 登出请求结构，all 为 true 时撤销该用户的全部会话
+type LogoutRequest struct {
+	All bool `json:"all"`
 }
 
 // User 用户信息
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
+	Role     string `json:"role"`
 }
 
-// LoginHandler 处理用户登录
-func LoginHandler(c *gin.Context) {
+// LoginHandler 处理用户登录。启用了两步验证的用户密码正确后返回 challenge，
+// 需要再调用 TwoFactorLoginHandler 提交验证码才能取得令牌
+func (h *Handler) LoginHandler(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		service.LogWarn("Login request with invalid parameters: %v", err)
@@ -42,74 +69,241 @@ func LoginHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	u, err := service.GetUser(ctx, req.Username)
+	// 处于锁定期时不校验密码，也不增加失败次数
+	ip := c.ClientIP()
+	wait, err := service.CheckLoginAllowed(ctx, h.stores.LoginAttempts, req.Username, ip)
+	if err != nil {
+		service.LogError("Failed to check login attempts for user %s: %v", req.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if wait > 0 {
+		service.LogWarn("Login for user %s from %s rejected: locked for %s", req.Username, ip, wait.Round(time.Second))
+		respondLoginLocked(c, wait)
+		return
+	}
+
+	u, err := service.LookupUser(ctx, h.stores.Users, req.Username)
 	if err != nil {
 		service.LogError("Failed to get user %s: %v", req.Username, err)
 		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
 		return
 	}
 	if u == nil || !service.VerifyPassword(req.Password, u.PasswordHash) {
-		service.LogWarn("Failed login attempt for user: %s", req.Username)
+		service.LogWarn("Failed login attempt for user %s from %s", req.Username, ip)
+		wait, err := service.RecordLoginFailure(ctx, h.stores.LoginAttempts, req.Username, ip)
+		if err != nil {
+			service.LogError("Failed to record login failure for user %s: %v", req.Username, err)
+		}
+		if wait > 0 {
+			respondLoginLocked(c, wait)
+			return
+		}
 		api.RespondError(c, http.StatusUnauthorized, "用户名或密码错误")
 		return
 	}
+	twoFactor, err := service.TwoFactorEnabled(ctx, h.stores.TwoFactor, u.Username)
+	if err != nil {
+		service.LogError("Failed to get two-factor settings of user %s: %v", u.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	// 启用两步验证时等验证码通过后再清除失败计数，否则反复输入正确的密码就能绕过验证码的锁定
+	if !twoFactor {
+		if err := service.RecordLoginSuccess(ctx, h.stores.LoginAttempts, u.Username); err != nil {
+			service.LogWarn("Failed to clear login attempts for user %s: %v", u.Username, err)
+		}
+	}
+	if u.Disabled {
+		service.LogWarn("Login rejected for disabled user %s", u.Username)
+		api.RespondError(c, http.StatusForbidden, "账户已停用")
+		return
+	}
+	if twoFactor {
+		challenge, err := service.CreateLoginChallenge(ctx, h.stores.TwoFactor, u)
+		if err != nil {
+			service.LogError("Failed to create login challenge for user %s: %v", u.Username, err)
+			api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+			return
+		}
+		service.LogInfo("User %s passed password check, waiting for two-factor code", u.Username)
+		c.JSON(http.StatusOK, LoginResponse{
+			Success:            true,
+			Message:            "请输入两步验证码",
+			TwoFactorRequired:  true,
+			Challenge:          challenge,
+			ChallengeExpiresIn: int(service.LoginChallengeTTL / time.Second),
+		})
+		return
+	}
 
-	token, err := service.GenerateToken(u.ID, u.Username, 24*time.Hour)
+	pair, err := service.StartSession(ctx, h.stores.Sessions, u, deviceInfo(c))
 	if err != nil {
-		service.LogError("Failed to generate token for user %s: %v", req.Username, err)
+		service.LogError("Failed to start session for user %s: %v", req.Username, err)
 		api.RespondError(c, http.StatusInternalServerError, "生成 token 失败")
 		return
 	}
 
 	service.LogInfo("User %s (ID: %d) logged in successfully", req.Username, u.ID)
 	c.JSON(http.StatusOK, LoginResponse{
-		Success: true,
-		Message: "登录成功",
-		Token:   token,
+		Success:      true,
+		Message:      "登录成功",
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
 		User: &User{
 			ID:       u.ID,
 			Username: u.Username,
+			Role:     u.Role,
 		},
 	})
 }
 
-// RegisterHandler 处理用户注册
-func RegisterHandler(c *gin.Context) {
-	var req LoginRequest
+// respondLoginLocked 登录失败次数过多时返回 429 和需要等待的秒数
+func respondLoginLocked(c *gin.Context, wait time.Duration) {
+	respondRetryAfter(c, wait, "登录失败次数过多，请在 %d 秒后重试")
+}
+
+// respondRetryAfter 返回 429、Retry-After 头和需要等待的秒数，message 中的 %d 替换为秒数
+func respondRetryAfter(c *gin.Context, wait time.Duration, message string) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"success":    false,
+		"message":    fmt.Sprintf(message, seconds),
+		"retryAfter": seconds,
+	})
+}
+
+// RefreshHandler 用 refresh token 换取新的 access token 和 refresh token，旧的 refresh token 随之失效
+func (h *Handler) RefreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	pair, sess, err := service.RefreshSession(ctx, h.stores.Sessions, h.stores.Users, req.RefreshToken, deviceInfo(c))
+	switch {
+	case errors.Is(err, service.ErrRefreshTokenReused):
+		service.LogWarn("Reused refresh token for user %s, session %s revoked", sess.Username, sess.ID)
+		api.RespondError(c, http.StatusUnauthorized, "refresh token 已被使用，会话已撤销，请重新登录")
+		return
+	case errors.Is(err, service.ErrInvalidRefreshToken):
+		api.RespondError(c, http.StatusUnauthorized, "refresh token 无效或已过期")
+		return
+	case err != nil:
+		service.LogError("Failed to refresh session: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "刷新 token 失败")
+		return
+	}
+
+	c.JSON(http.StatusOK, LoginResponse{
+		Success:      true,
+		Message:      "刷新成功",
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+	})
+}
+
+// LogoutHandler 撤销当前登录会话，请求体 {"all": true} 时撤销当前用户的全部会话
+func (h *Handler) LogoutHandler(c *gin.Context) {
+	var req LogoutRequest
+	// 请求体可以为空
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+			return
+		}
+	}
+	username, _ := api.GetUsername(c)
+	sessionID, _ := api.GetSessionID(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	revoked := 1
+	var err error
+	if req.All {
+		revoked, err = h.stores.Sessions.DeleteUserSessions(ctx, username)
+	} else {
+		err = h.stores.Sessions.DeleteSession(ctx, sessionID)
+	}
+	if err != nil {
+		service.LogError("Failed to log out user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "登出失败")
+		return
+	}
+
+	service.LogInfo("User %s logged out (%d sessions revoked)", username, revoked)
+	api.RespondSuccess(c, gin.H{"revoked": revoked})
+}
+
+// JWKSHandler 公开 RS256/EdDSA 验证公钥，供其他服务自行验证 access token
+func JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, service.PublicJWKS())
+}
+
+// RegisterHandler 处理用户注册，用户名或密码不符合规则时返回 400 和逐个字段的错误
+func (h *Handler) RegisterHandler(c *gin.Context) {
+	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		service.LogWarn("Register request with invalid parameters: %v", err)
 		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
 		return
 	}
+	// 按规范形式校验和保存，大小写或全角写法不同的用户名不能重复注册，也不能绕过保留名
+	username := service.NormalizeUsername(req.Username)
+	var verr *service.ValidationError
+	if err := service.Credentials.ValidateRegistration(username, req.Password); errors.As(err, &verr) {
+		service.LogWarn("Registration rejected for username %q: %v", req.Username, err)
+		api.RespondValidationError(c, "注册信息不符合要求", verr.Errors)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	existing, err := service.GetUser(ctx, req.Username)
+	existing, err := service.LookupUser(ctx, h.stores.Users, req.Username)
 	if err != nil {
 		service.LogError("Failed to check existing user %s: %v", req.Username, err)
 		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
 		return
 	}
 	if existing != nil {
-		service.LogWarn("Registration failed - username already exists: %s", req.Username)
-		c.JSON(http.StatusConflict, LoginResponse{
-			Success: false,
-			Message: "用户名已存在",
-		})
+		h.respondUserExists(c, req.Username)
 		return
 	}
 
-	userRecord, err := service.CreateUser(ctx, req.Username, req.Password)
+	userRecord, err := h.stores.Users.CreateUser(ctx, username, req.Password)
+	if errors.Is(err, service.ErrUserExists) {
+		// 同名的并发注册中只有一个能成功
+		h.respondUserExists(c, req.Username)
+		return
+	}
 	if err != nil {
-		service.LogError("Failed to create user %s: %v", req.Username, err)
+		service.LogError("Failed to create user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "注册失败")
 		return
 	}
 
-	service.LogInfo("New user registered: %s (ID: %d)", req.Username, userRecord.ID)
+	service.LogInfo("New user registered: %s (ID: %d)", username, userRecord.ID)
 	c.JSON(http.StatusCreated, LoginResponse{
 		Success: true,
 		Message: "注册成功",
 	})
 }
+
+// respondUserExists 注册的用户名已被使用
+func (h *Handler) respondUserExists(c *gin.Context, username string) {
+	service.LogWarn("Registration failed - username already exists: %s", username)
+	c.JSON(http.StatusConflict, LoginResponse{
+		Success: false,
+		Message: "用户名已存在",
+	})
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// recordingNotifier 记录发出的通知
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []service.Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, msg service.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func (n *recordingNotifier) notifications() []service.Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]service.Notification(nil), n.sent...)
+}
+
+// newTestHandler 使用内存存储创建处理器和已注册的路由，通知记录在 h.notifier 中
+func newTestHandler(t *testing.T) (*Handler, *gin.Engine) {
+	t.Helper()
+	stores := service.NewStores(service.NewMemoryStore())
+	notifier := &recordingNotifier{}
+	r := gin.New()
+	RegisterRoutes(r.Group(""), stores, notifier, nil, nil)
+	return &Handler{stores: stores, notifier: notifier}, r
+}
+
+// doJSON 以 ip 为客户端地址发送 JSON 请求，返回响应和解码后的响应体
+func doJSON(t *testing.T, r http.Handler, method, path, ip, token string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":40000"
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+// mustCreateTestUser 创建测试用户
+func mustCreateTestUser(t *testing.T, h *Handler, username, password string) *service.UserRecord {
+	t.Helper()
+	u, err := h.stores.Users.CreateUser(context.Background(), username, password)
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", username, err)
+	}
+	return u
+}
+
+func TestLoginHandlerLockout(t *testing.T) {
+	h, r := newTestHandler(t)
+	mustCreateTestUser(t, h, "alice", "correct-password")
+	login := func(ip, password string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return doJSON(t, r, http.MethodPost, "/api/auth/login", ip, "",
+			LoginRequest{Username: "alice", Password: password})
+	}
+
+	// 成功登录清除之前的失败次数
+	for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+		if w, _ := login("10.0.0.1", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d = %d; want 401", i+1, w.Code)
+		}
+	}
+	if w, resp := login("10.0.0.1", "correct-password"); w.Code != http.StatusOK || resp["token"] == nil {
+		t.Fatalf("login = %d %v; want 200 with a token", w.Code, resp)
+	}
+	if a, _ := h.stores.LoginAttempts.GetLoginAttempts(context.Background(), "user:alice"); a != nil {
+		t.Fatalf("failure record after successful login = %+v; want cleared", a)
+	}
+
+	// 达到次数后返回 429 和 Retry-After，换 IP 或输入正确的密码也不能登录
+	for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+		if w, _ := login("10.0.0.2", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d after reset = %d; want 401", i+1, w.Code)
+		}
+	}
+	w, resp := login("10.0.0.3", "wrong")
+	wantRetry := strconv.Itoa(int(service.UserLoginPolicy.BaseDelay / time.Second))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != wantRetry {
+		t.Fatalf("locking login = %d, Retry-After %q; want 429, %s", w.Code, w.Header().Get("Retry-After"), wantRetry)
+	}
+	if resp["retryAfter"] != float64(service.UserLoginPolicy.BaseDelay/time.Second) {
+		t.Fatalf("retryAfter = %v; want %s", resp["retryAfter"], wantRetry)
+	}
+	w, _ = login("10.0.0.4", "correct-password")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("login while locked = %d; want 429 with Retry-After", w.Code)
+	}
+}
+
+func TestLoginHandlerIPLockout(t *testing.T) {
+	h, r := newTestHandler(t)
+	mustCreateTestUser(t, h, "alice", "correct-password")
+
+	// 同一 IP 尝试大量不同的用户名，每个用户名只失败一次
+	attempts := service.IPLoginPolicy.FreeAttempts
+	for i := 1; i < attempts; i++ {
+		w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "",
+			LoginRequest{Username: "user" + strconv.Itoa(i), Password: "wrong"})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d = %d; want 401", i, w.Code)
+		}
+	}
+	w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "",
+		LoginRequest{Username: "user0", Password: "wrong"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("failed login %d from one IP = %d; want 429 with Retry-After", attempts, w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "",
+		LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login from the locked IP = %d; want 429", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.2", "",
+		LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusOK {
+		t.Fatalf("login from another IP = %d; want 200", w.Code)
+	}
+}
+
+func TestRegisterHandlerValidation(t *testing.T) {
+	_, r := newTestHandler(t)
+	register := func(username, password string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return doJSON(t, r, http.MethodPost, "/api/auth/register", "10.0.0.1", "", RegisterRequest{Username: username, Password: password})
+	}
+
+	tests := []struct {
+		name, username, password string
+		want                     map[string]string // field -> code
+	}{
+		{"short username and weak password", "ab", "password", map[string]string{"username": service.CodeTooShort, "password": service.CodeBreached}},
+		{"invalid format", "-alice", "Str0ng-enough", map[string]string{"username": service.CodeInvalidFormat}},
+		{"reserved", "Admin", "Str0ng-enough", map[string]string{"username": service.CodeReserved}},
+		{"fullwidth reserved", "ｒｏｏｔ", "Str0ng-enough", map[string]string{"username": service.CodeReserved}},
+		{"password contains username", "carol", "Carol-2024", map[string]string{"password": service.CodeContainsUsername}},
+		{"missing password", "carol", "", map[string]string{"password": service.CodeRequired}},
+	}
+	for _, tt := range tests {
+		w, resp := register(tt.username, tt.password)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: register = %d %v; want 400", tt.name, w.Code, resp)
+			continue
+		}
+		errs, _ := resp["errors"].([]interface{})
+		got := make(map[string]string, len(errs))
+		for _, e := range errs {
+			fe := e.(map[string]interface{})
+			if fe["message"] == "" {
+				t.Errorf("%s: error %v has no message", tt.name, fe)
+			}
+			got[fe["field"].(string)] = fe["code"].(string)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: errors = %v; want %v", tt.name, got, tt.want)
+			continue
+		}
+		for field, code := range tt.want {
+			if got[field] != code {
+				t.Errorf("%s: errors = %v; want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRegisterHandlerNormalizesUsername(t *testing.T) {
+	h, r := newTestHandler(t)
+	register := func(username string) *httptest.ResponseRecorder {
+		w, _ := doJSON(t, r, http.MethodPost, "/api/auth/register", "10.0.0.1", "", RegisterRequest{Username: username, Password: "Str0ng-enough"})
+		return w
+	}
+
+	if w := register("Alice"); w.Code != http.StatusCreated {
+		t.Fatalf("register Alice = %d; want 201", w.Code)
+	}
+	if u, _ := h.stores.Users.GetUser(context.Background(), "alice"); u == nil {
+		t.Fatal("Alice was not stored as alice")
+	}
+	for _, username := range []string{"alice", "ALICE", "ａｌｉｃｅ"} {
+		if w := register(username); w.Code != http.StatusConflict {
+			t.Errorf("register %q after Alice = %d; want 409", username, w.Code)
+		}
+	}
+	// 登录时任一写法都进入同一账户
+	for _, username := range []string{"Alice", "ａｌｉｃｅ"} {
+		w, resp := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: username, Password: "Str0ng-enough"})
+		if w.Code != http.StatusOK || resp["user"].(map[string]interface{})["username"] != "alice" {
+			t.Errorf("login as %q = %d %v; want alice", username, w.Code, resp)
+		}
+	}
+}
+
+// racingUserStore 查找用户时总是返回不存在，模拟同名用户在检查之后被并发注册
+type racingUserStore struct {
+	service.UserStore
+}
+
+func (racingUserStore) GetUser(ctx context.Context, username string) (*service.UserRecord, error) {
+	return nil, nil
+}
+
+func TestRegisterHandlerConcurrentDuplicate(t *testing.T) {
+	stores := service.NewStores(service.NewMemoryStore())
+	if _, err := stores.Users.CreateUser(context.Background(), "alice", "Str0ng-enough"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	stores.Users = racingUserStore{stores.Users}
+	r := gin.New()
+	RegisterRoutes(r.Group(""), stores, &recordingNotifier{}, nil, nil)
+
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/auth/register", "10.0.0.1", "", RegisterRequest{Username: "alice", Password: "Str0ng-enough"}); w.Code != http.StatusConflict {
+		t.Fatalf("register over a concurrent duplicate = %d %v; want 409", w.Code, resp)
+	}
+}
@@ -7,50 +7,128 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// RegisterRoutes 注册所有路由
-func RegisterRoutes(r *gin.RouterGroup) {
+// Handler 持有处理器依赖的存储、通知渠道、单点登录的身份提供方和后台任务工作池
+type Handler struct {
+	stores   *service.Stores
+	notifier service.Notifier
+	oidc     *service.OIDCProvider
+	jobs     *service.JobRunner
+}
+
+// RegisterRoutes 注册所有路由，oidc 为 nil 时不注册单点登录路由，jobs 为 nil 时不注册后台任务路由
+func RegisterRoutes(r *gin.RouterGroup, stores *service.Stores, notifier service.Notifier, oidc *service.OIDCProvider, jobs *service.JobRunner) {
+	h := &Handler{stores: stores, notifier: notifier, oidc: oidc, jobs: jobs}
+	// auth 只接受登录后的 access token；scoped 同时接受具有相应权限的个人访问令牌
+	auth := service.AuthMiddleware(stores, "")
+	scoped := func(resource string) gin.HandlerFunc { return service.AuthMiddleware(stores, resource) }
+
 	r.GET("/", RootHandler)
 	r.GET("/health", HealthCheckHandler)
+	r.GET("/.well-known/jwks.json", JWKSHandler)
 
 	authGroup := r.Group("/api/auth")
-	authGroup.POST("/login", LoginHandler)
-	authGroup.POST("/register", RegisterHandler)
+	authGroup.POST("/login", h.LoginHandler)
+	authGroup.POST("/login/2fa", h.TwoFactorLoginHandler)
+	authGroup.POST("/register", h.RegisterHandler)
+	authGroup.POST("/refresh", h.RefreshHandler)
+	authGroup.POST("/logout", auth, h.LogoutHandler)
+	authGroup.POST("/password", auth, h.ChangePasswordHandler)
+	authGroup.POST("/password/forgot", h.ForgotPasswordHandler)
+	authGroup.POST("/password/reset", h.ResetPasswordHandler)
+	authGroup.GET("/2fa", auth, h.TwoFactorStatusHandler)
+	authGroup.POST("/2fa/setup", auth, h.SetupTwoFactorHandler)
+	authGroup.POST("/2fa/enable", auth, h.EnableTwoFactorHandler)
+	authGroup.POST("/2fa/recovery-codes", auth, h.RegenerateRecoveryCodesHandler)
+	authGroup.POST("/2fa/disable", auth, h.DisableTwoFactorHandler)
+	authGroup.GET("/sessions", auth, h.ListSessionsHandler)
+	authGroup.DELETE("/sessions", auth, h.RevokeOtherSessionsHandler)
+	authGroup.DELETE("/sessions/:id", auth, h.RevokeSessionHandler)
+	authGroup.GET("/tokens", auth, h.ListAccessTokensHandler)
+	authGroup.POST("/tokens", auth, h.CreateAccessTokenHandler)
+	authGroup.DELETE("/tokens/:id", auth, h.RevokeAccessTokenHandler)
+	if oidc != nil {
+		authGroup.GET("/oidc/login", h.OIDCLoginHandler)
+		authGroup.GET("/oidc/callback", h.OIDCCallbackHandler)
+		authGroup.POST("/oidc/link", auth, h.OIDCLinkHandler)
+	}
 
 	tripsGroup := r.Group("/api/trips")
-	tripsGroup.Use(service.AuthMiddleware())
-	tripsGroup.POST("/plan", PlanTripHandler)
-	tripsGroup.GET("", GetUserTripsHandler)
-	tripsGroup.GET("/:id", GetTripHandler)
-	tripsGroup.DELETE("/:id", DeleteTripHandler)
-	tripsGroup.GET("/favorites/list", GetFavoriteTripHandler)
-	tripsGroup.POST("/favorites/:id", AddFavoriteTripHandler)
-	tripsGroup.DELETE("/favorites/:id", RemoveFavoriteTripHandler)
+	tripsGroup.Use(scoped("trips"))
+	tripsGroup.POST("/plan", h.PlanTripHandler)
+	tripsGroup.POST("/plan/stream", h.PlanTripStreamHandler)
+	tripsGroup.GET("", h.GetUserTripsHandler)
+	tripsGroup.GET("/:id", h.GetTripHandler)
+	tripsGroup.PUT("/:id", h.UpdateTripHandler)
+	tripsGroup.DELETE("/:id", h.DeleteTripHandler)
+	tripsGroup.POST("/:id/regenerate", h.RegenerateTripHandler)
+	tripsGroup.GET("/:id/revisions", h.ListTripRevisionsHandler)
+	tripsGroup.GET("/:id/revisions/:rev", h.GetTripRevisionHandler)
+	tripsGroup.POST("/:id/revisions/:rev/revert", h.RevertTripHandler)
+	tripsGroup.GET("/:id/diff", h.DiffTripRevisionsHandler)
+	tripsGroup.GET("/favorites/list", h.GetFavoriteTripHandler)
+	tripsGroup.POST("/favorites/:id", h.AddFavoriteTripHandler)
+	tripsGroup.DELETE("/favorites/:id", h.RemoveFavoriteTripHandler)
+
+	if jobs != nil {
+		jobsGroup := r.Group("/api/jobs")
+		jobsGroup.Use(scoped("trips"))
+		jobsGroup.GET("", h.ListJobsHandler)
+		jobsGroup.GET("/:id", h.GetJobHandler)
+		jobsGroup.POST("/:id/cancel", h.CancelJobHandler)
+	}
 
 	expenseGroup := r.Group("/api/expenses")
-	expenseGroup.Use(service.AuthMiddleware())
-	expenseGroup.POST("", CreateExpenseHandler)
-	expenseGroup.GET("", ListExpensesHandler)
-	expenseGroup.POST("/analyze", AnalyzeExpensesHandler)
+	expenseGroup.Use(scoped("expenses"))
+	expenseGroup.POST("", h.CreateExpenseHandler)
+	expenseGroup.GET("", h.ListExpensesHandler)
+	expenseGroup.POST("/analyze", h.AnalyzeExpensesHandler)
 
 	exploreGroup := r.Group("/api/favorites")
-	exploreGroup.Use(service.AuthMiddleware())
-	exploreGroup.GET("", GetFavorites)
-	exploreGroup.POST("", AddFavorite)
-	exploreGroup.DELETE("/:id", RemoveFavorite)
+	exploreGroup.Use(scoped("favorites"))
+	exploreGroup.GET("", h.GetFavorites)
+	exploreGroup.POST("", h.AddFavorite)
+	exploreGroup.DELETE("/:id", h.RemoveFavorite)
 
 	parserGroup := r.Group("/api/parser")
-	parserGroup.Use(service.AuthMiddleware())
+	parserGroup.Use(auth)
 	parserGroup.POST("/parse", ParseTextHandler)
 	parserGroup.POST("/parse-expense", ParseExpenseQueryHandler)
 
 	diaryGroup := r.Group("/api/diaries")
-	diaryGroup.Use(service.AuthMiddleware())
-	diaryGroup.POST("", CreateDiaryHandler)
-	diaryGroup.GET("", GetDiariesHandler)
-	diaryGroup.GET("/:id", GetDiaryHandler)
-	diaryGroup.PUT("/:id", UpdateDiaryHandler)
-	diaryGroup.DELETE("/:id", DeleteDiaryHandler)
+	diaryGroup.Use(scoped("diaries"))
+	diaryGroup.POST("", h.CreateDiaryHandler)
+	diaryGroup.GET("", h.GetDiariesHandler)
+	diaryGroup.GET("/:id", h.GetDiaryHandler)
+	diaryGroup.PUT("/:id", h.UpdateDiaryHandler)
+	diaryGroup.DELETE("/:id", h.DeleteDiaryHandler)
+
+	accountGroup := r.Group("/api/account")
+	accountGroup.GET("/export", scoped("account"), h.ExportAccountHandler)
+	accountGroup.POST("/import", scoped("account"), h.ImportAccountHandler)
+	accountGroup.DELETE("", auth, h.DeleteAccountHandler)
+
+	trashGroup := r.Group("/api/trash")
+	trashGroup.Use(scoped("trash"))
+	trashGroup.GET("", h.ListTrashHandler)
+	trashGroup.DELETE("", h.EmptyTrashHandler)
+	trashGroup.POST("/:kind/:id/restore", h.RestoreTrashHandler)
+	trashGroup.DELETE("/:kind/:id", h.PurgeTrashHandler)
+
+	searchGroup := r.Group("/api/search")
+	searchGroup.Use(scoped("search"))
+	searchGroup.GET("", h.SearchHandler)
 
+	adminGroup := r.Group("/api/admin")
+	adminGroup.Use(auth, service.RequireRole(service.RoleAdmin))
+	adminGroup.GET("/users", h.ListUsersHandler)
+	adminGroup.GET("/users/:username", h.GetUserHandler)
+	adminGroup.PUT("/users/:username/role", h.SetUserRoleHandler)
+	adminGroup.POST("/users/:username/disable", h.DisableUserHandler)
+	adminGroup.POST("/users/:username/enable", h.EnableUserHandler)
+	adminGroup.DELETE("/users/:username/2fa", h.ResetTwoFactorHandler)
+	adminGroup.GET("/usage", h.SystemUsageHandler)
+	adminGroup.GET("/lockouts", h.ListLockoutsHandler)
+	adminGroup.DELETE("/lockouts/:key", h.ClearLockoutHandler)
 }
 
 func RootHandler(c *gin.Context) {
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"example.com/travel_planner/backend/api"
@@ -27,7 +28,7 @@ type UpdateDiaryRequest struct {
 }
 
 // CreateDiaryHandler 创建日记
-func CreateDiaryHandler(c *gin.Context) {
+func (h *Handler) CreateDiaryHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -71,7 +72,7 @@ func CreateDiaryHandler(c *gin.Context) {
 		Mood:     req.Mood,
 	}
 
-	id, err := service.CreateDiary(&diary)
+	id, err := h.stores.Diaries.CreateDiary(c.Request.Context(), &diary)
 	if err != nil {
 		service.LogError("Failed to create diary for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "创建日记失败")
@@ -87,7 +88,7 @@ func CreateDiaryHandler(c *gin.Context) {
 }
 
 // GetDiariesHandler 获取用户的所有日记
-func GetDiariesHandler(c *gin.Context) {
+func (h *Handler) GetDiariesHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -114,7 +115,7 @@ func GetDiariesHandler(c *gin.Context) {
 		return
 	}
 
-	diaries, err := service.GetUserDiaries(userID)
+	diaries, err := h.stores.Diaries.GetUserDiaries(c.Request.Context(), userID)
 	if err != nil {
 		service.LogError("Failed to get diaries for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取日记失败")
@@ -129,7 +130,7 @@ func GetDiariesHandler(c *gin.Context) {
 }
 
 // GetDiaryHandler 获取单条日记
-func GetDiaryHandler(c *gin.Context) {
+func (h *Handler) GetDiaryHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -157,7 +158,7 @@ func GetDiaryHandler(c *gin.Context) {
 	}
 
 	id := c.Param("id")
-	diary, err := service.GetDiary(id, userID)
+	diary, err := h.stores.Diaries.GetDiary(c.Request.Context(), id, userID)
 	if err != nil {
 		service.LogWarn("Diary %s not found for user %s", id, username)
 		api.RespondError(c, http.StatusNotFound, "日记不存在")
@@ -172,7 +173,7 @@ func GetDiaryHandler(c *gin.Context) {
 }
 
 // UpdateDiaryHandler 更新日记
-func UpdateDiaryHandler(c *gin.Context) {
+func (h *Handler) UpdateDiaryHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -216,7 +217,16 @@ func UpdateDiaryHandler(c *gin.Context) {
 		Mood:     req.Mood,
 	}
 
-	err := service.UpdateDiary(id, userID, &diary)
+	err := h.stores.Diaries.UpdateDiary(c.Request.Context(), id, userID, &diary)
+	if errors.Is(err, service.ErrDiaryNotFound) {
+		api.RespondError(c, http.StatusNotFound, "日记不存在")
+		return
+	}
+	if errors.Is(err, service.ErrConcurrentUpdate) {
+		service.LogWarn("Concurrent update of diary %s for user %s", id, username)
+		api.RespondError(c, http.StatusConflict, "日记已被修改，请刷新后重试")
+		return
+	}
 	if err != nil {
 		service.LogError("Failed to update diary %s for user %s: %v", id, username, err)
 		api.RespondError(c, http.StatusInternalServerError, "更新日记失败")
@@ -231,7 +241,7 @@ func UpdateDiaryHandler(c *gin.Context) {
 }
 
 // DeleteDiaryHandler 删除日记
-func DeleteDiaryHandler(c *gin.Context) {
+func (h *Handler) DeleteDiaryHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -259,7 +269,7 @@ func DeleteDiaryHandler(c *gin.Context) {
 	}
 
 	id := c.Param("id")
-	err := service.DeleteDiary(id, userID)
+	err := h.stores.Diaries.DeleteDiary(c.Request.Context(), id, userID, username)
 	if err != nil {
 		service.LogError("Failed to delete diary %s for user %s: %v", id, username, err)
 		api.RespondError(c, http.StatusInternalServerError, "删除日记失败")
@@ -22,7 +22,7 @@ type ExpenseRecord struct {
 }
 
 // CreateExpenseHandler 保存一条花费记录
-func CreateExpenseHandler(c *gin.Context) {
+func (h *Handler) CreateExpenseHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -39,7 +39,7 @@ func CreateExpenseHandler(c *gin.Context) {
 	defer cancel()
 
 	if rec.ID == "" {
-		id, _ := service.GenerateExpenseID(ctx)
+		id, _ := h.stores.Expenses.GenerateExpenseID(ctx)
 		rec.ID = id
 	}
 	// ensure date is set (YYYY-MM-DD)
@@ -48,7 +48,7 @@ func CreateExpenseHandler(c *gin.Context) {
 	}
 	rec.CreatedAt = time.Now().Format(time.RFC3339)
 
-	if err := service.SaveExpense(ctx, username, &rec); err != nil {
+	if err := h.stores.Expenses.SaveExpense(ctx, username, &rec); err != nil {
 		service.LogError("Failed to save expense for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "保存失败")
 		return
@@ -59,7 +59,7 @@ func CreateExpenseHandler(c *gin.Context) {
 }
 
 // ListExpensesHandler 列出用户花费
-func ListExpensesHandler(c *gin.Context) {
+func (h *Handler) ListExpensesHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -74,7 +74,7 @@ func ListExpensesHandler(c *gin.Context) {
 	from := c.Query("from") // YYYY-MM-DD
 	to := c.Query("to")     // YYYY-MM-DD
 
-	list, err := service.GetExpenses(ctx, username)
+	list, err := h.stores.Expenses.GetExpenses(ctx, username)
 	if err != nil {
 		service.LogError("Failed to get expenses for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取失败")
@@ -125,7 +125,7 @@ func ListExpensesHandler(c *gin.Context) {
 }
 
 // AnalyzeExpensesHandler 使用大模型分析用户开销并返回建议
-func AnalyzeExpensesHandler(c *gin.Context) {
+func (h *Handler) AnalyzeExpensesHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -158,7 +158,7 @@ func AnalyzeExpensesHandler(c *gin.Context) {
 	to := req.To
 	userQuery := req.Query
 
-	list, err := service.GetExpenses(ctx, username)
+	list, err := h.stores.Expenses.GetExpenses(ctx, username)
 	if err != nil {
 		service.LogError("Failed to get expenses for analysis for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取失败")
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"example.com/travel_planner/backend/api"
@@ -9,14 +10,14 @@ import (
 )
 
 // GetFavorites 获取用户收藏的景点列表
-func GetFavorites(c *gin.Context) {
+func (h *Handler) GetFavorites(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
 		return
 	}
 
-	favorites, err := service.GetUserFavorites(c.Request.Context(), username)
+	favorites, err := h.stores.Favorites.GetUserFavorites(c.Request.Context(), username)
 	if err != nil {
 		service.LogError("Failed to get favorites for user %s: %v", username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -28,7 +29,7 @@ func GetFavorites(c *gin.Context) {
 }
 
 // AddFavorite 添加景点到收藏夹
-func AddFavorite(c *gin.Context) {
+func (h *Handler) AddFavorite(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
@@ -41,8 +42,8 @@ func AddFavorite(c *gin.Context) {
 		return
 	}
 
-	if err := service.AddFavorite(c.Request.Context(), username, favorite); err != nil {
-		if err.Error() == "favorite already exists" {
+	if err := h.stores.Favorites.AddFavorite(c.Request.Context(), username, favorite); err != nil {
+		if errors.Is(err, service.ErrFavoriteExists) {
 			service.LogWarn("User %s attempted to add duplicate favorite: %s", username, favorite.Name)
 			c.JSON(http.StatusConflict, gin.H{"error": "已收藏"})
 			return
@@ -57,7 +58,7 @@ func AddFavorite(c *gin.Context) {
 }
 
 // RemoveFavorite 从收藏夹中删除景点
-func RemoveFavorite(c *gin.Context) {
+func (h *Handler) RemoveFavorite(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
@@ -70,7 +71,7 @@ func RemoveFavorite(c *gin.Context) {
 		return
 	}
 
-	if err := service.RemoveFavorite(c.Request.Context(), username, favoriteID); err != nil {
+	if err := h.stores.Favorites.RemoveFavorite(c.Request.Context(), username, favoriteID); err != nil {
 		service.LogError("Failed to remove favorite %s for user %s: %v", favoriteID, username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
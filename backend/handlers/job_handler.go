@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// enqueueTripPlan 创建生成行程的后台任务，返回 202 和任务信息
+func (h *Handler) enqueueTripPlan(ctx context.Context, c *gin.Context, user *service.UserRecord, req *service.TripPlanRequest) {
+	if h.jobs == nil {
+		api.RespondError(c, http.StatusServiceUnavailable, "后台任务未启用")
+		return
+	}
+	job, err := h.jobs.EnqueueTripPlan(ctx, user, req)
+	if errors.Is(err, service.ErrTooManyJobs) {
+		api.RespondError(c, http.StatusTooManyRequests, fmt.Sprintf("最多同时进行 %d 个生成任务", service.MaxActiveJobsPerUser))
+		return
+	}
+	if errors.Is(err, service.ErrJobQueueFull) {
+		api.RespondError(c, http.StatusServiceUnavailable, "任务队列已满，请稍后重试")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to enqueue trip plan for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "创建任务失败")
+		return
+	}
+
+	service.LogInfo("User %s queued trip plan to %s (job: %s)", user.Username, req.Destination, job.ID)
+	c.Header("Location", "/api/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": job.Info()})
+}
+
+// ListJobsHandler 列出当前用户保留期内的后台任务，最新的在前
+func (h *Handler) ListJobsHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	jobs, err := h.stores.Jobs.ListUserJobs(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list jobs for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取任务失败")
+		return
+	}
+	out := make([]*service.JobInfo, 0, len(jobs))
+	for _, job := range jobs {
+		out = append(out, job.Info())
+	}
+	api.RespondSuccess(c, out)
+}
+
+// GetJobHandler 查询后台任务状态，成功后 tripId 为生成的行程
+func (h *Handler) GetJobHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	job, err := service.GetUserJob(ctx, h.stores.Jobs, username, id)
+	if errors.Is(err, service.ErrJobNotFound) {
+		api.RespondError(c, http.StatusNotFound, "任务不存在")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to get job %s for user %s: %v", id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取任务失败")
+		return
+	}
+	api.RespondSuccess(c, job.Info())
+}
+
+// CancelJobHandler 取消排队或执行中的后台任务
+func (h *Handler) CancelJobHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	job, err := h.jobs.Cancel(ctx, username, id)
+	if errors.Is(err, service.ErrJobNotFound) {
+		api.RespondError(c, http.StatusNotFound, "任务不存在")
+		return
+	}
+	if errors.Is(err, service.ErrJobFinished) {
+		api.RespondError(c, http.StatusConflict, "任务已结束")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to cancel job %s for user %s: %v", id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "取消任务失败")
+		return
+	}
+
+	service.LogInfo("User %s canceled job %s", username, id)
+	api.RespondSuccess(c, job.Info())
+}
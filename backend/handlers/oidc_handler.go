@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// 保存浏览器绑定值的 cookie，只在单点登录的接口下发送，回调时必须与登录状态中的一致
+const (
+	oidcBindingCookie     = "oidc_binding"
+	oidcBindingCookiePath = "/api/auth/oidc"
+)
+
+// setOIDCBindingCookie 在发起登录的浏览器中保存绑定值，value 为空时清除。
+// SameSite=Lax 使身份提供方跳转回来的顶层 GET 请求仍会带上 cookie
+func (h *Handler) setOIDCBindingCookie(c *gin.Context, value string) {
+	maxAge := int(service.OIDCLoginTTL / time.Second)
+	if value == "" {
+		maxAge = -1
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcBindingCookie, value, maxAge, oidcBindingCookiePath, "", h.oidc.SecureCookie(), true)
+}
+
+// OIDCLoginHandler 跳转到身份提供方的授权页面
+func (h *Handler) OIDCLoginHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	authURL, binding, err := h.oidc.AuthCodeURL(ctx, h.stores.Identities, nil)
+	if err != nil {
+		service.LogError("Failed to start oidc login: %v", err)
+		api.RespondError(c, http.StatusServiceUnavailable, "单点登录暂时不可用")
+		return
+	}
+	h.setOIDCBindingCookie(c, binding)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCLinkHandler 为当前用户发起外部身份关联，返回身份提供方的授权地址。
+// 请求需要携带令牌，因此不直接跳转，由前端在同一浏览器中打开返回的地址；回调完成后以该用户登录
+func (h *Handler) OIDCLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	authURL, binding, err := h.oidc.AuthCodeURL(ctx, h.stores.Identities, user)
+	if err != nil {
+		service.LogError("Failed to start oidc link for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusServiceUnavailable, "单点登录暂时不可用")
+		return
+	}
+	h.setOIDCBindingCookie(c, binding)
+	api.RespondSuccess(c, gin.H{"url": authURL})
+}
+
+// OIDCCallbackHandler 处理身份提供方的回调，登录成功后创建会话。配置了 frontendUrl 时
+// 以 URL fragment 把令牌或错误带回前端，否则直接返回登录响应
+func (h *Handler) OIDCCallbackHandler(c *gin.Context) {
+	if idpErr := c.Query("error"); idpErr != "" {
+		service.LogWarn("OIDC login failed at identity provider: %s %s", idpErr, c.Query("error_description"))
+		h.oidcFail(c, http.StatusUnauthorized, "身份提供方拒绝了登录")
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		h.oidcFail(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	// 回调必须来自发起登录的浏览器；绑定值不一致时登录状态保留，不影响该浏览器自己进行中的登录
+	binding, _ := c.Cookie(oidcBindingCookie)
+	u, err := h.oidc.Login(ctx, h.stores, code, state, binding)
+	if errors.Is(err, service.ErrInvalidOIDCState) {
+		service.LogWarn("OIDC callback rejected: unknown state or browser binding mismatch")
+		h.oidcFail(c, http.StatusBadRequest, "登录已过期，请重新登录")
+		return
+	}
+	h.setOIDCBindingCookie(c, "")
+	switch {
+	case errors.Is(err, service.ErrOIDCSignupDisabled):
+		h.oidcFail(c, http.StatusForbidden, "该账户尚未开通")
+		return
+	case errors.Is(err, service.ErrIdentityExists):
+		h.oidcFail(c, http.StatusConflict, "该身份已关联其他账户")
+		return
+	case errors.Is(err, service.ErrUserNotFound):
+		h.oidcFail(c, http.StatusUnauthorized, "用户不存在")
+		return
+	case err != nil:
+		service.LogError("OIDC login failed: %v", err)
+		h.oidcFail(c, http.StatusUnauthorized, "单点登录失败")
+		return
+	}
+	if u.Disabled {
+		service.LogWarn("OIDC login rejected for disabled user %s", u.Username)
+		h.oidcFail(c, http.StatusForbidden, "账户已停用")
+		return
+	}
+
+	pair, err := service.StartSession(ctx, h.stores.Sessions, u, deviceInfo(c))
+	if err != nil {
+		service.LogError("Failed to start session for user %s: %v", u.Username, err)
+		h.oidcFail(c, http.StatusInternalServerError, "生成 token 失败")
+		return
+	}
+
+	service.LogInfo("User %s (ID: %d) logged in via OIDC", u.Username, u.ID)
+	if frontend := h.oidc.FrontendURL(); frontend != "" {
+		fragment := url.Values{
+			"token":        {pair.AccessToken},
+			"refreshToken": {pair.RefreshToken},
+			"expiresIn":    {strconv.Itoa(pair.ExpiresIn)},
+		}
+		c.Redirect(http.StatusFound, frontend+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, LoginResponse{
+		Success:      true,
+		Message:      "登录成功",
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+		User: &User{
+			ID:       u.ID,
+			Username: u.Username,
+			Role:     u.Role,
+		},
+	})
+}
+
+// oidcFail 登录失败时跳回前端并在 fragment 中带上错误信息，未配置前端地址时返回错误响应
+func (h *Handler) oidcFail(c *gin.Context, status int, message string) {
+	if frontend := h.oidc.FrontendURL(); frontend != "" {
+		c.Redirect(http.StatusFound, frontend+"#"+url.Values{"error": {message}}.Encode())
+		return
+	}
+	api.RespondError(c, status, message)
+}
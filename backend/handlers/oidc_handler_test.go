@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"example.com/travel_planner/backend/config"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// newTestOIDCRouter 注册启用单点登录的路由。身份提供方只提供发现文档，并记录令牌接口被调用的次数
+func newTestOIDCRouter(t *testing.T) (*Handler, *gin.Engine, *int32) {
+	t.Helper()
+	var exchanges int32
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 idp.URL,
+				"authorization_endpoint": idp.URL + "/authorize",
+				"token_endpoint":         idp.URL + "/token",
+				"jwks_uri":               idp.URL + "/jwks",
+			})
+		case "/token":
+			atomic.AddInt32(&exchanges, 1)
+			http.Error(w, "unexpected code exchange", http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.Close)
+
+	p, err := service.NewOIDCProvider(config.OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "travel-planner",
+		RedirectURL: "https://planner.example.com/api/auth/oidc/callback",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	stores := service.NewStores(service.NewMemoryStore())
+	r := gin.New()
+	RegisterRoutes(r.Group(""), stores, &recordingNotifier{}, p, nil)
+	return &Handler{stores: stores, oidc: p}, r, &exchanges
+}
+
+// bindingCookie 取出响应中设置的浏览器绑定 cookie
+func bindingCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcBindingCookie {
+			return c
+		}
+	}
+	t.Fatalf("response sets no %s cookie: %v", oidcBindingCookie, w.Header()["Set-Cookie"])
+	return nil
+}
+
+func TestOIDCCallbackRequiresBrowserBinding(t *testing.T) {
+	h, r, exchanges := newTestOIDCRouter(t)
+	token := loginTestSession(t, h, mustCreateTestUser(t, h, "alice", "correct-password"))
+
+	// 登录和关联都在发起的浏览器中设置 HttpOnly、SameSite=Lax 的绑定 cookie
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("oidc login = %d; want 302", w.Code)
+	}
+	loginCookie := bindingCookie(t, w)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	loginState := loc.Query().Get("state")
+
+	lw, resp := doJSON(t, r, http.MethodPost, "/api/auth/oidc/link", "10.0.0.1", token, nil)
+	if lw.Code != http.StatusOK {
+		t.Fatalf("oidc link = %d %v; want 200", lw.Code, resp)
+	}
+	linkCookie := bindingCookie(t, lw)
+	linkURL, _ := url.Parse(resp["data"].(map[string]interface{})["url"].(string))
+	linkState := linkURL.Query().Get("state")
+
+	for _, c := range []*http.Cookie{loginCookie, linkCookie} {
+		if c.Value == "" || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode || c.Path != oidcBindingCookiePath || c.MaxAge <= 0 {
+			t.Fatalf("binding cookie = %+v; want a secure HttpOnly SameSite=Lax cookie", c)
+		}
+	}
+	if loginCookie.Value == linkCookie.Value {
+		t.Fatal("login and link share a binding value")
+	}
+
+	// 回调没有 cookie 或带着另一次登录的 cookie 时被拒绝，不会用授权码换取令牌
+	callback := func(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code=attacker-code&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cases := []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+	}{
+		{"login without cookie", loginState, nil},
+		{"login with the link cookie", loginState, linkCookie},
+		{"link without cookie", linkState, nil},
+		{"link with the login cookie", linkState, loginCookie},
+		{"link with a forged cookie", linkState, &http.Cookie{Name: oidcBindingCookie, Value: "forged"}},
+	}
+	for _, tc := range cases {
+		if w := callback(tc.state, tc.cookie); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d; want 400", tc.name, w.Code)
+		}
+	}
+	if n := atomic.LoadInt32(exchanges); n != 0 {
+		t.Fatalf("rejected callbacks exchanged %d codes; want 0", n)
+	}
+
+	// 被拒绝的回调不消耗登录状态：带正确 cookie 的回调进入令牌交换，之后清除 cookie
+	w = callback(loginState, loginCookie)
+	if n := atomic.LoadInt32(exchanges); n != 1 {
+		t.Fatalf("callback from the initiating browser exchanged %d codes; want 1", n)
+	}
+	if c := bindingCookie(t, w); c.Value != "" || c.MaxAge >= 0 {
+		t.Fatalf("binding cookie after callback = %+v; want it cleared", c)
+	}
+	if w := callback(loginState, loginCookie); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback = %d; want 400", w.Code)
+	}
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ChangePasswordRequest 修改密码请求结构
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+// ForgotPasswordRequest 申请重置密码请求结构
+type ForgotPasswordRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// ResetPasswordRequest 使用重置令牌设置新密码的请求结构
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+// checkReauthAllowed 已登录用户再次输入密码或验证码前检查登录保护，处于锁定期时已写入 429 响应
+func (h *Handler) checkReauthAllowed(ctx context.Context, c *gin.Context, username string) bool {
+	wait, err := service.CheckLoginAllowed(ctx, h.stores.LoginAttempts, username, c.ClientIP())
+	if err != nil {
+		service.LogError("Failed to check login attempts for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return false
+	}
+	if wait > 0 {
+		service.LogWarn("Re-authentication for user %s rejected: locked for %s", username, wait.Round(time.Second))
+		respondLoginLocked(c, wait)
+		return false
+	}
+	return true
+}
+
+// recordReauthFailure 记录一次密码或验证码确认失败，达到锁定次数时写入 429 响应并返回 true
+func (h *Handler) recordReauthFailure(ctx context.Context, c *gin.Context, username string) bool {
+	wait, err := service.RecordLoginFailure(ctx, h.stores.LoginAttempts, username, c.ClientIP())
+	if err != nil {
+		service.LogError("Failed to record login failure for user %s: %v", username, err)
+	}
+	if wait > 0 {
+		respondLoginLocked(c, wait)
+		return true
+	}
+	return false
+}
+
+// ChangePasswordHandler 校验旧密码后修改密码，撤销该用户的全部会话和个人访问令牌并为当前客户端签发新的令牌
+func (h *Handler) ChangePasswordHandler(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	// 与登录共用失败计数，被盗用的会话不能无限次猜测当前密码
+	if !h.checkReauthAllowed(ctx, c, user.Username) {
+		return
+	}
+	if !service.VerifyPassword(req.OldPassword, user.PasswordHash) {
+		service.LogWarn("Password change for user %s rejected: wrong password", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+		api.RespondError(c, http.StatusForbidden, "原密码错误")
+		return
+	}
+	if errs := service.Credentials.ValidatePassword(req.NewPassword, user.Username); len(errs) > 0 {
+		api.RespondValidationError(c, "新密码不符合要求", renameField(errs, "newPassword"))
+		return
+	}
+
+	revoked, err := service.ChangePassword(ctx, h.stores, user, req.NewPassword)
+	if err != nil {
+		service.LogError("Failed to change password for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "修改密码失败")
+		return
+	}
+	pair, err := service.StartSession(ctx, h.stores.Sessions, user, deviceInfo(c))
+	if err != nil {
+		service.LogError("Failed to start session for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "密码已修改，请重新登录")
+		return
+	}
+
+	service.LogInfo("User %s changed password, %d sessions revoked", user.Username, revoked)
+	c.JSON(http.StatusOK, LoginResponse{
+		Success:      true,
+		Message:      "密码已修改，其他设备需要重新登录",
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+	})
+}
+
+// ForgotPasswordHandler 生成密码重置令牌并通过通知渠道发送给用户。
+// 无论用户是否存在都返回相同的响应，避免泄露用户名是否已注册；同一用户名或 IP 申请过于频繁时返回 429
+func (h *Handler) ForgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	ip := c.ClientIP()
+	wait, err := service.CheckPasswordResetAllowed(ctx, h.stores.LoginAttempts, req.Username, ip)
+	if err != nil {
+		service.LogError("Failed to check password reset requests for user %s: %v", req.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if wait > 0 {
+		service.LogWarn("Password reset for user %s from %s rejected: limited for %s", req.Username, ip, wait.Round(time.Second))
+		respondRetryAfter(c, wait, "申请过于频繁，请在 %d 秒后重试")
+		return
+	}
+	if _, err := service.RecordPasswordResetRequest(ctx, h.stores.LoginAttempts, req.Username, ip); err != nil {
+		service.LogError("Failed to record password reset request for user %s: %v", req.Username, err)
+	}
+
+	if err := service.RequestPasswordReset(ctx, h.stores, h.notifier, req.Username); err != nil {
+		service.LogError("Failed to send password reset for user %s: %v", req.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "发送重置令牌失败")
+		return
+	}
+
+	service.LogInfo("Password reset requested for user %s", req.Username)
+	api.RespondSuccess(c, gin.H{"message": "如果该用户存在，重置令牌已发送"})
+}
+
+// ResetPasswordHandler 使用重置令牌设置新密码，令牌只能使用一次，成功后该用户的全部会话和个人访问令牌被撤销。
+// 新密码在使用令牌之前校验，不符合规则时令牌仍然有效
+func (h *Handler) ResetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	// 先查看令牌属于哪个用户，用于校验新密码是否包含用户名
+	reset, err := service.LookupPasswordReset(ctx, h.stores, req.Token)
+	if errors.Is(err, service.ErrInvalidResetToken) {
+		api.RespondError(c, http.StatusBadRequest, "重置令牌无效或已过期")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to look up password reset token: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "重置密码失败")
+		return
+	}
+	if errs := service.Credentials.ValidatePassword(req.NewPassword, reset.Username); len(errs) > 0 {
+		api.RespondValidationError(c, "新密码不符合要求", renameField(errs, "newPassword"))
+		return
+	}
+
+	user, err := service.ResetPassword(ctx, h.stores, req.Token, req.NewPassword)
+	if errors.Is(err, service.ErrInvalidResetToken) {
+		api.RespondError(c, http.StatusBadRequest, "重置令牌无效或已过期")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to reset password: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "重置密码失败")
+		return
+	}
+	if err := service.RecordPasswordResetSuccess(ctx, h.stores.LoginAttempts, user.Username); err != nil {
+		service.LogWarn("Failed to clear password reset requests for user %s: %v", user.Username, err)
+	}
+
+	service.LogInfo("User %s reset password", user.Username)
+	api.RespondSuccess(c, gin.H{"message": "密码已重置，请使用新密码登录"})
+}
+
+// renameField 把校验错误的字段名改为请求中实际的字段名
+func renameField(errs []service.FieldError, field string) []service.FieldError {
+	for i := range errs {
+		errs[i].Field = field
+	}
+	return errs
+}
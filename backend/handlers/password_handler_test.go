@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// resetTokenFrom 从重置密码通知中取出令牌
+func resetTokenFrom(t *testing.T, n service.Notification) string {
+	t.Helper()
+	for _, line := range strings.Split(n.Body, "\n") {
+		if line = strings.TrimSpace(line); len(line) >= 32 && !strings.ContainsAny(line, " ：。") {
+			return line
+		}
+	}
+	t.Fatalf("no reset token in %q", n.Body)
+	return ""
+}
+
+func TestResetPasswordChecksUsername(t *testing.T) {
+	h, r := newTestHandler(t)
+	mustCreateTestUser(t, h, "alice", "Old-password-1")
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/password/forgot", "10.0.0.1", "",
+		ForgotPasswordRequest{Username: "alice"}); w.Code != http.StatusOK {
+		t.Fatalf("forgot password = %d", w.Code)
+	}
+	sent := h.notifier.(*recordingNotifier).notifications()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d notifications; want 1", len(sent))
+	}
+	token := resetTokenFrom(t, sent[0])
+
+	// 包含用户名的新密码被拒绝，令牌仍然有效
+	w, resp := doJSON(t, r, http.MethodPost, "/api/auth/password/reset", "10.0.0.1", "",
+		ResetPasswordRequest{Token: token, NewPassword: "alice-Password-2"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), service.CodeContainsUsername) {
+		t.Fatalf("reset with the username in the password = %d %v; want 400 %s", w.Code, resp, service.CodeContainsUsername)
+	}
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/auth/password/reset", "10.0.0.1", "",
+		ResetPasswordRequest{Token: token, NewPassword: "New-password-2"}); w.Code != http.StatusOK {
+		t.Fatalf("reset = %d %v; want 200", w.Code, resp)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/password/reset", "10.0.0.1", "",
+		ResetPasswordRequest{Token: token, NewPassword: "Another-password-3"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("reusing the token = %d; want 400", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "",
+		LoginRequest{Username: "alice", Password: "New-password-2"}); w.Code != http.StatusOK {
+		t.Fatalf("login with the new password = %d; want 200", w.Code)
+	}
+}
+
+func TestForgotPasswordRateLimit(t *testing.T) {
+	h, r := newTestHandler(t)
+	mustCreateTestUser(t, h, "alice", "Old-password-1")
+	forgot := func(username, ip string) int {
+		w, _ := doJSON(t, r, http.MethodPost, "/api/auth/password/forgot", ip, "", ForgotPasswordRequest{Username: username})
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Fatal("429 without Retry-After")
+		}
+		return w.Code
+	}
+
+	// 按用户名：换 IP 也受限制，其他用户不受影响
+	for i := 0; i < service.UserResetPolicy.FreeAttempts; i++ {
+		if code := forgot("alice", "10.0.0."+strconv.Itoa(i+1)); code != http.StatusOK {
+			t.Fatalf("request %d = %d; want 200", i+1, code)
+		}
+	}
+	if code := forgot("alice", "10.0.0.9"); code != http.StatusTooManyRequests {
+		t.Fatalf("request over the per-user limit = %d; want 429", code)
+	}
+	if n := len(h.notifier.(*recordingNotifier).notifications()); n != service.UserResetPolicy.FreeAttempts {
+		t.Fatalf("sent %d reset messages; want %d", n, service.UserResetPolicy.FreeAttempts)
+	}
+	// 不存在的用户名同样计数，响应不泄露用户是否存在
+	for i := 0; i < service.UserResetPolicy.FreeAttempts; i++ {
+		forgot("nobody", "10.0.1.1")
+	}
+	if code := forgot("nobody", "10.0.1.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("request for an unknown user over the limit = %d; want 429", code)
+	}
+	// 申请重置不影响登录
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.9", "",
+		LoginRequest{Username: "alice", Password: "Old-password-1"}); w.Code != http.StatusOK {
+		t.Fatalf("login after reset requests = %d; want 200", w.Code)
+	}
+
+	// 按 IP：同一 IP 申请不同的用户名
+	ip := "10.0.2.1"
+	for i := 0; ; i++ {
+		if i > service.IPResetPolicy.FreeAttempts {
+			t.Fatal("per-IP limit never applied")
+		}
+		if code := forgot("user"+strconv.Itoa(i), ip); code == http.StatusTooManyRequests {
+			if i != service.IPResetPolicy.FreeAttempts {
+				t.Fatalf("IP limited after %d requests; want %d", i, service.IPResetPolicy.FreeAttempts)
+			}
+			break
+		}
+	}
+	if code := forgot("bob", "10.0.2.2"); code != http.StatusOK {
+		t.Fatalf("request from another IP = %d; want 200", code)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "Old-password-1")
+	token := loginTestSession(t, h, u)
+	change := func(old string) int {
+		w, _ := doJSON(t, r, http.MethodPost, "/api/auth/password", "10.0.0.1", token,
+			ChangePasswordRequest{OldPassword: old, NewPassword: "New-password-2"})
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Fatal("429 without Retry-After")
+		}
+		return w.Code
+	}
+
+	// 错误的原密码与登录失败共用计数，锁定后正确的原密码和登录都被拒绝
+	for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+		if code := change("wrong"); code != http.StatusForbidden {
+			t.Fatalf("change with wrong password %d = %d; want 403", i+1, code)
+		}
+	}
+	if code := change("wrong"); code != http.StatusTooManyRequests {
+		t.Fatalf("locking change = %d; want 429", code)
+	}
+	if code := change("Old-password-1"); code != http.StatusTooManyRequests {
+		t.Fatalf("change while locked = %d; want 429", code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.2", "",
+		LoginRequest{Username: "alice", Password: "Old-password-1"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login while locked = %d; want 429", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.2", "",
+		LoginRequest{Username: "alice", Password: "New-password-2"}); w.Code == http.StatusOK {
+		t.Fatal("password was changed while locked")
+	}
+}
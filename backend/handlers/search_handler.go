@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SearchHandler 在当前用户的行程、日记和花费中全文搜索
+// 查询参数：q 为搜索词，type=trip|diary|expense 只搜索一种类型，limit 为每种类型的最大结果数
+func (h *Handler) SearchHandler(c *gin.Context) {
+	q := service.SearchQuery{Query: strings.TrimSpace(c.Query("q"))}
+	if q.Query == "" {
+		api.RespondError(c, http.StatusBadRequest, "缺少搜索词")
+		return
+	}
+	if v := c.Query("type"); v != "" {
+		typ, ok := service.ParseSearchType(v)
+		if !ok {
+			api.RespondError(c, http.StatusBadRequest, "type 参数只能为 trip、diary 或 expense")
+			return
+		}
+		q.Type = typ
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			api.RespondError(c, http.StatusBadRequest, "limit 参数无效")
+			return
+		}
+		q.Limit = limit
+	}
+
+	// 首次搜索时可能需要为已有数据建立索引
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	res, err := service.Search(ctx, h.stores, user, q)
+	if err != nil {
+		service.LogError("Search failed for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "搜索失败")
+		return
+	}
+
+	service.LogInfo("User %s searched %q: %d trips, %d diaries, %d expenses",
+		user.Username, q.Query, len(res.Trips), len(res.Diaries), len(res.Expenses))
+	api.RespondSuccess(c, res)
+}
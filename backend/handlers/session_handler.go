@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// deviceInfo 当前请求的客户端信息，记录在登录会话中
+func deviceInfo(c *gin.Context) service.DeviceInfo {
+	return service.DeviceInfo{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+}
+
+// ListSessionsHandler 列出当前用户已登录的设备，current 标记发起请求的会话
+func (h *Handler) ListSessionsHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	sessionID, _ := api.GetSessionID(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	sessions, err := h.stores.Sessions.ListUserSessions(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list sessions for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取登录设备失败")
+		return
+	}
+	out := make([]*service.SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		out = append(out, sess.Info(sessionID))
+	}
+	api.RespondSuccess(c, out)
+}
+
+// RevokeSessionHandler 撤销当前用户的一个会话，该会话的 access token 和 refresh token 立即失效；
+// 撤销当前会话等同于登出
+func (h *Handler) RevokeSessionHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	sess, err := h.stores.Sessions.GetSession(ctx, id)
+	if err != nil {
+		service.LogError("Failed to get session %s for user %s: %v", id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if sess == nil || sess.Username != username {
+		api.RespondError(c, http.StatusNotFound, "会话不存在")
+		return
+	}
+	if err := h.stores.Sessions.DeleteSession(ctx, id); err != nil {
+		service.LogError("Failed to revoke session %s for user %s: %v", id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "撤销会话失败")
+		return
+	}
+
+	service.LogInfo("User %s revoked session %s", username, id)
+	api.RespondSuccess(c, gin.H{"message": "已撤销"})
+}
+
+// RevokeOtherSessionsHandler 撤销当前用户除发起请求的会话以外的全部会话，返回撤销数量
+func (h *Handler) RevokeOtherSessionsHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+	sessionID, _ := api.GetSessionID(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	sessions, err := h.stores.Sessions.ListUserSessions(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list sessions for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "撤销会话失败")
+		return
+	}
+	revoked := 0
+	for _, sess := range sessions {
+		if sess.ID == sessionID {
+			continue
+		}
+		if err := h.stores.Sessions.DeleteSession(ctx, sess.ID); err != nil {
+			service.LogError("Failed to revoke session %s for user %s: %v", sess.ID, username, err)
+			api.RespondError(c, http.StatusInternalServerError, "撤销会话失败")
+			return
+		}
+		revoked++
+	}
+
+	service.LogInfo("User %s revoked %d other sessions", username, revoked)
+	api.RespondSuccess(c, gin.H{"revoked": revoked})
+}
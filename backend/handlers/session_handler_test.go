@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// sessionIDOf 取出 access token 中的会话ID
+func sessionIDOf(t *testing.T, token string) string {
+	t.Helper()
+	claims, err := service.ParseToken(token)
+	if err != nil {
+		t.Fatalf("ParseToken: %v", err)
+	}
+	return claims.SessionID
+}
+
+func TestRevokeSession(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	phone, laptop, tablet := loginTestSession(t, h, u), loginTestSession(t, h, u), loginTestSession(t, h, u)
+	bob := loginTestSession(t, h, mustCreateTestUser(t, h, "bob", "correct-password"))
+
+	w, resp := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", laptop, nil)
+	sessions, _ := resp["data"].([]interface{})
+	if w.Code != http.StatusOK || len(sessions) != 3 {
+		t.Fatalf("list sessions = %d %v; want 3 sessions", w.Code, resp)
+	}
+	current := 0
+	for _, s := range sessions {
+		if s.(map[string]interface{})["current"] == true {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Fatalf("%d sessions marked current; want 1", current)
+	}
+
+	// 撤销一个会话只影响该设备，不能撤销其他用户的会话
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/auth/sessions/"+sessionIDOf(t, phone), "10.0.0.1", laptop, nil); w.Code != http.StatusOK {
+		t.Fatalf("revoke session = %d; want 200", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", phone, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked session = %d; want 401", w.Code)
+	}
+	for _, token := range []string{laptop, tablet} {
+		if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", token, nil); w.Code != http.StatusOK {
+			t.Fatalf("other session after revoke = %d; want 200", w.Code)
+		}
+	}
+	if w, _ := doJSON(t, r, http.MethodDelete, "/api/auth/sessions/"+sessionIDOf(t, bob), "10.0.0.1", laptop, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("revoke another user's session = %d; want 404", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", bob, nil); w.Code != http.StatusOK {
+		t.Fatalf("bob's session = %d; want 200", w.Code)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	phone, laptop, tablet := loginTestSession(t, h, u), loginTestSession(t, h, u), loginTestSession(t, h, u)
+	bob := loginTestSession(t, h, mustCreateTestUser(t, h, "bob", "correct-password"))
+
+	w, resp := doJSON(t, r, http.MethodDelete, "/api/auth/sessions", "10.0.0.1", laptop, nil)
+	data, _ := resp["data"].(map[string]interface{})
+	if w.Code != http.StatusOK || data["revoked"] != float64(2) {
+		t.Fatalf("revoke others = %d %v; want 2 revoked", w.Code, resp)
+	}
+	for _, token := range []string{phone, tablet} {
+		if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", token, nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("other session after revoke others = %d; want 401", w.Code)
+		}
+	}
+	w, resp = doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", laptop, nil)
+	if sessions, _ := resp["data"].([]interface{}); w.Code != http.StatusOK || len(sessions) != 1 {
+		t.Fatalf("current session after revoke others = %d %v; want it kept alone", w.Code, resp)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", bob, nil); w.Code != http.StatusOK {
+		t.Fatalf("bob's session after alice revoked others = %d; want 200", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ListTrashHandler 列出回收站中的条目
+func (h *Handler) ListTrashHandler(c *gin.Context) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	items, err := h.stores.Trash.ListTrash(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list trash for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取回收站失败")
+		return
+	}
+
+	service.LogInfo("User %s retrieved %d trash items", username, len(items))
+	api.RespondSuccess(c, items)
+}
+
+// trashItemParams 解析路径中的条目类型和ID，失败时已写入错误响应
+func trashItemParams(c *gin.Context) (string, service.TrashKind, string, bool) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return "", "", "", false
+	}
+	kind, ok := service.ParseTrashKind(c.Param("kind"))
+	if !ok {
+		api.RespondError(c, http.StatusBadRequest, "未知的条目类型")
+		return "", "", "", false
+	}
+	return username, kind, c.Param("id"), true
+}
+
+// RestoreTrashHandler 恢复回收站条目
+func (h *Handler) RestoreTrashHandler(c *gin.Context) {
+	username, kind, id, ok := trashItemParams(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	err := h.stores.Trash.RestoreTrash(ctx, username, kind, id)
+	if errors.Is(err, service.ErrTrashItemNotFound) {
+		api.RespondError(c, http.StatusNotFound, "回收站中没有该条目")
+		return
+	}
+	if errors.Is(err, service.ErrRestoreConflict) {
+		api.RespondError(c, http.StatusConflict, "已存在相同的记录，无法恢复")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to restore %s %s for user %s: %v", kind, id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "恢复失败")
+		return
+	}
+
+	service.LogInfo("User %s restored %s %s from trash", username, kind, id)
+	api.RespondSuccess(c, gin.H{"message": "恢复成功"})
+}
+
+// PurgeTrashHandler 永久删除回收站条目
+func (h *Handler) PurgeTrashHandler(c *gin.Context) {
+	username, kind, id, ok := trashItemParams(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	err := h.stores.Trash.PurgeTrash(ctx, username, kind, id)
+	if errors.Is(err, service.ErrTrashItemNotFound) {
+		api.RespondError(c, http.StatusNotFound, "回收站中没有该条目")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to purge %s %s for user %s: %v", kind, id, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "删除失败")
+		return
+	}
+
+	service.LogInfo("User %s purged %s %s from trash", username, kind, id)
+	api.RespondSuccess(c, gin.H{"message": "已永久删除"})
+}
+
+// EmptyTrashHandler 清空回收站
+func (h *Handler) EmptyTrashHandler(c *gin.Context) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	items, err := h.stores.Trash.ListTrash(ctx, username)
+	if err != nil {
+		service.LogError("Failed to list trash for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "清空回收站失败")
+		return
+	}
+	purged := 0
+	for _, item := range items {
+		err := h.stores.Trash.PurgeTrash(ctx, username, item.Kind, item.ID)
+		if err != nil && !errors.Is(err, service.ErrTrashItemNotFound) {
+			service.LogError("Failed to purge %s %s for user %s: %v", item.Kind, item.ID, username, err)
+			api.RespondError(c, http.StatusInternalServerError, "清空回收站失败")
+			return
+		}
+		if err == nil {
+			purged++
+		}
+	}
+
+	service.LogInfo("User %s emptied trash (%d items)", username, purged)
+	api.RespondSuccess(c, gin.H{"purged": purged})
+}
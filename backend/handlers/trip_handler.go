@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"example.com/travel_planner/backend/api"
@@ -10,6 +12,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// generateTripPlan 同步生成行程，测试中替换为不调用模型的实现
+var generateTripPlan = service.GenerateTripPlan
+
+// generateTripPlanStream 流式生成行程，测试中替换为不调用模型的实现
+var generateTripPlanStream = service.GenerateTripPlanStream
+
 // TripRequest 创建行程请求
 type TripRequest struct {
 	Destination  string   `json:"destination" binding:"required"`
@@ -26,18 +34,21 @@ type TripResponse struct {
 	Success bool              `json:"success"`
 	Message string            `json:"message"`
 	Trip    *service.TripPlan `json:"trip,omitempty"`
+	// Warnings 行程校验后仍未解决的问题
+	Warnings []service.ItineraryIssue `json:"warnings,omitempty"`
 }
 
-// PlanTripHandler 生成行程计划
-func PlanTripHandler(c *gin.Context) {
+// PlanTripHandler 生成行程计划。?async=true 时创建后台任务并立即返回 202，
+// 通过 /api/jobs/:id 查询进度
+func (h *Handler) PlanTripHandler(c *gin.Context) {
 	var req TripRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
 		return
 	}
-
-	if req.Budget <= 0 {
-		req.Budget = 2000
+	if errs := service.ValidateTripDates(req.StartDate, req.EndDate); len(errs) > 0 {
+		api.RespondValidationError(c, "行程日期无效", errs)
+		return
 	}
 
 	username, ok := api.GetUsername(c)
@@ -46,74 +57,239 @@ func PlanTripHandler(c *gin.Context) {
 		return
 	}
 
-	// 增加超时时间到 2 分钟，因为 AI 生成行程需要较长时间
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 120*time.Second)
+	// 增加超时时间到 3 分钟，因为 AI 生成行程需要较长时间，校验不通过时还会重新生成
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 180*time.Second)
 	defer cancel()
 
-	user, err := service.GetUser(ctx, username)
+	user, err := h.stores.Users.GetUser(ctx, username)
 	if err != nil || user == nil {
 		api.RespondError(c, http.StatusUnauthorized, "用户不存在")
 		return
 	}
 
-	tripReq := &service.TripPlanRequest{
-		Destination:  req.Destination,
-		StartDate:    req.StartDate,
-		EndDate:      req.EndDate,
-		Budget:       req.Budget,
-		Travelers:    req.Travelers,
-		Preferences:  req.Preferences,
-		SpecialNeeds: req.SpecialNeeds,
+	if c.Query("async") == "true" {
+		h.enqueueTripPlan(ctx, c, user, req.planRequest())
+		return
 	}
 
-	plan, err := service.GenerateTripPlan(ctx, tripReq)
+	plan, report, err := generateTripPlan(ctx, req.planRequest())
 	if err != nil {
 		service.LogError("Failed to generate trip plan for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "生成行程失败: "+err.Error())
 		return
 	}
 
-	plan.UserID = user.ID
-	plan.Username = username
-
-	if err := service.SaveTripPlan(ctx, plan); err != nil {
+	if err := service.SaveNewTrip(ctx, h.stores.Trips, plan, user); err != nil {
 		service.LogError("Failed to save trip plan for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "保存行程失败")
 		return
 	}
 
-	service.LogInfo("User %s created trip plan to %s (ID: %s)", username, req.Destination, plan.ID)
+	service.LogInfo("User %s created trip plan to %s (ID: %s, attempts: %d, fixed: %d, warnings: %d)",
+		username, req.Destination, plan.ID, report.Attempts, len(report.Fixed), len(report.Warnings))
 	c.JSON(http.StatusOK, TripResponse{
-		Success: true,
-		Message: "行程规划成功",
-		Trip:    plan,
+		Success:  true,
+		Message:  "行程规划成功",
+		Trip:     plan,
+		Warnings: report.Warnings,
 	})
 }
 
-// GetUserTripsHandler 获取用户的所有行程
-func GetUserTripsHandler(c *gin.Context) {
+// planStreamProgressInterval 流式生成时 progress 事件的最小间隔
+const planStreamProgressInterval = time.Second
+
+// TripStreamProgress 流式生成行程的进度事件
+type TripStreamProgress struct {
+	Stage         string `json:"stage"`
+	ReceivedChars int    `json:"receivedChars"`
+	Days          int    `json:"days"`
+	TotalDays     int    `json:"totalDays"`
+}
+
+// PlanTripStreamHandler 以 Server-Sent Events 流式生成行程计划。依次发送 progress 事件
+// （stage 为 generating、repairing 或 saving）、每解析出一天时的 day 事件，行程校验不通过重新生成时
+// 发送 repair 事件并从第 1 天起重新发送 day 事件，校验后仍有问题时发送 warnings 事件，
+// 最后发送保存后的行程 done 事件，其内容以最终保存的行程为准；开始输出后出现的错误以 error 事件发送。
+// 客户端在生成结束前断开时不保存行程
+func (h *Handler) PlanTripStreamHandler(c *gin.Context) {
+	var req TripRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+	if errs := service.ValidateTripDates(req.StartDate, req.EndDate); len(errs) > 0 {
+		api.RespondValidationError(c, "行程日期无效", errs)
+		return
+	}
+
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
 		return
 	}
 
+	// 与 PlanTripHandler 相同的超时；客户端断开时 context 随之取消，模型请求也会中止
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 180*time.Second)
+	defer cancel()
+
+	user, err := h.stores.Users.GetUser(ctx, username)
+	if err != nil || user == nil {
+		api.RespondError(c, http.StatusUnauthorized, "用户不存在")
+		return
+	}
+
+	tripReq := req.planRequest()
+	progress := TripStreamProgress{Stage: "generating", TotalDays: tripReq.DayCount()}
+	send := func(event string, data interface{}) {
+		c.SSEvent(event, data)
+		c.Writer.Flush()
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	send("progress", progress)
+
+	var lastProgress time.Time
+	plan, report, err := generateTripPlanStream(ctx, tripReq, service.TripStreamEvents{
+		OnProgress: func(received, days int) error {
+			progress.ReceivedChars, progress.Days = received, days
+			if time.Since(lastProgress) >= planStreamProgressInterval {
+				lastProgress = time.Now()
+				send("progress", progress)
+			}
+			return nil
+		},
+		OnDay: func(day service.DayItinerary) error {
+			send("day", day)
+			return nil
+		},
+		OnRepair: func(attempt int, issues []service.ItineraryIssue) error {
+			progress.Stage, progress.ReceivedChars, progress.Days = "repairing", 0, 0
+			send("repair", gin.H{"attempt": attempt, "issues": issues})
+			send("progress", progress)
+			return nil
+		},
+	})
+	// 重试期间断开时 generateValidated 会返回之前的结果而不是错误，保存前再检查一次连接
+	if errors.Is(err, context.Canceled) || c.Request.Context().Err() != nil {
+		service.LogInfo("User %s disconnected during streamed trip generation", username)
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to generate trip plan for user %s: %v", username, err)
+		send("error", gin.H{"message": "生成行程失败: " + err.Error()})
+		return
+	}
+
+	if len(report.Warnings) > 0 {
+		send("warnings", report.Warnings)
+	}
+	progress.Stage, progress.Days = "saving", len(plan.Itinerary)
+	send("progress", progress)
+	if err := service.SaveNewTrip(ctx, h.stores.Trips, plan, user); err != nil {
+		service.LogError("Failed to save trip plan for user %s: %v", username, err)
+		send("error", gin.H{"message": "保存行程失败"})
+		return
+	}
+
+	service.LogInfo("User %s created trip plan to %s via stream (ID: %s, attempts: %d, fixed: %d, warnings: %d)",
+		username, req.Destination, plan.ID, report.Attempts, len(report.Fixed), len(report.Warnings))
+	send("done", plan)
+}
+
+// planRequest 转换为行程规划请求，未填写预算时使用默认值
+func (req *TripRequest) planRequest() *service.TripPlanRequest {
+	budget := req.Budget
+	if budget <= 0 {
+		budget = 2000
+	}
+	return &service.TripPlanRequest{
+		Destination:  req.Destination,
+		StartDate:    req.StartDate,
+		EndDate:      req.EndDate,
+		Budget:       budget,
+		Travelers:    req.Travelers,
+		Preferences:  req.Preferences,
+		SpecialNeeds: req.SpecialNeeds,
+	}
+}
+
+// GetUserTripsHandler 获取用户的行程
+// 查询参数：sort=createdAt|startDate|budget，order=asc|desc（默认 desc），limit，cursor，
+// destination，from/to（YYYY-MM-DD，返回与该日期区间有交集的行程）。
+// 指定 limit 或 cursor 时分页返回并带 nextCursor，否则与旧版本一样返回全部行程
+func (h *Handler) GetUserTripsHandler(c *gin.Context) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return
+	}
+
+	q := service.TripQuery{
+		SortBy:      c.Query("sort"),
+		Cursor:      c.Query("cursor"),
+		Destination: c.Query("destination"),
+		From:        c.Query("from"),
+		To:          c.Query("to"),
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "desc":
+		q.Desc = true
+	case "asc":
+	default:
+		api.RespondError(c, http.StatusBadRequest, "order 参数只能为 asc 或 desc")
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			api.RespondError(c, http.StatusBadRequest, "limit 参数无效")
+			return
+		}
+		q.Limit = limit
+	}
+
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	trips, err := service.GetUserTrips(ctx, username)
+	if _, paged := c.GetQuery("limit"); !paged && q.Cursor == "" {
+		trips, err := service.ListAllUserTrips(ctx, h.stores.Trips, username, q)
+		if errors.Is(err, service.ErrInvalidTripQuery) {
+			api.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			service.LogError("Failed to get trips for user %s: %v", username, err)
+			api.RespondError(c, http.StatusInternalServerError, "获取行程失败")
+			return
+		}
+		service.LogInfo("User %s retrieved %d trips", username, len(trips))
+		api.RespondSuccess(c, trips)
+		return
+	}
+
+	page, err := h.stores.Trips.ListUserTrips(ctx, username, q)
+	if errors.Is(err, service.ErrInvalidTripQuery) {
+		api.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		service.LogError("Failed to get trips for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取行程失败")
 		return
 	}
 
-	service.LogInfo("User %s retrieved %d trips", username, len(trips))
-	api.RespondSuccess(c, trips)
+	service.LogInfo("User %s retrieved %d trips", username, len(page.Trips))
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"data":       page.Trips,
+		"nextCursor": page.NextCursor,
+	})
 }
 
 // GetTripHandler 获取单个行程详情
-func GetTripHandler(c *gin.Context) {
+func (h *Handler) GetTripHandler(c *gin.Context) {
 	tripID := c.Param("id")
 	if tripID == "" {
 		api.RespondError(c, http.StatusBadRequest, "缺少行程ID")
@@ -123,7 +299,7 @@ func GetTripHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	trip, err := service.GetTripPlan(ctx, tripID)
+	trip, err := h.stores.Trips.GetTripPlan(ctx, tripID)
 	if err != nil {
 		service.LogError("Failed to get trip %s: %v", tripID, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取行程失败")
@@ -140,7 +316,7 @@ func GetTripHandler(c *gin.Context) {
 }
 
 // DeleteTripHandler 删除行程
-func DeleteTripHandler(c *gin.Context) {
+func (h *Handler) DeleteTripHandler(c *gin.Context) {
 	tripID := c.Param("id")
 	username, ok := api.GetUsername(c)
 	if !ok {
@@ -151,7 +327,7 @@ func DeleteTripHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	if err := service.DeleteTripPlan(ctx, tripID, username); err != nil {
+	if err := h.stores.Trips.DeleteTripPlan(ctx, tripID, username); err != nil {
 		service.LogError("Failed to delete trip %s for user %s: %v", tripID, username, err)
 		api.RespondError(c, http.StatusInternalServerError, "删除失败")
 		return
@@ -162,7 +338,7 @@ func DeleteTripHandler(c *gin.Context) {
 }
 
 // GetFavoriteTripHandler 获取收藏的行程列表
-func GetFavoriteTripHandler(c *gin.Context) {
+func (h *Handler) GetFavoriteTripHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -172,7 +348,7 @@ func GetFavoriteTripHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	trips, err := service.GetUserFavoriteTrips(ctx, username)
+	trips, err := h.stores.Favorites.GetUserFavoriteTrips(ctx, username)
 	if err != nil {
 		service.LogError("Failed to get favorite trips for user %s: %v", username, err)
 		api.RespondError(c, http.StatusInternalServerError, "获取收藏失败")
@@ -184,7 +360,7 @@ func GetFavoriteTripHandler(c *gin.Context) {
 }
 
 // AddFavoriteTripHandler 添加行程到收藏
-func AddFavoriteTripHandler(c *gin.Context) {
+func (h *Handler) AddFavoriteTripHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -200,7 +376,7 @@ func AddFavoriteTripHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	if err := service.AddFavoriteTrip(ctx, username, tripID); err != nil {
+	if err := h.stores.Favorites.AddFavoriteTrip(ctx, username, tripID); err != nil {
 		service.LogError("Failed to add favorite trip %s for user %s: %v", tripID, username, err)
 		api.RespondError(c, http.StatusInternalServerError, "收藏失败: "+err.Error())
 		return
@@ -211,7 +387,7 @@ func AddFavoriteTripHandler(c *gin.Context) {
 }
 
 // RemoveFavoriteTripHandler 取消收藏行程
-func RemoveFavoriteTripHandler(c *gin.Context) {
+func (h *Handler) RemoveFavoriteTripHandler(c *gin.Context) {
 	username, ok := api.GetUsername(c)
 	if !ok {
 		api.RespondError(c, http.StatusUnauthorized, "未登录")
@@ -227,7 +403,7 @@ func RemoveFavoriteTripHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	if err := service.RemoveFavoriteTrip(ctx, username, tripID); err != nil {
+	if err := h.stores.Favorites.RemoveFavoriteTrip(ctx, username, tripID); err != nil {
 		service.LogError("Failed to remove favorite trip %s for user %s: %v", tripID, username, err)
 		api.RespondError(c, http.StatusInternalServerError, "取消收藏失败")
 		return
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/travel_planner/backend/service"
+)
+
+func TestGetUserTripsPaging(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	n := service.MaxTripPageSize + 5
+	for i := 0; i < n; i++ {
+		mustSaveTestTrip(t, h, u)
+	}
+
+	// 不带 limit 和 cursor 时与旧版本一样返回全部行程，不分页
+	w, resp := doJSON(t, r, http.MethodGet, "/api/trips", "10.0.0.1", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list = %d %v; want 200", w.Code, resp)
+	}
+	if trips, _ := resp["data"].([]interface{}); len(trips) != n {
+		t.Fatalf("list returned %d trips; want all %d", len(trips), n)
+	}
+	if _, ok := resp["nextCursor"]; ok {
+		t.Fatalf("list without paging params has nextCursor: %v", resp["nextCursor"])
+	}
+	// 过滤条件同样适用于全部行程
+	w, resp = doJSON(t, r, http.MethodGet, "/api/trips?destination=%E4%B8%8A%E6%B5%B7", "10.0.0.1", token, nil)
+	if trips, ok := resp["data"].([]interface{}); w.Code != http.StatusOK || !ok || len(trips) != 0 {
+		t.Fatalf("filtered list = %d %v; want an empty list", w.Code, resp)
+	}
+
+	// 指定 limit 后按游标分页，取完全部页面
+	seen := map[string]bool{}
+	path := "/api/trips?limit=40"
+	for pages := 0; ; pages++ {
+		if pages > n/40+1 {
+			t.Fatal("paging did not terminate")
+		}
+		w, resp := doJSON(t, r, http.MethodGet, path, "10.0.0.1", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d = %d %v; want 200", pages, w.Code, resp)
+		}
+		trips, _ := resp["data"].([]interface{})
+		if len(trips) > 40 {
+			t.Fatalf("page %d has %d trips; limit 40", pages, len(trips))
+		}
+		for _, trip := range trips {
+			seen[trip.(map[string]interface{})["id"].(string)] = true
+		}
+		next, _ := resp["nextCursor"].(string)
+		if next == "" {
+			break
+		}
+		path = "/api/trips?limit=40&cursor=" + next
+	}
+	if len(seen) != n {
+		t.Fatalf("paging returned %d distinct trips; want %d", len(seen), n)
+	}
+
+	for _, path := range []string{"/api/trips?order=sideways", "/api/trips?sort=name", "/api/trips?limit=0", "/api/trips?cursor=bogus"} {
+		if w, _ := doJSON(t, r, http.MethodGet, path, "10.0.0.1", token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d; want 400", path, w.Code)
+		}
+	}
+}
+
+// stubGenerateTripPlanStream 替换流式生成函数，during 在返回生成结果之前调用
+func stubGenerateTripPlanStream(t *testing.T, during func()) {
+	t.Helper()
+	saved := generateTripPlanStream
+	generateTripPlanStream = func(ctx context.Context, req *service.TripPlanRequest, events service.TripStreamEvents) (*service.TripPlan, *service.ItineraryReport, error) {
+		if during != nil {
+			during()
+		}
+		plan, report, err := generateTripPlan(ctx, req)
+		if err == nil {
+			err = events.OnDay(plan.Itinerary[0])
+		}
+		return plan, report, err
+	}
+	t.Cleanup(func() { generateTripPlanStream = saved })
+}
+
+func TestPlanTripStreamSkipsSaveAfterDisconnect(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	stubGenerateTripPlan(t, nil)
+	body := `{"destination":"北京","startDate":"2026-11-01","endDate":"2026-11-01","budget":1000,"travelers":1}`
+	stream := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/trips/plan/stream", strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	trips := func() int {
+		t.Helper()
+		list, err := h.stores.Trips.GetUserTrips(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("GetUserTrips: %v", err)
+		}
+		return len(list)
+	}
+
+	// 生成结束时客户端已断开：不保存也不发送 done
+	ctx, cancel := context.WithCancel(context.Background())
+	stubGenerateTripPlanStream(t, cancel)
+	w := stream(ctx)
+	if n := trips(); n != 0 || strings.Contains(w.Body.String(), "event:done") {
+		t.Fatalf("disconnected stream saved %d trips, body %q; want nothing saved", n, w.Body.String())
+	}
+
+	stubGenerateTripPlanStream(t, nil)
+	w = stream(context.Background())
+	if n := trips(); n != 1 || !strings.Contains(w.Body.String(), "event:day") || !strings.Contains(w.Body.String(), "event:done") {
+		t.Fatalf("stream saved %d trips, body %q; want the trip saved and done sent", n, w.Body.String())
+	}
+}
+
+func TestPlanTripRejectsInvalidDates(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	stubGenerateTripPlan(t, func() { t.Error("generated a trip for invalid dates") })
+
+	tests := []struct {
+		start, end, field string
+	}{
+		{"2026-11-03", "2026-11-01", "endDate"},
+		{"2026/11/01", "2026-11-03", "startDate"},
+		{"2026-11-01", "tomorrow", "endDate"},
+	}
+	for _, path := range []string{"/api/trips/plan", "/api/trips/plan?async=true", "/api/trips/plan/stream"} {
+		for _, tt := range tests {
+			body := TripRequest{Destination: "北京", StartDate: tt.start, EndDate: tt.end, Travelers: 1}
+			w, resp := doJSON(t, r, http.MethodPost, path, "10.0.0.1", token, body)
+			errs, _ := resp["errors"].([]interface{})
+			if w.Code != http.StatusBadRequest || len(errs) != 1 || errs[0].(map[string]interface{})["field"] != tt.field {
+				t.Errorf("%s %s..%s = %d %v; want 400 on %s", path, tt.start, tt.end, w.Code, resp, tt.field)
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// TripUpdateRequest 手动编辑行程请求
+type TripUpdateRequest struct {
+	Itinerary []service.DayItinerary `json:"itinerary" binding:"required"`
+	Summary   *string                `json:"summary"`   // 为空时保留原概述
+	TotalCost *float64               `json:"totalCost"` // 为空时按每日花费汇总
+	Note      string                 `json:"note"`      // 版本说明
+	Revision  *int                   `json:"revision"`  // 编辑所基于的版本号，为空时使用当前版本
+}
+
+// TripRegenerateRequest 重新生成行程请求，请求体可省略
+type TripRegenerateRequest struct {
+	Note string `json:"note"`
+}
+
+// ownedTrip 加载路径中的行程并确认属于当前用户，失败时已写入错误响应；
+// 不属于当前用户的行程按不存在处理
+func (h *Handler) ownedTrip(ctx context.Context, c *gin.Context) (*service.TripPlan, string, bool) {
+	username, ok := api.GetUsername(c)
+	if !ok {
+		api.RespondError(c, http.StatusUnauthorized, "未登录")
+		return nil, "", false
+	}
+	tripID := c.Param("id")
+	trip, err := h.stores.Trips.GetTripPlan(ctx, tripID)
+	if err != nil {
+		service.LogError("Failed to get trip %s: %v", tripID, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取行程失败")
+		return nil, "", false
+	}
+	if trip == nil || trip.Username != username {
+		api.RespondError(c, http.StatusNotFound, "行程不存在")
+		return nil, "", false
+	}
+	return trip, username, true
+}
+
+// ListTripRevisionsHandler 列出行程的历史版本
+func (h *Handler) ListTripRevisionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trip, username, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+	revs, err := h.stores.Trips.ListTripRevisions(ctx, trip.ID)
+	if err != nil {
+		service.LogError("Failed to list revisions of trip %s: %v", trip.ID, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取版本历史失败")
+		return
+	}
+
+	service.LogInfo("User %s retrieved %d revisions of trip %s", username, len(revs), trip.ID)
+	api.RespondSuccess(c, revs)
+}
+
+// getRevision 按版本号获取行程版本，失败时已写入错误响应
+func (h *Handler) getRevision(ctx context.Context, c *gin.Context, tripID, param string) (*service.TripRevision, bool) {
+	number, ok := service.ParseRevisionNumber(param)
+	if !ok {
+		api.RespondError(c, http.StatusBadRequest, "版本号无效")
+		return nil, false
+	}
+	rev, err := h.stores.Trips.GetTripRevision(ctx, tripID, number)
+	if errors.Is(err, service.ErrRevisionNotFound) {
+		api.RespondError(c, http.StatusNotFound, "版本不存在")
+		return nil, false
+	}
+	if err != nil {
+		service.LogError("Failed to get revision %d of trip %s: %v", number, tripID, err)
+		api.RespondError(c, http.StatusInternalServerError, "获取版本失败")
+		return nil, false
+	}
+	return rev, true
+}
+
+// GetTripRevisionHandler 获取行程的指定版本
+func (h *Handler) GetTripRevisionHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trip, _, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+	rev, ok := h.getRevision(ctx, c, trip.ID, c.Param("rev"))
+	if !ok {
+		return
+	}
+	api.RespondSuccess(c, rev)
+}
+
+// DiffTripRevisionsHandler 比较行程的两个版本
+// 查询参数：from、to 为版本号，to 默认为最新版本，from 默认为 to 的上一个版本
+func (h *Handler) DiffTripRevisionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trip, _, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+
+	toParam, fromParam := c.Query("to"), c.Query("from")
+	if toParam == "" {
+		revs, err := h.stores.Trips.ListTripRevisions(ctx, trip.ID)
+		if err != nil {
+			service.LogError("Failed to list revisions of trip %s: %v", trip.ID, err)
+			api.RespondError(c, http.StatusInternalServerError, "获取版本历史失败")
+			return
+		}
+		if len(revs) == 0 {
+			api.RespondError(c, http.StatusNotFound, "行程没有历史版本")
+			return
+		}
+		toParam = strconv.Itoa(revs[0].Number)
+	}
+	to, ok := h.getRevision(ctx, c, trip.ID, toParam)
+	if !ok {
+		return
+	}
+	if fromParam == "" {
+		if to.Number == 1 {
+			api.RespondError(c, http.StatusBadRequest, "版本 1 没有上一个版本，请指定 from")
+			return
+		}
+		fromParam = strconv.Itoa(to.Number - 1)
+	}
+	from, ok := h.getRevision(ctx, c, trip.ID, fromParam)
+	if !ok {
+		return
+	}
+
+	diff := service.DiffTripPlans(from.Plan, to.Plan)
+	diff.From, diff.To = from.Number, to.Number
+	api.RespondSuccess(c, diff)
+}
+
+// RevertTripHandler 将行程恢复为指定版本，恢复操作本身记录为新版本
+func (h *Handler) RevertTripHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trip, username, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+	number, ok := service.ParseRevisionNumber(c.Param("rev"))
+	if !ok {
+		api.RespondError(c, http.StatusBadRequest, "版本号无效")
+		return
+	}
+
+	plan, err := service.RevertTripPlan(ctx, h.stores.Trips, trip, number, username)
+	if errors.Is(err, service.ErrRevisionNotFound) {
+		api.RespondError(c, http.StatusNotFound, "版本不存在")
+		return
+	}
+	if errors.Is(err, service.ErrConcurrentUpdate) {
+		api.RespondError(c, http.StatusConflict, "行程已被修改，请刷新后重试")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to revert trip %s to revision %d: %v", trip.ID, number, err)
+		api.RespondError(c, http.StatusInternalServerError, "恢复版本失败")
+		return
+	}
+
+	service.LogInfo("User %s reverted trip %s to revision %d", username, trip.ID, number)
+	api.RespondSuccess(c, plan)
+}
+
+// UpdateTripHandler 手动编辑行程的每日安排；行程在读取后或 revision 之后被修改过时返回 409
+func (h *Handler) UpdateTripHandler(c *gin.Context) {
+	var req TripUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trip, username, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+
+	trip.Itinerary = req.Itinerary
+	if req.Summary != nil {
+		trip.Summary = *req.Summary
+	}
+	if req.TotalCost != nil {
+		trip.TotalCost = *req.TotalCost
+	} else {
+		trip.TotalCost = 0
+		for _, day := range trip.Itinerary {
+			trip.TotalCost += day.DailyCost
+		}
+	}
+
+	expected := trip.Revision
+	if req.Revision != nil {
+		if *req.Revision <= 0 {
+			api.RespondError(c, http.StatusBadRequest, "版本号无效")
+			return
+		}
+		expected = *req.Revision
+	}
+	info := service.TripRevisionInfo{Author: username, Reason: service.RevisionEdited, Note: req.Note, ExpectedRevision: expected}
+	err := h.stores.Trips.SaveTripPlan(ctx, trip, info)
+	if errors.Is(err, service.ErrConcurrentUpdate) {
+		api.RespondError(c, http.StatusConflict, "行程已被修改，请刷新后重试")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to update trip %s for user %s: %v", trip.ID, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "保存行程失败")
+		return
+	}
+
+	service.LogInfo("User %s edited trip %s", username, trip.ID)
+	api.RespondSuccess(c, trip)
+}
+
+// RegenerateTripHandler 按原请求重新生成行程，保留行程ID和创建时间；生成期间行程被编辑时返回 409，被删除时返回 404
+func (h *Handler) RegenerateTripHandler(c *gin.Context) {
+	var req TripRegenerateRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+			return
+		}
+	}
+
+	// 与生成行程相同，AI 生成需要较长时间
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 180*time.Second)
+	defer cancel()
+
+	trip, username, ok := h.ownedTrip(ctx, c)
+	if !ok {
+		return
+	}
+
+	plan, report, err := generateTripPlan(ctx, &trip.Request)
+	if err != nil {
+		service.LogError("Failed to regenerate trip %s for user %s: %v", trip.ID, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "生成行程失败: "+err.Error())
+		return
+	}
+	plan.ID = trip.ID
+	plan.UserID = trip.UserID
+	plan.Username = trip.Username
+	plan.CreatedAt = trip.CreatedAt
+
+	// 生成期间行程被编辑或删除时不覆盖，删除的行程也不会被写回
+	info := service.TripRevisionInfo{Author: username, Reason: service.RevisionRegenerated, Note: req.Note, ExpectedRevision: trip.Revision}
+	err = h.stores.Trips.SaveTripPlan(ctx, plan, info)
+	if errors.Is(err, service.ErrConcurrentUpdate) {
+		if current, _ := h.stores.Trips.GetTripPlan(ctx, trip.ID); current == nil || current.Username != username {
+			api.RespondError(c, http.StatusNotFound, "行程不存在")
+			return
+		}
+		api.RespondError(c, http.StatusConflict, "行程已被修改，请刷新后重试")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to save regenerated trip %s for user %s: %v", trip.ID, username, err)
+		api.RespondError(c, http.StatusInternalServerError, "保存行程失败")
+		return
+	}
+
+	service.LogInfo("User %s regenerated trip %s (attempts: %d, fixed: %d, warnings: %d)",
+		username, trip.ID, report.Attempts, len(report.Fixed), len(report.Warnings))
+	if len(report.Warnings) > 0 {
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": plan, "warnings": report.Warnings})
+		return
+	}
+	api.RespondSuccess(c, plan)
+}
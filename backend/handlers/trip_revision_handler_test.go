@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// stubGenerateTripPlan 替换行程生成函数，during 在返回生成结果之前调用，模拟生成期间的其他请求
+func stubGenerateTripPlan(t *testing.T, during func()) {
+	t.Helper()
+	saved := generateTripPlan
+	generateTripPlan = func(ctx context.Context, req *service.TripPlanRequest) (*service.TripPlan, *service.ItineraryReport, error) {
+		if during != nil {
+			during()
+		}
+		return &service.TripPlan{
+			Request:   *req,
+			Itinerary: []service.DayItinerary{{Day: 1, Date: req.StartDate, Activities: []service.Activity{{Name: "天坛", Cost: 30}}, DailyCost: 30}},
+			TotalCost: 30,
+			Summary:   "regenerated",
+		}, &service.ItineraryReport{}, nil
+	}
+	t.Cleanup(func() { generateTripPlan = saved })
+}
+
+// mustSaveTestTrip 为用户保存一个行程
+func mustSaveTestTrip(t *testing.T, h *Handler, u *service.UserRecord) *service.TripPlan {
+	t.Helper()
+	plan := &service.TripPlan{
+		Request:   service.TripPlanRequest{Destination: "北京", StartDate: "2026-11-01", EndDate: "2026-11-01", Budget: 1000, Travelers: 1},
+		Itinerary: []service.DayItinerary{{Day: 1, Date: "2026-11-01", Activities: []service.Activity{{Name: "故宫", Cost: 60}}, DailyCost: 60}},
+		TotalCost: 60,
+		Summary:   "original",
+	}
+	if err := service.SaveNewTrip(context.Background(), h.stores.Trips, plan, u); err != nil {
+		t.Fatalf("SaveNewTrip: %v", err)
+	}
+	return plan
+}
+
+func TestRegenerateTrip(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	trip := mustSaveTestTrip(t, h, u)
+	stubGenerateTripPlan(t, nil)
+
+	w, resp := doJSON(t, r, http.MethodPost, "/api/trips/"+trip.ID+"/regenerate", "10.0.0.1", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("regenerate = %d %v; want 200", w.Code, resp)
+	}
+	got, _ := h.stores.Trips.GetTripPlan(context.Background(), trip.ID)
+	if got == nil || got.Summary != "regenerated" || got.Revision != 2 || !got.CreatedAt.Equal(trip.CreatedAt) {
+		t.Fatalf("regenerated trip = %+v; want revision 2 with the original creation time", got)
+	}
+}
+
+func TestRegenerateTripEditedDuringGeneration(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	trip := mustSaveTestTrip(t, h, u)
+	ctx := context.Background()
+	stubGenerateTripPlan(t, func() {
+		edit, _ := h.stores.Trips.GetTripPlan(ctx, trip.ID)
+		edit.Summary = "edited meanwhile"
+		if err := h.stores.Trips.SaveTripPlan(ctx, edit, service.TripRevisionInfo{Reason: service.RevisionEdited, ExpectedRevision: edit.Revision}); err != nil {
+			t.Errorf("concurrent edit: %v", err)
+		}
+	})
+
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/trips/"+trip.ID+"/regenerate", "10.0.0.1", token, nil); w.Code != http.StatusConflict {
+		t.Fatalf("regenerate over a concurrent edit = %d %v; want 409", w.Code, resp)
+	}
+	if got, _ := h.stores.Trips.GetTripPlan(ctx, trip.ID); got == nil || got.Summary != "edited meanwhile" || got.Revision != 2 {
+		t.Fatalf("trip after conflicting regenerate = %+v; want the concurrent edit kept", got)
+	}
+}
+
+func TestRegenerateTripDeletedDuringGeneration(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	token := loginTestSession(t, h, u)
+	trip := mustSaveTestTrip(t, h, u)
+	ctx := context.Background()
+	stubGenerateTripPlan(t, func() {
+		if err := h.stores.Trips.DeleteTripPlan(ctx, trip.ID, "alice"); err != nil {
+			t.Errorf("concurrent delete: %v", err)
+		}
+	})
+
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/trips/"+trip.ID+"/regenerate", "10.0.0.1", token, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("regenerate of a deleted trip = %d %v; want 404", w.Code, resp)
+	}
+	if got, _ := h.stores.Trips.GetTripPlan(ctx, trip.ID); got != nil {
+		t.Fatal("regenerate wrote the deleted trip back")
+	}
+	// 行程只在回收站中，可以正常恢复
+	if err := h.stores.Trash.RestoreTrash(ctx, "alice", service.TrashTrip, trip.ID); err != nil {
+		t.Fatalf("RestoreTrash after regenerate = %v; want nil", err)
+	}
+	if got, _ := h.stores.Trips.GetTripPlan(ctx, trip.ID); got == nil || got.Summary != "original" {
+		t.Fatalf("restored trip = %+v; want the original", got)
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/travel_planner/backend/api"
+	"example.com/travel_planner/backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// TwoFactorLoginRequest 登录第二步请求结构，code 为身份验证器应用中的验证码或恢复码
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+// TwoFactorPasswordRequest 开始设置两步验证时需要再次输入密码
+type TwoFactorPasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// TwoFactorCodeRequest 提交验证码或恢复码的请求结构
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableTwoFactorRequest 关闭两步验证需要密码和验证码（或恢复码）
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// TwoFactorLoginHandler 提交两步验证码完成登录。验证码错误计入登录失败次数，挑战在有效期内可以重试
+func (h *Handler) TwoFactorLoginHandler(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	ch, err := service.LookupLoginChallenge(ctx, h.stores.TwoFactor, req.Challenge)
+	if errors.Is(err, service.ErrInvalidLoginChallenge) {
+		api.RespondError(c, http.StatusUnauthorized, "登录已过期，请重新输入密码")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to get login challenge: %v", err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+
+	ip := c.ClientIP()
+	wait, err := service.CheckLoginAllowed(ctx, h.stores.LoginAttempts, ch.Username, ip)
+	if err != nil {
+		service.LogError("Failed to check login attempts for user %s: %v", ch.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if wait > 0 {
+		respondLoginLocked(c, wait)
+		return
+	}
+
+	u, recovery, err := service.CompleteLoginChallenge(ctx, h.stores, ch, req.Code)
+	switch {
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		service.LogWarn("Failed two-factor attempt for user %s from %s", ch.Username, ip)
+		wait, err := service.RecordLoginFailure(ctx, h.stores.LoginAttempts, ch.Username, ip)
+		if err != nil {
+			service.LogError("Failed to record login failure for user %s: %v", ch.Username, err)
+		}
+		if wait > 0 {
+			respondLoginLocked(c, wait)
+			return
+		}
+		api.RespondError(c, http.StatusUnauthorized, "验证码错误")
+		return
+	case errors.Is(err, service.ErrInvalidLoginChallenge):
+		api.RespondError(c, http.StatusUnauthorized, "登录已过期，请重新输入密码")
+		return
+	case err != nil:
+		service.LogError("Failed to verify two-factor code for user %s: %v", ch.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	if err := service.RecordLoginSuccess(ctx, h.stores.LoginAttempts, u.Username); err != nil {
+		service.LogWarn("Failed to clear login attempts for user %s: %v", u.Username, err)
+	}
+	if u.Disabled {
+		service.LogWarn("Login rejected for disabled user %s", u.Username)
+		api.RespondError(c, http.StatusForbidden, "账户已停用")
+		return
+	}
+
+	pair, err := service.StartSession(ctx, h.stores.Sessions, u, deviceInfo(c))
+	if err != nil {
+		service.LogError("Failed to start session for user %s: %v", u.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "生成 token 失败")
+		return
+	}
+
+	message := "登录成功"
+	if recovery {
+		service.LogInfo("User %s (ID: %d) logged in with a recovery code", u.Username, u.ID)
+		message = "登录成功，已使用一个恢复码"
+	} else {
+		service.LogInfo("User %s (ID: %d) logged in with two-factor code", u.Username, u.ID)
+	}
+	c.JSON(http.StatusOK, LoginResponse{
+		Success:      true,
+		Message:      message,
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    pair.ExpiresIn,
+		User: &User{
+			ID:       u.ID,
+			Username: u.Username,
+			Role:     u.Role,
+		},
+	})
+}
+
+// TwoFactorStatusHandler 查询当前用户的两步验证状态
+func (h *Handler) TwoFactorStatusHandler(c *gin.Context) {
+	username, _ := api.GetUsername(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	status, err := service.GetTwoFactorStatus(ctx, h.stores.TwoFactor, username)
+	if err != nil {
+		service.LogError("Failed to get two-factor status of user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+		return
+	}
+	api.RespondSuccess(c, status)
+}
+
+// SetupTwoFactorHandler 校验密码后生成 TOTP 密钥，返回密钥和 otpauth:// 地址，用验证码确认后才启用
+func (h *Handler) SetupTwoFactorHandler(c *gin.Context) {
+	var req TwoFactorPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	// 与登录共用失败计数，被盗用的会话不能借此无限次猜测密码
+	if !h.checkReauthAllowed(ctx, c, user.Username) {
+		return
+	}
+	if !service.VerifyPassword(req.Password, user.PasswordHash) {
+		service.LogWarn("Two-factor setup for user %s rejected: wrong password", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+		api.RespondError(c, http.StatusForbidden, "密码错误")
+		return
+	}
+	setup, err := service.BeginTwoFactorSetup(ctx, h.stores.TwoFactor, user)
+	if errors.Is(err, service.ErrTwoFactorEnabled) {
+		api.RespondError(c, http.StatusConflict, "已启用两步验证")
+		return
+	}
+	if err != nil {
+		service.LogError("Failed to begin two-factor setup for user %s: %v", user.Username, err)
+		api.RespondError(c, http.StatusInternalServerError, "设置两步验证失败")
+		return
+	}
+	api.RespondSuccess(c, setup)
+}
+
+// EnableTwoFactorHandler 用验证码确认设置并启用两步验证，恢复码只在响应中返回这一次
+func (h *Handler) EnableTwoFactorHandler(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+	username, _ := api.GetUsername(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if !h.checkReauthAllowed(ctx, c, username) {
+		return
+	}
+	codes, err := service.EnableTwoFactor(ctx, h.stores.TwoFactor, username, req.Code)
+	if errors.Is(err, service.ErrInvalidTwoFactorCode) {
+		service.LogWarn("Enabling two-factor for user %s rejected: wrong code", username)
+		if h.recordReauthFailure(ctx, c, username) {
+			return
+		}
+	}
+	if h.respondTwoFactorError(c, username, err) {
+		return
+	}
+
+	service.LogInfo("User %s enabled two-factor authentication", username)
+	api.RespondSuccess(c, gin.H{"recoveryCodes": codes})
+}
+
+// RegenerateRecoveryCodesHandler 校验验证码后生成新的恢复码，之前的恢复码全部作废
+func (h *Handler) RegenerateRecoveryCodesHandler(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+	username, _ := api.GetUsername(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if !h.checkReauthAllowed(ctx, c, username) {
+		return
+	}
+	codes, err := service.RegenerateRecoveryCodes(ctx, h.stores.TwoFactor, username, req.Code)
+	if errors.Is(err, service.ErrInvalidTwoFactorCode) {
+		service.LogWarn("Regenerating recovery codes for user %s rejected: wrong code", username)
+		if h.recordReauthFailure(ctx, c, username) {
+			return
+		}
+	}
+	if h.respondTwoFactorError(c, username, err) {
+		return
+	}
+
+	service.LogInfo("User %s regenerated two-factor recovery codes", username)
+	api.RespondSuccess(c, gin.H{"recoveryCodes": codes})
+}
+
+// DisableTwoFactorHandler 校验密码和验证码后关闭两步验证
+func (h *Handler) DisableTwoFactorHandler(c *gin.Context) {
+	var req DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		api.RespondError(c, http.StatusBadRequest, "请求参数错误")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	user, ok := h.currentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !h.checkReauthAllowed(ctx, c, user.Username) {
+		return
+	}
+	if !service.VerifyPassword(req.Password, user.PasswordHash) {
+		service.LogWarn("Disabling two-factor for user %s rejected: wrong password", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+		api.RespondError(c, http.StatusForbidden, "密码错误")
+		return
+	}
+	err := service.DisableTwoFactor(ctx, h.stores.TwoFactor, user.Username, req.Code)
+	if errors.Is(err, service.ErrInvalidTwoFactorCode) {
+		service.LogWarn("Disabling two-factor for user %s rejected: wrong code", user.Username)
+		if h.recordReauthFailure(ctx, c, user.Username) {
+			return
+		}
+	}
+	if h.respondTwoFactorError(c, user.Username, err) {
+		return
+	}
+
+	service.LogInfo("User %s disabled two-factor authentication", user.Username)
+	api.RespondSuccess(c, gin.H{"message": "已关闭两步验证"})
+}
+
+// respondTwoFactorError 按两步验证的错误类型返回响应，err 为 nil 时返回 false
+func (h *Handler) respondTwoFactorError(c *gin.Context, username string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		api.RespondError(c, http.StatusBadRequest, "验证码错误")
+	case errors.Is(err, service.ErrTwoFactorNotEnabled):
+		api.RespondError(c, http.StatusConflict, "尚未设置两步验证")
+	case errors.Is(err, service.ErrTwoFactorEnabled):
+		api.RespondError(c, http.StatusConflict, "已启用两步验证")
+	default:
+		service.LogError("Two-factor operation failed for user %s: %v", username, err)
+		api.RespondError(c, http.StatusInternalServerError, "服务器错误")
+	}
+	return true
+}
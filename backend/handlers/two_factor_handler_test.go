@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/service"
+)
+
+// testTOTPCode 按 RFC 6238 计算用户当前时间步的验证码，offset 为相对当前时间步的偏移
+func testTOTPCode(t *testing.T, h *Handler, username string, offset int64) string {
+	t.Helper()
+	tf, err := h.stores.TwoFactor.GetTwoFactor(context.Background(), username)
+	if err != nil || tf == nil {
+		t.Fatalf("GetTwoFactor = %+v, %v", tf, err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(tf.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30+offset))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	i := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[i:i+4])&0x7fffffff)%1000000)
+}
+
+func TestLoginHandlerTwoFactor(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	enableTestTwoFactor(t, h, u)
+	login := func() map[string]interface{} {
+		t.Helper()
+		w, resp := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"})
+		if w.Code != http.StatusOK || resp["twoFactorRequired"] != true || resp["token"] != nil || resp["refreshToken"] != nil {
+			t.Fatalf("password step = %d %v; want a challenge without tokens", w.Code, resp)
+		}
+		if resp["challengeExpiresIn"] != float64(service.LoginChallengeTTL/time.Second) {
+			t.Fatalf("challengeExpiresIn = %v; want %v", resp["challengeExpiresIn"], service.LoginChallengeTTL/time.Second)
+		}
+		return resp
+	}
+	complete := func(challenge interface{}, code string) (int, map[string]interface{}) {
+		t.Helper()
+		w, resp := doJSON(t, r, http.MethodPost, "/api/auth/login/2fa", "10.0.0.1", "", map[string]interface{}{"challenge": challenge, "code": code})
+		return w.Code, resp
+	}
+
+	// 密码错误时不返回 challenge
+	if w, resp := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "wrong"}); w.Code != http.StatusUnauthorized || resp["challenge"] != nil {
+		t.Fatalf("wrong password = %d %v; want 401 without a challenge", w.Code, resp)
+	}
+
+	challenge := login()["challenge"]
+	if code, resp := complete(challenge, "000000"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong code = %d %v; want 401", code, resp)
+	}
+	used := testTOTPCode(t, h, "alice", 0)
+	code, resp := complete(challenge, used)
+	if code != http.StatusOK || resp["token"] == nil || resp["refreshToken"] == nil {
+		t.Fatalf("two-factor step = %d %v; want tokens", code, resp)
+	}
+	if w, _ := doJSON(t, r, http.MethodGet, "/api/auth/sessions", "10.0.0.1", resp["token"].(string), nil); w.Code != http.StatusOK {
+		t.Fatalf("session from two-factor login = %d; want 200", w.Code)
+	}
+	// challenge 只能使用一次，同一验证码也不能在新的 challenge 中重复使用
+	if code, _ := complete(challenge, testTOTPCode(t, h, "alice", 1)); code != http.StatusUnauthorized {
+		t.Fatalf("reused challenge = %d; want 401", code)
+	}
+	if code, _ := complete(login()["challenge"], used); code != http.StatusUnauthorized {
+		t.Fatalf("reused TOTP code = %d; want 401", code)
+	}
+
+	// 过期的 challenge
+	saved := service.LoginChallengeTTL
+	service.LoginChallengeTTL = -time.Second
+	t.Cleanup(func() { service.LoginChallengeTTL = saved })
+	_, expired := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"})
+	if code, resp := complete(expired["challenge"], testTOTPCode(t, h, "alice", 1)); code != http.StatusUnauthorized {
+		t.Fatalf("expired challenge = %d %v; want 401", code, resp)
+	}
+}
+
+func TestLoginHandlerTwoFactorLockout(t *testing.T) {
+	h, r := newTestHandler(t)
+	u := mustCreateTestUser(t, h, "alice", "correct-password")
+	enableTestTwoFactor(t, h, u)
+	_, resp := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"})
+	challenge := resp["challenge"]
+
+	// 猜测验证码计入登录失败，锁定后正确的验证码也被拒绝
+	for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+		if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login/2fa", "10.0.0.1", "", map[string]interface{}{"challenge": challenge, "code": "000000"}); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d = %d; want 401", i+1, w.Code)
+		}
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login/2fa", "10.0.0.1", "", map[string]interface{}{"challenge": challenge, "code": "000000"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("wrong code after free attempts = %d; want 429", w.Code)
+	}
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login/2fa", "10.0.0.1", "", map[string]interface{}{"challenge": challenge, "code": testTOTPCode(t, h, "alice", 0)}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("correct code while locked = %d; want 429", w.Code)
+	}
+	// 密码正确也不能绕过验证码的锁定
+	if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.1", "", LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("password login while locked = %d; want 429", w.Code)
+	}
+}
+
+func TestTwoFactorManagementLockout(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		enabled bool // false 时只开始设置，尚未启用
+		setup   bool
+		wrong   func(h *Handler) interface{}
+		right   func(h *Handler) interface{}
+		want    int // 锁定前错误请求的状态码
+	}{
+		{
+			name:  "setup with a wrong password",
+			path:  "/api/auth/2fa/setup",
+			wrong: func(h *Handler) interface{} { return TwoFactorPasswordRequest{Password: "wrong"} },
+			right: func(h *Handler) interface{} { return TwoFactorPasswordRequest{Password: "correct-password"} },
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "enable with a wrong code",
+			path:  "/api/auth/2fa/enable",
+			setup: true,
+			wrong: func(h *Handler) interface{} { return TwoFactorCodeRequest{Code: "000000"} },
+			right: func(h *Handler) interface{} { return TwoFactorCodeRequest{Code: testTOTPCode(t, h, "alice", 0)} },
+			want:  http.StatusBadRequest,
+		},
+		{
+			name:    "recovery codes with a wrong code",
+			path:    "/api/auth/2fa/recovery-codes",
+			enabled: true,
+			wrong:   func(h *Handler) interface{} { return TwoFactorCodeRequest{Code: "000000"} },
+			right:   func(h *Handler) interface{} { return TwoFactorCodeRequest{Code: testTOTPCode(t, h, "alice", 0)} },
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "disable with a wrong password",
+			path:    "/api/auth/2fa/disable",
+			enabled: true,
+			wrong:   func(h *Handler) interface{} { return DisableTwoFactorRequest{Password: "wrong", Code: "000000"} },
+			right: func(h *Handler) interface{} {
+				return DisableTwoFactorRequest{Password: "correct-password", Code: testTOTPCode(t, h, "alice", 0)}
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:    "disable with a wrong code",
+			path:    "/api/auth/2fa/disable",
+			enabled: true,
+			wrong: func(h *Handler) interface{} {
+				return DisableTwoFactorRequest{Password: "correct-password", Code: "000000"}
+			},
+			right: func(h *Handler) interface{} {
+				return DisableTwoFactorRequest{Password: "correct-password", Code: testTOTPCode(t, h, "alice", 0)}
+			},
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		h, r := newTestHandler(t)
+		u := mustCreateTestUser(t, h, "alice", "correct-password")
+		switch {
+		case tt.enabled:
+			enableTestTwoFactor(t, h, u)
+		case tt.setup:
+			if _, err := service.BeginTwoFactorSetup(context.Background(), h.stores.TwoFactor, u); err != nil {
+				t.Fatalf("BeginTwoFactorSetup: %v", err)
+			}
+		}
+		token := loginTestSession(t, h, u)
+
+		// 错误的密码或验证码与登录失败共用计数，锁定后正确的请求和登录也被拒绝
+		for i := 0; i < service.UserLoginPolicy.FreeAttempts-1; i++ {
+			if w, _ := doJSON(t, r, http.MethodPost, tt.path, "10.0.0.1", token, tt.wrong(h)); w.Code != tt.want {
+				t.Fatalf("%s: attempt %d = %d; want %d", tt.name, i+1, w.Code, tt.want)
+			}
+		}
+		w, _ := doJSON(t, r, http.MethodPost, tt.path, "10.0.0.1", token, tt.wrong(h))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s: locking attempt = %d; want 429 with Retry-After", tt.name, w.Code)
+		}
+		if w, _ := doJSON(t, r, http.MethodPost, tt.path, "10.0.0.1", token, tt.right(h)); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s: correct request while locked = %d; want 429", tt.name, w.Code)
+		}
+		if w, _ := doJSON(t, r, http.MethodPost, "/api/auth/login", "10.0.0.2", "",
+			LoginRequest{Username: "alice", Password: "correct-password"}); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s: login while locked = %d; want 429", tt.name, w.Code)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
 	"example.com/travel_planner/backend/api"
 	"example.com/travel_planner/backend/config"
 	"example.com/travel_planner/backend/handlers"
@@ -15,22 +21,230 @@ func main() {
 	}
 	defer service.CloseLogger()
 
+	// 加载配置并初始化存储
+	serverAddr, redisAddr, redisPwd, redisDB := config.Load()
+	backend, closeBackend := openBackend(redisAddr, redisPwd, redisDB)
+	defer closeBackend()
+
+	// 登录失败锁定策略，lockouts 子命令也需要用它判断锁定状态
+	service.ConfigureLoginPolicies(config.Global.Auth.Lockout)
+
+	// 子命令：维护任务执行完即退出
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(backend, os.Args[2:]))
+		case "integrity":
+			os.Exit(runIntegrity(backend, os.Args[2:]))
+		case "lockouts":
+			os.Exit(runLockouts(backend, os.Args[2:]))
+		case "role":
+			os.Exit(runRole(backend, os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
+	// 令牌签名密钥与有效期
+	auth := config.Global.Auth
+	if err := service.InitSigningKeys(auth); err != nil {
+		panic("Failed to load JWT signing keys: " + err.Error())
+	}
+	if auth.AccessTokenMinutes > 0 {
+		service.AccessTokenTTL = time.Duration(auth.AccessTokenMinutes) * time.Minute
+	}
+	if auth.RefreshTokenDays > 0 {
+		service.RefreshTokenTTL = time.Duration(auth.RefreshTokenDays) * 24 * time.Hour
+	}
+	if auth.ResetTokenMinutes > 0 {
+		service.PasswordResetTTL = time.Duration(auth.ResetTokenMinutes) * time.Minute
+	}
+	if auth.TOTPIssuer != "" {
+		service.TOTPIssuer = auth.TOTPIssuer
+	}
+	if err := service.ConfigureCredentialPolicy(auth.Registration); err != nil {
+		panic("Failed to configure registration policy: " + err.Error())
+	}
+	notifier, err := service.NewNotifier(config.Global.Notifier)
+	if err != nil {
+		panic("Failed to create notifier: " + err.Error())
+	}
+	oidc, err := service.NewOIDCProvider(config.Global.OIDC)
+	if err != nil {
+		panic("Failed to configure OIDC: " + err.Error())
+	}
+
+	// 回收站过期清理
+	trash := config.Global.Trash
+	if trash.RetentionDays > 0 {
+		service.TrashRetention = time.Duration(trash.RetentionDays) * 24 * time.Hour
+	}
+	purgeInterval := time.Hour
+	if trash.PurgeIntervalMinutes > 0 {
+		purgeInterval = time.Duration(trash.PurgeIntervalMinutes) * time.Minute
+	}
+	service.StartTrashPurger(context.Background(), backend, purgeInterval)
+
+	// 定时一致性检查
+	integrity := config.Global.Integrity
+	if integrity.IntervalMinutes >= 0 {
+		checkInterval := 24 * time.Hour
+		if integrity.IntervalMinutes > 0 {
+			checkInterval = time.Duration(integrity.IntervalMinutes) * time.Minute
+		}
+		service.StartIntegrityChecker(context.Background(), backend, checkInterval, integrity.Repair)
+	}
+
+	// 生成行程校验不通过时的重试次数
+	if repairs := config.Global.Model.RepairAttempts; repairs != 0 {
+		service.MaxItineraryRepairs = max(repairs, 0)
+	}
+
+	// 后台任务：恢复上次未完成的任务并启动工作协程
+	stores := service.NewStores(backend)
+	jobsCfg := config.Global.Jobs
+	if jobsCfg.RetentionHours > 0 {
+		service.JobRetention = time.Duration(jobsCfg.RetentionHours) * time.Hour
+	}
+	workers, queueSize := 2, 100
+	if jobsCfg.Workers > 0 {
+		workers = jobsCfg.Workers
+	}
+	if jobsCfg.QueueSize > 0 {
+		queueSize = jobsCfg.QueueSize
+	}
+	jobs := service.NewJobRunner(stores, queueSize)
+	if err := jobs.Start(context.Background(), workers); err != nil {
+		panic("Failed to recover background jobs: " + err.Error())
+	}
+
 	r := gin.Default()
 
 	// 添加CORS中间件
 	r.Use(api.CORS())
 
 	apiGroup := r.Group("/")
-	handlers.RegisterRoutes(apiGroup)
-
-	// 加载配置并初始化 Redis
-	serverAddr, redisAddr, redisPwd, redisDB := config.Load()
-	if err := service.InitRedis(redisAddr, redisPwd, redisDB); err != nil {
-		service.LogError("Redis init failed: %v (login/register will fail)", err)
-	} else {
-		service.LogInfo("Redis connected at %s (db=%d)", redisAddr, redisDB)
-	}
+	handlers.RegisterRoutes(apiGroup, stores, notifier, oidc, jobs)
 
 	service.LogInfo("Server starting on %s", serverAddr)
 	r.Run(serverAddr)
 }
+
+// openBackend 根据配置打开存储后端，返回的 close 函数用于释放资源
+func openBackend(redisAddr, redisPwd string, redisDB int) (service.Backend, func()) {
+	switch config.Global.Storage.Driver {
+	case "sqlite":
+		path := config.Global.Storage.Path
+		if path == "" {
+			path = "travel_planner.db"
+		}
+		ss, err := service.NewSQLiteStore(path)
+		if err != nil {
+			panic("Failed to open sqlite database: " + err.Error())
+		}
+		service.LogInfo("SQLite storage opened at %s", path)
+		return ss, func() { ss.Close() }
+	case "memory":
+		service.LogWarn("Using in-memory storage, data will be lost on restart")
+		return service.NewMemoryStore(), func() {}
+	default:
+		rs := service.NewRedisStore(redisAddr, redisPwd, redisDB)
+		if err := rs.Ping(context.Background()); err != nil {
+			service.LogError("Redis init failed: %v (login/register will fail)", err)
+		} else {
+			service.LogInfo("Redis connected at %s (db=%d)", redisAddr, redisDB)
+		}
+		return rs, func() {}
+	}
+}
+
+// runMigrate 批量升级存量记录：migrate [-dry-run]
+func runMigrate(backend service.Backend, args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report records that need upgrading, do not write")
+	fs.Parse(args)
+
+	report, err := backend.MigrateRecords(context.Background(), *dryRun)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration aborted: %v\n", err)
+		return 1
+	}
+	for _, kr := range report.Kinds {
+		if kr.Failed > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runIntegrity 检查记录与索引的引用一致性：integrity [-repair]
+func runIntegrity(backend service.Backend, args []string) int {
+	fs := flag.NewFlagSet("integrity", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "remove dangling references, reindex orphan records and delete records of missing users")
+	fs.Parse(args)
+
+	report, err := backend.CheckIntegrity(context.Background(), *repair)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integrity check aborted: %v\n", err)
+		return 1
+	}
+	if report.Unrepaired() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runLockouts 查看或解除登录失败锁定：lockouts [-all] [-clear user:<用户名>|ip:<地址>]
+func runLockouts(backend service.Backend, args []string) int {
+	fs := flag.NewFlagSet("lockouts", flag.ExitOnError)
+	all := fs.Bool("all", false, "also list failure counters that are not locked")
+	clear := fs.String("clear", "", "clear the failure counter of user:<name> or ip:<addr>")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	if *clear != "" {
+		if err := backend.ClearLoginAttempts(ctx, *clear); err != nil {
+			fmt.Fprintf(os.Stderr, "clear %s: %v\n", *clear, err)
+			return 1
+		}
+		fmt.Printf("cleared %s\n", *clear)
+		return 0
+	}
+
+	lockouts, err := service.ListLoginLockouts(ctx, backend, !*all)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list lockouts: %v\n", err)
+		return 1
+	}
+	for _, l := range lockouts {
+		status := "not locked"
+		if l.Locked {
+			status = "locked until " + l.LockedUntil.Format(time.RFC3339)
+		}
+		fmt.Printf("%-40s %3d failures, last %s, %s\n", l.Key, l.Failures, l.LastFailure.Format(time.RFC3339), status)
+	}
+	fmt.Printf("%d entries\n", len(lockouts))
+	return 0
+}
+
+// runRole 修改用户角色，用于创建第一个管理员：role <用户名> user|admin
+func runRole(backend service.Backend, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: role <username> user|admin")
+		return 2
+	}
+	u, err := service.SetUserRole(context.Background(), service.NewStores(backend), args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "set role of %s: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("%s is now %s, existing sessions revoked\n", u.Username, u.Role)
+	return 0
+}
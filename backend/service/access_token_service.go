@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidAccessToken  = errors.New("invalid or expired access token")
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	ErrInvalidScope        = errors.New("invalid access token scope")
+	ErrTooManyAccessTokens = errors.New("too many access tokens")
+)
+
+// accessTokenPrefix 个人访问令牌的前缀，用于和 JWT 区分，也便于在代码和日志中识别泄露的令牌
+const accessTokenPrefix = "tpat_"
+
+// 个人访问令牌的有效期和数量限制
+var (
+	DefaultAccessTokenTTL  = 30 * 24 * time.Hour
+	MaxAccessTokenTTL      = 365 * 24 * time.Hour
+	MaxAccessTokensPerUser = 20
+)
+
+// accessTokenTouchInterval 最近使用时间的更新间隔，避免每个请求都写存储
+const accessTokenTouchInterval = time.Minute
+
+// AccessTokenScopes 可授予个人访问令牌的权限。GET 请求需要 <资源>:read，其他请求需要 <资源>:write，
+// write 不包含 read
+var AccessTokenScopes = []string{
+	"trips:read", "trips:write",
+	"expenses:read", "expenses:write",
+	"diaries:read", "diaries:write",
+	"favorites:read", "favorites:write",
+	"trash:read", "trash:write",
+	"account:read", "account:write",
+	"search:read",
+}
+
+// AccessToken 个人访问令牌，供脚本调用 API；只保存令牌的 SHA256 摘要
+type AccessToken struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"userId"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	TokenHash  string     `json:"tokenHash"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// AccessTokenStore 个人访问令牌存储
+type AccessTokenStore interface {
+	// CreateAccessToken 保存新令牌
+	CreateAccessToken(ctx context.Context, t *AccessToken) error
+	// GetAccessToken 获取令牌，不存在或已过期时返回 nil, nil
+	GetAccessToken(ctx context.Context, id string) (*AccessToken, error)
+	// ListAccessTokens 列出用户未过期的令牌，按创建时间排序
+	ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error)
+	// DeleteAccessToken 撤销用户的令牌，不存在或不属于该用户时返回 ErrAccessTokenNotFound
+	DeleteAccessToken(ctx context.Context, username, id string) error
+	// TouchAccessToken 更新最近使用时间，令牌已被撤销时不做任何操作
+	TouchAccessToken(ctx context.Context, id string, at time.Time) error
+}
+
+// AccessTokenInfo 返回给客户端的令牌信息，不包含摘要
+type AccessTokenInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// Info 返回令牌的展示信息
+func (t *AccessToken) Info() *AccessTokenInfo {
+	return &AccessTokenInfo{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.Scopes,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
+
+// HasScope 判断令牌是否具有指定权限
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccessToken 判断 Authorization 中的凭证是否为个人访问令牌
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
+
+// normalizeScopes 校验权限并去重排序
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+	valid := make(map[string]bool, len(AccessTokenScopes))
+	for _, s := range AccessTokenScopes {
+		valid[s] = true
+	}
+	seen := make(map[string]bool, len(scopes))
+	out := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		if !valid[s] {
+			return nil, ErrInvalidScope
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// CreateAccessToken 为用户创建个人访问令牌，返回只展示这一次的令牌明文。ttl 为 0 时使用默认有效期，
+// 超过 MaxAccessTokenTTL 时按最大值处理；权限无效时返回 ErrInvalidScope，
+// 用户的令牌数量达到上限时返回 ErrTooManyAccessTokens
+func CreateAccessToken(ctx context.Context, store AccessTokenStore, user *UserRecord, name string, scopes []string, ttl time.Duration) (string, *AccessToken, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	existing, err := store.ListAccessTokens(ctx, user.Username)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(existing) >= MaxAccessTokensPerUser {
+		return "", nil, ErrTooManyAccessTokens
+	}
+	if ttl <= 0 {
+		ttl = DefaultAccessTokenTTL
+	}
+	if ttl > MaxAccessTokenTTL {
+		ttl = MaxAccessTokenTTL
+	}
+
+	id, err := randomToken(12)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	t := &AccessToken{
+		ID:        id,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Name:      strings.TrimSpace(name),
+		Scopes:    scopes,
+		TokenHash: hashToken(secret),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := store.CreateAccessToken(ctx, t); err != nil {
+		return "", nil, err
+	}
+	return accessTokenPrefix + id + "." + secret, t, nil
+}
+
+// ValidAccessTokenName 令牌名称不能为空，最长 64 个字符
+func ValidAccessTokenName(name string) bool {
+	n := utf8.RuneCountInString(strings.TrimSpace(name))
+	return n > 0 && n <= 64
+}
+
+// AuthenticateAccessToken 校验个人访问令牌，返回令牌及其所属用户。令牌无效、已过期或被撤销，
+// 以及用户已注销或被停用时返回 ErrInvalidAccessToken
+func AuthenticateAccessToken(ctx context.Context, stores *Stores, token string) (*AccessToken, *UserRecord, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, accessTokenPrefix), ".")
+	if !IsAccessToken(token) || !ok || id == "" || secret == "" {
+		return nil, nil, ErrInvalidAccessToken
+	}
+	t, err := stores.AccessTokens.GetAccessToken(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(t.TokenHash)) != 1 {
+		return nil, nil, ErrInvalidAccessToken
+	}
+	user, err := stores.Users.GetUser(ctx, t.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil || user.ID != t.UserID || user.Disabled {
+		return nil, nil, ErrInvalidAccessToken
+	}
+
+	now := time.Now()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= accessTokenTouchInterval {
+		if err := stores.AccessTokens.TouchAccessToken(ctx, t.ID, now); err != nil {
+			LogWarn("Failed to update last use of access token %s: %v", t.ID, err)
+		}
+	}
+	return t, user, nil
+}
+
+// RevokeUserAccessTokens 撤销用户全部未过期的个人访问令牌，返回撤销数量
+func RevokeUserAccessTokens(ctx context.Context, store AccessTokenStore, username string) (int, error) {
+	tokens, err := store.ListAccessTokens(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, t := range tokens {
+		err := store.DeleteAccessToken(ctx, username, t.ID)
+		if errors.Is(err, ErrAccessTokenNotFound) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func accessTokenKey(id string) string            { return "access_token:" + id }
+func userAccessTokensKey(username string) string { return "user_access_tokens:" + username }
+
+// CreateAccessToken 保存令牌并加入用户的令牌集合。集合不设置过期时间，已过期的ID在列出时清理
+func (s *RedisStore) CreateAccessToken(ctx context.Context, t *AccessToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, accessTokenKey(t.ID), data, time.Until(t.ExpiresAt))
+		pipe.SAdd(ctx, userAccessTokensKey(t.Username), t.ID)
+		return nil
+	})
+	return err
+}
+
+// GetAccessToken 获取令牌
+func (s *RedisStore) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	data, err := s.rdb.Get(ctx, accessTokenKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t AccessToken
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListAccessTokens 批量读取用户集合中的令牌，并从集合中移除已过期的ID
+func (s *RedisStore) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	indexKey := userAccessTokensKey(username)
+	ids, err := s.rdb.SMembers(ctx, indexKey).Result()
+	if err != nil || len(ids) == 0 {
+		return []*AccessToken{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = accessTokenKey(id)
+	}
+	vals, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]*AccessToken, 0, len(ids))
+	var expired []interface{}
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+		var t AccessToken
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	if len(expired) > 0 {
+		s.rdb.SRem(ctx, indexKey, expired...)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// DeleteAccessToken 删除令牌及其在用户集合中的ID
+func (s *RedisStore) DeleteAccessToken(ctx context.Context, username, id string) error {
+	t, err := s.GetAccessToken(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.Username != username {
+		return ErrAccessTokenNotFound
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, accessTokenKey(id))
+		pipe.SRem(ctx, userAccessTokensKey(username), id)
+		return nil
+	})
+	return err
+}
+
+// TouchAccessToken 以 SET XX KEEPTTL 写回，令牌在读写之间被撤销时不会被重新创建
+func (s *RedisStore) TouchAccessToken(ctx context.Context, id string, at time.Time) error {
+	t, err := s.GetAccessToken(ctx, id)
+	if err != nil || t == nil {
+		return err
+	}
+	t.LastUsedAt = &at
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	err = s.rdb.SetArgs(ctx, accessTokenKey(id), data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustCreateAccessToken 为用户创建具有 scopes 权限的个人访问令牌，返回令牌明文
+func mustCreateAccessToken(t *testing.T, stores *Stores, u *UserRecord, scopes ...string) (string, *AccessToken) {
+	t.Helper()
+	token, at, err := CreateAccessToken(context.Background(), stores.AccessTokens, u, "ci", scopes, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateAccessToken: %v", err)
+	}
+	return token, at
+}
+
+func TestAccessTokenPrefix(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	token, at := mustCreateAccessToken(t, stores, u, "trips:read")
+
+	if !strings.HasPrefix(token, accessTokenPrefix+at.ID+".") || !IsAccessToken(token) {
+		t.Fatalf("token %q; want %s<id>.<secret>", token, accessTokenPrefix)
+	}
+	got, user, err := AuthenticateAccessToken(ctx, stores, token)
+	if err != nil || got.ID != at.ID || user.Username != "alice" {
+		t.Fatalf("AuthenticateAccessToken = %+v, %+v, %v; want alice's token", got, user, err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "trips", token); code != http.StatusOK {
+		t.Fatalf("access token = %d; want 200", code)
+	}
+
+	// 去掉前缀的令牌按 JWT 解析，前缀相同但 ID 或密钥不对的令牌都不被接受
+	_, secret, _ := strings.Cut(strings.TrimPrefix(token, accessTokenPrefix), ".")
+	for _, bad := range []string{
+		strings.TrimPrefix(token, accessTokenPrefix),
+		accessTokenPrefix + at.ID,
+		accessTokenPrefix + at.ID + ".",
+		accessTokenPrefix + "." + secret,
+		accessTokenPrefix + at.ID + ".forged",
+		accessTokenPrefix + "unknown." + secret,
+		"TPAT_" + at.ID + "." + secret,
+	} {
+		if _, _, err := AuthenticateAccessToken(ctx, stores, bad); !errors.Is(err, ErrInvalidAccessToken) {
+			t.Errorf("AuthenticateAccessToken(%q) = %v; want ErrInvalidAccessToken", bad, err)
+		}
+		if code := authStatus(t, stores, http.MethodGet, "trips", bad); code != http.StatusUnauthorized {
+			t.Errorf("token %q = %d; want 401", bad, code)
+		}
+	}
+
+	// 只接受 JWT 的接口拒绝个人访问令牌
+	if code := authStatus(t, stores, http.MethodGet, "", token); code != http.StatusForbidden {
+		t.Fatalf("access token on a session-only route = %d; want 403", code)
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	u := mustCreateUser(t, context.Background(), b, "alice")
+	read, _ := mustCreateAccessToken(t, stores, u, "trips:read")
+	write, _ := mustCreateAccessToken(t, stores, u, "trips:write")
+
+	tests := []struct {
+		token    string
+		method   string
+		resource string
+		want     int
+	}{
+		{read, http.MethodGet, "trips", http.StatusOK},
+		{read, http.MethodHead, "trips", http.StatusOK},
+		{read, http.MethodPost, "trips", http.StatusForbidden},
+		{read, http.MethodPut, "trips", http.StatusForbidden},
+		{read, http.MethodDelete, "trips", http.StatusForbidden},
+		{read, http.MethodGet, "expenses", http.StatusForbidden},
+		{write, http.MethodPost, "trips", http.StatusOK},
+		{write, http.MethodDelete, "trips", http.StatusOK},
+		{write, http.MethodGet, "trips", http.StatusForbidden}, // write 不包含 read
+	}
+	for _, tt := range tests {
+		if code := authStatus(t, stores, tt.method, tt.resource, tt.token); code != tt.want {
+			t.Errorf("%s %s with %q = %d; want %d", tt.method, tt.resource, tt.token[:10], code, tt.want)
+		}
+	}
+}
+
+func TestAccessTokenExpiredOrRevoked(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+
+	expired := &AccessToken{
+		ID: "expired", UserID: u.ID, Username: u.Username, Scopes: []string{"trips:read"},
+		TokenHash: hashToken("secret"), CreatedAt: time.Now().Add(-2 * time.Hour), ExpiresAt: time.Now().Add(-time.Hour),
+	}
+	if err := stores.AccessTokens.CreateAccessToken(ctx, expired); err != nil {
+		t.Fatalf("CreateAccessToken: %v", err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "trips", accessTokenPrefix+"expired.secret"); code != http.StatusUnauthorized {
+		t.Fatalf("expired access token = %d; want 401", code)
+	}
+
+	token, at := mustCreateAccessToken(t, stores, u, "trips:read")
+	if err := stores.AccessTokens.DeleteAccessToken(ctx, "bob", at.ID); !errors.Is(err, ErrAccessTokenNotFound) {
+		t.Fatalf("revoke another user's token = %v; want ErrAccessTokenNotFound", err)
+	}
+	if err := stores.AccessTokens.DeleteAccessToken(ctx, "alice", at.ID); err != nil {
+		t.Fatalf("DeleteAccessToken: %v", err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "trips", token); code != http.StatusUnauthorized {
+		t.Fatalf("revoked access token = %d; want 401", code)
+	}
+}
+
+func TestAccessTokenLastUsed(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	token, at := mustCreateAccessToken(t, stores, u, "trips:read")
+	if at.LastUsedAt != nil {
+		t.Fatalf("new token LastUsedAt = %v; want nil", at.LastUsedAt)
+	}
+	lastUsed := func() *time.Time {
+		t.Helper()
+		got, err := stores.AccessTokens.GetAccessToken(ctx, at.ID)
+		if err != nil || got == nil {
+			t.Fatalf("GetAccessToken = %v, %v", got, err)
+		}
+		return got.LastUsedAt
+	}
+
+	authStatus(t, stores, http.MethodGet, "trips", token)
+	first := lastUsed()
+	if first == nil || time.Since(*first) > time.Minute {
+		t.Fatalf("LastUsedAt after use = %v; want now", first)
+	}
+	// 间隔内的再次使用不写存储
+	authStatus(t, stores, http.MethodGet, "trips", token)
+	if got := lastUsed(); got == nil || !got.Equal(*first) {
+		t.Fatalf("LastUsedAt within the touch interval = %v; want %v", got, first)
+	}
+
+	stale := time.Now().Add(-2 * accessTokenTouchInterval)
+	if err := stores.AccessTokens.TouchAccessToken(ctx, at.ID, stale); err != nil {
+		t.Fatalf("TouchAccessToken: %v", err)
+	}
+	authStatus(t, stores, http.MethodGet, "trips", token)
+	if got := lastUsed(); got == nil || !got.After(stale) {
+		t.Fatalf("LastUsedAt after the touch interval = %v; want after %v", got, stale)
+	}
+}
+
+func TestChangePasswordRevokesAccessTokens(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	bob := mustCreateUser(t, ctx, b, "bob")
+	read, _ := mustCreateAccessToken(t, stores, u, "trips:read")
+	write, _ := mustCreateAccessToken(t, stores, u, "expenses:write")
+	other, _ := mustCreateAccessToken(t, stores, bob, "trips:read")
+
+	if _, err := ChangePassword(ctx, stores, u, "new-password-1"); err != nil {
+		t.Fatalf("ChangePassword: %v", err)
+	}
+	for _, token := range []string{read, write} {
+		if _, _, err := AuthenticateAccessToken(ctx, stores, token); !errors.Is(err, ErrInvalidAccessToken) {
+			t.Fatalf("access token after password change = %v; want ErrInvalidAccessToken", err)
+		}
+	}
+	if tokens, _ := stores.AccessTokens.ListAccessTokens(ctx, "alice"); len(tokens) != 0 {
+		t.Fatalf("%d access tokens left after password change; want 0", len(tokens))
+	}
+	if _, _, err := AuthenticateAccessToken(ctx, stores, other); err != nil {
+		t.Fatalf("bob's access token after alice changed password = %v; want nil", err)
+	}
+}
@@ -0,0 +1,482 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// 账户导出归档格式：zip 包内包含 manifest.json 和每类数据一个 JSON 数组文件
+const (
+	ArchiveFormat        = "travel-planner-account"
+	ArchiveFormatVersion = 1
+
+	archiveManifestName = "manifest.json"
+	// archiveMaxEntrySize 单个文件解压后的大小上限，防止压缩炸弹
+	archiveMaxEntrySize = 64 << 20
+)
+
+// 归档中的数据文件
+const (
+	ArchiveTrips         = "trips.json"
+	ArchiveFavoriteTrips = "favorite_trips.json"
+	ArchiveFavorites     = "favorites.json"
+	ArchiveExpenses      = "expenses.json"
+	ArchiveDiaries       = "diaries.json"
+)
+
+var archiveFileOrder = []string{ArchiveTrips, ArchiveFavoriteTrips, ArchiveFavorites, ArchiveExpenses, ArchiveDiaries}
+
+// ErrInvalidArchive 归档无法识别或已损坏
+var ErrInvalidArchive = errors.New("invalid account archive")
+
+// ArchiveManifest 归档清单
+type ArchiveManifest struct {
+	Format     string                `json:"format"`
+	Version    int                   `json:"version"`
+	ExportedAt time.Time             `json:"exportedAt"`
+	Username   string                `json:"username"`
+	UserID     int                   `json:"userId"`
+	Files      []ArchiveManifestFile `json:"files"`
+}
+
+// ArchiveManifestFile 清单中的单个数据文件，导入时校验 SHA256
+type ArchiveManifestFile struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportAccount 将用户的行程、收藏行程、景点收藏、花费和日记写入 zip 归档
+func ExportAccount(ctx context.Context, stores *Stores, user *UserRecord, w io.Writer) error {
+	trips, err := stores.Trips.GetUserTrips(ctx, user.Username)
+	if err != nil {
+		return fmt.Errorf("load trips: %w", err)
+	}
+	favTrips, err := stores.Favorites.GetUserFavoriteTrips(ctx, user.Username)
+	if err != nil {
+		return fmt.Errorf("load favorite trips: %w", err)
+	}
+	favTripIDs := make([]string, 0, len(favTrips))
+	for _, t := range favTrips {
+		favTripIDs = append(favTripIDs, t.ID)
+	}
+	favorites, err := stores.Favorites.GetUserFavorites(ctx, user.Username)
+	if err != nil {
+		return fmt.Errorf("load favorites: %w", err)
+	}
+	expenses, err := stores.Expenses.GetExpenses(ctx, user.Username)
+	if err != nil {
+		return fmt.Errorf("load expenses: %w", err)
+	}
+	diaries, err := stores.Diaries.GetUserDiaries(ctx, int64(user.ID))
+	if err != nil {
+		return fmt.Errorf("load diaries: %w", err)
+	}
+
+	manifest := ArchiveManifest{
+		Format:     ArchiveFormat,
+		Version:    ArchiveFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		Username:   user.Username,
+		UserID:     user.ID,
+	}
+	contents := map[string]interface{}{
+		ArchiveTrips:         trips,
+		ArchiveFavoriteTrips: favTripIDs,
+		ArchiveFavorites:     favorites,
+		ArchiveExpenses:      expenses,
+		ArchiveDiaries:       diaries,
+	}
+	counts := map[string]int{
+		ArchiveTrips:         len(trips),
+		ArchiveFavoriteTrips: len(favTripIDs),
+		ArchiveFavorites:     len(favorites),
+		ArchiveExpenses:      len(expenses),
+		ArchiveDiaries:       len(diaries),
+	}
+
+	zw := zip.NewWriter(w)
+	for _, name := range archiveFileOrder {
+		data, err := json.MarshalIndent(contents[name], "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", name, err)
+		}
+		if err := writeZipFile(zw, name, manifest.ExportedAt, data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, ArchiveManifestFile{Name: name, Count: counts[name], SHA256: hex.EncodeToString(sum[:])})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, archiveManifestName, manifest.ExportedAt, data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, modified time.Time, data []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// ImportConflict 导入记录与账户中已有记录ID相同时的处理方式
+type ImportConflict string
+
+const (
+	// ConflictSkip 保留已有记录（默认）
+	ConflictSkip ImportConflict = "skip"
+	// ConflictReplace 用归档中的版本覆盖已有记录；花费记录不支持修改，冲突的花费计为跳过并给出警告
+	ConflictReplace ImportConflict = "replace"
+	// ConflictDuplicate 以新ID再导入一份；景点收藏以地点ID为键，仍保留已有记录
+	ConflictDuplicate ImportConflict = "duplicate"
+)
+
+// ParseImportConflict 解析冲突处理方式，空字符串为 ConflictSkip
+func ParseImportConflict(s string) (ImportConflict, error) {
+	switch c := ImportConflict(s); c {
+	case "":
+		return ConflictSkip, nil
+	case ConflictSkip, ConflictReplace, ConflictDuplicate:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown conflict mode %q", s)
+}
+
+// ImportCounts 单类记录的导入统计
+type ImportCounts struct {
+	Imported int `json:"imported"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+// ImportReport 导入结果，TripIDs 为归档中行程ID到新行程ID的映射
+type ImportReport struct {
+	Source        string            `json:"source"`
+	Trips         ImportCounts      `json:"trips"`
+	FavoriteTrips ImportCounts      `json:"favoriteTrips"`
+	Favorites     ImportCounts      `json:"favorites"`
+	Expenses      ImportCounts      `json:"expenses"`
+	Diaries       ImportCounts      `json:"diaries"`
+	TripIDs       map[string]string `json:"tripIds"`
+	Warnings      []string          `json:"warnings,omitempty"`
+}
+
+func (r *ImportReport) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// accountArchive 已校验的归档内容，记录保持原始 JSON，导入时按记录类型迁移到当前版本
+type accountArchive struct {
+	manifest ArchiveManifest
+	files    map[string][]json.RawMessage
+}
+
+// readAccountArchive 读取并校验归档清单和数据文件
+func readAccountArchive(r io.ReaderAt, size int64) (*accountArchive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	readEntry := func(name string) ([]byte, error) {
+		f, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s", ErrInvalidArchive, name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, name, err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, archiveMaxEntrySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, name, err)
+		}
+		if len(data) > archiveMaxEntrySize {
+			return nil, fmt.Errorf("%w: %s is too large", ErrInvalidArchive, name)
+		}
+		return data, nil
+	}
+
+	data, err := readEntry(archiveManifestName)
+	if err != nil {
+		return nil, err
+	}
+	a := &accountArchive{files: make(map[string][]json.RawMessage)}
+	if err := json.Unmarshal(data, &a.manifest); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrInvalidArchive, err)
+	}
+	if a.manifest.Format != ArchiveFormat {
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidArchive, a.manifest.Format)
+	}
+	if a.manifest.Version > ArchiveFormatVersion {
+		return nil, fmt.Errorf("%w: archive version %d is newer than supported version %d",
+			ErrInvalidArchive, a.manifest.Version, ArchiveFormatVersion)
+	}
+	for _, mf := range a.manifest.Files {
+		data, err := readEntry(mf.Name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != mf.SHA256 {
+			return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidArchive, mf.Name)
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, mf.Name, err)
+		}
+		a.files[mf.Name] = items
+	}
+	return a, nil
+}
+
+// ImportAccount 将归档恢复到 user 账户。行程和花费总是分配新ID（覆盖已有同ID行程时除外），
+// 日记由存储分配新ID，收藏行程按新行程ID重新关联；与账户中已有记录冲突时按 conflict 处理
+func ImportAccount(ctx context.Context, stores *Stores, user *UserRecord, r io.ReaderAt, size int64, conflict ImportConflict) (*ImportReport, error) {
+	a, err := readAccountArchive(r, size)
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{Source: a.manifest.Username, TripIDs: make(map[string]string)}
+	imp := &accountImporter{stores: stores, user: user, conflict: conflict, archive: a, report: report}
+
+	steps := []func(ctx context.Context) error{
+		imp.importTrips,
+		imp.importFavoriteTrips,
+		imp.importFavorites,
+		imp.importExpenses,
+		imp.importDiaries,
+	}
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// accountImporter 单次导入的状态
+type accountImporter struct {
+	stores   *Stores
+	user     *UserRecord
+	conflict ImportConflict
+	archive  *accountArchive
+	report   *ImportReport
+}
+
+func (imp *accountImporter) importTrips(ctx context.Context) error {
+	existing, err := imp.stores.Trips.GetUserTrips(ctx, imp.user.Username)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]bool, len(existing))
+	for _, t := range existing {
+		owned[t.ID] = true
+	}
+
+	counts := &imp.report.Trips
+	for i, raw := range imp.archive.files[ArchiveTrips] {
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, raw, &plan); err != nil || plan.ID == "" {
+			counts.Failed++
+			imp.report.warn("trips[%d]: unreadable record", i)
+			continue
+		}
+		oldID := plan.ID
+		replace := false
+		if owned[oldID] {
+			switch imp.conflict {
+			case ConflictSkip:
+				counts.Skipped++
+				imp.report.TripIDs[oldID] = oldID
+				continue
+			case ConflictReplace:
+				replace = true
+			}
+		}
+		if !replace {
+			if plan.ID, err = imp.stores.Trips.GenerateTripID(ctx); err != nil {
+				return err
+			}
+		}
+		plan.UserID = imp.user.ID
+		plan.Username = imp.user.Username
+		if err := imp.stores.Trips.SaveTripPlan(ctx, &plan, TripRevisionInfo{Reason: RevisionImported}); err != nil {
+			return fmt.Errorf("save trip %s: %w", oldID, err)
+		}
+		imp.report.TripIDs[oldID] = plan.ID
+		if replace {
+			counts.Replaced++
+		} else {
+			counts.Imported++
+		}
+	}
+	return nil
+}
+
+func (imp *accountImporter) importFavoriteTrips(ctx context.Context) error {
+	counts := &imp.report.FavoriteTrips
+	for i, raw := range imp.archive.files[ArchiveFavoriteTrips] {
+		var oldID string
+		if err := json.Unmarshal(raw, &oldID); err != nil {
+			counts.Failed++
+			imp.report.warn("favorite_trips[%d]: unreadable record", i)
+			continue
+		}
+		// 归档内的行程使用新ID；收藏的他人行程若仍存在则保留原ID
+		tripID, ok := imp.report.TripIDs[oldID]
+		if !ok {
+			tripID = oldID
+		}
+		favorited, err := imp.stores.Favorites.IsTripFavorited(ctx, imp.user.Username, tripID)
+		if err != nil {
+			return err
+		}
+		if favorited {
+			counts.Skipped++
+			continue
+		}
+		err = imp.stores.Favorites.AddFavoriteTrip(ctx, imp.user.Username, tripID)
+		if errors.Is(err, ErrTripNotFound) {
+			counts.Skipped++
+			imp.report.warn("favorite trip %s no longer exists", oldID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("favorite trip %s: %w", oldID, err)
+		}
+		counts.Imported++
+	}
+	return nil
+}
+
+func (imp *accountImporter) importFavorites(ctx context.Context) error {
+	counts := &imp.report.Favorites
+	for i, raw := range imp.archive.files[ArchiveFavorites] {
+		var f Favorite
+		if err := json.Unmarshal(raw, &f); err != nil || f.ID == "" {
+			counts.Failed++
+			imp.report.warn("favorites[%d]: unreadable record", i)
+			continue
+		}
+		err := imp.stores.Favorites.AddFavorite(ctx, imp.user.Username, f)
+		if errors.Is(err, ErrFavoriteExists) {
+			if imp.conflict != ConflictReplace {
+				counts.Skipped++
+				continue
+			}
+			if err := imp.stores.Favorites.ReplaceFavorite(ctx, imp.user.Username, f); err != nil {
+				return fmt.Errorf("replace favorite %s: %w", f.ID, err)
+			}
+			counts.Replaced++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("add favorite %s: %w", f.ID, err)
+		}
+		counts.Imported++
+	}
+	return nil
+}
+
+func (imp *accountImporter) importExpenses(ctx context.Context) error {
+	existing, err := imp.stores.Expenses.GetExpenses(ctx, imp.user.Username)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		have[e.ID] = true
+	}
+
+	counts := &imp.report.Expenses
+	for i, raw := range imp.archive.files[ArchiveExpenses] {
+		var rec ExpenseRecord
+		if _, _, err := decodeRecord(KindExpense, raw, &rec); err != nil {
+			counts.Failed++
+			imp.report.warn("expenses[%d]: unreadable record", i)
+			continue
+		}
+		if have[rec.ID] && imp.conflict != ConflictDuplicate {
+			counts.Skipped++
+			if imp.conflict == ConflictReplace {
+				imp.report.warn("expense %s already exists and was kept: expenses cannot be replaced", rec.ID)
+			}
+			continue
+		}
+		oldID := rec.ID
+		if rec.ID, err = imp.stores.Expenses.GenerateExpenseID(ctx); err != nil {
+			return err
+		}
+		if err := imp.stores.Expenses.SaveExpense(ctx, imp.user.Username, &rec); err != nil {
+			return fmt.Errorf("save expense %s: %w", oldID, err)
+		}
+		counts.Imported++
+	}
+	return nil
+}
+
+func (imp *accountImporter) importDiaries(ctx context.Context) error {
+	// 日记ID只在用户内唯一，只有从同一账户导出的归档才按ID判断冲突
+	have := make(map[int64]bool)
+	if imp.archive.manifest.UserID == imp.user.ID && imp.archive.manifest.Username == imp.user.Username {
+		existing, err := imp.stores.Diaries.GetUserDiaries(ctx, int64(imp.user.ID))
+		if err != nil {
+			return err
+		}
+		for _, d := range existing {
+			have[d.ID] = true
+		}
+	}
+
+	counts := &imp.report.Diaries
+	for i, raw := range imp.archive.files[ArchiveDiaries] {
+		var d DiaryEntry
+		if _, _, err := decodeRecord(KindDiary, raw, &d); err != nil {
+			counts.Failed++
+			imp.report.warn("diaries[%d]: unreadable record", i)
+			continue
+		}
+		oldID := d.ID
+		d.UserID = int64(imp.user.ID)
+		if have[oldID] {
+			switch imp.conflict {
+			case ConflictSkip:
+				counts.Skipped++
+				continue
+			case ConflictReplace:
+				err := imp.stores.Diaries.UpdateDiary(ctx, strconv.FormatInt(oldID, 10), d.UserID, &d)
+				if err != nil {
+					return fmt.Errorf("replace diary %d: %w", oldID, err)
+				}
+				counts.Replaced++
+				continue
+			}
+		}
+		if _, err := imp.stores.Diaries.CreateDiary(ctx, &d); err != nil {
+			return fmt.Errorf("create diary %d: %w", oldID, err)
+		}
+		counts.Imported++
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTestAccount 导出用户归档
+func exportTestAccount(t *testing.T, ctx context.Context, stores *Stores, u *UserRecord) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := ExportAccount(ctx, stores, u, &buf); err != nil {
+		t.Fatalf("ExportAccount: %v", err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestAccountArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	alice := mustCreateUser(t, ctx, b, "alice")
+	bob := mustCreateUser(t, ctx, b, "bob")
+
+	mustSaveTrip(t, ctx, b, alice, "trip1", 1000, time.Now())
+	mustSaveTrip(t, ctx, b, alice, "trip2", 2000, time.Now())
+	if err := b.AddFavoriteTrip(ctx, "alice", "trip2"); err != nil {
+		t.Fatalf("AddFavoriteTrip: %v", err)
+	}
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "故宫"}); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	if err := b.SaveExpense(ctx, "alice", &ExpenseRecord{ID: "exp1", Category: "food", Amount: 50, Date: "2026-11-01"}); err != nil {
+		t.Fatalf("SaveExpense: %v", err)
+	}
+	diaryID, err := b.CreateDiary(ctx, &DiaryEntry{UserID: int64(alice.ID), Date: "2026-11-01", Title: "第一天", Content: "故宫"})
+	if err != nil {
+		t.Fatalf("CreateDiary: %v", err)
+	}
+
+	// 导入到另一个账户：所有记录分配新ID，收藏行程指向新行程
+	archive := exportTestAccount(t, ctx, stores, alice)
+	report, err := ImportAccount(ctx, stores, bob, archive, archive.Size(), ConflictSkip)
+	if err != nil {
+		t.Fatalf("ImportAccount: %v", err)
+	}
+	if report.Source != "alice" || report.Trips.Imported != 2 || report.FavoriteTrips.Imported != 1 ||
+		report.Favorites.Imported != 1 || report.Expenses.Imported != 1 || report.Diaries.Imported != 1 {
+		t.Fatalf("import report = %+v", report)
+	}
+	for _, oldID := range []string{"trip1", "trip2"} {
+		newID := report.TripIDs[oldID]
+		if newID == "" || newID == oldID {
+			t.Fatalf("trip %s was not given a new ID: %q", oldID, newID)
+		}
+		p, err := b.GetTripPlan(ctx, newID)
+		if err != nil || p == nil || p.Username != "bob" || p.UserID != bob.ID || p.Summary != "summary "+oldID {
+			t.Fatalf("imported trip %s = %+v, %v", newID, p, err)
+		}
+	}
+	if orig, _ := b.GetTripPlan(ctx, "trip1"); orig == nil || orig.Username != "alice" {
+		t.Fatalf("import changed the source account's trip: %+v", orig)
+	}
+	favTrips, _ := b.GetUserFavoriteTrips(ctx, "bob")
+	if len(favTrips) != 1 || favTrips[0].ID != report.TripIDs["trip2"] {
+		t.Fatalf("bob's favorite trips = %+v; want the imported copy of trip2", favTrips)
+	}
+	expenses, _ := b.GetExpenses(ctx, "bob")
+	if len(expenses) != 1 || expenses[0].ID == "exp1" || expenses[0].Amount != 50 {
+		t.Fatalf("bob's expenses = %+v", expenses)
+	}
+	diaries, _ := b.GetUserDiaries(ctx, int64(bob.ID))
+	if len(diaries) != 1 || diaries[0].UserID != int64(bob.ID) || diaries[0].Title != "第一天" {
+		t.Fatalf("bob's diaries = %+v", diaries)
+	}
+
+	// 重新导入到原账户并覆盖：景点收藏原地覆盖，不进入回收站；花费不支持覆盖，计为跳过并给出警告
+	archive = exportTestAccount(t, ctx, stores, alice)
+	if err := b.ReplaceFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "已修改"}); err != nil {
+		t.Fatalf("ReplaceFavorite: %v", err)
+	}
+	report, err = ImportAccount(ctx, stores, alice, archive, archive.Size(), ConflictReplace)
+	if err != nil {
+		t.Fatalf("ImportAccount(replace): %v", err)
+	}
+	if report.Trips.Replaced != 2 || report.Favorites.Replaced != 1 || report.Diaries.Replaced != 1 ||
+		report.Expenses.Skipped != 1 || report.Expenses.Imported != 0 || report.FavoriteTrips.Skipped != 1 {
+		t.Fatalf("replace report = %+v", report)
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "exp1") {
+		t.Fatalf("replace warnings = %q; want one about exp1", report.Warnings)
+	}
+	favs, _ := b.GetUserFavorites(ctx, "alice")
+	if len(favs) != 1 || favs[0].Name != "故宫" {
+		t.Fatalf("alice's favorites after replace = %+v", favs)
+	}
+	if items, _ := b.ListTrash(ctx, "alice"); len(items) != 0 {
+		t.Fatalf("replace import left %d trash items", len(items))
+	}
+	if trips, _ := b.GetUserTrips(ctx, "alice"); len(trips) != 2 {
+		t.Fatalf("alice has %d trips after replace; want 2", len(trips))
+	}
+	if d, err := b.GetDiary(ctx, strconv.FormatInt(diaryID, 10), int64(alice.ID)); err != nil || d.Title != "第一天" {
+		t.Fatalf("replaced diary = %+v, %v", d, err)
+	}
+	if expenses, _ := b.GetExpenses(ctx, "alice"); len(expenses) != 1 {
+		t.Fatalf("alice has %d expenses after replace; want 1", len(expenses))
+	}
+}
@@ -0,0 +1,385 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 注销账户时删除的数据类别
+const (
+	DeletedUser              = "user"
+	DeletedTrips             = "trips"
+	DeletedTripRevisions     = "tripRevisions"
+	DeletedFavoriteTrips     = "favoriteTrips"
+	DeletedFavorites         = "favorites"
+	DeletedExpenses          = "expenses"
+	DeletedDiaries           = "diaries"
+	DeletedTrash             = "trash"
+	DeletedSearchIndex       = "searchIndex"       // 搜索索引中的文档
+	DeletedSessions          = "sessions"          // 登录会话
+	DeletedAccessTokens      = "accessTokens"      // 个人访问令牌
+	DeletedIdentities        = "identities"        // 单点登录关联的外部身份
+	DeletedTwoFactor         = "twoFactor"         // 两步验证设置
+	DeletedJobs              = "jobs"              // 后台任务
+	DeletedFavoritedByOthers = "favoritedByOthers" // 其他用户对该用户行程的收藏
+)
+
+var deletedCategories = []string{
+	DeletedUser, DeletedTrips, DeletedTripRevisions, DeletedFavoriteTrips, DeletedFavorites,
+	DeletedExpenses, DeletedDiaries, DeletedTrash, DeletedSearchIndex, DeletedSessions, DeletedAccessTokens,
+	DeletedIdentities, DeletedTwoFactor, DeletedJobs, DeletedFavoritedByOthers,
+}
+
+// 注销账户确认的错误
+var (
+	ErrIncorrectPassword = errors.New("incorrect password")
+	ErrPasswordRequired  = errors.New("password required")
+	// ErrReauthRequired 关联了外部身份的账户既没有提供密码或验证码，当前会话也不是刚刚登录的
+	ErrReauthRequired = errors.New("recent sign-in required")
+)
+
+// ReauthWindow 关联了外部身份的账户注销时，会话登录后多长时间内视为已重新认证
+var ReauthWindow = 5 * time.Minute
+
+// ConfirmAccountDeletion 确认注销请求来自账户本人。提供密码时校验密码；单点登录创建的账户没有可用的密码，
+// 关联了外部身份的账户还可以输入两步验证码，或在 ReauthWindow 内重新登录后用新会话 sessionID 注销。
+// 密码错误返回 ErrIncorrectPassword，验证码的错误同 VerifyTwoFactor；未关联外部身份且没有提供密码时返回
+// ErrPasswordRequired，其余情况返回 ErrReauthRequired
+func ConfirmAccountDeletion(ctx context.Context, stores *Stores, user *UserRecord, sessionID, password, code string) error {
+	if password != "" {
+		if !VerifyPassword(password, user.PasswordHash) {
+			return ErrIncorrectPassword
+		}
+		return nil
+	}
+	linked, err := stores.Identities.HasUserIdentity(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		return ErrPasswordRequired
+	}
+	if code != "" {
+		_, err := VerifyTwoFactor(ctx, stores.TwoFactor, user.Username, code)
+		return err
+	}
+	if sessionID == "" {
+		return ErrReauthRequired
+	}
+	sess, err := stores.Sessions.GetSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if sess == nil || sess.UserID != user.ID || time.Since(sess.CreatedAt) > ReauthWindow {
+		return ErrReauthRequired
+	}
+	return nil
+}
+
+// AccountDeletionReport 注销账户的结果：各类数据的删除数量，以及删除后复查时仍然存在的数据
+type AccountDeletionReport struct {
+	Username  string         `json:"username"`
+	UserID    int            `json:"userId"`
+	Removed   map[string]int `json:"removed"`
+	Remaining []string       `json:"remaining"` // 复查时仍存在的键或表记录
+	Verified  bool           `json:"verified"`  // 复查未发现残留数据
+	DeletedAt time.Time      `json:"deletedAt"`
+}
+
+func newAccountDeletionReport(user *UserRecord) *AccountDeletionReport {
+	r := &AccountDeletionReport{
+		Username:  user.Username,
+		UserID:    user.ID,
+		Removed:   make(map[string]int, len(deletedCategories)),
+		Remaining: []string{},
+	}
+	for _, category := range deletedCategories {
+		r.Removed[category] = 0
+	}
+	return r
+}
+
+// verified 记录复查结果
+func (r *AccountDeletionReport) verified(remaining []string) {
+	r.Remaining = append(r.Remaining, remaining...)
+	r.Verified = len(r.Remaining) == 0
+	r.DeletedAt = time.Now()
+}
+
+// userSearchScopes 用户的全部搜索索引范围
+func userSearchScopes(user *UserRecord) []SearchScope {
+	return []SearchScope{
+		tripSearchScope(user.Username),
+		diarySearchScope(int64(user.ID)),
+		expenseSearchScope(user.Username),
+	}
+}
+
+// globEscaper 转义 SCAN 匹配模式中的特殊字符
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// DeleteUser 删除用户记录及其全部数据。用户记录、行程、版本历史、收藏、花费、日记、回收站
+// 和登录会话在一个 WATCH 事务中删除；搜索索引、其他用户对其行程的收藏以及不在日记索引中的日记
+// 需要扫描键空间，在事务之后清理。最后逐个复查已知的键
+func (s *RedisStore) DeleteUser(ctx context.Context, username string) (*AccountDeletionReport, error) {
+	user, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	report := newAccountDeletionReport(user)
+	// 旧版收藏夹是保存 JSON 数组的字符串，先迁移到哈希再统一统计和删除
+	if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
+		return nil, err
+	}
+	diariesKey := fmt.Sprintf("user:%d:diaries", user.ID)
+	trashKey := userTrashKey(username)
+
+	var (
+		allTripIDs []string // 包括回收站中的行程
+		keys       []string // 事务中删除的键，用于复查
+	)
+	err = s.watchRetry(ctx, func(tx *redis.Tx) error {
+		tripIDs, err := tx.SMembers(ctx, userTripsKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		diaryIDs, err := tx.ZRange(ctx, diariesKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		trashFields, err := tx.HKeys(ctx, trashKey).Result()
+		if err != nil {
+			return err
+		}
+		sessionIDs, err := tx.SMembers(ctx, userSessionsKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		accessTokenIDs, err := tx.SMembers(ctx, userAccessTokensKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		identityKeys, err := tx.SMembers(ctx, userIdentitiesKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		jobIDs, err := tx.SMembers(ctx, userJobsKey(username)).Result()
+		if err != nil {
+			return err
+		}
+		resetHash, err := tx.Get(ctx, userPasswordResetKey(username)).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		allTripIDs = append([]string(nil), tripIDs...)
+		var trashMembers []interface{}
+		for _, field := range trashFields {
+			kind, id, _ := strings.Cut(field, ":")
+			if TrashKind(kind) == TrashTrip {
+				allTripIDs = append(allTripIDs, id)
+			}
+			trashMembers = append(trashMembers, trashMember(username, TrashKind(kind), id))
+		}
+		tripKeys := make([]string, 0, len(tripIDs))
+		for _, id := range tripIDs {
+			tripKeys = append(tripKeys, tripKey(id))
+		}
+		revisionKeys := make([]string, 0, len(allTripIDs))
+		for _, id := range allTripIDs {
+			revisionKeys = append(revisionKeys, tripRevisionsKey(id))
+		}
+		diaryKeys := make([]string, 0, len(diaryIDs))
+		for _, id := range diaryIDs {
+			diaryKeys = append(diaryKeys, fmt.Sprintf("diary:%d:%s", user.ID, id))
+		}
+		sessionKeys := make([]string, 0, len(sessionIDs))
+		for _, id := range sessionIDs {
+			sessionKeys = append(sessionKeys, sessionKey(id))
+		}
+		accessTokenKeys := make([]string, 0, len(accessTokenIDs))
+		for _, id := range accessTokenIDs {
+			accessTokenKeys = append(accessTokenKeys, accessTokenKey(id))
+		}
+		jobKeys := make([]string, 0, len(jobIDs))
+		jobMembers := make([]interface{}, 0, len(jobIDs))
+		for _, id := range jobIDs {
+			jobKeys = append(jobKeys, jobKey(id))
+			jobMembers = append(jobMembers, id)
+		}
+		indexKeys := []string{userTripsKey(username), diariesKey, userSessionsKey(username), userAccessTokensKey(username),
+			userIdentitiesKey(username), userJobsKey(username)}
+		for _, field := range tripSortFields {
+			indexKeys = append(indexKeys, userTripIndexKey(field, username))
+		}
+
+		// 删除前统计列表和哈希中的条目数
+		var (
+			revisions = make([]*redis.IntCmd, len(revisionKeys))
+			counts    = make(map[string][]*redis.IntCmd)
+		)
+		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range revisionKeys {
+				revisions[i] = pipe.LLen(ctx, key)
+			}
+			counts[DeletedFavoriteTrips] = []*redis.IntCmd{pipe.SCard(ctx, userFavoriteTripIDsKey(username))}
+			counts[DeletedFavorites] = []*redis.IntCmd{pipe.HLen(ctx, userFavoritePlacesKey(username))}
+			counts[DeletedExpenses] = []*redis.IntCmd{pipe.LLen(ctx, expenseListKey(username))}
+			counts[DeletedTrash] = []*redis.IntCmd{pipe.HLen(ctx, trashKey)}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		counts[DeletedTripRevisions] = revisions
+
+		dataKeys := []string{
+			userFavoriteTripIDsKey(username), userFavoritePlacesKey(username), legacyFavoritesKey(username),
+			expenseListKey(username), trashKey, userPasswordResetKey(username),
+			loginAttemptsKey(userLoginKey(username)),
+		}
+		if resetHash != "" {
+			dataKeys = append(dataKeys, passwordResetKey(resetHash))
+		}
+		dataKeys = append(dataKeys, revisionKeys...)
+		dataKeys = append(dataKeys, indexKeys...)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			counts[DeletedUser] = []*redis.IntCmd{pipe.Del(ctx, userKey(username))}
+			if len(tripKeys) > 0 {
+				counts[DeletedTrips] = []*redis.IntCmd{pipe.Del(ctx, tripKeys...)}
+			}
+			if len(diaryKeys) > 0 {
+				counts[DeletedDiaries] = []*redis.IntCmd{pipe.Del(ctx, diaryKeys...)}
+			}
+			if len(sessionKeys) > 0 {
+				counts[DeletedSessions] = []*redis.IntCmd{pipe.Del(ctx, sessionKeys...)}
+			}
+			if len(accessTokenKeys) > 0 {
+				counts[DeletedAccessTokens] = []*redis.IntCmd{pipe.Del(ctx, accessTokenKeys...)}
+			}
+			if len(identityKeys) > 0 {
+				counts[DeletedIdentities] = []*redis.IntCmd{pipe.Del(ctx, identityKeys...)}
+			}
+			counts[DeletedTwoFactor] = []*redis.IntCmd{pipe.Del(ctx, twoFactorKey(username))}
+			if len(jobKeys) > 0 {
+				counts[DeletedJobs] = []*redis.IntCmd{pipe.Del(ctx, jobKeys...)}
+				pipe.SRem(ctx, activeJobsKey, jobMembers...)
+			}
+			pipe.Del(ctx, dataKeys...)
+			if len(trashMembers) > 0 {
+				pipe.ZRem(ctx, trashByTimeKey, trashMembers...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for category, cmds := range counts {
+			for _, cmd := range cmds {
+				report.Removed[category] += int(cmd.Val())
+			}
+		}
+		keys = append([]string{userKey(username)}, tripKeys...)
+		keys = append(keys, diaryKeys...)
+		keys = append(keys, sessionKeys...)
+		keys = append(keys, accessTokenKeys...)
+		keys = append(keys, identityKeys...)
+		keys = append(keys, twoFactorKey(username))
+		keys = append(keys, jobKeys...)
+		keys = append(keys, dataKeys...)
+		return nil
+	}, userKey(username), userTripsKey(username), diariesKey, trashKey, userSessionsKey(username),
+		userAccessTokensKey(username), userIdentitiesKey(username), userPasswordResetKey(username), twoFactorKey(username), userJobsKey(username))
+	if err != nil {
+		return nil, err
+	}
+
+	patterns, err := s.deleteUserScannedData(ctx, user, allTripIDs, report)
+	if err != nil {
+		return report, err
+	}
+
+	// 复查：事务中删除的键和扫描清理的模式均不应再有匹配
+	exists := make([]*redis.IntCmd, len(keys))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			exists[i] = pipe.Exists(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	var remaining []string
+	for i, cmd := range exists {
+		if cmd.Val() > 0 {
+			remaining = append(remaining, keys[i])
+		}
+	}
+	for _, pattern := range patterns {
+		err := s.scanKeys(ctx, pattern, func(key string) error {
+			remaining = append(remaining, key)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	report.verified(remaining)
+	return report, nil
+}
+
+// deleteUserScannedData 清理需要扫描键空间才能找到的用户数据，返回复查时使用的匹配模式
+func (s *RedisStore) deleteUserScannedData(ctx context.Context, user *UserRecord, tripIDs []string, report *AccountDeletionReport) ([]string, error) {
+	var patterns []string
+	for _, scope := range userSearchScopes(user) {
+		docs, err := s.rdb.SCard(ctx, searchKey(scope, "docs")).Result()
+		if err != nil {
+			return nil, err
+		}
+		report.Removed[DeletedSearchIndex] += int(docs)
+		patterns = append(patterns, globEscaper.Replace(searchKey(scope, ""))+"*")
+	}
+	// 日记键中的用户ID是数字，不需要转义
+	diaryPattern := fmt.Sprintf("diary:%d:*", user.ID)
+	patterns = append(patterns, diaryPattern)
+
+	for _, pattern := range patterns {
+		err := s.scanKeys(ctx, pattern, func(key string) error {
+			n, err := s.rdb.Del(ctx, key).Result()
+			if pattern == diaryPattern {
+				report.Removed[DeletedDiaries] += int(n)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(tripIDs) > 0 {
+		members := make([]interface{}, len(tripIDs))
+		for i, id := range tripIDs {
+			members[i] = id
+		}
+		err := s.scanKeys(ctx, userFavoriteTripIDsKey("*"), func(key string) error {
+			n, err := s.rdb.SRem(ctx, key, members...).Result()
+			report.Removed[DeletedFavoritedByOthers] += int(n)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 用户角色
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var ErrInvalidRole = errors.New("invalid role")
+
+// ValidRole 判断角色是否有效
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// SetUserRole 修改用户角色并撤销其全部会话，使携带旧角色的 access token 立即失效
+func SetUserRole(ctx context.Context, stores *Stores, username, role string) (*UserRecord, error) {
+	if !ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+	u, err := stores.Users.UpdateUser(ctx, username, func(u *UserRecord) error {
+		u.Role = role
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stores.Sessions.DeleteUserSessions(ctx, username); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SetUserDisabled 停用或启用账户。停用时撤销全部会话，返回撤销的会话数量
+func SetUserDisabled(ctx context.Context, stores *Stores, username string, disabled bool) (*UserRecord, int, error) {
+	u, err := stores.Users.UpdateUser(ctx, username, func(u *UserRecord) error {
+		u.Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !disabled {
+		return u, 0, nil
+	}
+	revoked, err := stores.Sessions.DeleteUserSessions(ctx, username)
+	if err != nil {
+		return nil, 0, err
+	}
+	return u, revoked, nil
+}
+
+// UserUsage 用户的数据量
+type UserUsage struct {
+	Trips         int `json:"trips"`
+	FavoriteTrips int `json:"favoriteTrips"`
+	Favorites     int `json:"favorites"`
+	Expenses      int `json:"expenses"`
+	Diaries       int `json:"diaries"`
+	Trash         int `json:"trash"`
+}
+
+func (u *UserUsage) add(o *UserUsage) {
+	u.Trips += o.Trips
+	u.FavoriteTrips += o.FavoriteTrips
+	u.Favorites += o.Favorites
+	u.Expenses += o.Expenses
+	u.Diaries += o.Diaries
+	u.Trash += o.Trash
+}
+
+// GetUserUsage 统计用户的数据量
+func GetUserUsage(ctx context.Context, stores *Stores, user *UserRecord) (*UserUsage, error) {
+	var usage UserUsage
+	trips, err := stores.Trips.GetUserTrips(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Trips = len(trips)
+	favTrips, err := stores.Favorites.GetUserFavoriteTrips(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.FavoriteTrips = len(favTrips)
+	favorites, err := stores.Favorites.GetUserFavorites(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Favorites = len(favorites)
+	expenses, err := stores.Expenses.GetExpenses(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Expenses = len(expenses)
+	diaries, err := stores.Diaries.GetUserDiaries(ctx, int64(user.ID))
+	if err != nil {
+		return nil, err
+	}
+	usage.Diaries = len(diaries)
+	trash, err := stores.Trash.ListTrash(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Trash = len(trash)
+	return &usage, nil
+}
+
+// AdminUser 管理接口中展示的用户信息，不包含密码摘要
+type AdminUser struct {
+	ID       int        `json:"id"`
+	Username string     `json:"username"`
+	Role     string     `json:"role"`
+	Disabled bool       `json:"disabled"`
+	Usage    *UserUsage `json:"usage,omitempty"`
+}
+
+// NewAdminUser 从用户记录构建展示信息
+func NewAdminUser(u *UserRecord) *AdminUser {
+	return &AdminUser{ID: u.ID, Username: u.Username, Role: u.Role, Disabled: u.Disabled}
+}
+
+// SystemUsage 系统整体的用户数和数据量
+type SystemUsage struct {
+	Users        int       `json:"users"`
+	Admins       int       `json:"admins"`
+	Disabled     int       `json:"disabled"`
+	Totals       UserUsage `json:"totals"`
+	LockedLogins int       `json:"lockedLogins"` // 仍在锁定期的用户名和 IP 数量
+	GeneratedAt  time.Time `json:"generatedAt"`
+}
+
+// GetSystemUsage 逐个用户统计数据量并汇总，用户较多时耗时较长
+func GetSystemUsage(ctx context.Context, stores *Stores) (*SystemUsage, error) {
+	users, err := stores.Users.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := &SystemUsage{Users: len(users)}
+	for _, u := range users {
+		if u.Role == RoleAdmin {
+			usage.Admins++
+		}
+		if u.Disabled {
+			usage.Disabled++
+		}
+		uu, err := GetUserUsage(ctx, stores, u)
+		if err != nil {
+			return nil, err
+		}
+		usage.Totals.add(uu)
+	}
+	locked, err := ListLoginLockouts(ctx, stores.LoginAttempts, true)
+	if err != nil {
+		return nil, err
+	}
+	usage.LockedLogins = len(locked)
+	usage.GeneratedAt = time.Now()
+	return usage, nil
+}
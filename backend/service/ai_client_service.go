@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -16,9 +17,110 @@ import (
 
 // CallModel sends a prompt to the configured model and returns the raw content string
 func CallModel(ctx context.Context, prompt string) (string, error) {
+	// 增加超时时间到 90 秒，因为生成行程需要较长时间
+	reqCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+
+	resp, err := postChatCompletion(reqCtx, prompt, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+	content, err := parseCompletion(body)
+	if err != nil {
+		return "", err
+	}
+	return extractJSON(content), nil
+}
+
+// StreamModel sends a prompt in streaming mode, calling onDelta with each content fragment
+// as it arrives, and returns the full content once the model finishes. Providers that ignore
+// the stream flag and reply with a single completion are handled by one onDelta call.
+// An error returned by onDelta aborts the request.
+func StreamModel(ctx context.Context, prompt string, onDelta func(string) error) (string, error) {
+	// 与 CallModel 相同的总时长限制，流式输出只是让调用方更早拿到部分结果
+	reqCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+
+	resp, err := postChatCompletion(reqCtx, prompt, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("read response: %w", err)
+		}
+		content, err := parseCompletion(body)
+		if err != nil {
+			return "", err
+		}
+		if err := onDelta(content); err != nil {
+			return "", err
+		}
+		return extractJSON(content), nil
+	}
+
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("unmarshal stream chunk: %w", err)
+		}
+		if chunk.Error.Message != "" {
+			return "", fmt.Errorf("model error: %s", chunk.Error.Message)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read stream: %w", err)
+	}
+	if content.Len() == 0 {
+		return "", errors.New("no content returned")
+	}
+	return extractJSON(content.String()), nil
+}
+
+// postChatCompletion sends the chat completion request and returns the response once the
+// status is 200; the caller must close the body
+func postChatCompletion(ctx context.Context, prompt string, stream bool) (*http.Response, error) {
 	cfg := config.Global.Model
 	if cfg.ApiKey == "" || cfg.BaseURL == "" || cfg.Model == "" {
-		return "", errors.New("model not configured")
+		return nil, errors.New("model not configured")
 	}
 
 	payload := map[string]interface{}{
@@ -27,45 +129,51 @@ func CallModel(ctx context.Context, prompt string) (string, error) {
 			{"role": "user", "content": prompt},
 		},
 	}
+	if stream {
+		payload["stream"] = true
+	}
 
 	b, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("marshal payload: %w", err)
+		return nil, fmt.Errorf("marshal payload: %w", err)
 	}
 
 	reqURL := strings.TrimRight(cfg.BaseURL, "/") + "/chat/completions"
 
-	// 增加超时时间到 90 秒，因为生成行程需要较长时间
-	reqCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
-	defer cancel()
-
-	httpReq, err := http.NewRequestWithContext(reqCtx, "POST", reqURL, bytes.NewReader(b))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewReader(b))
 	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
+		return nil, fmt.Errorf("create request: %w", err)
 	}
 	httpReq.Header.Set("Authorization", "Bearer "+cfg.ApiKey)
 	httpReq.Header.Set("Content-Type", "application/json")
+	if stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
 
-	// HTTP Client 超时设置略大于 context 超时
+	// 超时由调用方的 context 控制；非流式请求的 HTTP Client 超时略大于 context 超时，
+	// 流式请求的响应体会持续读取，不能设置整体超时
 	client := &http.Client{Timeout: 95 * time.Second}
+	if stream {
+		client = &http.Client{}
+	}
 
 	startTime := time.Now()
 
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		fmt.Printf("请求失败 (耗时: %.2f秒): %v\n", time.Since(startTime).Seconds(), err)
-		return "", fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("read response: %w", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("model API error %d: %s", resp.StatusCode, string(body))
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("model API error %d: %s", resp.StatusCode, string(body))
 	}
+	return resp, nil
+}
 
+// parseCompletion returns the message content of a non-streaming chat completion
+func parseCompletion(body []byte) (string, error) {
 	var result struct {
 		Choices []struct {
 			Message struct {
@@ -85,9 +193,7 @@ func CallModel(ctx context.Context, prompt string) (string, error) {
 	if len(result.Choices) == 0 {
 		return "", errors.New("no choices returned")
 	}
-
-	content := extractJSON(result.Choices[0].Message.Content)
-	return content, nil
+	return result.Choices[0].Message.Content, nil
 }
 
 // extractJSON strips code fences and returns the JSON-like portion
@@ -10,25 +10,26 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWT 密钥，生产环境应该从配置文件读取
-var jwtSecret = []byte("your-secret-key-change-in-production")
-
 // Claims JWT claims 结构
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"` // 签发 token 的登录会话
 	jwt.RegisteredClaims
 }
 
-// GenerateToken 生成 JWT token
-func GenerateToken(userID int, username string, duration time.Duration) (string, error) {
+// GenerateToken 为登录会话生成 JWT access token
+func GenerateToken(userID int, username, role, sessionID string, duration time.Duration) (string, error) {
 	if duration <= 0 {
-		duration = 24 * time.Hour
+		duration = AccessTokenTTL
 	}
 
 	claims := Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -36,15 +37,15 @@ func GenerateToken(userID int, username string, duration time.Duration) (string,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	key := signingKeys.signing
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
 }
 
-// ParseToken 解析 JWT token
+// ParseToken 解析 JWT token，按 kid 选择验证密钥
 func ParseToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, signingKeys.verificationKey)
 
 	if err != nil {
 		return nil, err
@@ -57,15 +58,11 @@ func ParseToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-// SetSecret 设置 JWT 密钥
-func SetSecret(secret string) {
-	if secret != "" {
-		jwtSecret = []byte(secret)
-	}
-}
-
-// AuthMiddleware JWT 认证中间件
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware 认证中间件。JWT access token 需要所属的登录会话仍然有效，
+// 登出、撤销会话或注销账户后，未过期的 access token 也立即失效；认证通过时更新会话的最近使用时间。
+// resource 为空时只接受 JWT；否则也接受个人访问令牌，GET 请求要求令牌具有 <resource>:read 权限，
+// 其他请求要求 <resource>:write 权限
+func AuthMiddleware(stores *Stores, resource string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
 		if token == "" {
@@ -75,15 +72,89 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		token = strings.TrimPrefix(token, "Bearer ")
+		if IsAccessToken(token) {
+			authenticateAccessToken(c, stores, token, resource)
+			return
+		}
 		claims, err := ParseToken(token)
-		if err != nil {
+		if err != nil || claims.SessionID == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "token 无效或已过期"})
 			c.Abort()
 			return
 		}
 
+		sess, err := stores.Sessions.GetSession(c.Request.Context(), claims.SessionID)
+		if err != nil {
+			LogError("Failed to get session of user %s during authentication: %v", claims.Username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "服务器错误"})
+			c.Abort()
+			return
+		}
+		if sess == nil || sess.UserID != claims.UserID || sess.Username != claims.Username {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "登录已失效，请重新登录"})
+			c.Abort()
+			return
+		}
+
+		TouchSessionIfStale(c.Request.Context(), stores.Sessions, sess, c.ClientIP())
+
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
+		c.Set("session_id", claims.SessionID)
+		c.Set("role", claims.Role)
 		c.Next()
 	}
 }
+
+// authenticateAccessToken 校验个人访问令牌及其对当前请求的权限
+func authenticateAccessToken(c *gin.Context, stores *Stores, token, resource string) {
+	if resource == "" {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "个人访问令牌不能访问此接口"})
+		c.Abort()
+		return
+	}
+	t, user, err := AuthenticateAccessToken(c.Request.Context(), stores, token)
+	if errors.Is(err, ErrInvalidAccessToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "访问令牌无效或已过期"})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		LogError("Failed to authenticate access token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "服务器错误"})
+		c.Abort()
+		return
+	}
+
+	scope := resource + ":write"
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		scope = resource + ":read"
+	}
+	if !t.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "访问令牌缺少权限 " + scope})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", user.ID)
+	c.Set("username", user.Username)
+	c.Set("role", user.Role)
+	c.Set("access_token_id", t.ID)
+	c.Next()
+}
+
+// RequireRole 角色检查中间件，必须放在 AuthMiddleware 之后；角色不在 roles 中时返回 403。
+// 修改角色会撤销用户的全部会话，因此 token 中的角色总是最新的
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, r := range roles {
+			if role == r {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "没有权限"})
+		c.Abort()
+	}
+}
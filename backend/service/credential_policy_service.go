@@ -0,0 +1,273 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"example.com/travel_planner/backend/config"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// FieldError 单个字段的校验错误，code 供前端判断，message 直接展示给用户
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// 校验错误代码
+const (
+	CodeRequired         = "required"
+	CodeTooShort         = "too_short"
+	CodeTooLong          = "too_long"
+	CodeInvalidFormat    = "invalid_format"
+	CodeReserved         = "reserved"
+	CodeTooWeak          = "too_weak"
+	CodeBreached         = "breached"
+	CodeContainsUsername = "contains_username"
+	CodeInvalidRange     = "invalid_range"
+)
+
+// ValidationError 一个或多个字段未通过校验
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		parts[i] = fe.Field + ": " + fe.Code
+	}
+	return "validation failed: " + strings.Join(parts, ", ")
+}
+
+// passwordMaxBytes bcrypt 只处理前 72 字节，更长的密码会被拒绝
+const passwordMaxBytes = 72
+
+// CredentialPolicy 用户名和密码规则
+type CredentialPolicy struct {
+	UsernameMinLength  int
+	UsernameMaxLength  int
+	UsernamePattern    *regexp.Regexp
+	Reserved           map[string]bool // 规范形式，见 NormalizeUsername
+	PasswordMinLength  int
+	PasswordMinClasses int
+	Breached           map[string]bool // 大写 SHA-1
+}
+
+// defaultReservedUsernames 容易被误认为系统账户或与路由冲突的用户名
+var defaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "sysadmin", "support", "help",
+	"api", "auth", "login", "logout", "register", "me", "null", "undefined",
+	"anonymous", "guest", "travel_planner",
+}
+
+// defaultBreachedPasswords 内置的常见密码，配置 breachedPasswordsFile 后与文件内容合并
+var defaultBreachedPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1", "password123",
+	"qwerty", "qwerty123", "qwertyuiop", "abc123", "abcd1234", "a1234567", "a123456789",
+	"11111111", "00000000", "88888888", "66666666", "123123123", "12341234", "1q2w3e4r",
+	"1qaz2wsx", "zaq12wsx", "iloveyou", "admin123", "admin@123", "welcome1", "letmein1",
+	"woaini1314", "5201314a", "aa123456", "qq123456", "passw0rd", "p@ssw0rd", "football1",
+	"monkey123", "dragon123", "sunshine1", "princess1", "baseball1", "trustno1",
+}
+
+// Credentials 当前生效的规则，由 ConfigureCredentialPolicy 按配置设置
+var Credentials = mustCredentialPolicy(config.PolicyConfig{})
+
+func mustCredentialPolicy(cfg config.PolicyConfig) *CredentialPolicy {
+	p, err := NewCredentialPolicy(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// NewCredentialPolicy 按配置创建规则，为 0 或空的项使用默认值
+func NewCredentialPolicy(cfg config.PolicyConfig) (*CredentialPolicy, error) {
+	p := &CredentialPolicy{
+		UsernameMinLength:  3,
+		UsernameMaxLength:  32,
+		PasswordMinLength:  8,
+		PasswordMinClasses: 2,
+		Reserved:           make(map[string]bool),
+		Breached:           make(map[string]bool),
+	}
+	if cfg.UsernameMinLength > 0 {
+		p.UsernameMinLength = cfg.UsernameMinLength
+	}
+	if cfg.UsernameMaxLength > 0 {
+		p.UsernameMaxLength = cfg.UsernameMaxLength
+	}
+	if p.UsernameMinLength > p.UsernameMaxLength {
+		return nil, fmt.Errorf("usernameMinLength %d exceeds usernameMaxLength %d", p.UsernameMinLength, p.UsernameMaxLength)
+	}
+	pattern := `^[\p{L}\p{N}][\p{L}\p{N}_.-]*$`
+	if cfg.UsernamePattern != "" {
+		pattern = cfg.UsernamePattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("usernamePattern: %w", err)
+	}
+	p.UsernamePattern = re
+	for _, name := range append(defaultReservedUsernames, cfg.ReservedUsernames...) {
+		p.Reserved[NormalizeUsername(strings.TrimSpace(name))] = true
+	}
+
+	if cfg.PasswordMinLength > 0 {
+		p.PasswordMinLength = cfg.PasswordMinLength
+	}
+	if cfg.PasswordMinClasses > 0 {
+		p.PasswordMinClasses = min(cfg.PasswordMinClasses, 4)
+	}
+	for _, pw := range defaultBreachedPasswords {
+		p.Breached[sha1Hex(pw)] = true
+	}
+	if cfg.BreachedPasswordsFile != "" {
+		if err := p.loadBreached(cfg.BreachedPasswordsFile); err != nil {
+			return nil, fmt.Errorf("breachedPasswordsFile: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// ConfigureCredentialPolicy 按配置设置当前生效的规则
+func ConfigureCredentialPolicy(cfg config.PolicyConfig) error {
+	p, err := NewCredentialPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	Credentials = p
+	return nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreached 读取泄露密码列表。40 位十六进制的行视为 SHA-1 摘要（兼容 Have I Been Pwned 的
+// HASH:次数 格式），其余行视为明文密码，比较时不区分大小写；空行和 # 开头的行忽略
+func (p *CredentialPolicy) loadBreached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); len(hash) == 40 {
+			if _, err := hex.DecodeString(hash); err == nil {
+				p.Breached[strings.ToUpper(hash)] = true
+				continue
+			}
+		}
+		p.Breached[sha1Hex(strings.ToLower(line))] = true
+	}
+	return sc.Err()
+}
+
+// NormalizeUsername 返回用户名的规范形式：NFKC 规范化（全角字母和数字转为半角）后折叠大小写。
+// 注册时保存规范形式，"Alice"、"alice" 和 "ａｌｉｃｅ" 是同一个用户名
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(username)))
+}
+
+// ValidateUsername 校验用户名，返回全部未通过的规则。username 应为 NormalizeUsername 的结果，
+// 保留名总是按规范形式比较
+func (p *CredentialPolicy) ValidateUsername(username string) []FieldError {
+	const field = "username"
+	n := utf8.RuneCountInString(username)
+	switch {
+	case n == 0:
+		return []FieldError{{field, CodeRequired, "请输入用户名"}}
+	case n < p.UsernameMinLength:
+		return []FieldError{{field, CodeTooShort, fmt.Sprintf("用户名至少 %d 个字符", p.UsernameMinLength)}}
+	case n > p.UsernameMaxLength:
+		return []FieldError{{field, CodeTooLong, fmt.Sprintf("用户名最多 %d 个字符", p.UsernameMaxLength)}}
+	}
+	if !p.UsernamePattern.MatchString(username) {
+		return []FieldError{{field, CodeInvalidFormat, "用户名只能包含字母、数字、下划线、点和连字符，且以字母或数字开头"}}
+	}
+	if p.Reserved[NormalizeUsername(username)] {
+		return []FieldError{{field, CodeReserved, "该用户名为系统保留，请换一个"}}
+	}
+	return nil
+}
+
+// ValidatePassword 校验密码，username 非空时还要求密码不包含用户名
+func (p *CredentialPolicy) ValidatePassword(password, username string) []FieldError {
+	const field = "password"
+	n := utf8.RuneCountInString(password)
+	switch {
+	case n == 0:
+		return []FieldError{{field, CodeRequired, "请输入密码"}}
+	case n < p.PasswordMinLength:
+		return []FieldError{{field, CodeTooShort, fmt.Sprintf("密码至少 %d 个字符", p.PasswordMinLength)}}
+	case len(password) > passwordMaxBytes:
+		return []FieldError{{field, CodeTooLong, fmt.Sprintf("密码最多 %d 字节", passwordMaxBytes)}}
+	}
+	var errs []FieldError
+	if classes := passwordClasses(password); classes < p.PasswordMinClasses {
+		errs = append(errs, FieldError{field, CodeTooWeak,
+			fmt.Sprintf("密码需要包含小写字母、大写字母、数字、符号中的至少 %d 类", p.PasswordMinClasses)})
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		errs = append(errs, FieldError{field, CodeContainsUsername, "密码不能包含用户名"})
+	}
+	if p.Breached[sha1Hex(password)] || p.Breached[sha1Hex(strings.ToLower(password))] {
+		errs = append(errs, FieldError{field, CodeBreached, "该密码过于常见或已在泄露数据中出现，请换一个"})
+	}
+	return errs
+}
+
+// ValidateRegistration 校验注册的用户名和密码，未通过时返回 *ValidationError
+func (p *CredentialPolicy) ValidateRegistration(username, password string) error {
+	errs := p.ValidateUsername(username)
+	if len(errs) == 0 {
+		errs = append(errs, p.ValidatePassword(password, username)...)
+	} else {
+		errs = append(errs, p.ValidatePassword(password, "")...)
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// passwordClasses 统计密码包含的字符类别数
+func passwordClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, b := range []bool{lower, upper, digit, other} {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/travel_planner/backend/config"
+)
+
+// fieldCodes 取出校验错误的代码
+func fieldCodes(errs []FieldError) []string {
+	codes := make([]string, len(errs))
+	for i, e := range errs {
+		codes[i] = e.Code
+	}
+	return codes
+}
+
+func sameCodes(got []FieldError, want []string) bool {
+	codes := fieldCodes(got)
+	if len(codes) != len(want) {
+		return false
+	}
+	for i := range codes {
+		if codes[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"ALICE", "alice"},
+		{"ａｌｉｃｅ", "alice"}, // 全角
+		{"ＡＤＭＩＮ", "admin"},
+		{"bob_１２", "bob_12"},
+		{"Straße", "strasse"},
+		{"张三", "张三"},
+		{"ﬁona", "fiona"}, // 合字
+	}
+	for _, tt := range tests {
+		if got := NormalizeUsername(tt.in); got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		if got := NormalizeUsername(tt.want); got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q; want it unchanged", tt.want, got)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	p, err := NewCredentialPolicy(config.PolicyConfig{ReservedUsernames: []string{" Staff "}})
+	if err != nil {
+		t.Fatalf("NewCredentialPolicy: %v", err)
+	}
+	tests := []struct {
+		username string
+		want     []string
+	}{
+		{"alice", nil},
+		{"a.b-c_d", nil},
+		{"张三丰", nil},
+		{"abc", nil},
+		{"a23456789012345678901234567890ab", nil}, // 32 个字符
+		{"", []string{CodeRequired}},
+		{"ab", []string{CodeTooShort}},
+		{"a234567890123456789012345678901234", []string{CodeTooLong}},
+		{"_alice", []string{CodeInvalidFormat}},
+		{".alice", []string{CodeInvalidFormat}},
+		{"ali ce", []string{CodeInvalidFormat}},
+		{"alice@example", []string{CodeInvalidFormat}},
+		{"admin", []string{CodeReserved}},
+		{"Admin", []string{CodeReserved}},
+		{"ａｄｍｉｎ", []string{CodeReserved}},
+		{"root", []string{CodeReserved}},
+		{"api", []string{CodeReserved}},
+		{"staff", []string{CodeReserved}},
+		{"STAFF", []string{CodeReserved}},
+		{"admin1", nil},
+	}
+	for _, tt := range tests {
+		if got := p.ValidateUsername(tt.username); !sameCodes(got, tt.want) {
+			t.Errorf("ValidateUsername(%q) = %v; want %v", tt.username, fieldCodes(got), tt.want)
+		}
+	}
+
+	custom, err := NewCredentialPolicy(config.PolicyConfig{UsernameMinLength: 5, UsernameMaxLength: 6, UsernamePattern: `^[a-z]+$`})
+	if err != nil {
+		t.Fatalf("NewCredentialPolicy: %v", err)
+	}
+	for username, want := range map[string][]string{
+		"abcd":    {CodeTooShort},
+		"abcde":   nil,
+		"abcdefg": {CodeTooLong},
+		"abc12":   {CodeInvalidFormat},
+	} {
+		if got := custom.ValidateUsername(username); !sameCodes(got, want) {
+			t.Errorf("custom ValidateUsername(%q) = %v; want %v", username, fieldCodes(got), want)
+		}
+	}
+	if _, err := NewCredentialPolicy(config.PolicyConfig{UsernameMinLength: 10, UsernameMaxLength: 5}); err == nil {
+		t.Error("NewCredentialPolicy accepted min length above max length")
+	}
+	if _, err := NewCredentialPolicy(config.PolicyConfig{UsernamePattern: "("}); err == nil {
+		t.Error("NewCredentialPolicy accepted an invalid pattern")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "breached.txt")
+	// 明文、SHA-1 摘要和 Have I Been Pwned 的 HASH:次数 格式
+	content := "# comment\n\nCorrectHorse9\n" + sha1Hex("Tr0ub4dor&3") + "\n" + sha1Hex("Xyzzy-2024") + ":1234\n"
+	if err := os.WriteFile(list, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewCredentialPolicy(config.PolicyConfig{BreachedPasswordsFile: list})
+	if err != nil {
+		t.Fatalf("NewCredentialPolicy: %v", err)
+	}
+
+	tests := []struct {
+		password, username string
+		want               []string
+	}{
+		{"Str0ng-enough", "alice", nil},
+		{"", "alice", []string{CodeRequired}},
+		{"Ab1!", "alice", []string{CodeTooShort}},
+		{string(make([]byte, 73)), "alice", []string{CodeTooLong}},
+		// 字符类别：小写、大写、数字、符号至少两类
+		{"onlylowercase", "alice", []string{CodeTooWeak}},
+		{"ONLYUPPERCASE", "alice", []string{CodeTooWeak}},
+		{"9876543210", "alice", []string{CodeTooWeak}},
+		{"lower-and-symbols", "alice", nil},
+		{"lowerUPPER", "alice", nil},
+		{"中文密码中文密码", "alice", []string{CodeTooWeak}},
+		// 不能包含用户名，不区分大小写
+		{"my-alice-pass", "alice", []string{CodeContainsUsername}},
+		{"My-ALICE-pass", "alice", []string{CodeContainsUsername}},
+		{"my-alice-pass", "", nil},
+		// 内置列表和配置的列表
+		{"password123", "alice", []string{CodeBreached}},
+		{"P@ssw0rd", "alice", []string{CodeBreached}},
+		{"correcthorse9", "alice", []string{CodeBreached}},
+		{"Tr0ub4dor&3", "alice", []string{CodeBreached}},
+		{"Xyzzy-2024", "alice", []string{CodeBreached}},
+		// 多项同时不满足时全部返回
+		{"aliceeeee", "alice", []string{CodeTooWeak, CodeContainsUsername}},
+	}
+	for _, tt := range tests {
+		if got := p.ValidatePassword(tt.password, tt.username); !sameCodes(got, tt.want) {
+			t.Errorf("ValidatePassword(%q, %q) = %v; want %v", tt.password, tt.username, fieldCodes(got), tt.want)
+		}
+	}
+
+	strict, err := NewCredentialPolicy(config.PolicyConfig{PasswordMinLength: 12, PasswordMinClasses: 4})
+	if err != nil {
+		t.Fatalf("NewCredentialPolicy: %v", err)
+	}
+	for password, want := range map[string][]string{
+		"Short1!":         {CodeTooShort},
+		"LongButNoDigit!": {CodeTooWeak},
+		"LongEnough-123":  nil,
+	} {
+		if got := strict.ValidatePassword(password, ""); !sameCodes(got, want) {
+			t.Errorf("strict ValidatePassword(%q) = %v; want %v", password, fieldCodes(got), want)
+		}
+	}
+	if _, err := NewCredentialPolicy(config.PolicyConfig{BreachedPasswordsFile: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("NewCredentialPolicy accepted a missing breached passwords file")
+	}
+}
+
+func TestValidateRegistration(t *testing.T) {
+	p := mustCredentialPolicy(config.PolicyConfig{})
+	if err := p.ValidateRegistration("alice", "Str0ng-enough"); err != nil {
+		t.Fatalf("ValidateRegistration = %v; want nil", err)
+	}
+	err := p.ValidateRegistration("admin", "admin-password")
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("ValidateRegistration = %v; want *ValidationError", err)
+	}
+	// 用户名无效时不检查密码是否包含用户名
+	if !sameCodes(verr.Errors, []string{CodeReserved}) || verr.Errors[0].Field != "username" {
+		t.Fatalf("errors = %+v; want only the reserved username", verr.Errors)
+	}
+	err = p.ValidateRegistration("bob", "bob")
+	verr, _ = err.(*ValidationError)
+	if verr == nil || !sameCodes(verr.Errors, []string{CodeTooShort}) || verr.Errors[0].Field != "password" {
+		t.Fatalf("ValidateRegistration(bob, bob) = %v; want a short password", err)
+	}
+}
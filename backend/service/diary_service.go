@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -19,44 +20,54 @@ type DiaryEntry struct {
 	Images   []string `json:"images"`
 	Location string   `json:"location,omitempty"`
 	Mood     string   `json:"mood,omitempty"`
+
+	SchemaVersion int `json:"schemaVersion"`
 }
 
+// createDiaryScript 以 SET NX 写入日记并加入用户索引，两步在脚本中原子执行；
+// 同一毫秒内ID冲突时返回 0 由调用方顺延重试
+var createDiaryScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX') then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[2])
+return 1
+`)
+
 // CreateDiary 创建日记
-func CreateDiary(diary *DiaryEntry) (int64, error) {
-	ctx := context.Background()
+func (s *RedisStore) CreateDiary(ctx context.Context, diary *DiaryEntry) (int64, error) {
 	id := time.Now().UnixNano() / 1e6 // 使用毫秒时间戳作为ID
-	diary.ID = id
-
-	key := fmt.Sprintf("diary:%d:%d", diary.UserID, id)
-	data, err := json.Marshal(diary)
-	if err != nil {
-		return 0, err
-	}
+	diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
+	userDiariesKey := fmt.Sprintf("user:%d:diaries", diary.UserID)
 
-	// 保存日记
-	if err := rdb.Set(ctx, key, data, 0).Err(); err != nil {
-		return 0, err
-	}
+	for attempt := 0; attempt < 10; attempt, id = attempt+1, id+1 {
+		diary.ID = id
+		key := fmt.Sprintf("diary:%d:%d", diary.UserID, id)
+		data, err := json.Marshal(diary)
+		if err != nil {
+			return 0, err
+		}
 
-	// 将日记ID添加到用户的日记列表
-	userDiariesKey := fmt.Sprintf("user:%d:diaries", diary.UserID)
-	if err := rdb.ZAdd(ctx, userDiariesKey, redis.Z{
-		Score:  float64(id),
-		Member: strconv.FormatInt(id, 10),
-	}).Err(); err != nil {
-		return 0, err
+		// 保存日记并将日记ID添加到用户的日记列表
+		created, err := createDiaryScript.Run(ctx, s.rdb, []string{key, userDiariesKey},
+			data, strconv.FormatInt(id, 10)).Int()
+		if err != nil {
+			return 0, err
+		}
+		if created == 1 {
+			s.reindexSearchDoc(ctx, diarySearchScope(diary.UserID), diarySearchRecord(diary).document())
+			return id, nil
+		}
 	}
-
-	return id, nil
+	return 0, errors.New("failed to allocate diary id")
 }
 
 // GetUserDiaries 获取用户的所有日记
-func GetUserDiaries(userID int64) ([]DiaryEntry, error) {
-	ctx := context.Background()
+func (s *RedisStore) GetUserDiaries(ctx context.Context, userID int64) ([]DiaryEntry, error) {
 	userDiariesKey := fmt.Sprintf("user:%d:diaries", userID)
 
 	// 获取所有日记ID，按时间倒序
-	ids, err := rdb.ZRevRange(ctx, userDiariesKey, 0, -1).Result()
+	ids, err := s.rdb.ZRevRange(ctx, userDiariesKey, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -64,15 +75,20 @@ func GetUserDiaries(userID int64) ([]DiaryEntry, error) {
 	var diaries []DiaryEntry
 	for _, idStr := range ids {
 		key := fmt.Sprintf("diary:%d:%s", userID, idStr)
-		data, err := rdb.Get(ctx, key).Result()
+		data, err := s.rdb.Get(ctx, key).Result()
 		if err != nil {
 			continue
 		}
 
 		var diary DiaryEntry
-		if err := json.Unmarshal([]byte(data), &diary); err != nil {
+		upgraded, ok, err := decodeRecord(KindDiary, []byte(data), &diary)
+		if err != nil {
+			LogWarn("Skipping unreadable diary %s: %v", key, err)
 			continue
 		}
+		if ok {
+			s.writeBack(ctx, key, data, upgraded)
+		}
 		diaries = append(diaries, diary)
 	}
 
@@ -80,40 +96,31 @@ func GetUserDiaries(userID int64) ([]DiaryEntry, error) {
 }
 
 // GetDiary 获取单条日记
-func GetDiary(idStr string, userID int64) (*DiaryEntry, error) {
-	ctx := context.Background()
+func (s *RedisStore) GetDiary(ctx context.Context, idStr string, userID int64) (*DiaryEntry, error) {
 	key := fmt.Sprintf("diary:%d:%s", userID, idStr)
 
-	data, err := rdb.Get(ctx, key).Result()
+	data, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, ErrDiaryNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	var diary DiaryEntry
-	if err := json.Unmarshal([]byte(data), &diary); err != nil {
+	upgraded, ok, err := decodeRecord(KindDiary, []byte(data), &diary)
+	if err != nil {
 		return nil, err
 	}
+	if ok {
+		s.writeBack(ctx, key, data, upgraded)
+	}
 
 	return &diary, nil
 }
 
-// UpdateDiary 更新日记
-func UpdateDiary(idStr string, userID int64, updated *DiaryEntry) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("diary:%d:%s", userID, idStr)
-
-	// 先获取原有日记
-	data, err := rdb.Get(ctx, key).Result()
-	if err != nil {
-		return err
-	}
-
-	var diary DiaryEntry
-	if err := json.Unmarshal([]byte(data), &diary); err != nil {
-		return err
-	}
-
-	// 更新字段
+// applyDiaryUpdate 将更新内容合并到已有日记，空字段保持原值
+func applyDiaryUpdate(diary, updated *DiaryEntry) {
 	if updated.Date != "" {
 		diary.Date = updated.Date
 	}
@@ -128,27 +135,70 @@ func UpdateDiary(idStr string, userID int64, updated *DiaryEntry) error {
 	}
 	diary.Location = updated.Location
 	diary.Mood = updated.Mood
+}
 
-	// 保存更新后的日记
-	newData, err := json.Marshal(diary)
+// UpdateDiary 更新日记
+func (s *RedisStore) UpdateDiary(ctx context.Context, idStr string, userID int64, updated *DiaryEntry) error {
+	key := fmt.Sprintf("diary:%d:%s", userID, idStr)
+
+	// 先获取原有日记
+	data, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return ErrDiaryNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	return rdb.Set(ctx, key, newData, 0).Err()
-}
+	var diary DiaryEntry
+	if _, _, err := decodeRecord(KindDiary, []byte(data), &diary); err != nil {
+		return err
+	}
 
-// DeleteDiary 删除日记
-func DeleteDiary(idStr string, userID int64) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("diary:%d:%s", userID, idStr)
+	// 更新字段
+	applyDiaryUpdate(&diary, updated)
+	diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
 
-	// 从Redis删除日记数据
-	if err := rdb.Del(ctx, key).Err(); err != nil {
+	// 保存更新后的日记
+	newData, err := json.Marshal(diary)
+	if err != nil {
+		return err
+	}
+
+	// 仅当日记未被并发修改或删除时写入，避免删除后的日记被重新写回成为孤儿数据
+	written, err := s.casSet(ctx, key, data, newData)
+	if err != nil {
 		return err
 	}
+	if !written {
+		return ErrConcurrentUpdate
+	}
+	s.reindexSearchDoc(ctx, diarySearchScope(userID), diarySearchRecord(&diary).document())
+	return nil
+}
 
-	// 从用户的日记列表中删除
+// DeleteDiary 将日记移入回收站
+func (s *RedisStore) DeleteDiary(ctx context.Context, idStr string, userID int64, username string) error {
+	key := fmt.Sprintf("diary:%d:%s", userID, idStr)
 	userDiariesKey := fmt.Sprintf("user:%d:diaries", userID)
-	return rdb.ZRem(ctx, userDiariesKey, idStr).Err()
+
+	// 日记数据与用户日记列表在同一事务中删除
+	return s.moveToTrash(ctx, username, key, func(tx *redis.Tx) (*TrashItem, error) {
+		data, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var diary DiaryEntry
+		if _, _, err := decodeRecord(KindDiary, []byte(data), &diary); err != nil {
+			return nil, err
+		}
+		return diaryTrashItem(&diary)
+	}, func(pipe redis.Pipeliner) {
+		pipe.Del(ctx, key)
+		pipe.ZRem(ctx, userDiariesKey, idStr)
+		indexSearchDoc(ctx, pipe, diarySearchScope(userID), SearchDocument{ID: idStr})
+	})
 }
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"example.com/travel_planner/backend/config"
+	"github.com/redis/go-redis/v9"
 )
 
 // ExpenseRecord mirrors handler struct
@@ -23,51 +24,77 @@ type ExpenseRecord struct {
 	Note      string  `json:"note"`
 	Date      string  `json:"date"` // YYYY-MM-DD user-provided date for the expense
 	CreatedAt string  `json:"createdAt"`
+
+	SchemaVersion int `json:"schemaVersion"`
 }
 
 func expenseListKey(username string) string { return "user_expenses:" + username }
 
 // SaveExpense 将单条记录追加到用户的 expense 列表
-func SaveExpense(ctx context.Context, username string, rec *ExpenseRecord) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
-	}
+func (s *RedisStore) SaveExpense(ctx context.Context, username string, rec *ExpenseRecord) error {
+	rec.SchemaVersion = CurrentSchemaVersion(KindExpense)
 	b, err := json.Marshal(rec)
 	if err != nil {
 		return err
 	}
-	if err := rdb.RPush(ctx, expenseListKey(username), b).Err(); err != nil {
-		return err
-	}
-	return nil
+	doc := expenseSearchRecord(rec).document()
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, expenseListKey(username), b)
+		indexSearchDoc(ctx, pipe, expenseSearchScope(username), doc)
+		return nil
+	})
+	return err
 }
 
 // GetExpenses 返回用户的所有 expense 记录
-func GetExpenses(ctx context.Context, username string) ([]*ExpenseRecord, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
-	}
-	vals, err := rdb.LRange(ctx, expenseListKey(username), 0, -1).Result()
+func (s *RedisStore) GetExpenses(ctx context.Context, username string) ([]*ExpenseRecord, error) {
+	vals, err := s.rdb.LRange(ctx, expenseListKey(username), 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
 	res := make([]*ExpenseRecord, 0, len(vals))
-	for _, v := range vals {
+	for i, v := range vals {
 		var er ExpenseRecord
-		if err := json.Unmarshal([]byte(v), &er); err != nil {
+		data, upgraded, err := decodeRecord(KindExpense, []byte(v), &er)
+		if err != nil {
+			LogWarn("Skipping unreadable expense %d of user %s: %v", i, username, err)
 			continue
 		}
+		if upgraded {
+			s.writeBackListItem(ctx, expenseListKey(username), int64(i), v, data)
+		}
 		res = append(res, &er)
 	}
 	return res, nil
 }
 
-// GenerateExpenseID 生成唯一 expense ID
-func GenerateExpenseID(ctx context.Context) (string, error) {
-	if rdb == nil {
-		return "", errors.New("redis not initialized")
+// casListSetScript 仅当列表元素未被修改时替换，列表只追加不插入，下标保持稳定
+var casListSetScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('LSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return false
+`)
+
+// casListSet 当列表元素仍为 old 时替换为 value，返回是否写入
+func (s *RedisStore) casListSet(ctx context.Context, key string, index int64, old string, value []byte) (bool, error) {
+	err := casListSetScript.Run(ctx, s.rdb, []string{key}, index, old, value).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// writeBackListItem 将惰性升级后的列表元素写回
+func (s *RedisStore) writeBackListItem(ctx context.Context, key string, index int64, old string, upgraded []byte) {
+	if _, err := s.casListSet(ctx, key, index, old, upgraded); err != nil {
+		LogWarn("Failed to write back migrated list item %s[%d]: %v", key, index, err)
 	}
-	id, err := rdb.Incr(ctx, "expense:next_id").Result()
+}
+
+// GenerateExpenseID 生成唯一 expense ID
+func (s *RedisStore) GenerateExpenseID(ctx context.Context) (string, error) {
+	id, err := s.rdb.Incr(ctx, "expense:next_id").Result()
 	if err != nil {
 		return "", err
 	}
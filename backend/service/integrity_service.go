@@ -0,0 +1,569 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IntegrityIssueKind 一致性问题类型
+type IntegrityIssueKind string
+
+const (
+	// IssueDangling 索引或引用中的ID指向不存在的记录
+	IssueDangling IntegrityIssueKind = "dangling"
+	// IssueOrphan 记录不在所属用户的索引中，或所属用户已不存在
+	IssueOrphan IntegrityIssueKind = "orphan"
+)
+
+// IntegrityIssue 一条一致性问题
+type IntegrityIssue struct {
+	Kind     IntegrityIssueKind `json:"kind"`
+	Where    string             `json:"where"`  // 发现问题的索引、键或表
+	Ref      string             `json:"ref"`    // 涉及的记录ID
+	Detail   string             `json:"detail"` // 问题说明
+	Action   string             `json:"action"` // 修复方式
+	Repaired bool               `json:"repaired"`
+	Error    string             `json:"error,omitempty"` // 修复失败的原因
+}
+
+// IntegrityReport 一致性检查报告
+type IntegrityReport struct {
+	Backend  string           `json:"backend"`
+	Repair   bool             `json:"repair"`
+	Scanned  map[string]int   `json:"scanned"` // 各类记录和索引的扫描数量
+	Issues   []IntegrityIssue `json:"issues"`
+	Duration time.Duration    `json:"duration"`
+}
+
+// IntegrityChecker 可检查并修复引用一致性的存储后端
+type IntegrityChecker interface {
+	// CheckIntegrity 扫描全部索引和记录，报告悬空引用和孤立记录；
+	// repair 为 true 时同时修复：删除悬空引用，将孤立记录重新加入索引，
+	// 所属用户已不存在的记录直接删除
+	CheckIntegrity(ctx context.Context, repair bool) (*IntegrityReport, error)
+}
+
+func newIntegrityReport(backend string, repair bool) *IntegrityReport {
+	return &IntegrityReport{Backend: backend, Repair: repair, Scanned: make(map[string]int), Issues: []IntegrityIssue{}}
+}
+
+// add 记录一条问题，repair 模式下执行 fix，fix 返回 false 表示复查时问题已不存在
+func (r *IntegrityReport) add(kind IntegrityIssueKind, where, ref, detail, action string, fix func() (bool, error)) {
+	issue := IntegrityIssue{Kind: kind, Where: where, Ref: ref, Detail: detail, Action: action}
+	if r.Repair && fix != nil {
+		fixed, err := fix()
+		if err != nil {
+			issue.Error = err.Error()
+		} else if !fixed {
+			// 扫描与修复之间记录被并发修改，问题已不存在
+			return
+		}
+		issue.Repaired = err == nil
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// Unrepaired 返回尚未修复的问题数量
+func (r *IntegrityReport) Unrepaired() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// String 生成可读的报告文本
+func (r *IntegrityReport) String() string {
+	var b strings.Builder
+	mode := "check only"
+	if r.Repair {
+		mode = "repair"
+	}
+	fmt.Fprintf(&b, "Integrity report (%s backend, %s, %s)\n", r.Backend, mode, r.Duration.Round(time.Millisecond))
+	names := make([]string, 0, len(r.Scanned))
+	for name := range r.Scanned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "  scanned %-20s %d\n", name, r.Scanned[name])
+	}
+	for _, issue := range r.Issues {
+		status := "found"
+		switch {
+		case issue.Repaired:
+			status = "repaired"
+		case issue.Error != "":
+			status = "failed: " + issue.Error
+		}
+		fmt.Fprintf(&b, "  %-8s %s %s: %s -> %s (%s)\n", issue.Kind, issue.Where, issue.Ref, issue.Detail, issue.Action, status)
+	}
+	fmt.Fprintf(&b, "  %d issues, %d unrepaired\n", len(r.Issues), r.Unrepaired())
+	return b.String()
+}
+
+// StartIntegrityChecker 启动后台任务，每隔 interval 执行一次一致性检查，ctx 取消后退出
+func StartIntegrityChecker(ctx context.Context, checker IntegrityChecker, interval time.Duration, repair bool) {
+	check := func() {
+		report, err := checker.CheckIntegrity(ctx, repair)
+		if err != nil {
+			LogError("Integrity check failed: %v", err)
+			return
+		}
+		for _, issue := range report.Issues {
+			LogWarn("Integrity %s in %s (%s): %s, repaired=%v %s", issue.Kind, issue.Where, issue.Ref, issue.Detail, issue.Repaired, issue.Error)
+		}
+		LogInfo("Integrity check finished: %d issues, %d unrepaired", len(report.Issues), report.Unrepaired())
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// ==================== Redis 一致性检查 ====================
+
+// redisIntegrity 一次 Redis 一致性检查的扫描状态
+type redisIntegrity struct {
+	s      *RedisStore
+	report *IntegrityReport
+
+	users        map[string]bool
+	usernames    []string // 按字典序，保证报告顺序稳定
+	userIDs      map[int64]bool
+	tripOwners   map[string]string // 行程ID -> 所属用户名
+	trashedTrips map[string]bool
+}
+
+// userScopedKeys 以用户名结尾的各类用户数据键前缀
+var userScopedKeys = []string{
+	userTripsKey(""),
+	userTripIndexKey(TripSortCreatedAt, ""),
+	userTripIndexKey(TripSortStartDate, ""),
+	userTripIndexKey(TripSortBudget, ""),
+	userFavoriteTripIDsKey(""),
+	userFavoritePlacesKey(""),
+	legacyFavoritesKey(""),
+	expenseListKey(""),
+	userTrashKey(""),
+	userSessionsKey(""),
+	userAccessTokensKey(""),
+	userIdentitiesKey(""),
+	twoFactorKey(""),
+	userJobsKey(""),
+	userPasswordResetKey(""),
+}
+
+// CheckIntegrity 检查 Redis 中记录与索引的一致性，修复时在 WATCH 事务中复查后再修改
+func (s *RedisStore) CheckIntegrity(ctx context.Context, repair bool) (*IntegrityReport, error) {
+	start := time.Now()
+	c := &redisIntegrity{
+		s:            s,
+		report:       newIntegrityReport("redis", repair),
+		users:        make(map[string]bool),
+		userIDs:      make(map[int64]bool),
+		tripOwners:   make(map[string]string),
+		trashedTrips: make(map[string]bool),
+	}
+	steps := []func(ctx context.Context) error{
+		c.scanUsers,
+		c.checkUserScopedKeys,
+		c.checkTrash,
+		c.checkTrips,
+		c.checkTripIndexes,
+		c.checkFavoriteTrips,
+		c.checkRevisions,
+		c.checkDiaries,
+	}
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			c.report.Duration = time.Since(start)
+			return c.report, err
+		}
+	}
+	c.report.Duration = time.Since(start)
+	return c.report, nil
+}
+
+// stringKeys 遍历匹配 pattern 的字符串类型键，跳过同前缀的索引和计数器
+func (c *redisIntegrity) stringKeys(ctx context.Context, pattern string, fn func(key, raw string) error) error {
+	return c.s.scanKeys(ctx, pattern, func(key string) error {
+		if strings.HasSuffix(key, ":next_id") {
+			return nil
+		}
+		typ, err := c.s.rdb.Type(ctx, key).Result()
+		if err != nil || typ != "string" {
+			return err
+		}
+		raw, err := c.s.rdb.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(key, raw)
+	})
+}
+
+// fixIf 在监视 keys 的事务中复查 still，条件仍成立时执行 ops
+func (c *redisIntegrity) fixIf(ctx context.Context, still func(tx *redis.Tx) (bool, error), ops func(pipe redis.Pipeliner), keys ...string) func() (bool, error) {
+	return func() (bool, error) {
+		fixed := false
+		err := c.s.watchRetry(ctx, func(tx *redis.Tx) error {
+			ok, err := still(tx)
+			if err != nil || !ok {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				ops(pipe)
+				return nil
+			})
+			fixed = err == nil
+			return err
+		}, keys...)
+		return fixed, err
+	}
+}
+
+// tripOwnedBy 复查行程是否存在且属于 username
+func (c *redisIntegrity) tripOwnedBy(ctx context.Context, tx *redis.Tx, tripID, username string) (bool, error) {
+	data, err := tx.Get(ctx, tripKey(tripID)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var plan TripPlan
+	if _, _, err := decodeRecord(KindTrip, []byte(data), &plan); err != nil {
+		return false, err
+	}
+	return plan.Username == username, nil
+}
+
+func (c *redisIntegrity) scanUsers(ctx context.Context) error {
+	err := c.stringKeys(ctx, userKey("*"), func(key, raw string) error {
+		var u UserRecord
+		if _, _, err := decodeRecord(KindUser, []byte(raw), &u); err != nil {
+			LogWarn("Integrity check skipping unreadable user %s: %v", key, err)
+		}
+		c.users[strings.TrimPrefix(key, userKey(""))] = true
+		c.userIDs[int64(u.ID)] = true
+		c.report.Scanned["users"]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for username := range c.users {
+		c.usernames = append(c.usernames, username)
+	}
+	sort.Strings(c.usernames)
+	return nil
+}
+
+// checkUserScopedKeys 所属用户已不存在的用户数据键整体删除
+func (c *redisIntegrity) checkUserScopedKeys(ctx context.Context) error {
+	for _, prefix := range userScopedKeys {
+		err := c.s.scanKeys(ctx, prefix+"*", func(key string) error {
+			username := strings.TrimPrefix(key, prefix)
+			if c.users[username] {
+				return nil
+			}
+			c.report.add(IssueOrphan, key, username, "owner does not exist", "delete key",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					n, err := tx.Exists(ctx, userKey(username)).Result()
+					return n == 0, err
+				}, func(pipe redis.Pipeliner) {
+					pipe.Del(ctx, key)
+				}, userKey(username)))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTrash 回收站哈希与过期索引互相对应
+func (c *redisIntegrity) checkTrash(ctx context.Context) error {
+	err := c.s.scanKeys(ctx, userTrashKey("*"), func(key string) error {
+		username := strings.TrimPrefix(key, userTrashKey(""))
+		entries, err := c.s.rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		for field, data := range entries {
+			c.report.Scanned["trash items"]++
+			var item TrashItem
+			if err := json.Unmarshal([]byte(data), &item); err != nil {
+				continue
+			}
+			if item.Kind == TrashTrip {
+				c.trashedTrips[item.ID] = true
+			}
+			member := trashMember(username, item.Kind, item.ID)
+			if _, err := c.s.rdb.ZScore(ctx, trashByTimeKey, member).Result(); err != redis.Nil {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			// 未进入过期索引的条目永远不会被清理
+			score := float64(item.DeletedAt.UnixMilli())
+			c.report.add(IssueOrphan, key, field, "trash item missing from expiry index", "add to "+trashByTimeKey,
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					ok, err := tx.HExists(ctx, key, field).Result()
+					return ok, err
+				}, func(pipe redis.Pipeliner) {
+					pipe.ZAdd(ctx, trashByTimeKey, redis.Z{Score: score, Member: member})
+				}, key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	members, err := c.s.rdb.ZRange(ctx, trashByTimeKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		var parts []string
+		if err := json.Unmarshal([]byte(m), &parts); err != nil || len(parts) != 3 {
+			c.report.add(IssueDangling, trashByTimeKey, m, "malformed member", "remove", c.fixIf(ctx,
+				func(tx *redis.Tx) (bool, error) { return true, nil },
+				func(pipe redis.Pipeliner) { pipe.ZRem(ctx, trashByTimeKey, m) }, trashByTimeKey))
+			continue
+		}
+		key, field := userTrashKey(parts[0]), trashField(TrashKind(parts[1]), parts[2])
+		ok, err := c.s.rdb.HExists(ctx, key, field).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		c.report.add(IssueDangling, trashByTimeKey, m, "trash item does not exist", "remove",
+			c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+				ok, err := tx.HExists(ctx, key, field).Result()
+				return !ok, err
+			}, func(pipe redis.Pipeliner) {
+				pipe.ZRem(ctx, trashByTimeKey, m)
+			}, key))
+	}
+	return nil
+}
+
+// checkTrips 行程必须属于存在的用户并在其行程集合中
+func (c *redisIntegrity) checkTrips(ctx context.Context) error {
+	return c.stringKeys(ctx, tripKey("*"), func(key, raw string) error {
+		c.report.Scanned["trips"]++
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, []byte(raw), &plan); err != nil {
+			LogWarn("Integrity check skipping unreadable trip %s: %v", key, err)
+			return nil
+		}
+		id, username := strings.TrimPrefix(key, tripKey("")), plan.Username
+		if !c.users[username] {
+			c.report.add(IssueOrphan, key, id, fmt.Sprintf("owner %q does not exist", username), "delete trip",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					n, err := tx.Exists(ctx, userKey(username)).Result()
+					return n == 0, err
+				}, func(pipe redis.Pipeliner) {
+					pipe.Del(ctx, key)
+				}, userKey(username), key))
+			return nil
+		}
+		c.tripOwners[id] = username
+		ok, err := c.s.rdb.SIsMember(ctx, userTripsKey(username), id).Result()
+		if err != nil || ok {
+			return err
+		}
+		c.report.add(IssueOrphan, key, id, "missing from "+userTripsKey(username), "reindex",
+			c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+				return c.tripOwnedBy(ctx, tx, id, username)
+			}, func(pipe redis.Pipeliner) {
+				pipe.SAdd(ctx, userTripsKey(username), id)
+				for _, field := range tripSortFields {
+					pipe.ZAdd(ctx, userTripIndexKey(field, username), redis.Z{Score: tripSortScore(&plan, field), Member: id})
+				}
+			}, key))
+		return nil
+	})
+}
+
+// checkTripIndexes 用户行程集合和排序索引中的ID必须指向该用户的行程
+func (c *redisIntegrity) checkTripIndexes(ctx context.Context) error {
+	check := func(key, username string, members []string, remove func(pipe redis.Pipeliner, id string)) {
+		for _, id := range members {
+			c.report.Scanned["trip index entries"]++
+			if c.tripOwners[id] == username {
+				continue
+			}
+			id := id
+			c.report.add(IssueDangling, key, id, "trip does not exist or belongs to another user", "remove",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					ok, err := c.tripOwnedBy(ctx, tx, id, username)
+					return !ok, err
+				}, func(pipe redis.Pipeliner) {
+					remove(pipe, id)
+				}, tripKey(id)))
+		}
+	}
+	for _, username := range c.usernames {
+		key := userTripsKey(username)
+		members, err := c.s.rdb.SMembers(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		check(key, username, members, func(pipe redis.Pipeliner, id string) { pipe.SRem(ctx, key, id) })
+		for _, field := range tripSortFields {
+			key := userTripIndexKey(field, username)
+			members, err := c.s.rdb.ZRange(ctx, key, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			check(key, username, members, func(pipe redis.Pipeliner, id string) { pipe.ZRem(ctx, key, id) })
+		}
+	}
+	return nil
+}
+
+// checkFavoriteTrips 收藏的行程必须存在，回收站中的行程保留收藏以便恢复
+func (c *redisIntegrity) checkFavoriteTrips(ctx context.Context) error {
+	for _, username := range c.usernames {
+		key := userFavoriteTripIDsKey(username)
+		ids, err := c.s.rdb.SMembers(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			c.report.Scanned["favorite trips"]++
+			if c.tripOwners[id] != "" || c.trashedTrips[id] {
+				continue
+			}
+			id := id
+			c.report.add(IssueDangling, key, id, "trip does not exist", "remove",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					n, err := tx.Exists(ctx, tripKey(id)).Result()
+					return n == 0, err
+				}, func(pipe redis.Pipeliner) {
+					pipe.SRem(ctx, key, id)
+				}, tripKey(id)))
+		}
+	}
+	return nil
+}
+
+// checkRevisions 版本历史只为存在或在回收站中的行程保留
+func (c *redisIntegrity) checkRevisions(ctx context.Context) error {
+	return c.s.scanKeys(ctx, tripRevisionsKey("*"), func(key string) error {
+		c.report.Scanned["trip revisions"]++
+		id := strings.TrimPrefix(key, tripRevisionsKey(""))
+		if c.tripOwners[id] != "" || c.trashedTrips[id] {
+			return nil
+		}
+		c.report.add(IssueOrphan, key, id, "trip does not exist", "delete revisions", func() (bool, error) {
+			return true, c.s.dropOrphanRevisions(ctx, id)
+		})
+		return nil
+	})
+}
+
+// checkDiaries 日记与用户日记索引互相对应
+func (c *redisIntegrity) checkDiaries(ctx context.Context) error {
+	err := c.stringKeys(ctx, "diary:*", func(key, raw string) error {
+		c.report.Scanned["diaries"]++
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			return nil
+		}
+		userID, err1 := strconv.ParseInt(parts[1], 10, 64)
+		id, err2 := strconv.ParseInt(parts[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		indexKey := fmt.Sprintf("user:%d:diaries", userID)
+		if !c.userIDs[userID] {
+			c.report.add(IssueOrphan, key, parts[2], fmt.Sprintf("owner %d does not exist", userID), "delete diary",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) { return true, nil },
+					func(pipe redis.Pipeliner) {
+						pipe.Del(ctx, key)
+						pipe.ZRem(ctx, indexKey, parts[2])
+					}, key))
+			return nil
+		}
+		if _, err := c.s.rdb.ZScore(ctx, indexKey, parts[2]).Result(); err != redis.Nil {
+			return err
+		}
+		c.report.add(IssueOrphan, key, parts[2], "missing from "+indexKey, "reindex",
+			c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+				n, err := tx.Exists(ctx, key).Result()
+				return n > 0, err
+			}, func(pipe redis.Pipeliner) {
+				pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(id), Member: parts[2]})
+			}, key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.s.scanKeys(ctx, "user:*:diaries", func(indexKey string) error {
+		userID, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(indexKey, "user:"), ":diaries"), 10, 64)
+		if err != nil {
+			return nil
+		}
+		if !c.userIDs[userID] {
+			c.report.add(IssueOrphan, indexKey, strconv.FormatInt(userID, 10), "owner does not exist", "delete key",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) { return true, nil },
+					func(pipe redis.Pipeliner) { pipe.Del(ctx, indexKey) }, indexKey))
+			return nil
+		}
+		ids, err := c.s.rdb.ZRange(ctx, indexKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			c.report.Scanned["diary index entries"]++
+			key := fmt.Sprintf("diary:%d:%s", userID, id)
+			n, err := c.s.rdb.Exists(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+			id := id
+			c.report.add(IssueDangling, indexKey, id, "diary does not exist", "remove",
+				c.fixIf(ctx, func(tx *redis.Tx) (bool, error) {
+					n, err := tx.Exists(ctx, key).Result()
+					return n == 0, err
+				}, func(pipe redis.Pipeliner) {
+					pipe.ZRem(ctx, indexKey, id)
+				}, key))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// hasIssue 报告中是否有指定类型和记录的问题
+func hasIssue(r *IntegrityReport, kind IntegrityIssueKind, ref string) bool {
+	for _, issue := range r.Issues {
+		if issue.Kind == kind && issue.Ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckIntegrityRepair(t *testing.T) {
+	// 每个后端按自己的存储方式制造问题：trip2 的记录被直接删除而版本历史保留，
+	// 不使用外键的后端另外在用户行程索引中留下不存在的 ghost
+	cases := []struct {
+		name     string
+		open     func(t *testing.T) Backend
+		corrupt  func(t *testing.T, ctx context.Context, b Backend)
+		dangling bool
+	}{
+		{"memory", func(t *testing.T) Backend { return NewMemoryStore() }, func(t *testing.T, ctx context.Context, b Backend) {
+			s := b.(*MemoryStore)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.trips, "trip2")
+			delete(s.userTrips["alice"], "trip2")
+			s.userTrips["alice"]["ghost"] = struct{}{}
+		}, true},
+		{"sqlite", func(t *testing.T) Backend { return newSQLiteTestStore(t) }, func(t *testing.T, ctx context.Context, b Backend) {
+			if _, err := b.(*SQLiteStore).db.ExecContext(ctx, "DELETE FROM trips WHERE id = ?", "trip2"); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"redis", func(t *testing.T) Backend {
+			s, _ := newRedisTestStore(t)
+			return s
+		}, func(t *testing.T, ctx context.Context, b Backend) {
+			rdb := b.(*RedisStore).rdb
+			if err := rdb.Del(ctx, tripKey("trip2")).Err(); err != nil {
+				t.Fatal(err)
+			}
+			rdb.SRem(ctx, userTripsKey("alice"), "trip2")
+			for _, field := range tripSortFields {
+				rdb.ZRem(ctx, userTripIndexKey(field, "alice"), "trip2")
+			}
+			if err := rdb.SAdd(ctx, userTripsKey("alice"), "ghost").Err(); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := tc.open(t)
+			u := mustCreateUser(t, ctx, b, "alice")
+			mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+			mustSaveTrip(t, ctx, b, u, "trip2", 1000, time.Now())
+			tc.corrupt(t, ctx, b)
+
+			// 只检查时报告问题但不修改数据
+			report, err := b.CheckIntegrity(ctx, false)
+			if err != nil {
+				t.Fatalf("CheckIntegrity: %v", err)
+			}
+			if !hasIssue(report, IssueOrphan, "trip2") {
+				t.Errorf("check = %s; want the orphaned revisions of trip2", report)
+			}
+			if tc.dangling && !hasIssue(report, IssueDangling, "ghost") {
+				t.Errorf("check = %s; want the dangling index entry ghost", report)
+			}
+			if report.Unrepaired() != len(report.Issues) {
+				t.Fatalf("check only repaired %d issues", len(report.Issues)-report.Unrepaired())
+			}
+			if revs, _ := b.ListTripRevisions(ctx, "trip2"); len(revs) == 0 {
+				t.Fatal("check only removed the revisions")
+			}
+
+			report, err = b.CheckIntegrity(ctx, true)
+			if err != nil {
+				t.Fatalf("CheckIntegrity(repair): %v", err)
+			}
+			if len(report.Issues) == 0 || report.Unrepaired() != 0 {
+				t.Fatalf("repair = %s; want every issue repaired", report)
+			}
+			if revs, _ := b.ListTripRevisions(ctx, "trip2"); len(revs) != 0 {
+				t.Errorf("%d revisions of trip2 left after repair", len(revs))
+			}
+			page, err := b.ListUserTrips(ctx, "alice", TripQuery{})
+			if err != nil || len(page.Trips) != 1 || page.Trips[0].ID != "trip1" {
+				t.Errorf("ListUserTrips after repair = %+v, %v; want only trip1", page, err)
+			}
+			if revs, _ := b.ListTripRevisions(ctx, "trip1"); len(revs) != 1 {
+				t.Errorf("repair touched the revisions of trip1: %d left", len(revs))
+			}
+
+			report, err = b.CheckIntegrity(ctx, false)
+			if err != nil || len(report.Issues) != 0 {
+				t.Fatalf("check after repair = %s, %v; want no issues", report, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,602 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job already finished")
+	ErrJobQueueFull = errors.New("job queue is full")
+	ErrTooManyJobs  = errors.New("too many unfinished jobs")
+
+	// errJobSkipped 任务出队时已不处于排队状态（例如已被取消）
+	errJobSkipped = errors.New("job is no longer queued")
+)
+
+// 后台任务的保留时长、单个任务的时限和数量限制
+var (
+	JobRetention         = 7 * 24 * time.Hour
+	JobTimeout           = 3 * time.Minute // 包含行程校验不通过时重新生成的时间
+	MaxActiveJobsPerUser = 5
+)
+
+// maxJobAttempts 任务因服务重启而中断后最多执行的次数，避免反复导致崩溃的任务无限重试
+const maxJobAttempts = 3
+
+// JobStatus 后台任务状态
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// JobTripPlan 生成行程计划的任务类型，目前唯一的任务类型
+const JobTripPlan = "tripPlan"
+
+// Job 后台任务。排队和执行中的任务在服务重启后恢复，结束的任务保留 JobRetention 后删除
+type Job struct {
+	ID              string           `json:"id"`
+	Type            string           `json:"type"`
+	UserID          int              `json:"userId"`
+	Username        string           `json:"username"`
+	Status          JobStatus        `json:"status"`
+	Request         TripPlanRequest  `json:"request"`
+	TripID          string           `json:"tripId,omitempty"`   // 保存的行程ID，保存前记入，成功后才展示
+	Error           string           `json:"error,omitempty"`    // 失败原因
+	Warnings        []ItineraryIssue `json:"warnings,omitempty"` // 成功后行程校验仍未解决的问题
+	Attempts        int              `json:"attempts"`           // 开始执行的次数
+	CancelRequested bool             `json:"cancelRequested"`    // 执行中被请求取消，等待工作协程结束
+	CreatedAt       time.Time        `json:"createdAt"`
+	StartedAt       *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time       `json:"finishedAt,omitempty"`
+}
+
+// JobStore 后台任务存储
+type JobStore interface {
+	// CreateJob 保存新任务
+	CreateJob(ctx context.Context, job *Job) error
+	// GetJob 获取任务，不存在或已超过保留时长时返回 nil, nil
+	GetJob(ctx context.Context, id string) (*Job, error)
+	// UpdateJob 原子地读取、修改并写回任务，fn 返回错误时不写入；不存在时返回 ErrJobNotFound
+	UpdateJob(ctx context.Context, id string, fn func(job *Job) error) (*Job, error)
+	// ListUserJobs 列出用户仍在保留期内的任务，按创建时间倒序
+	ListUserJobs(ctx context.Context, username string) ([]*Job, error)
+	// ListActiveJobs 列出全部排队和执行中的任务，按创建时间排序，供重启后恢复
+	ListActiveJobs(ctx context.Context) ([]*Job, error)
+}
+
+// JobInfo 返回给客户端的任务信息
+type JobInfo struct {
+	ID              string           `json:"id"`
+	Type            string           `json:"type"`
+	Status          JobStatus        `json:"status"`
+	Request         TripPlanRequest  `json:"request"`
+	TripID          string           `json:"tripId,omitempty"`
+	Error           string           `json:"error,omitempty"`
+	Warnings        []ItineraryIssue `json:"warnings,omitempty"`
+	CancelRequested bool             `json:"cancelRequested,omitempty"`
+	CreatedAt       time.Time        `json:"createdAt"`
+	StartedAt       *time.Time       `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time       `json:"finishedAt,omitempty"`
+}
+
+// Info 返回任务的展示信息
+func (job *Job) Info() *JobInfo {
+	info := &JobInfo{
+		ID:              job.ID,
+		Type:            job.Type,
+		Status:          job.Status,
+		Request:         job.Request,
+		Error:           job.Error,
+		CancelRequested: job.CancelRequested,
+		CreatedAt:       job.CreatedAt,
+		StartedAt:       job.StartedAt,
+		FinishedAt:      job.FinishedAt,
+	}
+	// 执行中已记入的行程ID在任务成功后才展示
+	if job.Status == JobSucceeded {
+		info.TripID, info.Warnings = job.TripID, job.Warnings
+	}
+	return info
+}
+
+// Finished 任务是否已结束
+func (job *Job) Finished() bool {
+	return job.Status == JobSucceeded || job.Status == JobFailed || job.Status == JobCanceled
+}
+
+// expired 已结束且超过保留时长的任务视为不存在
+func (job *Job) expired(now time.Time) bool {
+	return job.Finished() && job.FinishedAt != nil && now.Sub(*job.FinishedAt) >= JobRetention
+}
+
+// finish 将任务标记为结束
+func (job *Job) finish(status JobStatus, message string) {
+	now := time.Now()
+	job.Status = status
+	job.Error = message
+	job.FinishedAt = &now
+}
+
+// JobRunner 执行后台任务的工作池。任务状态保存在 JobStore 中，队列只在进程内，
+// 服务重启后由 Start 恢复未完成的任务；因此多个实例不能共用同一存储运行任务
+type JobRunner struct {
+	stores   *Stores
+	queue    chan string
+	generate func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error)
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc // 执行中任务的取消函数
+}
+
+// NewJobRunner 创建工作池，queueSize 为等待执行的任务数上限
+func NewJobRunner(stores *Stores, queueSize int) *JobRunner {
+	return &JobRunner{
+		stores:   stores,
+		queue:    make(chan string, queueSize),
+		generate: GenerateTripPlan,
+		cancels:  make(map[string]context.CancelFunc),
+	}
+}
+
+// Start 恢复上次运行时未完成的任务并启动 workers 个工作协程。中断时正在执行的任务重新排队，
+// 已执行 maxJobAttempts 次的任务标记为失败
+func (r *JobRunner) Start(ctx context.Context, workers int) error {
+	jobs, err := r.stores.Jobs.ListActiveJobs(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, job := range jobs {
+		recovered, err := r.stores.Jobs.UpdateJob(ctx, job.ID, func(j *Job) error {
+			switch {
+			case j.Finished():
+			case j.CancelRequested:
+				j.finish(JobCanceled, "")
+			case j.Status == JobRunning && j.Attempts >= maxJobAttempts:
+				j.finish(JobFailed, "任务多次因服务重启中断，已停止重试")
+			default:
+				j.Status = JobQueued
+				j.StartedAt = nil
+			}
+			return nil
+		})
+		if err != nil {
+			LogError("Failed to recover job %s: %v", job.ID, err)
+			continue
+		}
+		if recovered.Status == JobQueued {
+			pending = append(pending, recovered.ID)
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		go r.work(ctx)
+	}
+	// 恢复的任务可能超过队列容量，在后台逐个放回队列
+	go func() {
+		for _, id := range pending {
+			select {
+			case r.queue <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if len(jobs) > 0 {
+		LogInfo("Recovered %d unfinished jobs, %d requeued", len(jobs), len(pending))
+	}
+	return nil
+}
+
+// EnqueueTripPlan 创建生成行程的任务并放入队列。用户未结束的任务达到 MaxActiveJobsPerUser 时
+// 返回 ErrTooManyJobs；队列已满时任务标记为失败并返回 ErrJobQueueFull
+func (r *JobRunner) EnqueueTripPlan(ctx context.Context, user *UserRecord, req *TripPlanRequest) (*Job, error) {
+	if len(r.queue) >= cap(r.queue) {
+		return nil, ErrJobQueueFull
+	}
+	jobs, err := r.stores.Jobs.ListUserJobs(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	active := 0
+	for _, job := range jobs {
+		if !job.Finished() {
+			active++
+		}
+	}
+	if active >= MaxActiveJobsPerUser {
+		return nil, ErrTooManyJobs
+	}
+
+	id, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:        id,
+		Type:      JobTripPlan,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Status:    JobQueued,
+		Request:   *req,
+		CreatedAt: time.Now(),
+	}
+	if err := r.stores.Jobs.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	select {
+	case r.queue <- id:
+		return job, nil
+	default:
+		// 检查队列长度之后队列被其他请求占满，已保存的任务标记为失败
+		if _, err := r.stores.Jobs.UpdateJob(ctx, id, func(j *Job) error {
+			j.finish(JobFailed, "任务队列已满")
+			return nil
+		}); err != nil {
+			LogError("Failed to mark job %s as failed: %v", id, err)
+		}
+		return nil, ErrJobQueueFull
+	}
+}
+
+// Cancel 取消用户的任务。排队中的任务立即取消；执行中的任务记录取消请求并中止模型调用，
+// 由工作协程随后标记为已取消。任务不存在或不属于该用户时返回 ErrJobNotFound，已结束时返回 ErrJobFinished
+func (r *JobRunner) Cancel(ctx context.Context, username, id string) (*Job, error) {
+	job, err := r.stores.Jobs.UpdateJob(ctx, id, func(j *Job) error {
+		if j.Username != username {
+			return ErrJobNotFound
+		}
+		if j.Finished() {
+			return ErrJobFinished
+		}
+		if j.Status == JobQueued {
+			j.finish(JobCanceled, "")
+		} else {
+			j.CancelRequested = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == JobRunning {
+		r.mu.Lock()
+		cancel := r.cancels[id]
+		r.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	return job, nil
+}
+
+// GetUserJob 获取用户的任务，不存在或不属于该用户时返回 ErrJobNotFound
+func GetUserJob(ctx context.Context, store JobStore, username, id string) (*Job, error) {
+	job, err := store.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.Username != username {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (r *JobRunner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-r.queue:
+			r.run(ctx, id)
+		}
+	}
+}
+
+// run 执行一个任务并写回结果
+func (r *JobRunner) run(ctx context.Context, id string) {
+	// 先登记取消函数再标记为执行中，Cancel 看到执行中的状态时一定能找到取消函数
+	jobCtx, cancel := context.WithTimeout(ctx, JobTimeout)
+	defer cancel()
+	r.mu.Lock()
+	r.cancels[id] = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+	}()
+
+	job, err := r.stores.Jobs.UpdateJob(ctx, id, func(j *Job) error {
+		if j.Status != JobQueued {
+			return errJobSkipped
+		}
+		now := time.Now()
+		j.Status = JobRunning
+		j.StartedAt = &now
+		j.Attempts++
+		return nil
+	})
+	if errors.Is(err, errJobSkipped) || errors.Is(err, ErrJobNotFound) {
+		return
+	}
+	if err != nil {
+		// 任务仍处于排队状态，下次启动时恢复
+		LogError("Failed to start job %s: %v", id, err)
+		return
+	}
+
+	tripID, warnings, runErr := r.runTripPlan(jobCtx, job)
+
+	// 任务超时或被取消后 jobCtx 已失效，结果使用独立的 context 写回
+	finishCtx, cancelFinish := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFinish()
+	job, err = r.stores.Jobs.UpdateJob(finishCtx, id, func(j *Job) error {
+		// 取消请求优先于执行结果：用户请求取消后不应再看到任务成功
+		switch {
+		case j.CancelRequested:
+			j.finish(JobCanceled, "")
+		case runErr == nil:
+			j.TripID = tripID
+			j.Warnings = warnings
+			j.finish(JobSucceeded, "")
+		default:
+			j.finish(JobFailed, jobErrorMessage(runErr))
+		}
+		return nil
+	})
+	if errors.Is(err, ErrJobNotFound) {
+		// 执行期间用户注销，任务随账户一起删除
+		return
+	}
+	if err != nil {
+		LogError("Failed to save result of job %s: %v", id, err)
+		return
+	}
+	if job.Status == JobCanceled && runErr == nil {
+		// 行程保存之后才收到取消请求，移入回收站，用户仍可以恢复
+		if err := r.stores.Trips.DeleteTripPlan(finishCtx, tripID, job.Username); err != nil {
+			LogError("Failed to discard trip %s of canceled job %s: %v", tripID, id, err)
+		}
+	}
+	if job.Status == JobFailed {
+		LogError("Job %s for user %s failed: %v", id, job.Username, runErr)
+		return
+	}
+	LogInfo("Job %s for user %s %s (trip: %s)", id, job.Username, job.Status, job.TripID)
+}
+
+// runTripPlan 生成并保存行程，返回行程ID和行程校验仍未解决的问题；保存前确认任务没有被取消、
+// 用户没有在执行期间注销。行程ID在保存前记入任务，保存之后、标记结束之前服务重启时，
+// 恢复的任务直接使用已保存的行程，不会再生成和保存一份
+func (r *JobRunner) runTripPlan(ctx context.Context, job *Job) (string, []ItineraryIssue, error) {
+	if job.TripID != "" {
+		saved, err := r.stores.Trips.GetTripPlan(ctx, job.TripID)
+		if err != nil {
+			return "", nil, err
+		}
+		if saved != nil && saved.Username == job.Username {
+			LogInfo("Job %s resumed with trip %s saved before restart", job.ID, job.TripID)
+			return saved.ID, job.Warnings, nil
+		}
+	}
+
+	plan, report, err := r.generate(ctx, &job.Request)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := r.checkCanceled(ctx, job.ID); err != nil {
+		return "", nil, err
+	}
+	user, err := r.stores.Users.GetUser(ctx, job.Username)
+	if err != nil {
+		return "", nil, err
+	}
+	if user == nil || user.ID != job.UserID {
+		return "", nil, ErrUserNotFound
+	}
+	// 上次执行已分配但没有保存成功的ID继续使用
+	plan.ID = job.TripID
+	if plan.ID == "" {
+		if plan.ID, err = r.stores.Trips.GenerateTripID(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+	_, err = r.stores.Jobs.UpdateJob(ctx, job.ID, func(j *Job) error {
+		if j.CancelRequested {
+			return context.Canceled
+		}
+		j.TripID, j.Warnings = plan.ID, report.Warnings
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := SaveNewTrip(ctx, r.stores.Trips, plan, user); err != nil {
+		return "", nil, err
+	}
+	return plan.ID, report.Warnings, nil
+}
+
+// checkCanceled 任务已被请求取消时返回 context.Canceled。Cancel 先记录取消请求再调用取消函数，
+// 两者之间 ctx 仍然有效，因此还要以存储中的状态为准
+func (r *JobRunner) checkCanceled(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	job, err := r.stores.Jobs.GetJob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job != nil && job.CancelRequested {
+		return context.Canceled
+	}
+	return nil
+}
+
+// jobErrorMessage 返回给客户端的失败原因
+func jobErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "生成行程超时"
+	case errors.Is(err, ErrUserNotFound):
+		return "用户不存在"
+	}
+	return "生成行程失败: " + err.Error()
+}
+
+// ==================== Redis 后台任务 ====================
+
+func jobKey(id string) string            { return "job:" + id }
+func userJobsKey(username string) string { return "user_jobs:" + username }
+
+// activeJobsKey 排队和执行中的任务ID集合，供重启后恢复
+const activeJobsKey = "jobs_active"
+
+// CreateJob 保存任务并加入用户的任务集合和未完成任务集合
+func (s *RedisStore) CreateJob(ctx context.Context, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, jobKey(job.ID), data, 0)
+		pipe.SAdd(ctx, userJobsKey(job.Username), job.ID)
+		pipe.SAdd(ctx, activeJobsKey, job.ID)
+		return nil
+	})
+	return err
+}
+
+// GetJob 获取任务
+func (s *RedisStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	data, err := s.rdb.Get(ctx, jobKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	if job.expired(time.Now()) {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// UpdateJob 在监视任务键的事务中修改。任务结束时设置保留时长并移出未完成任务集合
+func (s *RedisStore) UpdateJob(ctx context.Context, id string, fn func(job *Job) error) (*Job, error) {
+	key := jobKey(id)
+	var job *Job
+	err := s.watchRetry(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		job = &Job{}
+		if err := json.Unmarshal([]byte(raw), job); err != nil {
+			return err
+		}
+		if job.expired(time.Now()) {
+			return ErrJobNotFound
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if job.Finished() {
+				pipe.Set(ctx, key, data, JobRetention)
+				pipe.SRem(ctx, activeJobsKey, id)
+			} else {
+				pipe.Set(ctx, key, data, 0)
+				pipe.SAdd(ctx, activeJobsKey, id)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ListUserJobs 批量读取用户集合中的任务，并从集合中移除已过期的ID
+func (s *RedisStore) ListUserJobs(ctx context.Context, username string) ([]*Job, error) {
+	jobs, err := s.loadJobSet(ctx, userJobsKey(username))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// ListActiveJobs 读取未完成任务集合中的任务
+func (s *RedisStore) ListActiveJobs(ctx context.Context) ([]*Job, error) {
+	jobs, err := s.loadJobSet(ctx, activeJobsKey)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// loadJobSet 读取集合中ID对应且仍在保留期内的任务，任务键已不存在的ID从集合中移除
+func (s *RedisStore) loadJobSet(ctx context.Context, setKey string) ([]*Job, error) {
+	ids, err := s.rdb.SMembers(ctx, setKey).Result()
+	if err != nil || len(ids) == 0 {
+		return []*Job{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = jobKey(id)
+	}
+	vals, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	jobs := make([]*Job, 0, len(ids))
+	var missing []interface{}
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			missing = append(missing, ids[i])
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			return nil, err
+		}
+		if !job.expired(now) {
+			jobs = append(jobs, &job)
+		}
+	}
+	if len(missing) > 0 {
+		s.rdb.SRem(ctx, setKey, missing...)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestJobRunner 使用内存存储和替换后的行程生成函数启动工作池
+func newTestJobRunner(t *testing.T, generate func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error)) (*JobRunner, *Stores, *UserRecord) {
+	t.Helper()
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	u := mustCreateUser(t, context.Background(), b, "alice")
+	r := NewJobRunner(stores, 4)
+	r.generate = generate
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := r.Start(ctx, 1); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return r, stores, u
+}
+
+func testGeneratedPlan(req *TripPlanRequest) *TripPlan {
+	return &TripPlan{
+		Request:   *req,
+		Itinerary: []DayItinerary{{Day: 1, Date: req.StartDate, Activities: []Activity{{Name: "故宫", Cost: 60}}, DailyCost: 60}},
+		TotalCost: 60,
+		Summary:   "summary",
+	}
+}
+
+// waitJob 等待任务满足 cond
+func waitJob(t *testing.T, stores *Stores, id string, cond func(j *Job) bool) *Job {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		j, err := stores.Jobs.GetJob(context.Background(), id)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if j != nil && cond(j) {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not reach the expected state: %+v", id, j)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func finished(j *Job) bool { return j.Finished() }
+
+var testJobRequest = TripPlanRequest{Destination: "北京", StartDate: "2026-11-01", EndDate: "2026-11-01", Budget: 1000, Travelers: 1}
+
+func TestJobRunnerSucceeds(t *testing.T) {
+	r, stores, u := newTestJobRunner(t, func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		return testGeneratedPlan(req), &ItineraryReport{}, nil
+	})
+	job, err := r.EnqueueTripPlan(context.Background(), u, &testJobRequest)
+	if err != nil {
+		t.Fatalf("EnqueueTripPlan: %v", err)
+	}
+	j := waitJob(t, stores, job.ID, finished)
+	if j.Status != JobSucceeded || j.TripID == "" {
+		t.Fatalf("job = %+v; want succeeded with a trip", j)
+	}
+	if p, _ := stores.Trips.GetTripPlan(context.Background(), j.TripID); p == nil || p.Username != "alice" {
+		t.Fatalf("saved trip = %+v", p)
+	}
+}
+
+func TestJobRunnerCancelDuringGeneration(t *testing.T) {
+	started := make(chan struct{})
+	r, stores, u := newTestJobRunner(t, func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	})
+	job, err := r.EnqueueTripPlan(context.Background(), u, &testJobRequest)
+	if err != nil {
+		t.Fatalf("EnqueueTripPlan: %v", err)
+	}
+	<-started
+	canceled, err := r.Cancel(context.Background(), "alice", job.ID)
+	if err != nil || canceled.Status != JobRunning || !canceled.CancelRequested {
+		t.Fatalf("Cancel = %+v, %v; want a running job with a cancel request", canceled, err)
+	}
+	// 取消函数中止了生成，任务很快结束
+	j := waitJob(t, stores, job.ID, finished)
+	if j.Status != JobCanceled || j.TripID != "" {
+		t.Fatalf("job = %+v; want canceled without a trip", j)
+	}
+}
+
+func TestJobRunnerCancelWinsOverSuccess(t *testing.T) {
+	// 生成忽略 ctx 并正常返回，模拟取消请求在生成完成时才到达
+	release := make(chan struct{})
+	r, stores, u := newTestJobRunner(t, func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		<-release
+		return testGeneratedPlan(req), &ItineraryReport{}, nil
+	})
+	job, err := r.EnqueueTripPlan(context.Background(), u, &testJobRequest)
+	if err != nil {
+		t.Fatalf("EnqueueTripPlan: %v", err)
+	}
+	waitJob(t, stores, job.ID, func(j *Job) bool { return j.Status == JobRunning })
+	if _, err := r.Cancel(context.Background(), "alice", job.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	close(release)
+
+	j := waitJob(t, stores, job.ID, finished)
+	if j.Status != JobCanceled || j.TripID != "" {
+		t.Fatalf("job = %+v; want canceled without a trip", j)
+	}
+	if trips, _ := stores.Trips.GetUserTrips(context.Background(), "alice"); len(trips) != 0 {
+		t.Fatalf("canceled job saved %d trips", len(trips))
+	}
+}
+
+func TestJobRunnerCancelBeforeCancelFuncRuns(t *testing.T) {
+	// 取消请求已写入存储，但 Cancel 还没来得及调用取消函数：仍然不保存行程
+	var stores *Stores
+	r, stores, u := newTestJobRunner(t, func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		jobs, _ := stores.Jobs.ListUserJobs(ctx, "alice")
+		for _, j := range jobs {
+			if _, err := stores.Jobs.UpdateJob(ctx, j.ID, func(j *Job) error {
+				j.CancelRequested = true
+				return nil
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+		return testGeneratedPlan(req), &ItineraryReport{}, nil
+	})
+	job, err := r.EnqueueTripPlan(context.Background(), u, &testJobRequest)
+	if err != nil {
+		t.Fatalf("EnqueueTripPlan: %v", err)
+	}
+	j := waitJob(t, stores, job.ID, finished)
+	if j.Status != JobCanceled {
+		t.Fatalf("job = %+v; want canceled", j)
+	}
+	if trips, _ := stores.Trips.GetUserTrips(context.Background(), "alice"); len(trips) != 0 {
+		t.Fatalf("canceled job saved %d trips", len(trips))
+	}
+	if items, _ := stores.Trash.ListTrash(context.Background(), "alice"); len(items) != 0 {
+		t.Fatalf("canceled job left %d trips in the trash; want none saved at all", len(items))
+	}
+}
+
+func TestJobRunnerRecoveryDoesNotSaveTwice(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	u := mustCreateUser(t, ctx, b, "alice")
+	saved := testGeneratedPlan(&testJobRequest)
+	if err := SaveNewTrip(ctx, stores.Trips, saved, u); err != nil {
+		t.Fatalf("SaveNewTrip: %v", err)
+	}
+	reserved, err := stores.Trips.GenerateTripID(ctx)
+	if err != nil {
+		t.Fatalf("GenerateTripID: %v", err)
+	}
+	// 重启前执行中的任务：一个已保存行程但没有标记结束，一个只记入了行程ID
+	warnings := []ItineraryIssue{{Code: IssueOverBudget, Message: "over budget"}}
+	started := time.Now()
+	for id, tripID := range map[string]string{"saved": saved.ID, "reserved": reserved} {
+		err := stores.Jobs.CreateJob(ctx, &Job{ID: id, Type: JobTripPlan, UserID: u.ID, Username: "alice", Status: JobRunning,
+			Request: testJobRequest, TripID: tripID, Warnings: warnings, Attempts: 1, CreatedAt: started, StartedAt: &started})
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+	}
+
+	var calls int32
+	r := NewJobRunner(stores, 4)
+	r.generate = func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		atomic.AddInt32(&calls, 1)
+		return testGeneratedPlan(req), &ItineraryReport{}, nil
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	if err := r.Start(runCtx, 1); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if j := waitJob(t, stores, "saved", finished); j.Status != JobSucceeded || j.TripID != saved.ID || len(j.Warnings) != 1 {
+		t.Fatalf("recovered job = %+v; want succeeded with the saved trip and its warnings", j)
+	}
+	if j := waitJob(t, stores, "reserved", finished); j.Status != JobSucceeded || j.TripID != reserved || len(j.Warnings) != 0 {
+		t.Fatalf("recovered job = %+v; want succeeded with the reserved trip ID", j)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("generated %d times; want only the job without a saved trip", n)
+	}
+	if trips, _ := stores.Trips.GetUserTrips(ctx, "alice"); len(trips) != 2 {
+		t.Fatalf("alice has %d trips; want 2 without duplicates", len(trips))
+	}
+}
+
+func TestJobInfoHidesTripUntilSucceeded(t *testing.T) {
+	job := &Job{Status: JobRunning, TripID: "trip1", Warnings: []ItineraryIssue{{Code: IssueOverBudget}}}
+	if info := job.Info(); info.TripID != "" || info.Warnings != nil {
+		t.Fatalf("running job info = %+v; want no trip yet", info)
+	}
+	job.Status = JobSucceeded
+	if info := job.Info(); info.TripID != "trip1" || len(info.Warnings) != 1 {
+		t.Fatalf("succeeded job info = %+v; want the trip and warnings", info)
+	}
+}
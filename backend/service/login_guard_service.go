@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/travel_planner/backend/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// LoginAttempts 一个用户名或 IP 的连续登录失败记录
+type LoginAttempts struct {
+	Key         string    `json:"key"` // user:<用户名>、ip:<地址>，申请重置密码的记录为 reset:user:<用户名>、reset:ip:<地址>
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// LoginAttemptStore 登录失败计数存储
+type LoginAttemptStore interface {
+	// RecordLoginFailure 失败次数加一并记录时间，超过 ttl 没有新的失败时记录过期、计数从零开始；
+	// 返回更新后的记录
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (*LoginAttempts, error)
+	// GetLoginAttempts 获取记录，不存在或已过期时返回 nil, nil
+	GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	// ClearLoginAttempts 清除记录，不存在时不做任何操作
+	ClearLoginAttempts(ctx context.Context, key string) error
+	// ListLoginAttempts 列出全部未过期的记录
+	ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error)
+}
+
+// LoginPolicy 登录失败的退避策略：前 FreeAttempts 次失败不受限制，之后每次失败都会锁定，
+// 锁定时长从 BaseDelay 开始逐次翻倍，最长 MaxDelay；Window 内没有新的失败时计数清零，
+// 但记录至少保留到锁定结束
+type LoginPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+// 按用户名和按 IP 的退避策略，可通过配置修改。IP 的阈值更高，避免同一出口的多个用户互相影响
+var (
+	UserLoginPolicy = LoginPolicy{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, Window: time.Hour}
+	IPLoginPolicy   = LoginPolicy{FreeAttempts: 20, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, Window: time.Hour}
+)
+
+// 申请重置密码的频率限制，与登录失败共用计数存储和退避算法，但使用独立的键，
+// 避免他人反复申请重置导致账户无法登录。每次申请都计数，不论用户是否存在
+var (
+	UserResetPolicy = LoginPolicy{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	IPResetPolicy   = LoginPolicy{FreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+)
+
+// ConfigureLoginPolicies 按配置调整退避策略，为 0 的项保持默认值
+func ConfigureLoginPolicies(cfg config.LockoutConfig) {
+	for _, p := range []*LoginPolicy{&UserLoginPolicy, &IPLoginPolicy} {
+		if cfg.BaseDelaySeconds > 0 {
+			p.BaseDelay = time.Duration(cfg.BaseDelaySeconds) * time.Second
+		}
+		if cfg.MaxDelayMinutes > 0 {
+			p.MaxDelay = time.Duration(cfg.MaxDelayMinutes) * time.Minute
+		}
+		if cfg.ResetAfterMinutes > 0 {
+			p.Window = time.Duration(cfg.ResetAfterMinutes) * time.Minute
+		}
+	}
+	if cfg.UserAttempts > 0 {
+		UserLoginPolicy.FreeAttempts = cfg.UserAttempts
+	}
+	if cfg.IPAttempts > 0 {
+		IPLoginPolicy.FreeAttempts = cfg.IPAttempts
+	}
+}
+
+// lockedUntil 根据失败次数计算锁定截止时间，未锁定时返回零值
+func (p LoginPolicy) lockedUntil(a *LoginAttempts) time.Time {
+	if a == nil || a.Failures < p.FreeAttempts {
+		return time.Time{}
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < a.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return a.LastFailure.Add(delay)
+}
+
+// recordTTL 失败记录的保留时长。Window 比 MaxDelay 短时按 MaxDelay 保留，否则锁定会在到期前随记录一起消失
+func (p LoginPolicy) recordTTL() time.Duration {
+	if p.MaxDelay > p.Window {
+		return p.MaxDelay
+	}
+	return p.Window
+}
+
+// userLoginKey 按用户名的规范形式计数，大小写或全角写法不同的尝试共用同一个计数
+func userLoginKey(username string) string { return "user:" + NormalizeUsername(username) }
+func ipLoginKey(ip string) string         { return "ip:" + ip }
+
+const resetKeyPrefix = "reset:"
+
+// loginPolicyFor 按记录键的类型选择策略
+func loginPolicyFor(key string) LoginPolicy {
+	switch {
+	case strings.HasPrefix(key, resetKeyPrefix+"ip:"):
+		return IPResetPolicy
+	case strings.HasPrefix(key, resetKeyPrefix):
+		return UserResetPolicy
+	case strings.HasPrefix(key, "ip:"):
+		return IPLoginPolicy
+	}
+	return UserLoginPolicy
+}
+
+// loginGuardKeys 一次登录请求对应的全部记录键
+func loginGuardKeys(username, ip string) []string {
+	return []string{userLoginKey(username), ipLoginKey(ip)}
+}
+
+// resetGuardKeys 一次重置密码申请对应的全部记录键
+func resetGuardKeys(username, ip string) []string {
+	return []string{resetKeyPrefix + userLoginKey(username), resetKeyPrefix + ipLoginKey(ip)}
+}
+
+// CheckLoginAllowed 检查用户名和 IP 是否处于锁定期，返回还需等待的时间，未锁定时为 0
+func CheckLoginAllowed(ctx context.Context, store LoginAttemptStore, username, ip string) (time.Duration, error) {
+	return checkGuard(ctx, store, loginGuardKeys(username, ip))
+}
+
+// RecordLoginFailure 记录一次失败的登录，返回由此产生的锁定时长，未锁定时为 0
+func RecordLoginFailure(ctx context.Context, store LoginAttemptStore, username, ip string) (time.Duration, error) {
+	return recordGuard(ctx, store, loginGuardKeys(username, ip))
+}
+
+// CheckPasswordResetAllowed 检查用户名和 IP 申请重置密码是否过于频繁，返回还需等待的时间，未限制时为 0
+func CheckPasswordResetAllowed(ctx context.Context, store LoginAttemptStore, username, ip string) (time.Duration, error) {
+	return checkGuard(ctx, store, resetGuardKeys(username, ip))
+}
+
+// RecordPasswordResetRequest 记录一次重置密码申请，返回之后的申请需要等待的时间
+func RecordPasswordResetRequest(ctx context.Context, store LoginAttemptStore, username, ip string) (time.Duration, error) {
+	return recordGuard(ctx, store, resetGuardKeys(username, ip))
+}
+
+// RecordPasswordResetSuccess 重置密码成功后清除用户名的申请计数，IP 的计数保留
+func RecordPasswordResetSuccess(ctx context.Context, store LoginAttemptStore, username string) error {
+	return store.ClearLoginAttempts(ctx, resetKeyPrefix+userLoginKey(username))
+}
+
+// checkGuard 返回 keys 中最长的剩余锁定时间
+func checkGuard(ctx context.Context, store LoginAttemptStore, keys []string) (time.Duration, error) {
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		a, err := store.GetLoginAttempts(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if d := loginPolicyFor(key).lockedUntil(a).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordGuard 为 keys 各计数一次，返回由此产生的最长锁定时间
+func recordGuard(ctx context.Context, store LoginAttemptStore, keys []string) (time.Duration, error) {
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		policy := loginPolicyFor(key)
+		a, err := store.RecordLoginFailure(ctx, key, now, policy.recordTTL())
+		if err != nil {
+			return 0, err
+		}
+		if d := policy.lockedUntil(a).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// RecordLoginSuccess 登录成功后清除用户名的失败记录。IP 的记录保留，
+// 否则攻击者可以用自己的账户登录来重置所在 IP 的计数
+func RecordLoginSuccess(ctx context.Context, store LoginAttemptStore, username string) error {
+	return store.ClearLoginAttempts(ctx, userLoginKey(username))
+}
+
+// LoginLockout 供管理员查看的失败记录及锁定状态
+type LoginLockout struct {
+	LoginAttempts
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// ListLoginLockouts 列出全部失败记录，lockedOnly 为 true 时只返回仍在锁定期的记录
+func ListLoginLockouts(ctx context.Context, store LoginAttemptStore, lockedOnly bool) ([]*LoginLockout, error) {
+	records, err := store.ListLoginAttempts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := []*LoginLockout{}
+	for _, a := range records {
+		l := &LoginLockout{LoginAttempts: *a}
+		if until := loginPolicyFor(a.Key).lockedUntil(a); until.After(now) {
+			l.Locked, l.LockedUntil = true, &until
+		}
+		if l.Locked || !lockedOnly {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func loginAttemptsKey(key string) string { return "login_attempts:" + key }
+
+// RecordLoginFailure 以哈希保存计数和最后失败时间，每次失败后重新设置过期时间
+func (s *RedisStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (*LoginAttempts, error) {
+	rkey := loginAttemptsKey(key)
+	var failures *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		failures = pipe.HIncrBy(ctx, rkey, "failures", 1)
+		pipe.HSet(ctx, rkey, "last", at.UnixMilli())
+		pipe.PExpire(ctx, rkey, ttl)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &LoginAttempts{Key: key, Failures: int(failures.Val()), LastFailure: time.UnixMilli(at.UnixMilli())}, nil
+}
+
+// GetLoginAttempts 获取失败记录
+func (s *RedisStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	fields, err := s.rdb.HGetAll(ctx, loginAttemptsKey(key)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	failures, _ := strconv.Atoi(fields["failures"])
+	last, _ := strconv.ParseInt(fields["last"], 10, 64)
+	return &LoginAttempts{Key: key, Failures: failures, LastFailure: time.UnixMilli(last)}, nil
+}
+
+// ClearLoginAttempts 删除失败记录
+func (s *RedisStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	return s.rdb.Del(ctx, loginAttemptsKey(key)).Err()
+}
+
+// ListLoginAttempts 扫描全部失败记录，按键排序
+func (s *RedisStore) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	var out []*LoginAttempts
+	prefix := loginAttemptsKey("")
+	err := s.scanKeys(ctx, prefix+"*", func(rkey string) error {
+		a, err := s.GetLoginAttempts(ctx, strings.TrimPrefix(rkey, prefix))
+		if a != nil {
+			out = append(out, a)
+		}
+		return err
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, err
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/config"
+)
+
+// withLoginPolicies 测试期间替换退避策略，结束后恢复
+func withLoginPolicies(t *testing.T, user, ip LoginPolicy) {
+	t.Helper()
+	savedUser, savedIP := UserLoginPolicy, IPLoginPolicy
+	UserLoginPolicy, IPLoginPolicy = user, ip
+	t.Cleanup(func() { UserLoginPolicy, IPLoginPolicy = savedUser, savedIP })
+}
+
+func TestLoginPolicyLockedUntil(t *testing.T) {
+	p := LoginPolicy{FreeAttempts: 3, BaseDelay: 30 * time.Second, MaxDelay: 5 * time.Minute, Window: time.Hour}
+	last := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		failures int
+		delay    time.Duration // 0 表示未锁定
+	}{
+		{0, 0},
+		{2, 0},
+		{3, 30 * time.Second},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{6, 4 * time.Minute},
+		{7, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+	for _, tc := range cases {
+		got := p.lockedUntil(&LoginAttempts{Failures: tc.failures, LastFailure: last})
+		want := time.Time{}
+		if tc.delay > 0 {
+			want = last.Add(tc.delay)
+		}
+		if !got.Equal(want) {
+			t.Errorf("lockedUntil(%d failures) = %v; want %v", tc.failures, got, want)
+		}
+	}
+	if got := p.lockedUntil(nil); !got.IsZero() {
+		t.Errorf("lockedUntil(nil) = %v; want zero", got)
+	}
+}
+
+func TestLoginPolicyRecordOutlivesLockout(t *testing.T) {
+	withLoginPolicies(t, UserLoginPolicy, IPLoginPolicy)
+	ConfigureLoginPolicies(config.LockoutConfig{MaxDelayMinutes: 30, ResetAfterMinutes: 10})
+	for _, p := range []LoginPolicy{UserLoginPolicy, IPLoginPolicy} {
+		if p.Window != 10*time.Minute || p.MaxDelay != 30*time.Minute {
+			t.Fatalf("ConfigureLoginPolicies = %+v", p)
+		}
+		if ttl := p.recordTTL(); ttl != p.MaxDelay {
+			t.Fatalf("recordTTL = %v; want the max delay %v so the record outlives the lockout", ttl, p.MaxDelay)
+		}
+	}
+	if ttl := (LoginPolicy{MaxDelay: time.Minute, Window: time.Hour}).recordTTL(); ttl != time.Hour {
+		t.Fatalf("recordTTL = %v; want the window", ttl)
+	}
+
+	// 锁定到期前记录不能过期
+	s, m := newRedisTestStore(t)
+	ctx := context.Background()
+	var wait time.Duration
+	for i := 0; i < UserLoginPolicy.FreeAttempts+6; i++ {
+		var err error
+		if wait, err = RecordLoginFailure(ctx, s, "alice", "10.0.0.1"); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+	}
+	if wait <= UserLoginPolicy.Window {
+		t.Fatalf("lockout = %v; want longer than the %v window for this test", wait, UserLoginPolicy.Window)
+	}
+	m.FastForward(UserLoginPolicy.Window + time.Minute)
+	if a, _ := s.GetLoginAttempts(ctx, userLoginKey("alice")); a == nil {
+		t.Fatal("failure record expired before the lockout ended")
+	}
+	m.FastForward(UserLoginPolicy.MaxDelay)
+	if a, _ := s.GetLoginAttempts(ctx, userLoginKey("alice")); a != nil {
+		t.Fatal("failure record was kept after the lockout ended")
+	}
+}
+
+func TestLoginGuardKeys(t *testing.T) {
+	withLoginPolicies(t,
+		LoginPolicy{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour},
+		LoginPolicy{FreeAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour})
+	ctx := context.Background()
+	store := NewMemoryStore()
+	allowed := func(username, ip string) bool {
+		t.Helper()
+		wait, err := CheckLoginAllowed(ctx, store, username, ip)
+		if err != nil {
+			t.Fatalf("CheckLoginAllowed: %v", err)
+		}
+		return wait == 0
+	}
+	fail := func(username, ip string) time.Duration {
+		t.Helper()
+		wait, err := RecordLoginFailure(ctx, store, username, ip)
+		if err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		return wait
+	}
+
+	// 按用户名：从不同 IP 失败也会累计，锁定对所有 IP 生效；大小写和全角写法不同的用户名共用计数
+	for i, attempt := range []struct{ username, ip string }{{"alice", "10.0.0.1"}, {"Alice", "10.0.0.2"}} {
+		if wait := fail(attempt.username, attempt.ip); wait != 0 {
+			t.Fatalf("failure %d locked alice for %v", i+1, wait)
+		}
+	}
+	if wait := fail("ＡＬＩＣＥ", "10.0.0.3"); wait <= 0 || wait > time.Minute {
+		t.Fatalf("third failure locked alice for %v; want about a minute", wait)
+	}
+	if allowed("alice", "10.0.0.9") || allowed("ALICE", "10.0.0.9") {
+		t.Fatal("alice can log in from a new IP while locked")
+	}
+	if !allowed("bob", "10.0.0.1") {
+		t.Fatal("locking alice also locked bob")
+	}
+
+	// 按 IP：不同用户名的失败累计到同一 IP
+	for i, name := range []string{"u1", "u2", "u3", "u4"} {
+		if wait := fail(name, "10.0.1.1"); wait != 0 {
+			t.Fatalf("failure %d locked the IP for %v", i+1, wait)
+		}
+	}
+	if wait := fail("u5", "10.0.1.1"); wait <= 0 {
+		t.Fatal("fifth failure from one IP did not lock it")
+	}
+	if allowed("carol", "10.0.1.1") {
+		t.Fatal("a locked IP can still log in as another user")
+	}
+	if !allowed("carol", "10.0.1.2") {
+		t.Fatal("locking an IP also locked other IPs")
+	}
+
+	// 登录成功清除用户名的计数，IP 的计数保留
+	if err := RecordLoginSuccess(ctx, store, "u1"); err != nil {
+		t.Fatalf("RecordLoginSuccess: %v", err)
+	}
+	if a, _ := store.GetLoginAttempts(ctx, userLoginKey("u1")); a != nil {
+		t.Fatalf("user record after success = %+v; want cleared", a)
+	}
+	if a, _ := store.GetLoginAttempts(ctx, ipLoginKey("10.0.1.1")); a == nil || a.Failures != 5 {
+		t.Fatalf("IP record after success = %+v; want 5 failures kept", a)
+	}
+}
@@ -0,0 +1,1534 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryStore 基于进程内存的存储实现，进程退出后数据丢失，适用于开发和测试
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	users      map[string]*UserRecord
+	nextUserID int
+
+	trips         map[string]*TripPlan
+	userTrips     map[string]map[string]struct{}
+	nextTripID    int
+	favorites     map[string][]Favorite
+	favoriteTrips map[string]map[string]struct{}
+	revisions     map[string][]*tripRevisionRecord
+
+	expenses      map[string][]*ExpenseRecord
+	nextExpenseID int
+
+	diaries     map[int64]map[int64]*DiaryEntry
+	lastDiaryID int64
+
+	trash map[string]map[string]*TrashItem
+
+	search map[SearchScope]*memorySearchIndex
+
+	sessions       map[string]*Session
+	passwordResets map[string]*PasswordReset
+	loginAttempts  map[string]*memoryLoginAttempts
+	accessTokens   map[string]*AccessToken
+	oidcLogins     map[string]*OIDCLogin
+	identities     map[string]*ExternalIdentity // issuer + "\x00" + subject
+	twoFactor      map[string]*TwoFactor        // 按用户名
+	challenges     map[string]*LoginChallenge
+	jobs           map[string]*Job
+}
+
+// NewMemoryStore 创建内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:          make(map[string]*UserRecord),
+		trips:          make(map[string]*TripPlan),
+		userTrips:      make(map[string]map[string]struct{}),
+		favorites:      make(map[string][]Favorite),
+		favoriteTrips:  make(map[string]map[string]struct{}),
+		revisions:      make(map[string][]*tripRevisionRecord),
+		expenses:       make(map[string][]*ExpenseRecord),
+		diaries:        make(map[int64]map[int64]*DiaryEntry),
+		trash:          make(map[string]map[string]*TrashItem),
+		search:         make(map[SearchScope]*memorySearchIndex),
+		sessions:       make(map[string]*Session),
+		passwordResets: make(map[string]*PasswordReset),
+		loginAttempts:  make(map[string]*memoryLoginAttempts),
+		accessTokens:   make(map[string]*AccessToken),
+		oidcLogins:     make(map[string]*OIDCLogin),
+		identities:     make(map[string]*ExternalIdentity),
+		twoFactor:      make(map[string]*TwoFactor),
+		challenges:     make(map[string]*LoginChallenge),
+		jobs:           make(map[string]*Job),
+	}
+}
+
+// cloneTrip 通过 JSON 往返深拷贝行程，与 Redis 存储的序列化行为保持一致
+func cloneTrip(plan *TripPlan) (*TripPlan, error) {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	var out TripPlan
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func cloneDiary(d *DiaryEntry) DiaryEntry {
+	out := *d
+	if d.Images != nil {
+		out.Images = append([]string(nil), d.Images...)
+	}
+	return out
+}
+
+// sortedMembers 返回集合中的成员（按字典序，保证结果稳定）
+func sortedMembers(set map[string]struct{}) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// GetUser 获取用户
+func (s *MemoryStore) GetUser(ctx context.Context, username string) (*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, nil
+	}
+	cp := *u
+	return &cp, nil
+}
+
+// CreateUser 创建新用户
+func (s *MemoryStore) CreateUser(ctx context.Context, username, password string) (*UserRecord, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return nil, ErrUserExists
+	}
+	s.nextUserID++
+	u := &UserRecord{
+		ID:            s.nextUserID,
+		Username:      username,
+		PasswordHash:  string(hash),
+		Role:          RoleUser,
+		SchemaVersion: CurrentSchemaVersion(KindUser),
+	}
+	s.users[username] = u
+	cp := *u
+	return &cp, nil
+}
+
+// SetPassword 更新用户的密码哈希
+func (s *MemoryStore) SetPassword(ctx context.Context, username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// UpdateUser 修改用户记录，fn 返回错误时不做修改
+func (s *MemoryStore) UpdateUser(ctx context.Context, username string, fn func(u *UserRecord) error) (*UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	cp := *u
+	if err := fn(&cp); err != nil {
+		return nil, err
+	}
+	cp.Username, cp.ID = u.Username, u.ID
+	*u = cp
+	return &cp, nil
+}
+
+// ListUsers 列出全部用户，按ID排序
+func (s *MemoryStore) ListUsers(ctx context.Context) ([]*UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*UserRecord, 0, len(s.users))
+	for _, u := range s.users {
+		cp := *u
+		users = append(users, &cp)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// DeleteUser 删除用户及其全部数据，内存中可以直接按所属用户遍历全部记录
+func (s *MemoryStore) DeleteUser(ctx context.Context, username string) (*AccountDeletionReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	report := newAccountDeletionReport(user)
+	userID := int64(user.ID)
+
+	tripIDs := make(map[string]bool)
+	for id, plan := range s.trips {
+		if plan.Username == username {
+			tripIDs[id] = true
+			delete(s.trips, id)
+			report.Removed[DeletedTrips]++
+		}
+	}
+	for _, item := range s.trash[username] {
+		if item.Kind == TrashTrip {
+			tripIDs[item.ID] = true
+		}
+	}
+	for id := range tripIDs {
+		report.Removed[DeletedTripRevisions] += len(s.revisions[id])
+		delete(s.revisions, id)
+	}
+	for other, set := range s.favoriteTrips {
+		for id := range set {
+			if tripIDs[id] && other != username {
+				delete(set, id)
+				report.Removed[DeletedFavoritedByOthers]++
+			}
+		}
+	}
+	for _, scope := range userSearchScopes(user) {
+		if idx := s.search[scope]; idx != nil {
+			report.Removed[DeletedSearchIndex] += len(idx.docs)
+		}
+		delete(s.search, scope)
+	}
+
+	for id, sess := range s.sessions {
+		if sess.Username == username {
+			delete(s.sessions, id)
+			report.Removed[DeletedSessions]++
+		}
+	}
+	for hash, reset := range s.passwordResets {
+		if reset.Username == username {
+			delete(s.passwordResets, hash)
+		}
+	}
+	delete(s.loginAttempts, userLoginKey(username))
+	for id, t := range s.accessTokens {
+		if t.Username == username {
+			delete(s.accessTokens, id)
+			report.Removed[DeletedAccessTokens]++
+		}
+	}
+	for key, identity := range s.identities {
+		if identity.Username == username {
+			delete(s.identities, key)
+			report.Removed[DeletedIdentities]++
+		}
+	}
+	if _, ok := s.twoFactor[username]; ok {
+		delete(s.twoFactor, username)
+		report.Removed[DeletedTwoFactor]++
+	}
+	for hash, ch := range s.challenges {
+		if ch.Username == username {
+			delete(s.challenges, hash)
+		}
+	}
+	for id, job := range s.jobs {
+		if job.Username == username {
+			delete(s.jobs, id)
+			report.Removed[DeletedJobs]++
+		}
+	}
+
+	report.Removed[DeletedUser] = 1
+	report.Removed[DeletedFavoriteTrips] = len(s.favoriteTrips[username])
+	report.Removed[DeletedFavorites] = len(s.favorites[username])
+	report.Removed[DeletedExpenses] = len(s.expenses[username])
+	report.Removed[DeletedDiaries] = len(s.diaries[userID])
+	report.Removed[DeletedTrash] = len(s.trash[username])
+	delete(s.users, username)
+	delete(s.userTrips, username)
+	delete(s.favoriteTrips, username)
+	delete(s.favorites, username)
+	delete(s.expenses, username)
+	delete(s.diaries, userID)
+	delete(s.trash, username)
+
+	var remaining []string
+	for id, plan := range s.trips {
+		if plan.Username == username {
+			remaining = append(remaining, "trip:"+id)
+		}
+	}
+	report.verified(remaining)
+	return report, nil
+}
+
+// SaveTripPlan 保存行程计划
+func (s *MemoryStore) SaveTripPlan(ctx context.Context, plan *TripPlan, rev TripRevisionInfo) error {
+	plan.UpdatedAt = time.Now()
+	if plan.CreatedAt.IsZero() {
+		plan.CreatedAt = plan.UpdatedAt
+	}
+	plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := len(s.revisions[plan.ID])
+	if rev.ExpectedRevision > 0 {
+		if _, exists := s.trips[plan.ID]; !exists || current != rev.ExpectedRevision {
+			return ErrConcurrentUpdate
+		}
+	}
+	plan.Revision = current + 1
+	cp, err := cloneTrip(plan)
+	if err != nil {
+		return err
+	}
+	rec, err := newRevisionRecord(plan, rev)
+	if err != nil {
+		return err
+	}
+	s.trips[plan.ID] = cp
+	s.revisions[plan.ID] = append(s.revisions[plan.ID], rec)
+	if s.userTrips[plan.Username] == nil {
+		s.userTrips[plan.Username] = make(map[string]struct{})
+	}
+	s.userTrips[plan.Username][plan.ID] = struct{}{}
+	s.indexSearchDoc(tripSearchScope(plan.Username), tripSearchRecord(cp).document())
+	return nil
+}
+
+// GetTripPlan 获取行程计划
+func (s *MemoryStore) GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	plan, ok := s.trips[tripID]
+	if !ok {
+		return nil, nil
+	}
+	return cloneTrip(plan)
+}
+
+// ListTripRevisions 列出行程的全部版本
+func (s *MemoryStore) ListTripRevisions(ctx context.Context, tripID string) ([]*TripRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recs := s.revisions[tripID]
+	revs := make([]*TripRevision, 0, len(recs))
+	for i := len(recs) - 1; i >= 0; i-- {
+		rev, _ := recs[i].revision(tripID, i+1, false)
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+// GetTripRevision 获取行程的指定版本
+func (s *MemoryStore) GetTripRevision(ctx context.Context, tripID string, number int) (*TripRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	recs := s.revisions[tripID]
+	if number <= 0 || number > len(recs) {
+		return nil, ErrRevisionNotFound
+	}
+	return recs[number-1].revision(tripID, number, true)
+}
+
+// dropOrphanRevisions 行程已被永久删除时清除其版本历史，调用方需持有写锁
+func (s *MemoryStore) dropOrphanRevisions(kind TrashKind, id string) {
+	if _, exists := s.trips[id]; kind == TrashTrip && !exists {
+		delete(s.revisions, id)
+	}
+}
+
+// tripsByIDs 按 ID 列表获取行程，跳过不存在的 ID，调用方需持有读锁
+func (s *MemoryStore) tripsByIDs(ids []string) []*TripPlan {
+	trips := make([]*TripPlan, 0, len(ids))
+	for _, id := range ids {
+		plan, ok := s.trips[id]
+		if !ok {
+			continue
+		}
+		cp, err := cloneTrip(plan)
+		if err != nil {
+			continue
+		}
+		trips = append(trips, cp)
+	}
+	return trips
+}
+
+// GetUserTrips 获取用户的所有行程
+func (s *MemoryStore) GetUserTrips(ctx context.Context, username string) ([]*TripPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tripsByIDs(sortedMembers(s.userTrips[username])), nil
+}
+
+// ListUserTrips 按条件分页查询用户行程
+func (s *MemoryStore) ListUserTrips(ctx context.Context, username string, q TripQuery) (*TripPage, error) {
+	cur, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	type scored struct {
+		plan  *TripPlan
+		score float64
+	}
+	candidates := make([]scored, 0, len(s.userTrips[username]))
+	for id := range s.userTrips[username] {
+		plan, ok := s.trips[id]
+		if !ok || !q.matches(plan) {
+			continue
+		}
+		score := tripSortScore(plan, q.SortBy)
+		if cur.afterCursor(score, plan.ID) {
+			candidates = append(candidates, scored{plan, score})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.score != b.score {
+			return (a.score < b.score) != q.Desc
+		}
+		return (a.plan.ID < b.plan.ID) != q.Desc
+	})
+
+	pager := &tripPager{q: &q}
+	for _, c := range candidates {
+		cp, err := cloneTrip(c.plan)
+		if err != nil {
+			return nil, err
+		}
+		if pager.add(cp, c.score) {
+			break
+		}
+	}
+	return pager.page(), nil
+}
+
+// DeleteTripPlan 将行程移入回收站
+func (s *MemoryStore) DeleteTripPlan(ctx context.Context, tripID, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan, ok := s.trips[tripID]
+	if !ok || plan.Username != username {
+		return nil
+	}
+	item, err := tripTrashItem(plan)
+	if err != nil {
+		return err
+	}
+	s.putTrash(username, item)
+	delete(s.userTrips[username], tripID)
+	delete(s.trips, tripID)
+	s.indexSearchDoc(tripSearchScope(username), SearchDocument{ID: tripID})
+	return nil
+}
+
+// GenerateTripID 生成唯一行程ID
+func (s *MemoryStore) GenerateTripID(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextTripID++
+	return fmt.Sprintf("trip_%d_%d", s.nextTripID, time.Now().Unix()), nil
+}
+
+// GetUserFavorites 获取用户的收藏夹
+func (s *MemoryStore) GetUserFavorites(ctx context.Context, username string) ([]Favorite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Favorite{}, s.favorites[username]...), nil
+}
+
+// AddFavorite 添加收藏
+func (s *MemoryStore) AddFavorite(ctx context.Context, username string, favorite Favorite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.favorites[username] {
+		if f.ID == favorite.ID {
+			return ErrFavoriteExists
+		}
+	}
+	s.favorites[username] = append(s.favorites[username], favorite)
+	return nil
+}
+
+// ReplaceFavorite 原地覆盖收藏，不存在时添加
+func (s *MemoryStore) ReplaceFavorite(ctx context.Context, username string, favorite Favorite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.favorites[username] {
+		if f.ID == favorite.ID {
+			s.favorites[username][i] = favorite
+			return nil
+		}
+	}
+	s.favorites[username] = append(s.favorites[username], favorite)
+	return nil
+}
+
+// RemoveFavorite 将收藏移入回收站
+func (s *MemoryStore) RemoveFavorite(ctx context.Context, username, favoriteID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	favorites := s.favorites[username]
+	kept := make([]Favorite, 0, len(favorites))
+	for i, f := range favorites {
+		if f.ID != favoriteID {
+			kept = append(kept, f)
+			continue
+		}
+		item, err := favoriteTrashItem(&favorites[i])
+		if err != nil {
+			return err
+		}
+		s.putTrash(username, item)
+	}
+	s.favorites[username] = kept
+	return nil
+}
+
+// GetUserFavoriteTrips 获取用户收藏的行程列表
+func (s *MemoryStore) GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tripsByIDs(sortedMembers(s.favoriteTrips[username])), nil
+}
+
+// AddFavoriteTrip 添加行程到收藏
+func (s *MemoryStore) AddFavoriteTrip(ctx context.Context, username, tripID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.trips[tripID]; !ok {
+		return ErrTripNotFound
+	}
+	if s.favoriteTrips[username] == nil {
+		s.favoriteTrips[username] = make(map[string]struct{})
+	}
+	s.favoriteTrips[username][tripID] = struct{}{}
+	return nil
+}
+
+// RemoveFavoriteTrip 从收藏中移除行程
+func (s *MemoryStore) RemoveFavoriteTrip(ctx context.Context, username, tripID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.favoriteTrips[username], tripID)
+	return nil
+}
+
+// IsTripFavorited 检查行程是否已收藏
+func (s *MemoryStore) IsTripFavorited(ctx context.Context, username, tripID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.favoriteTrips[username][tripID]
+	return ok, nil
+}
+
+// SaveExpense 将单条记录追加到用户的 expense 列表
+func (s *MemoryStore) SaveExpense(ctx context.Context, username string, rec *ExpenseRecord) error {
+	rec.SchemaVersion = CurrentSchemaVersion(KindExpense)
+	cp := *rec
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expenses[username] = append(s.expenses[username], &cp)
+	s.indexSearchDoc(expenseSearchScope(username), expenseSearchRecord(&cp).document())
+	return nil
+}
+
+// GetExpenses 返回用户的所有 expense 记录
+func (s *MemoryStore) GetExpenses(ctx context.Context, username string) ([]*ExpenseRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := s.expenses[username]
+	res := make([]*ExpenseRecord, 0, len(list))
+	for _, e := range list {
+		cp := *e
+		res = append(res, &cp)
+	}
+	return res, nil
+}
+
+// GenerateExpenseID 生成唯一 expense ID
+func (s *MemoryStore) GenerateExpenseID(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextExpenseID++
+	return fmt.Sprintf("exp_%d_%d", s.nextExpenseID, time.Now().Unix()), nil
+}
+
+// CreateDiary 创建日记
+func (s *MemoryStore) CreateDiary(ctx context.Context, diary *DiaryEntry) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 与 Redis 实现一样使用毫秒时间戳作为ID，同一毫秒内递增避免冲突
+	id := time.Now().UnixNano() / 1e6
+	if id <= s.lastDiaryID {
+		id = s.lastDiaryID + 1
+	}
+	s.lastDiaryID = id
+	diary.ID = id
+	diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
+
+	if s.diaries[diary.UserID] == nil {
+		s.diaries[diary.UserID] = make(map[int64]*DiaryEntry)
+	}
+	cp := cloneDiary(diary)
+	s.diaries[diary.UserID][id] = &cp
+	s.indexSearchDoc(diarySearchScope(diary.UserID), diarySearchRecord(&cp).document())
+	return id, nil
+}
+
+// GetUserDiaries 获取用户的所有日记
+func (s *MemoryStore) GetUserDiaries(ctx context.Context, userID int64) ([]DiaryEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var diaries []DiaryEntry
+	for _, d := range s.diaries[userID] {
+		diaries = append(diaries, cloneDiary(d))
+	}
+	sort.Slice(diaries, func(i, j int) bool { return diaries[i].ID > diaries[j].ID })
+	return diaries, nil
+}
+
+// lookupDiary 解析日记ID并查找日记，调用方需持有锁
+func (s *MemoryStore) lookupDiary(idStr string, userID int64) (*DiaryEntry, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, ErrDiaryNotFound
+	}
+	d, ok := s.diaries[userID][id]
+	if !ok {
+		return nil, ErrDiaryNotFound
+	}
+	return d, nil
+}
+
+// GetDiary 获取单条日记
+func (s *MemoryStore) GetDiary(ctx context.Context, idStr string, userID int64) (*DiaryEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, err := s.lookupDiary(idStr, userID)
+	if err != nil {
+		return nil, err
+	}
+	cp := cloneDiary(d)
+	return &cp, nil
+}
+
+// UpdateDiary 更新日记
+func (s *MemoryStore) UpdateDiary(ctx context.Context, idStr string, userID int64, updated *DiaryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.lookupDiary(idStr, userID)
+	if err != nil {
+		return err
+	}
+	applyDiaryUpdate(d, updated)
+	if updated.Images != nil {
+		d.Images = append([]string(nil), updated.Images...)
+	}
+	s.indexSearchDoc(diarySearchScope(userID), diarySearchRecord(d).document())
+	return nil
+}
+
+// DeleteDiary 将日记移入回收站
+func (s *MemoryStore) DeleteDiary(ctx context.Context, idStr string, userID int64, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil
+	}
+	diary, ok := s.diaries[userID][id]
+	if !ok {
+		return nil
+	}
+	item, err := diaryTrashItem(diary)
+	if err != nil {
+		return err
+	}
+	s.putTrash(username, item)
+	delete(s.diaries[userID], id)
+	s.indexSearchDoc(diarySearchScope(userID), SearchDocument{ID: idStr})
+	return nil
+}
+
+// putTrash 写入回收站条目，调用方需持有写锁
+func (s *MemoryStore) putTrash(username string, item *TrashItem) {
+	if s.trash[username] == nil {
+		s.trash[username] = make(map[string]*TrashItem)
+	}
+	s.trash[username][trashField(item.Kind, item.ID)] = item
+}
+
+// ListTrash 列出用户回收站中的条目
+func (s *MemoryStore) ListTrash(ctx context.Context, username string) ([]*TrashItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]*TrashItem, 0, len(s.trash[username]))
+	for _, item := range s.trash[username] {
+		cp := *item
+		items = append(items, cp.withExpiry())
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// RestoreTrash 恢复回收站条目
+func (s *MemoryStore) RestoreTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	field := trashField(kind, id)
+	item, ok := s.trash[username][field]
+	if !ok {
+		return ErrTrashItemNotFound
+	}
+
+	switch kind {
+	case TrashTrip:
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, item.Record, &plan); err != nil {
+			return err
+		}
+		if _, exists := s.trips[plan.ID]; exists {
+			return ErrRestoreConflict
+		}
+		plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+		s.trips[plan.ID] = &plan
+		if s.userTrips[username] == nil {
+			s.userTrips[username] = make(map[string]struct{})
+		}
+		s.userTrips[username][plan.ID] = struct{}{}
+		s.indexSearchDoc(tripSearchScope(username), tripSearchRecord(&plan).document())
+
+	case TrashDiary:
+		var diary DiaryEntry
+		if _, _, err := decodeRecord(KindDiary, item.Record, &diary); err != nil {
+			return err
+		}
+		if _, exists := s.diaries[diary.UserID][diary.ID]; exists {
+			return ErrRestoreConflict
+		}
+		diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
+		if s.diaries[diary.UserID] == nil {
+			s.diaries[diary.UserID] = make(map[int64]*DiaryEntry)
+		}
+		s.diaries[diary.UserID][diary.ID] = &diary
+		s.indexSearchDoc(diarySearchScope(diary.UserID), diarySearchRecord(&diary).document())
+
+	case TrashFavorite:
+		var f Favorite
+		if err := json.Unmarshal(item.Record, &f); err != nil {
+			return err
+		}
+		for _, existing := range s.favorites[username] {
+			if existing.ID == f.ID {
+				return ErrRestoreConflict
+			}
+		}
+		s.favorites[username] = append(s.favorites[username], f)
+
+	default:
+		return fmt.Errorf("unknown trash kind %q", kind)
+	}
+	delete(s.trash[username], field)
+	return nil
+}
+
+// PurgeTrash 永久删除回收站条目
+func (s *MemoryStore) PurgeTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	field := trashField(kind, id)
+	if _, ok := s.trash[username][field]; !ok {
+		return ErrTrashItemNotFound
+	}
+	delete(s.trash[username], field)
+	s.dropOrphanRevisions(kind, id)
+	return nil
+}
+
+// PurgeExpiredTrash 永久删除过期的回收站条目
+func (s *MemoryStore) PurgeExpiredTrash(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for _, items := range s.trash {
+		for field, item := range items {
+			if item.DeletedAt.Before(before) {
+				delete(items, field)
+				s.dropOrphanRevisions(item.Kind, item.ID)
+				purged++
+			}
+		}
+	}
+	return purged, nil
+}
+
+// MigrateRecords 内存中的记录总是以当前版本写入，只统计记录数
+func (s *MemoryStore) MigrateRecords(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report := newMigrationReport("memory", dryRun)
+	count := func(kind RecordKind, n int) {
+		kr := report.Kinds[kind]
+		kr.Scanned += n
+		kr.Current += n
+	}
+	count(KindUser, len(s.users))
+	count(KindTrip, len(s.trips))
+	for _, list := range s.expenses {
+		count(KindExpense, len(list))
+	}
+	for _, m := range s.diaries {
+		count(KindDiary, len(m))
+	}
+	return report, nil
+}
+
+// CheckIntegrity 检查内存中记录与索引的一致性
+func (s *MemoryStore) CheckIntegrity(ctx context.Context, repair bool) (*IntegrityReport, error) {
+	start := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := newIntegrityReport("memory", repair)
+	report.Scanned["users"] = len(s.users)
+	report.Scanned["trips"] = len(s.trips)
+
+	userIDs := make(map[int64]bool, len(s.users))
+	for _, u := range s.users {
+		userIDs[int64(u.ID)] = true
+	}
+	trashed := make(map[string]bool)
+	for _, items := range s.trash {
+		for _, item := range items {
+			if item.Kind == TrashTrip {
+				trashed[item.ID] = true
+			}
+		}
+	}
+	userExists := func(username string) bool {
+		_, ok := s.users[username]
+		return ok
+	}
+
+	for id, plan := range s.trips {
+		id, username := id, plan.Username
+		if !userExists(username) {
+			report.add(IssueOrphan, "trips", id, fmt.Sprintf("owner %q does not exist", username), "delete trip", func() (bool, error) {
+				delete(s.trips, id)
+				return true, nil
+			})
+			continue
+		}
+		if _, ok := s.userTrips[username][id]; !ok {
+			report.add(IssueOrphan, "trips", id, "missing from trips of "+username, "reindex", func() (bool, error) {
+				if s.userTrips[username] == nil {
+					s.userTrips[username] = make(map[string]struct{})
+				}
+				s.userTrips[username][id] = struct{}{}
+				return true, nil
+			})
+		}
+	}
+
+	// 按用户名索引的用户数据，所属用户不存在时整体删除
+	for username := range s.userTrips {
+		if !userExists(username) {
+			username := username
+			report.add(IssueOrphan, "user trips", username, "owner does not exist", "delete", func() (bool, error) {
+				delete(s.userTrips, username)
+				return true, nil
+			})
+		}
+	}
+	for username := range s.favoriteTrips {
+		if !userExists(username) {
+			username := username
+			report.add(IssueOrphan, "favorite trips", username, "owner does not exist", "delete", func() (bool, error) {
+				delete(s.favoriteTrips, username)
+				return true, nil
+			})
+		}
+	}
+	for username := range s.favorites {
+		if !userExists(username) {
+			username := username
+			report.add(IssueOrphan, "favorites", username, "owner does not exist", "delete", func() (bool, error) {
+				delete(s.favorites, username)
+				return true, nil
+			})
+		}
+	}
+	for username := range s.expenses {
+		if !userExists(username) {
+			username := username
+			report.add(IssueOrphan, "expenses", username, "owner does not exist", "delete", func() (bool, error) {
+				delete(s.expenses, username)
+				return true, nil
+			})
+		}
+	}
+	for userID, diaries := range s.diaries {
+		report.Scanned["diaries"] += len(diaries)
+		if !userIDs[userID] {
+			userID := userID
+			report.add(IssueOrphan, "diaries", strconv.FormatInt(userID, 10), "owner does not exist", "delete", func() (bool, error) {
+				delete(s.diaries, userID)
+				return true, nil
+			})
+		}
+	}
+
+	for username, set := range s.userTrips {
+		for id := range set {
+			report.Scanned["trip index entries"]++
+			if plan, ok := s.trips[id]; ok && plan.Username == username {
+				continue
+			}
+			set, id := set, id
+			report.add(IssueDangling, "trips of "+username, id, "trip does not exist or belongs to another user", "remove", func() (bool, error) {
+				delete(set, id)
+				return true, nil
+			})
+		}
+	}
+	for username, set := range s.favoriteTrips {
+		for id := range set {
+			report.Scanned["favorite trips"]++
+			if _, ok := s.trips[id]; ok || trashed[id] {
+				continue
+			}
+			set, id := set, id
+			report.add(IssueDangling, "favorite trips of "+username, id, "trip does not exist", "remove", func() (bool, error) {
+				delete(set, id)
+				return true, nil
+			})
+		}
+	}
+	for id := range s.revisions {
+		report.Scanned["trip revisions"]++
+		if _, ok := s.trips[id]; ok || trashed[id] {
+			continue
+		}
+		id := id
+		report.add(IssueOrphan, "trip revisions", id, "trip does not exist", "delete revisions", func() (bool, error) {
+			delete(s.revisions, id)
+			return true, nil
+		})
+	}
+
+	// map 遍历顺序不固定，按位置排序使报告稳定
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		return a.Where < b.Where || (a.Where == b.Where && a.Ref < b.Ref)
+	})
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// memorySearchIndex 一个范围的索引，按文档保存词项，查询时遍历文档。
+// 内存存储从空数据开始，每次写入都会更新索引，因此索引总是已建立
+type memorySearchIndex struct {
+	docs map[string]map[string]float64
+}
+
+// indexSearchDoc 更新文档的词项，Terms 为空时移除文档，调用方需持有写锁
+func (s *MemoryStore) indexSearchDoc(scope SearchScope, doc SearchDocument) {
+	idx := s.search[scope]
+	if idx == nil {
+		idx = &memorySearchIndex{docs: make(map[string]map[string]float64)}
+		s.search[scope] = idx
+	}
+	if len(doc.Terms) == 0 {
+		delete(idx.docs, doc.ID)
+		return
+	}
+	idx.docs[doc.ID] = doc.Terms
+}
+
+// SearchPostings 读取范围内指定词项的倒排列表
+func (s *MemoryStore) SearchPostings(ctx context.Context, scope SearchScope, terms []string) (*SearchPostings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	post := &SearchPostings{Built: true, Postings: make(map[string]map[string]float64, len(terms))}
+	for _, term := range terms {
+		post.Postings[term] = make(map[string]float64)
+	}
+	idx := s.search[scope]
+	if idx == nil {
+		return post, nil
+	}
+	post.Docs = len(idx.docs)
+	for id, docTerms := range idx.docs {
+		for _, term := range terms {
+			if w, ok := docTerms[term]; ok {
+				post.Postings[term][id] = w
+			}
+		}
+	}
+	return post, nil
+}
+
+// ReplaceSearchIndex 整体替换范围内的索引
+func (s *MemoryStore) ReplaceSearchIndex(ctx context.Context, scope SearchScope, docs []SearchDocument) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.search[scope] = &memorySearchIndex{docs: make(map[string]map[string]float64, len(docs))}
+	for _, doc := range docs {
+		s.indexSearchDoc(scope, doc)
+	}
+	return nil
+}
+
+// CreateSession 保存会话，同时清理已过期的会话
+func (s *MemoryStore) CreateSession(ctx context.Context, sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, existing := range s.sessions {
+		if !existing.ExpiresAt.After(now) {
+			delete(s.sessions, id)
+		}
+	}
+	cp := *sess
+	s.sessions[sess.ID] = &cp
+	return nil
+}
+
+// GetSession 获取未过期的会话
+func (s *MemoryStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[id]
+	if !ok || !sess.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := *sess
+	return &cp, nil
+}
+
+// RotateSession 比较 refresh token 摘要后更新会话
+func (s *MemoryStore) RotateSession(ctx context.Context, sess *Session, oldHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.sessions[sess.ID]
+	if !ok || !current.ExpiresAt.After(time.Now()) || current.TokenHash != oldHash {
+		return ErrInvalidRefreshToken
+	}
+	cp := *sess
+	s.sessions[sess.ID] = &cp
+	return nil
+}
+
+// DeleteSession 删除会话
+func (s *MemoryStore) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// DeleteUserSessions 删除用户的全部会话
+func (s *MemoryStore) DeleteUserSessions(ctx context.Context, username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for id, sess := range s.sessions {
+		if sess.Username == username {
+			if sess.ExpiresAt.After(now) {
+				n++
+			}
+			delete(s.sessions, id)
+		}
+	}
+	return n, nil
+}
+
+// ListUserSessions 列出用户未过期的会话
+func (s *MemoryStore) ListUserSessions(ctx context.Context, username string) ([]*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	sessions := []*Session{}
+	for _, sess := range s.sessions {
+		if sess.Username == username && sess.ExpiresAt.After(now) {
+			cp := *sess
+			sessions = append(sessions, &cp)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// TouchSession 更新会话的最近使用时间和 IP
+func (s *MemoryStore) TouchSession(ctx context.Context, id string, at time.Time, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		sess.LastSeenAt = at
+		sess.IP = ip
+	}
+	return nil
+}
+
+// CreatePasswordReset 保存重置令牌，删除该用户之前的令牌
+func (s *MemoryStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, existing := range s.passwordResets {
+		if existing.Username == reset.Username {
+			delete(s.passwordResets, hash)
+		}
+	}
+	cp := *reset
+	s.passwordResets[reset.TokenHash] = &cp
+	return nil
+}
+
+// GetPasswordReset 读取未过期的令牌
+func (s *MemoryStore) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reset, ok := s.passwordResets[tokenHash]
+	if !ok || !reset.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := *reset
+	return &cp, nil
+}
+
+// ConsumePasswordReset 取出并删除未过期的令牌
+func (s *MemoryStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset, ok := s.passwordResets[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.passwordResets, tokenHash)
+	if !reset.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := *reset
+	return &cp, nil
+}
+
+// memoryLoginAttempts 带过期时间的登录失败记录
+type memoryLoginAttempts struct {
+	LoginAttempts
+	expiresAt time.Time
+}
+
+// RecordLoginFailure 失败次数加一，已过期的记录从零开始
+func (s *MemoryStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.loginAttempts[key]
+	if !ok || !a.expiresAt.After(at) {
+		a = &memoryLoginAttempts{LoginAttempts: LoginAttempts{Key: key}}
+		s.loginAttempts[key] = a
+	}
+	a.Failures++
+	a.LastFailure = at
+	a.expiresAt = at.Add(ttl)
+	cp := a.LoginAttempts
+	return &cp, nil
+}
+
+// GetLoginAttempts 获取未过期的失败记录
+func (s *MemoryStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.loginAttempts[key]
+	if !ok || !a.expiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := a.LoginAttempts
+	return &cp, nil
+}
+
+// ClearLoginAttempts 删除失败记录
+func (s *MemoryStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginAttempts, key)
+	return nil
+}
+
+// ListLoginAttempts 列出未过期的失败记录，同时清理已过期的记录
+func (s *MemoryStore) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	keys := make([]string, 0, len(s.loginAttempts))
+	for key, a := range s.loginAttempts {
+		if !a.expiresAt.After(now) {
+			delete(s.loginAttempts, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*LoginAttempts, 0, len(keys))
+	for _, key := range keys {
+		cp := s.loginAttempts[key].LoginAttempts
+		out = append(out, &cp)
+	}
+	return out, nil
+}
+
+// cloneAccessToken 复制令牌，调用方修改权限列表不影响存储中的记录
+func cloneAccessToken(t *AccessToken) *AccessToken {
+	cp := *t
+	cp.Scopes = append([]string(nil), t.Scopes...)
+	if t.LastUsedAt != nil {
+		at := *t.LastUsedAt
+		cp.LastUsedAt = &at
+	}
+	return &cp
+}
+
+// CreateAccessToken 保存令牌，同时清理该用户已过期的令牌
+func (s *MemoryStore) CreateAccessToken(ctx context.Context, t *AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, existing := range s.accessTokens {
+		if existing.Username == t.Username && !existing.ExpiresAt.After(now) {
+			delete(s.accessTokens, id)
+		}
+	}
+	s.accessTokens[t.ID] = cloneAccessToken(t)
+	return nil
+}
+
+// GetAccessToken 获取未过期的令牌
+func (s *MemoryStore) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.accessTokens[id]
+	if !ok || !t.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return cloneAccessToken(t), nil
+}
+
+// ListAccessTokens 列出用户未过期的令牌
+func (s *MemoryStore) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	tokens := []*AccessToken{}
+	for _, t := range s.accessTokens {
+		if t.Username == username && t.ExpiresAt.After(now) {
+			tokens = append(tokens, cloneAccessToken(t))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// DeleteAccessToken 删除用户的令牌
+func (s *MemoryStore) DeleteAccessToken(ctx context.Context, username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.accessTokens[id]
+	if !ok || t.Username != username || !t.ExpiresAt.After(time.Now()) {
+		return ErrAccessTokenNotFound
+	}
+	delete(s.accessTokens, id)
+	return nil
+}
+
+// TouchAccessToken 更新最近使用时间
+func (s *MemoryStore) TouchAccessToken(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.accessTokens[id]; ok {
+		t.LastUsedAt = &at
+	}
+	return nil
+}
+
+// CreateOIDCLogin 保存登录状态，同时清理已过期的状态
+func (s *MemoryStore) CreateOIDCLogin(ctx context.Context, login *OIDCLogin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, existing := range s.oidcLogins {
+		if !existing.ExpiresAt.After(now) {
+			delete(s.oidcLogins, hash)
+		}
+	}
+	cp := *login
+	s.oidcLogins[login.StateHash] = &cp
+	return nil
+}
+
+// ConsumeOIDCLogin 取出并删除未过期且绑定值一致的登录状态
+func (s *MemoryStore) ConsumeOIDCLogin(ctx context.Context, stateHash, bindingHash string) (*OIDCLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.oidcLogins[stateHash]
+	if !ok || login.BindingHash != bindingHash {
+		return nil, nil
+	}
+	delete(s.oidcLogins, stateHash)
+	if !login.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := *login
+	return &cp, nil
+}
+
+// GetIdentity 获取外部身份的关联
+func (s *MemoryStore) GetIdentity(ctx context.Context, issuer, subject string) (*ExternalIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	identity, ok := s.identities[issuer+"\x00"+subject]
+	if !ok {
+		return nil, nil
+	}
+	cp := *identity
+	return &cp, nil
+}
+
+// CreateIdentity 关联外部身份
+func (s *MemoryStore) CreateIdentity(ctx context.Context, identity *ExternalIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := identity.Issuer + "\x00" + identity.Subject
+	if _, ok := s.identities[key]; ok {
+		return ErrIdentityExists
+	}
+	cp := *identity
+	s.identities[key] = &cp
+	return nil
+}
+
+// HasUserIdentity 用户是否关联了外部身份
+func (s *MemoryStore) HasUserIdentity(ctx context.Context, username string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, identity := range s.identities {
+		if identity.Username == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func cloneTwoFactor(tf *TwoFactor) *TwoFactor {
+	cp := *tf
+	cp.RecoveryCodes = append([]string{}, tf.RecoveryCodes...)
+	if tf.EnabledAt != nil {
+		at := *tf.EnabledAt
+		cp.EnabledAt = &at
+	}
+	return &cp
+}
+
+// GetTwoFactor 获取两步验证设置
+func (s *MemoryStore) GetTwoFactor(ctx context.Context, username string) (*TwoFactor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tf, ok := s.twoFactor[username]
+	if !ok {
+		return nil, nil
+	}
+	return cloneTwoFactor(tf), nil
+}
+
+// CreateTwoFactor 保存尚未启用的设置
+func (s *MemoryStore) CreateTwoFactor(ctx context.Context, tf *TwoFactor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.twoFactor[tf.Username]; ok && current.Enabled {
+		return ErrTwoFactorEnabled
+	}
+	s.twoFactor[tf.Username] = cloneTwoFactor(tf)
+	return nil
+}
+
+// UpdateTwoFactor 在锁内修改设置
+func (s *MemoryStore) UpdateTwoFactor(ctx context.Context, username string, fn func(tf *TwoFactor) error) (*TwoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.twoFactor[username]
+	if !ok {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	tf := cloneTwoFactor(current)
+	if err := fn(tf); err != nil {
+		return nil, err
+	}
+	s.twoFactor[username] = cloneTwoFactor(tf)
+	return tf, nil
+}
+
+// DeleteTwoFactor 删除两步验证设置
+func (s *MemoryStore) DeleteTwoFactor(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.twoFactor, username)
+	return nil
+}
+
+// CreateLoginChallenge 保存登录挑战，同时清理已过期的挑战
+func (s *MemoryStore) CreateLoginChallenge(ctx context.Context, ch *LoginChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for hash, existing := range s.challenges {
+		if !existing.ExpiresAt.After(now) {
+			delete(s.challenges, hash)
+		}
+	}
+	cp := *ch
+	s.challenges[ch.TokenHash] = &cp
+	return nil
+}
+
+// GetLoginChallenge 获取未过期的登录挑战
+func (s *MemoryStore) GetLoginChallenge(ctx context.Context, tokenHash string) (*LoginChallenge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ch, ok := s.challenges[tokenHash]
+	if !ok || !ch.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	cp := *ch
+	return &cp, nil
+}
+
+// DeleteLoginChallenge 删除登录挑战
+func (s *MemoryStore) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, tokenHash)
+	return nil
+}
+
+func cloneJob(job *Job) *Job {
+	cp := *job
+	cp.Request.Preferences = append([]string(nil), job.Request.Preferences...)
+	cp.Warnings = append([]ItineraryIssue(nil), job.Warnings...)
+	if job.StartedAt != nil {
+		at := *job.StartedAt
+		cp.StartedAt = &at
+	}
+	if job.FinishedAt != nil {
+		at := *job.FinishedAt
+		cp.FinishedAt = &at
+	}
+	return &cp
+}
+
+// CreateJob 保存任务，同时清理超过保留时长的任务
+func (s *MemoryStore) CreateJob(ctx context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, existing := range s.jobs {
+		if existing.expired(now) {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = cloneJob(job)
+	return nil
+}
+
+// GetJob 获取保留期内的任务
+func (s *MemoryStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok || job.expired(time.Now()) {
+		return nil, nil
+	}
+	return cloneJob(job), nil
+}
+
+// UpdateJob 在锁内修改任务
+func (s *MemoryStore) UpdateJob(ctx context.Context, id string, fn func(job *Job) error) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.jobs[id]
+	if !ok || current.expired(time.Now()) {
+		return nil, ErrJobNotFound
+	}
+	job := cloneJob(current)
+	if err := fn(job); err != nil {
+		return nil, err
+	}
+	s.jobs[id] = cloneJob(job)
+	return job, nil
+}
+
+// ListUserJobs 列出用户保留期内的任务
+func (s *MemoryStore) ListUserJobs(ctx context.Context, username string) ([]*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	jobs := []*Job{}
+	for _, job := range s.jobs {
+		if job.Username == username && !job.expired(now) {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// ListActiveJobs 列出排队和执行中的任务
+func (s *MemoryStore) ListActiveJobs(ctx context.Context) ([]*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := []*Job{}
+	for _, job := range s.jobs {
+		if !job.Finished() {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
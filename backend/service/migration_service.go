@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordKind 以 JSON 形式持久化的记录类型
+type RecordKind string
+
+const (
+	KindUser    RecordKind = "user"
+	KindTrip    RecordKind = "trip"
+	KindExpense RecordKind = "expense"
+	KindDiary   RecordKind = "diary"
+)
+
+// migrationStep 将记录从版本 i 升级到 i+1，直接修改解码后的 JSON 文档
+type migrationStep struct {
+	Description string
+	Up          func(doc map[string]interface{}) error
+}
+
+// recordMigrations 每类记录的迁移步骤，下标即起始版本，步骤数即当前版本；
+// 版本 0 表示没有 schemaVersion 字段的旧记录。修改持久化结构时在末尾追加步骤
+var recordMigrations = map[RecordKind][]migrationStep{
+	KindUser: {
+		{Description: "add schema version", Up: func(doc map[string]interface{}) error { return nil }},
+		{Description: "add role", Up: migrateUserV1},
+	},
+	KindTrip: {
+		{Description: "restore request from promoted top-level fields", Up: migrateTripV0},
+	},
+	KindExpense: {
+		{Description: "coerce string amounts and fill missing date", Up: migrateExpenseV0},
+	},
+	KindDiary: {
+		{Description: "add schema version", Up: func(doc map[string]interface{}) error { return nil }},
+	},
+}
+
+// CurrentSchemaVersion 返回记录类型的当前版本
+func CurrentSchemaVersion(kind RecordKind) int {
+	return len(recordMigrations[kind])
+}
+
+// migrateUserV1 引入角色前的用户均为普通用户
+func migrateUserV1(doc map[string]interface{}) error {
+	if r, _ := doc["role"].(string); r == "" {
+		doc["role"] = RoleUser
+	}
+	return nil
+}
+
+// migrateTripV0 旧行程可能缺少 request，从 MarshalJSON 提升到顶层的字段中恢复
+func migrateTripV0(doc map[string]interface{}) error {
+	req, _ := doc["request"].(map[string]interface{})
+	if req == nil {
+		req = make(map[string]interface{})
+		doc["request"] = req
+	}
+	for _, field := range []string{"destination", "startDate", "endDate"} {
+		if s, _ := req[field].(string); s == "" {
+			if top, ok := doc[field].(string); ok {
+				req[field] = top
+			}
+		}
+	}
+	return nil
+}
+
+// migrateExpenseV0 旧花费记录的金额可能是字符串，日期可能为空
+func migrateExpenseV0(doc map[string]interface{}) error {
+	if s, ok := doc["amount"].(string); ok {
+		amount, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("invalid amount %q", s)
+		}
+		doc["amount"] = json.Number(strconv.FormatFloat(amount, 'f', -1, 64))
+	}
+	if d, _ := doc["date"].(string); d == "" {
+		if created, ok := doc["createdAt"].(string); ok {
+			if t, err := time.Parse(time.RFC3339, created); err == nil {
+				doc["date"] = t.Format("2006-01-02")
+			}
+		}
+	}
+	return nil
+}
+
+// schemaVersionOf 读取文档中的版本号，缺失时为 0
+func schemaVersionOf(doc map[string]interface{}) (int, error) {
+	raw, ok := doc["schemaVersion"]
+	if !ok || raw == nil {
+		return 0, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("invalid schemaVersion %v", raw)
+	}
+	v, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid schemaVersion %v", raw)
+	}
+	return int(v), nil
+}
+
+// migrateRecord 将原始 JSON 升级到当前版本，返回升级后的数据和原始版本；
+// 已是当前版本时原样返回 data
+func migrateRecord(kind RecordKind, data []byte) ([]byte, int, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	from, err := schemaVersionOf(doc)
+	if err != nil {
+		return nil, 0, err
+	}
+	steps := recordMigrations[kind]
+	if from > len(steps) {
+		return nil, from, fmt.Errorf("%s schema version %d is newer than supported %d", kind, from, len(steps))
+	}
+	if from == len(steps) {
+		return data, from, nil
+	}
+	for v := from; v < len(steps); v++ {
+		if err := steps[v].Up(doc); err != nil {
+			return nil, from, fmt.Errorf("%s migration v%d->v%d: %w", kind, v, v+1, err)
+		}
+	}
+	doc["schemaVersion"] = len(steps)
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, from, err
+	}
+	return out, from, nil
+}
+
+// decodeRecord 升级并解码记录，upgraded 为 true 时调用方应将 data 写回存储
+func decodeRecord(kind RecordKind, raw []byte, v interface{}) (data []byte, upgraded bool, err error) {
+	data, from, err := migrateRecord(kind, raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, false, err
+	}
+	return data, from != CurrentSchemaVersion(kind), nil
+}
+
+// KindReport 单类记录的迁移统计
+type KindReport struct {
+	Scanned      int         `json:"scanned"`
+	Current      int         `json:"current"`
+	Upgraded     int         `json:"upgraded"`
+	Failed       int         `json:"failed"`
+	FromVersions map[int]int `json:"fromVersions"`
+	Errors       []string    `json:"errors,omitempty"`
+}
+
+// MigrationReport 批量迁移报告
+type MigrationReport struct {
+	Backend string                     `json:"backend"`
+	DryRun  bool                       `json:"dryRun"`
+	Kinds   map[RecordKind]*KindReport `json:"kinds"`
+	Notes   []string                   `json:"notes,omitempty"`
+}
+
+func newMigrationReport(backend string, dryRun bool) *MigrationReport {
+	r := &MigrationReport{Backend: backend, DryRun: dryRun, Kinds: make(map[RecordKind]*KindReport)}
+	for _, kind := range []RecordKind{KindUser, KindTrip, KindExpense, KindDiary} {
+		r.Kinds[kind] = &KindReport{FromVersions: make(map[int]int)}
+	}
+	return r
+}
+
+// record 记录一条记录的迁移结果
+func (r *MigrationReport) record(kind RecordKind, key string, from int, err error) {
+	kr := r.Kinds[kind]
+	kr.Scanned++
+	switch {
+	case err != nil:
+		kr.Failed++
+		kr.Errors = append(kr.Errors, fmt.Sprintf("%s: %v", key, err))
+	case from == CurrentSchemaVersion(kind):
+		kr.Current++
+	default:
+		kr.Upgraded++
+		kr.FromVersions[from]++
+	}
+}
+
+// String 生成可读的报告文本
+func (r *MigrationReport) String() string {
+	var b strings.Builder
+	mode := "applied"
+	if r.DryRun {
+		mode = "dry run"
+	}
+	fmt.Fprintf(&b, "Migration report (%s backend, %s)\n", r.Backend, mode)
+	kinds := make([]string, 0, len(r.Kinds))
+	for k := range r.Kinds {
+		kinds = append(kinds, string(k))
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		kr := r.Kinds[RecordKind(k)]
+		fmt.Fprintf(&b, "  %-8s v%d  scanned=%d current=%d upgraded=%d failed=%d",
+			k, CurrentSchemaVersion(RecordKind(k)), kr.Scanned, kr.Current, kr.Upgraded, kr.Failed)
+		if len(kr.FromVersions) > 0 {
+			versions := make([]int, 0, len(kr.FromVersions))
+			for v := range kr.FromVersions {
+				versions = append(versions, v)
+			}
+			sort.Ints(versions)
+			parts := make([]string, 0, len(versions))
+			for _, v := range versions {
+				parts = append(parts, fmt.Sprintf("v%d:%d", v, kr.FromVersions[v]))
+			}
+			fmt.Fprintf(&b, " from=[%s]", strings.Join(parts, " "))
+		}
+		b.WriteString("\n")
+		for _, e := range kr.Errors {
+			fmt.Fprintf(&b, "    ! %s\n", e)
+		}
+	}
+	for _, n := range r.Notes {
+		fmt.Fprintf(&b, "  note: %s\n", n)
+	}
+	return b.String()
+}
+
+// Migrator 可批量升级存量记录的存储后端
+type Migrator interface {
+	// MigrateRecords 扫描全部记录并升级到当前版本，dryRun 时只统计不写回
+	MigrateRecords(ctx context.Context, dryRun bool) (*MigrationReport, error)
+}
+
+// migrateOne 升级单条原始记录并计入报告，write 负责以比较并交换的方式写回
+func migrateOne(report *MigrationReport, kind RecordKind, key, raw string, write func(data []byte) (bool, error)) {
+	data, from, err := migrateRecord(kind, []byte(raw))
+	if err == nil && from != CurrentSchemaVersion(kind) && !report.DryRun {
+		var written bool
+		if written, err = write(data); err == nil && !written {
+			err = errors.New("record changed during migration, rerun to retry")
+		}
+	}
+	report.record(kind, key, from, err)
+}
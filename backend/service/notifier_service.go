@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"example.com/travel_planner/backend/config"
+)
+
+// Notification 发送给用户的通知
+type Notification struct {
+	Username  string    `json:"username"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Notifier 通知发送渠道，例如邮件或短信
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// OutboxNotifier 将通知逐行以 JSON 追加到本地文件，不会真正送达用户，用于开发调试
+type OutboxNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewOutboxNotifier 创建写入 path 的本地发件箱
+func NewOutboxNotifier(path string) *OutboxNotifier {
+	return &OutboxNotifier{path: path}
+}
+
+// Notify 追加一条通知到发件箱文件
+func (o *OutboxNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = time.Now()
+	}
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(o.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewNotifier 按配置创建通知渠道
+func NewNotifier(cfg config.NotifierConfig) (Notifier, error) {
+	switch cfg.Driver {
+	case "", "outbox":
+		path := cfg.OutboxPath
+		if path == "" {
+			path = filepath.Join("logs", "outbox.jsonl")
+		}
+		LogWarn("Notifications are written to the local outbox %s and not delivered to users", path)
+		return NewOutboxNotifier(path), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier driver %q", cfg.Driver)
+	}
+}
@@ -0,0 +1,672 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"example.com/travel_planner/backend/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrInvalidOIDCState 回调中的 state 不存在、已使用或已过期
+	ErrInvalidOIDCState = errors.New("invalid or expired oidc state")
+	// ErrOIDCSignupDisabled 身份尚未关联用户且配置不允许自动创建用户
+	ErrOIDCSignupDisabled = errors.New("oidc signup is disabled")
+	ErrIdentityExists     = errors.New("external identity already linked")
+)
+
+// OIDCLoginTTL 从跳转到身份提供方到回调完成的最长时间
+var OIDCLoginTTL = 10 * time.Minute
+
+// OIDCLogin 进行中的授权码登录，以 state 的摘要为键，回调时取出并删除。
+// BindingHash 为发起登录的浏览器 cookie 中绑定值的摘要，回调必须来自同一浏览器，
+// 防止攻击者诱导用户完成攻击者发起的登录或关联。
+// 由已登录用户发起关联时 LinkUserID 和 LinkUsername 为该用户，回调时把外部身份关联到这个用户
+type OIDCLogin struct {
+	StateHash    string    `json:"stateHash"`
+	BindingHash  string    `json:"bindingHash"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"codeVerifier"` // PKCE
+	LinkUserID   int       `json:"linkUserId,omitempty"`
+	LinkUsername string    `json:"linkUsername,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// ExternalIdentity 身份提供方的用户（issuer + subject）与本地用户的关联
+type ExternalIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    int       `json:"userId"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IdentityStore 单点登录的登录状态与外部身份关联存储
+type IdentityStore interface {
+	// CreateOIDCLogin 保存进行中的登录
+	CreateOIDCLogin(ctx context.Context, login *OIDCLogin) error
+	// ConsumeOIDCLogin 取出并删除登录状态，保证只能使用一次；不存在、已过期或 bindingHash 不一致时
+	// 返回 nil, nil，绑定值不一致时不删除登录状态
+	ConsumeOIDCLogin(ctx context.Context, stateHash, bindingHash string) (*OIDCLogin, error)
+	// GetIdentity 获取外部身份的关联，不存在时返回 nil, nil
+	GetIdentity(ctx context.Context, issuer, subject string) (*ExternalIdentity, error)
+	// CreateIdentity 关联外部身份，已关联时返回 ErrIdentityExists
+	CreateIdentity(ctx context.Context, identity *ExternalIdentity) error
+	// HasUserIdentity 用户是否关联了外部身份
+	HasUserIdentity(ctx context.Context, username string) (bool, error)
+}
+
+// OIDCProvider OpenID Connect 身份提供方。端点和签名公钥在首次使用时获取，
+// 身份提供方暂时不可用不影响服务启动
+type OIDCProvider struct {
+	cfg    config.OIDCConfig
+	secret string
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+	keys      map[string]interface{}
+	keysAt    time.Time
+}
+
+// oidcEndpoints 发现文档中用到的字段
+type oidcEndpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcKeyRefreshInterval 遇到未知 kid 时重新获取公钥的最短间隔
+const oidcKeyRefreshInterval = time.Minute
+
+// NewOIDCProvider 按配置创建身份提供方，未配置 issuer 时返回 nil, nil
+func NewOIDCProvider(cfg config.OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: clientId and redirectUrl are required")
+	}
+	secret := cfg.ClientSecret
+	if cfg.ClientSecretEnv != "" {
+		secret = os.Getenv(cfg.ClientSecretEnv)
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &OIDCProvider{cfg: cfg, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// FrontendURL 登录完成后跳转的前端地址，为空时回调直接返回 JSON
+func (p *OIDCProvider) FrontendURL() string {
+	return p.cfg.FrontendURL
+}
+
+// SecureCookie 回调地址为 HTTPS 时浏览器绑定 cookie 只通过 HTTPS 发送
+func (p *OIDCProvider) SecureCookie() bool {
+	return strings.HasPrefix(p.cfg.RedirectURL, "https://")
+}
+
+// getJSON 请求身份提供方并解析 JSON 响应
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// discover 获取并缓存发现文档
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	var ep oidcEndpoints
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &ep); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(ep.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match configured %q", ep.Issuer, p.cfg.Issuer)
+	}
+	if ep.AuthorizationEndpoint == "" || ep.TokenEndpoint == "" || ep.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: missing authorization, token or jwks endpoint")
+	}
+	p.endpoints = &ep
+	return p.endpoints, nil
+}
+
+// AuthCodeURL 创建登录状态，返回跳转到身份提供方的授权地址和浏览器绑定值。绑定值由调用方保存在
+// 发起登录的浏览器的 cookie 中，回调时传给 Login。link 不为 nil 时回调把外部身份关联到该用户
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, store IdentityStore, link *UserRecord) (string, string, error) {
+	ep, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	login := &OIDCLogin{
+		StateHash:    hashToken(state),
+		BindingHash:  hashToken(binding),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(OIDCLoginTTL),
+	}
+	if link != nil {
+		login.LinkUserID, login.LinkUsername = link.ID, link.Username
+	}
+	if err := store.CreateOIDCLogin(ctx, login); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(ep.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return ep.AuthorizationEndpoint + sep + q.Encode(), binding, nil
+}
+
+// oidcClaims ID token 中用到的 claims，其余 claim 保留在 extra 中供 usernameClaim 使用
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	extra         map[string]interface{}
+}
+
+// Login 用回调中的授权码换取 ID token 并验证，返回关联的本地用户；首次登录时按配置创建用户，
+// 由已登录用户发起时关联到该用户。binding 为回调请求 cookie 中的绑定值，必须与发起登录时的一致。
+// state 无效或绑定值不一致时返回 ErrInvalidOIDCState，身份未关联且不允许注册时
+// 返回 ErrOIDCSignupDisabled，要关联的身份已属于其他用户时返回 ErrIdentityExists
+func (p *OIDCProvider) Login(ctx context.Context, stores *Stores, code, state, binding string) (*UserRecord, error) {
+	if binding == "" {
+		return nil, ErrInvalidOIDCState
+	}
+	login, err := stores.Identities.ConsumeOIDCLogin(ctx, hashToken(state), hashToken(binding))
+	if err != nil {
+		return nil, err
+	}
+	if login == nil {
+		return nil, ErrInvalidOIDCState
+	}
+	rawIDToken, err := p.exchange(ctx, code, login.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(ctx, rawIDToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if login.LinkUserID != 0 {
+		return p.linkUser(ctx, stores, claims, login)
+	}
+	return p.resolveUser(ctx, stores, claims)
+}
+
+// linkUser 将外部身份关联到发起关联的用户，已关联到该用户时直接返回。
+// 发起关联后用户已注销时返回 ErrUserNotFound
+func (p *OIDCProvider) linkUser(ctx context.Context, stores *Stores, claims *oidcClaims, login *OIDCLogin) (*UserRecord, error) {
+	user, err := stores.Users.GetUser(ctx, login.LinkUsername)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.ID != login.LinkUserID {
+		return nil, ErrUserNotFound
+	}
+	identity, err := stores.Identities.GetIdentity(ctx, p.cfg.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		if identity.UserID == user.ID && identity.Username == user.Username {
+			return user, nil
+		}
+		return nil, ErrIdentityExists
+	}
+	err = stores.Identities.CreateIdentity(ctx, &ExternalIdentity{
+		Issuer:    p.cfg.Issuer,
+		Subject:   claims.Subject,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     claims.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	LogInfo("Linked OIDC subject %s to user %s (ID: %d)", claims.Subject, user.Username, user.ID)
+	return user, nil
+}
+
+// exchange 在 token 端点用授权码换取 ID token，客户端以 HTTP Basic 认证
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	ep, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.secret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc token exchange: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("oidc token exchange: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc token exchange: response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken 验证 ID token 的签名、issuer、audience、有效期和 nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*oidcClaims, error) {
+	var claims oidcClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc id token: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("oidc id token: missing sub")
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("oidc id token: nonce mismatch")
+	}
+	// 未知字段单独解析一次，供 usernameClaim 读取
+	parts := strings.Split(raw, ".")
+	if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+		json.Unmarshal(payload, &claims.extra)
+	}
+	return &claims, nil
+}
+
+// publicKey 按 kid 查找身份提供方的签名公钥，找不到时重新获取 JWKS（最多每分钟一次）
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	key, ok := p.lookupKey(kid)
+	stale := time.Since(p.keysAt) >= oidcKeyRefreshInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	ep, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, ep.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, raw := range set.Keys {
+		id, pub, err := parseJWK(raw)
+		if err != nil {
+			LogWarn("Skipping OIDC signing key: %v", err)
+			continue
+		}
+		keys[id] = pub
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys, p.keysAt = keys, time.Now()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey 按 kid 查找已缓存的公钥；token 没有 kid 时只有一个公钥才能确定，调用方需持有锁
+func (p *OIDCProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// parseJWK 解析签名用的 RSA、EC（P-256/P-384）或 Ed25519 公钥
+func parseJWK(raw json.RawMessage) (string, interface{}, error) {
+	var k struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q: use %q", k.Kid, k.Use)
+	}
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return "", nil, fmt.Errorf("key %q: invalid RSA parameters", k.Kid)
+		}
+		return k.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return "", nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return "", nil, fmt.Errorf("key %q: invalid EC parameters", k.Kid)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return "", nil, fmt.Errorf("key %q: point is not on curve", k.Kid)
+		}
+		return k.Kid, pub, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return "", nil, fmt.Errorf("key %q: invalid OKP parameters", k.Kid)
+		}
+		return k.Kid, ed25519.PublicKey(x), nil
+	default:
+		return "", nil, fmt.Errorf("key %q: unsupported kty %q", k.Kid, k.Kty)
+	}
+}
+
+// resolveUser 返回外部身份关联的用户。首次登录时创建用户并关联：用户名取自 usernameClaim，
+// 与已有用户重名时追加数字后缀，不会关联到同名的已有用户；已有账户需要登录后通过 AuthCodeURL 发起关联
+func (p *OIDCProvider) resolveUser(ctx context.Context, stores *Stores, claims *oidcClaims) (*UserRecord, error) {
+	identity, err := stores.Identities.GetIdentity(ctx, p.cfg.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		user, err := stores.Users.GetUser(ctx, identity.Username)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && user.ID == identity.UserID {
+			return user, nil
+		}
+		return nil, fmt.Errorf("oidc identity %s is linked to missing user %s", claims.Subject, identity.Username)
+	}
+	if p.cfg.DisableSignup {
+		return nil, ErrOIDCSignupDisabled
+	}
+
+	// 本地密码随机生成且不返回，用户只能通过单点登录或重置密码登录
+	password, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	base := p.preferredUsername(claims)
+	var user *UserRecord
+	for i := 1; user == nil; i++ {
+		if i > 100 {
+			return nil, fmt.Errorf("no free username for %q", base)
+		}
+		name := base
+		if i > 1 {
+			name = base + strconv.Itoa(i)
+		}
+		if len(Credentials.ValidateUsername(name)) > 0 {
+			continue
+		}
+		user, err = stores.Users.CreateUser(ctx, name, password)
+		if err != nil && !errors.Is(err, ErrUserExists) {
+			return nil, err
+		}
+	}
+
+	err = stores.Identities.CreateIdentity(ctx, &ExternalIdentity{
+		Issuer:    p.cfg.Issuer,
+		Subject:   claims.Subject,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     claims.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		// 同一身份的并发首次登录中只有一个能完成关联，其余删除刚创建的用户后使用已关联的用户
+		if _, derr := stores.Users.DeleteUser(ctx, user.Username); derr != nil {
+			LogError("Failed to remove user %s after failed identity link: %v", user.Username, derr)
+		}
+		if errors.Is(err, ErrIdentityExists) {
+			return p.resolveUser(ctx, stores, claims)
+		}
+		return nil, err
+	}
+	LogInfo("Created user %s (ID: %d) for OIDC subject %s", user.Username, user.ID, claims.Subject)
+	return user, nil
+}
+
+// preferredUsername 新用户的用户名：usernameClaim，其次是邮箱 @ 前的部分，最后是 sub。
+// 不符合用户名规则的字符替换为 _，仍不符合时使用 user；长度为数字后缀预留 3 个字符
+func (p *OIDCProvider) preferredUsername(claims *oidcClaims) string {
+	name, _ := claims.extra[p.cfg.UsernameClaim].(string)
+	if name == "" && claims.Email != "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+	name = NormalizeUsername(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(strings.TrimSpace(name), "_.-"))
+	if r, max := []rune(name), Credentials.UsernameMaxLength-3; len(r) > max && max > 0 {
+		name = string(r[:max])
+	}
+	if len(Credentials.ValidateUsername(name)) > 0 {
+		return "user"
+	}
+	return name
+}
+
+func oidcLoginKey(stateHash string) string { return "oidc_login:" + stateHash }
+func identityKey(issuer, subject string) string {
+	return "identity:" + hashToken(issuer+"\x00"+subject)
+}
+func userIdentitiesKey(username string) string { return "user_identities:" + username }
+
+// CreateOIDCLogin 保存登录状态，过期后自动删除
+func (s *RedisStore) CreateOIDCLogin(ctx context.Context, login *OIDCLogin) error {
+	data, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, oidcLoginKey(login.StateHash), data, time.Until(login.ExpiresAt)).Err()
+}
+
+// ConsumeOIDCLogin 在事务中读取登录状态，绑定值一致时删除，并发请求中只有一个能取到
+func (s *RedisStore) ConsumeOIDCLogin(ctx context.Context, stateHash, bindingHash string) (*OIDCLogin, error) {
+	key := oidcLoginKey(stateHash)
+	var consumed *OIDCLogin
+	err := s.watchRetry(ctx, func(tx *redis.Tx) error {
+		consumed = nil
+		data, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var login OIDCLogin
+		if err := json.Unmarshal([]byte(data), &login); err != nil {
+			return err
+		}
+		if login.BindingHash != bindingHash {
+			return nil
+		}
+		if _, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		consumed = &login
+		return nil
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return consumed, nil
+}
+
+// GetIdentity 获取外部身份的关联
+func (s *RedisStore) GetIdentity(ctx context.Context, issuer, subject string) (*ExternalIdentity, error) {
+	data, err := s.rdb.Get(ctx, identityKey(issuer, subject)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var identity ExternalIdentity
+	if err := json.Unmarshal([]byte(data), &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// CreateIdentity 在监视身份键的事务中确认未关联后写入，并加入用户的身份集合
+func (s *RedisStore) CreateIdentity(ctx context.Context, identity *ExternalIdentity) error {
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+	key := identityKey(identity.Issuer, identity.Subject)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrIdentityExists
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.SAdd(ctx, userIdentitiesKey(identity.Username), key)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// HasUserIdentity 用户的身份集合是否非空
+func (s *RedisStore) HasUserIdentity(ctx context.Context, username string) (bool, error) {
+	n, err := s.rdb.SCard(ctx, userIdentitiesKey(username)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockClientID     = "travel-planner"
+	mockClientSecret = "s3cret/+="
+	mockRedirectURL  = "http://127.0.0.1:3000/api/auth/oidc/callback"
+)
+
+// mockIdP 测试用的身份提供方：发现文档、JWKS 和校验客户端认证与 PKCE 的 token 端点
+type mockIdP struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthCode
+}
+
+// mockAuthCode 授权码对应的 PKCE challenge 和要签发的 ID token claims
+type mockAuthCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, codes: make(map[string]mockAuthCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig", "alg": "RS256",
+			"n": b64.EncodeToString(key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// tokenError 按 OAuth 2.0 返回 token 端点错误
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != mockClientID || secret != mockClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != mockRedirectURL {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	idp.mu.Lock()
+	code, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !ok {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, code.claims)
+	tok.Header["kid"] = "k1"
+	signed, err := tok.SignedString(idp.key)
+	if err != nil {
+		idp.t.Error(err)
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+}
+
+// authorize 模拟用户在身份提供方登录：校验授权地址并签发授权码，mutate 可以修改 ID token 的 claims。
+// 返回授权码和回调中的 state
+func (idp *mockIdP) authorize(authURL, subject, username string, mutate func(claims jwt.MapClaims, code *mockAuthCode)) (string, string) {
+	idp.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != mockClientID ||
+		q.Get("redirect_uri") != mockRedirectURL || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || q.Get("state") == "" || q.Get("nonce") == "" {
+		idp.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	now := time.Now()
+	code := mockAuthCode{
+		challenge: q.Get("code_challenge"),
+		claims: jwt.MapClaims{
+			"iss":                idp.srv.URL,
+			"aud":                mockClientID,
+			"sub":                subject,
+			"nonce":              q.Get("nonce"),
+			"iat":                now.Unix(),
+			"exp":                now.Add(5 * time.Minute).Unix(),
+			"email":              username + "@example.com",
+			"email_verified":     true,
+			"preferred_username": username,
+		},
+	}
+	if mutate != nil {
+		mutate(code.claims, &code)
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.codes[id] = code
+	idp.mu.Unlock()
+	return id, q.Get("state")
+}
+
+func newTestOIDCProvider(t *testing.T, idp *mockIdP) *OIDCProvider {
+	t.Helper()
+	p, err := NewOIDCProvider(config.OIDCConfig{
+		Issuer:       idp.srv.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		RedirectURL:  mockRedirectURL,
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	return p
+}
+
+// oidcLogin 走完一次授权码流程，link 不为 nil 时为关联身份
+func oidcLogin(t *testing.T, p *OIDCProvider, idp *mockIdP, stores *Stores, link *UserRecord, subject, username string) (*UserRecord, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, binding, err := p.AuthCodeURL(ctx, stores.Identities, link)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, state := idp.authorize(authURL, subject, username, nil)
+	return p.Login(ctx, stores, code, state, binding)
+}
+
+func TestOIDCLoginCodeFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestOIDCProvider(t, idp)
+	stores := NewStores(NewMemoryStore())
+	ctx := context.Background()
+
+	u, err := oidcLogin(t, p, idp, stores, nil, "sub-1", "alice")
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if u.Username != "alice" {
+		t.Fatalf("new user = %q; want alice", u.Username)
+	}
+	again, err := oidcLogin(t, p, idp, stores, nil, "sub-1", "renamed")
+	if err != nil || again.ID != u.ID {
+		t.Fatalf("second login = %+v, %v; want the same user", again, err)
+	}
+	// 另一个身份使用相同的用户名时创建带后缀的新用户，不会进入已有账户
+	other, err := oidcLogin(t, p, idp, stores, nil, "sub-2", "alice")
+	if err != nil || other.Username != "alice2" {
+		t.Fatalf("login of another subject = %+v, %v; want a new user alice2", other, err)
+	}
+
+	// state 只能使用一次
+	authURL, binding, _ := p.AuthCodeURL(ctx, stores.Identities, nil)
+	code, state := idp.authorize(authURL, "sub-1", "alice", nil)
+	if _, err := p.Login(ctx, stores, code, state, binding); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	code, _ = idp.authorize(authURL, "sub-1", "alice", nil)
+	if _, err := p.Login(ctx, stores, code, state, binding); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("replayed state = %v; want ErrInvalidOIDCState", err)
+	}
+	if _, err := p.Login(ctx, stores, code, "forged", binding); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("unknown state = %v; want ErrInvalidOIDCState", err)
+	}
+}
+
+func TestOIDCLoginBrowserBinding(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestOIDCProvider(t, idp)
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	bob := mustCreateUser(t, ctx, b, "bob")
+
+	// 攻击者发起的登录或关联在用户的浏览器中回调：没有 cookie 或 cookie 是用户自己的绑定值
+	for i, link := range []*UserRecord{nil, bob} {
+		subject := fmt.Sprintf("sub-%d", i)
+		authURL, binding, err := p.AuthCodeURL(ctx, stores.Identities, link)
+		if err != nil {
+			t.Fatalf("AuthCodeURL: %v", err)
+		}
+		_, other, err := p.AuthCodeURL(ctx, stores.Identities, nil)
+		if err != nil {
+			t.Fatalf("AuthCodeURL: %v", err)
+		}
+		code, state := idp.authorize(authURL, subject, "mallory", nil)
+		for _, wrong := range []string{"", other, binding + "x"} {
+			if u, err := p.Login(ctx, stores, code, state, wrong); !errors.Is(err, ErrInvalidOIDCState) {
+				t.Fatalf("callback with binding %q = %+v, %v; want ErrInvalidOIDCState", wrong, u, err)
+			}
+		}
+		if identity, _ := stores.Identities.GetIdentity(ctx, idp.srv.URL, subject); identity != nil {
+			t.Fatalf("rejected callback linked identity %+v", identity)
+		}
+		// 被拒绝的回调不消耗登录状态，发起登录的浏览器仍可完成
+		if _, err := p.Login(ctx, stores, code, state, binding); err != nil {
+			t.Fatalf("callback from the initiating browser = %v; want nil", err)
+		}
+	}
+	if identity, _ := stores.Identities.GetIdentity(ctx, idp.srv.URL, "sub-1"); identity == nil || identity.UserID != bob.ID {
+		t.Fatalf("identity linked from the initiating browser = %+v; want bob", identity)
+	}
+}
+
+func TestOIDCLoginExpiredState(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestOIDCProvider(t, idp)
+	stores := NewStores(NewMemoryStore())
+	saved := OIDCLoginTTL
+	OIDCLoginTTL = -time.Second
+	t.Cleanup(func() { OIDCLoginTTL = saved })
+
+	if _, err := oidcLogin(t, p, idp, stores, nil, "sub-1", "alice"); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("expired state = %v; want ErrInvalidOIDCState", err)
+	}
+}
+
+func TestOIDCLoginRejectsInvalidTokens(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(claims jwt.MapClaims, code *mockAuthCode)
+	}{
+		{"wrong issuer", func(c jwt.MapClaims, _ *mockAuthCode) { c["iss"] = "https://evil.example.com" }},
+		{"wrong audience", func(c jwt.MapClaims, _ *mockAuthCode) { c["aud"] = "another-client" }},
+		{"nonce mismatch", func(c jwt.MapClaims, _ *mockAuthCode) { c["nonce"] = "replayed-nonce" }},
+		{"missing nonce", func(c jwt.MapClaims, _ *mockAuthCode) { delete(c, "nonce") }},
+		{"expired", func(c jwt.MapClaims, _ *mockAuthCode) { c["exp"] = time.Now().Add(-10 * time.Minute).Unix() }},
+		{"missing expiry", func(c jwt.MapClaims, _ *mockAuthCode) { delete(c, "exp") }},
+		{"missing subject", func(c jwt.MapClaims, _ *mockAuthCode) { delete(c, "sub") }},
+		// 授权码签发给了另一个 code_challenge，客户端的 code_verifier 无法通过 PKCE 校验
+		{"PKCE mismatch", func(_ jwt.MapClaims, code *mockAuthCode) { code.challenge = "intercepted" }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			p := newTestOIDCProvider(t, idp)
+			stores := NewStores(NewMemoryStore())
+			ctx := context.Background()
+
+			authURL, binding, err := p.AuthCodeURL(ctx, stores.Identities, nil)
+			if err != nil {
+				t.Fatalf("AuthCodeURL: %v", err)
+			}
+			code, state := idp.authorize(authURL, "sub-1", "alice", tc.mutate)
+			if u, err := p.Login(ctx, stores, code, state, binding); err == nil {
+				t.Fatalf("Login accepted the token as %+v", u)
+			}
+			if users, _ := stores.Users.ListUsers(ctx); len(users) != 0 {
+				t.Fatalf("rejected login created %d users", len(users))
+			}
+		})
+	}
+}
+
+func TestOIDCLinkExistingAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestOIDCProvider(t, idp)
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	bob := mustCreateUser(t, ctx, b, "bob")
+	carol := mustCreateUser(t, ctx, b, "carol")
+
+	linked, err := oidcLogin(t, p, idp, stores, bob, "sub-bob", "bob.sso")
+	if err != nil || linked.ID != bob.ID {
+		t.Fatalf("link = %+v, %v; want bob", linked, err)
+	}
+	identity, err := stores.Identities.GetIdentity(ctx, idp.srv.URL, "sub-bob")
+	if err != nil || identity == nil || identity.UserID != bob.ID || identity.Email != "bob.sso@example.com" {
+		t.Fatalf("identity = %+v, %v", identity, err)
+	}
+	// 关联后单点登录进入原账户，不再创建新用户
+	u, err := oidcLogin(t, p, idp, stores, nil, "sub-bob", "bob.sso")
+	if err != nil || u.ID != bob.ID {
+		t.Fatalf("login after link = %+v, %v; want bob", u, err)
+	}
+	if users, _ := stores.Users.ListUsers(ctx); len(users) != 2 {
+		t.Fatalf("have %d users after link and login; want 2", len(users))
+	}
+	// 再次关联同一身份不报错；已属于 bob 的身份不能关联到 carol
+	if u, err := oidcLogin(t, p, idp, stores, bob, "sub-bob", "bob.sso"); err != nil || u.ID != bob.ID {
+		t.Fatalf("relink = %+v, %v", u, err)
+	}
+	if _, err := oidcLogin(t, p, idp, stores, carol, "sub-bob", "bob.sso"); !errors.Is(err, ErrIdentityExists) {
+		t.Fatalf("link to another user = %v; want ErrIdentityExists", err)
+	}
+	// 发起关联后账户被注销
+	if _, err := b.DeleteUser(ctx, "carol"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := oidcLogin(t, p, idp, stores, carol, "sub-carol", "carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("link for a deleted user = %v; want ErrUserNotFound", err)
+	}
+}
+
+func TestOIDCLinkStateRoundTrip(t *testing.T) {
+	// 关联信息和绑定值随登录状态一起保存，三种存储都能取回，绑定值不一致时不取出也不删除
+	backends := map[string]Backend{
+		"memory": NewMemoryStore(),
+		"sqlite": newSQLiteTestStore(t),
+	}
+	rs, _ := newRedisTestStore(t)
+	backends["redis"] = rs
+	for name, b := range backends {
+		ctx := context.Background()
+		login := &OIDCLogin{StateHash: "h-" + name, BindingHash: "b", Nonce: "n", CodeVerifier: "v", LinkUserID: 7, LinkUsername: "bob", ExpiresAt: time.Now().Add(time.Minute)}
+		if err := b.CreateOIDCLogin(ctx, login); err != nil {
+			t.Fatalf("%s: CreateOIDCLogin: %v", name, err)
+		}
+		for _, wrong := range []string{"", "other"} {
+			if got, err := b.ConsumeOIDCLogin(ctx, login.StateHash, wrong); err != nil || got != nil {
+				t.Fatalf("%s: ConsumeOIDCLogin with binding %q = %+v, %v; want nil", name, wrong, got, err)
+			}
+		}
+		got, err := b.ConsumeOIDCLogin(ctx, login.StateHash, "b")
+		if err != nil || got == nil || got.LinkUserID != 7 || got.LinkUsername != "bob" || got.CodeVerifier != "v" || got.BindingHash != "b" {
+			t.Fatalf("%s: ConsumeOIDCLogin = %+v, %v", name, got, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// PasswordResetTTL 密码重置令牌的有效期，可通过配置修改
+var PasswordResetTTL = 30 * time.Minute
+
+// PasswordReset 密码重置令牌，只保存令牌的 SHA256 摘要
+type PasswordReset struct {
+	TokenHash string    `json:"tokenHash"`
+	UserID    int       `json:"userId"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// PasswordResetStore 密码重置令牌存储，每个用户同一时间只有一个有效令牌
+type PasswordResetStore interface {
+	// CreatePasswordReset 保存重置令牌，该用户之前未使用的令牌随之失效
+	CreatePasswordReset(ctx context.Context, reset *PasswordReset) error
+	// GetPasswordReset 查看令牌但不使用；不存在或已过期时返回 nil, nil
+	GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+	// ConsumePasswordReset 取出并删除令牌，保证只能使用一次；不存在或已过期时返回 nil, nil
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+}
+
+// ChangePassword 设置新密码并撤销用户的全部会话和个人访问令牌，返回撤销的会话数量。
+// 令牌可能是用泄露的密码登录后创建的，因此和会话一起撤销
+func ChangePassword(ctx context.Context, stores *Stores, user *UserRecord, newPassword string) (int, error) {
+	if err := stores.Users.SetPassword(ctx, user.Username, newPassword); err != nil {
+		return 0, err
+	}
+	if _, err := RevokeUserAccessTokens(ctx, stores.AccessTokens, user.Username); err != nil {
+		return 0, err
+	}
+	return stores.Sessions.DeleteUserSessions(ctx, user.Username)
+}
+
+// RequestPasswordReset 为用户生成重置令牌并通过 notifier 发送。用户不存在时不做任何操作，
+// 调用方不应向客户端透露用户是否存在
+func RequestPasswordReset(ctx context.Context, stores *Stores, notifier Notifier, username string) error {
+	user, err := LookupUser(ctx, stores.Users, username)
+	if err != nil || user == nil {
+		return err
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	reset := &PasswordReset{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		Username:  user.Username,
+		ExpiresAt: time.Now().Add(PasswordResetTTL),
+	}
+	if err := stores.PasswordResets.CreatePasswordReset(ctx, reset); err != nil {
+		return err
+	}
+	return notifier.Notify(ctx, Notification{
+		Username: user.Username,
+		Subject:  "重置密码",
+		Body: fmt.Sprintf("您正在重置旅行规划账户 %s 的密码，重置令牌为：\n\n%s\n\n令牌在 %d 分钟内有效且只能使用一次。如果这不是您本人的操作，请忽略此消息。",
+			user.Username, token, int(PasswordResetTTL/time.Minute)),
+	})
+}
+
+// LookupPasswordReset 查看重置令牌属于哪个用户，令牌仍可使用；无效或已过期时返回 ErrInvalidResetToken
+func LookupPasswordReset(ctx context.Context, stores *Stores, token string) (*PasswordReset, error) {
+	reset, err := stores.PasswordResets.GetPasswordReset(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if reset == nil {
+		return nil, ErrInvalidResetToken
+	}
+	return reset, nil
+}
+
+// ResetPassword 使用重置令牌设置新密码并撤销该用户的全部会话和个人访问令牌。令牌无效、已使用、已过期，
+// 或账户在签发令牌后被注销时返回 ErrInvalidResetToken
+func ResetPassword(ctx context.Context, stores *Stores, token, newPassword string) (*UserRecord, error) {
+	reset, err := stores.PasswordResets.ConsumePasswordReset(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if reset == nil {
+		return nil, ErrInvalidResetToken
+	}
+	user, err := stores.Users.GetUser(ctx, reset.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.ID != reset.UserID {
+		return nil, ErrInvalidResetToken
+	}
+	if _, err := ChangePassword(ctx, stores, user, newPassword); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func passwordResetKey(tokenHash string) string    { return "password_reset:" + tokenHash }
+func userPasswordResetKey(username string) string { return "user_password_reset:" + username }
+
+// CreatePasswordReset 保存令牌，并通过用户键找到之前的令牌一并删除
+func (s *RedisStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	data, err := json.Marshal(reset)
+	if err != nil {
+		return err
+	}
+	indexKey := userPasswordResetKey(reset.Username)
+	ttl := time.Until(reset.ExpiresAt)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		prev, err := tx.Get(ctx, indexKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if prev != "" {
+				pipe.Del(ctx, passwordResetKey(prev))
+			}
+			pipe.Set(ctx, passwordResetKey(reset.TokenHash), data, ttl)
+			pipe.Set(ctx, indexKey, reset.TokenHash, ttl)
+			return nil
+		})
+		return err
+	}, indexKey)
+}
+
+// GetPasswordReset 读取令牌，过期的令牌已由 Redis 删除
+func (s *RedisStore) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	data, err := s.rdb.Get(ctx, passwordResetKey(tokenHash)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reset PasswordReset
+	if err := json.Unmarshal([]byte(data), &reset); err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// casDelScript 仅当键的值仍为 ARGV[1] 时删除
+var casDelScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ConsumePasswordReset 以 GETDEL 取出令牌，并发请求中只有一个能取到
+func (s *RedisStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	data, err := s.rdb.GetDel(ctx, passwordResetKey(tokenHash)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reset PasswordReset
+	if err := json.Unmarshal([]byte(data), &reset); err != nil {
+		return nil, err
+	}
+	// 用户键指向已使用的令牌时一并删除，失败也无妨，它会随令牌过期
+	casDelScript.Run(ctx, s.rdb, []string{userPasswordResetKey(reset.Username)}, tokenHash)
+	return &reset, nil
+}
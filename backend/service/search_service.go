@@ -0,0 +1,606 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"example.com/travel_planner/backend/api"
+	"github.com/redis/go-redis/v9"
+)
+
+// SearchType 搜索的资源类型
+type SearchType string
+
+const (
+	SearchTrip    SearchType = "trip"
+	SearchDiary   SearchType = "diary"
+	SearchExpense SearchType = "expense"
+)
+
+var searchTypes = []SearchType{SearchTrip, SearchDiary, SearchExpense}
+
+// ParseSearchType 解析查询参数中的资源类型
+func ParseSearchType(s string) (SearchType, bool) {
+	for _, t := range searchTypes {
+		if string(t) == s {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// 搜索结果数量
+const (
+	DefaultSearchLimit = 10
+	MaxSearchLimit     = 50
+)
+
+// SearchScope 一个倒排索引的范围：某个用户的某类资源。
+// 行程和花费按用户名归属，日记按用户ID归属，与各自的存储方式一致
+type SearchScope struct {
+	Type  SearchType
+	Owner string
+}
+
+func tripSearchScope(username string) SearchScope { return SearchScope{SearchTrip, username} }
+func diarySearchScope(userID int64) SearchScope {
+	return SearchScope{SearchDiary, strconv.FormatInt(userID, 10)}
+}
+func expenseSearchScope(username string) SearchScope { return SearchScope{SearchExpense, username} }
+
+func (sc SearchScope) String() string { return string(sc.Type) + ":" + sc.Owner }
+
+// SearchDocument 写入索引的文档，Terms 为词项及按字段加权后的词频；
+// Terms 为空表示从索引中移除该文档
+type SearchDocument struct {
+	ID    string
+	Terms map[string]float64
+}
+
+// SearchPostings 范围内若干词项的倒排列表
+type SearchPostings struct {
+	Built    bool                          // 范围的索引是否已建立，未建立时需要先重建
+	Docs     int                           // 范围内的文档总数
+	Postings map[string]map[string]float64 // 词项 -> 文档ID -> 权重
+}
+
+// SearchIndex 按用户划分的全文倒排索引，记录写入时由各存储在同一事务中维护
+type SearchIndex interface {
+	// SearchPostings 读取范围内指定词项的倒排列表
+	SearchPostings(ctx context.Context, scope SearchScope, terms []string) (*SearchPostings, error)
+	// ReplaceSearchIndex 用 docs 整体替换范围内的索引并标记为已建立
+	ReplaceSearchIndex(ctx context.Context, scope SearchScope, docs []SearchDocument) error
+}
+
+// searchField 参与检索的一个字段，Weight 为该字段中词项的权重
+type searchField struct {
+	Name   string
+	Text   string
+	Weight float64
+}
+
+// searchRecord 可检索的记录：结果中展示的标题、日期以及建立索引的字段
+type searchRecord struct {
+	ID     string
+	Title  string
+	Date   string
+	Fields []searchField
+}
+
+func tripSearchRecord(plan *TripPlan) searchRecord {
+	fields := []searchField{
+		{"destination", plan.Request.Destination, 3},
+		{"summary", plan.Summary, 1},
+	}
+	for _, day := range plan.Itinerary {
+		for _, a := range day.Activities {
+			fields = append(fields, searchField{"activity", a.Name, 2}, searchField{"location", a.Location, 1.5})
+		}
+	}
+	return searchRecord{ID: plan.ID, Title: plan.Request.Destination, Date: plan.Request.StartDate, Fields: fields}
+}
+
+func diarySearchRecord(d *DiaryEntry) searchRecord {
+	return searchRecord{
+		ID:    strconv.FormatInt(d.ID, 10),
+		Title: d.Title,
+		Date:  d.Date,
+		Fields: []searchField{
+			{"title", d.Title, 3},
+			{"content", d.Content, 1},
+		},
+	}
+}
+
+func expenseSearchRecord(e *ExpenseRecord) searchRecord {
+	return searchRecord{
+		ID:     e.ID,
+		Title:  e.Category,
+		Date:   e.Date,
+		Fields: []searchField{{"note", e.Note, 1}},
+	}
+}
+
+// document 分词并按字段权重累计词频
+func (r searchRecord) document() SearchDocument {
+	doc := SearchDocument{ID: r.ID, Terms: make(map[string]float64)}
+	for _, f := range r.Fields {
+		for _, term := range searchTerms(f.Text) {
+			doc.Terms[term] += f.Weight
+		}
+	}
+	return doc
+}
+
+// searchTerms 使用共享的gse分词器切分文本（搜索引擎模式，长词同时产出其中的短词），
+// 统一转为小写并丢弃不含字母和数字的词
+func searchTerms(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	var terms []string
+	for _, w := range api.GetSegmenter().CutSearch(text, true) {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if strings.IndexFunc(w, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		terms = append(terms, w)
+	}
+	return terms
+}
+
+// queryTerms 切分搜索词并去重，保持出现顺序
+func queryTerms(q string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, t := range searchTerms(q) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// SearchQuery 搜索条件
+type SearchQuery struct {
+	Query string
+	Type  SearchType // 为空时搜索全部类型
+	Limit int        // 每种类型返回的最大结果数
+}
+
+// SearchHighlight 命中字段的片段，命中的词用 <mark> 标出，其余内容已做 HTML 转义
+type SearchHighlight struct {
+	Field   string `json:"field"`
+	Snippet string `json:"snippet"`
+}
+
+// SearchHit 一条搜索结果
+type SearchHit struct {
+	ID         string            `json:"id"`
+	Title      string            `json:"title"`
+	Date       string            `json:"date,omitempty"`
+	Score      float64           `json:"score"`
+	Highlights []SearchHighlight `json:"highlights"`
+}
+
+// SearchResults 按资源类型分组的搜索结果，组内按相关度倒序
+type SearchResults struct {
+	Query    string      `json:"query"`
+	Terms    []string    `json:"terms"`
+	Trips    []SearchHit `json:"trips"`
+	Diaries  []SearchHit `json:"diaries"`
+	Expenses []SearchHit `json:"expenses"`
+}
+
+// searchSource 一类资源的数据来源：all 加载全部记录用于重建索引，
+// get 加载命中的记录，已不存在的记录不出现在结果中
+type searchSource struct {
+	scope SearchScope
+	all   func(ctx context.Context) ([]searchRecord, error)
+	get   func(ctx context.Context, ids []string) (map[string]searchRecord, error)
+}
+
+func searchSources(stores *Stores, user *UserRecord) map[SearchType]searchSource {
+	userID := int64(user.ID)
+	allExpenses := func(ctx context.Context) ([]searchRecord, error) {
+		expenses, err := stores.Expenses.GetExpenses(ctx, user.Username)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]searchRecord, 0, len(expenses))
+		for _, e := range expenses {
+			records = append(records, expenseSearchRecord(e))
+		}
+		return records, nil
+	}
+
+	return map[SearchType]searchSource{
+		SearchTrip: {
+			scope: tripSearchScope(user.Username),
+			all: func(ctx context.Context) ([]searchRecord, error) {
+				trips, err := stores.Trips.GetUserTrips(ctx, user.Username)
+				if err != nil {
+					return nil, err
+				}
+				records := make([]searchRecord, 0, len(trips))
+				for _, plan := range trips {
+					records = append(records, tripSearchRecord(plan))
+				}
+				return records, nil
+			},
+			get: func(ctx context.Context, ids []string) (map[string]searchRecord, error) {
+				records := make(map[string]searchRecord)
+				for _, id := range ids {
+					plan, err := stores.Trips.GetTripPlan(ctx, id)
+					if err != nil {
+						return nil, err
+					}
+					if plan != nil && plan.Username == user.Username {
+						records[id] = tripSearchRecord(plan)
+					}
+				}
+				return records, nil
+			},
+		},
+		SearchDiary: {
+			scope: diarySearchScope(userID),
+			all: func(ctx context.Context) ([]searchRecord, error) {
+				diaries, err := stores.Diaries.GetUserDiaries(ctx, userID)
+				if err != nil {
+					return nil, err
+				}
+				records := make([]searchRecord, 0, len(diaries))
+				for i := range diaries {
+					records = append(records, diarySearchRecord(&diaries[i]))
+				}
+				return records, nil
+			},
+			get: func(ctx context.Context, ids []string) (map[string]searchRecord, error) {
+				records := make(map[string]searchRecord)
+				for _, id := range ids {
+					d, err := stores.Diaries.GetDiary(ctx, id, userID)
+					if errors.Is(err, ErrDiaryNotFound) {
+						continue
+					}
+					if err != nil {
+						return nil, err
+					}
+					records[id] = diarySearchRecord(d)
+				}
+				return records, nil
+			},
+		},
+		SearchExpense: {
+			scope: expenseSearchScope(user.Username),
+			all:   allExpenses,
+			// 花费没有按ID读取的接口，记录数不多，直接加载全部后筛选
+			get: func(ctx context.Context, ids []string) (map[string]searchRecord, error) {
+				all, err := allExpenses(ctx)
+				if err != nil {
+					return nil, err
+				}
+				wanted := make(map[string]bool, len(ids))
+				for _, id := range ids {
+					wanted[id] = true
+				}
+				records := make(map[string]searchRecord)
+				for _, r := range all {
+					if wanted[r.ID] {
+						records[r.ID] = r
+					}
+				}
+				return records, nil
+			},
+		},
+	}
+}
+
+// Search 在用户的行程、日记和花费中全文搜索，范围的索引尚未建立时（例如升级前写入的数据）先重建
+func Search(ctx context.Context, stores *Stores, user *UserRecord, q SearchQuery) (*SearchResults, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultSearchLimit
+	}
+	if q.Limit > MaxSearchLimit {
+		q.Limit = MaxSearchLimit
+	}
+	terms := queryTerms(q.Query)
+	res := &SearchResults{
+		Query:    q.Query,
+		Terms:    terms,
+		Trips:    []SearchHit{},
+		Diaries:  []SearchHit{},
+		Expenses: []SearchHit{},
+	}
+	if len(terms) == 0 {
+		return res, nil
+	}
+
+	sources := searchSources(stores, user)
+	for _, typ := range searchTypes {
+		if q.Type != "" && q.Type != typ {
+			continue
+		}
+		hits, err := searchScope(ctx, stores.Search, sources[typ], terms, q.Limit)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case SearchTrip:
+			res.Trips = hits
+		case SearchDiary:
+			res.Diaries = hits
+		case SearchExpense:
+			res.Expenses = hits
+		}
+	}
+	return res, nil
+}
+
+// BM25 词频饱和参数，文档长度差异不大，不做长度归一化
+const searchK1 = 1.2
+
+// searchScope 在一个范围内检索并返回前 limit 条结果
+func searchScope(ctx context.Context, index SearchIndex, src searchSource, terms []string, limit int) ([]SearchHit, error) {
+	post, err := index.SearchPostings(ctx, src.scope, terms)
+	if err != nil {
+		return nil, err
+	}
+	if !post.Built {
+		records, err := src.all(ctx)
+		if err != nil {
+			return nil, err
+		}
+		docs := make([]SearchDocument, 0, len(records))
+		for _, r := range records {
+			docs = append(docs, r.document())
+		}
+		if err := index.ReplaceSearchIndex(ctx, src.scope, docs); err != nil {
+			return nil, err
+		}
+		LogInfo("Rebuilt search index %s with %d documents", src.scope, len(docs))
+		if post, err = index.SearchPostings(ctx, src.scope, terms); err != nil {
+			return nil, err
+		}
+	}
+
+	// 逐词累加 BM25 得分，再乘以命中词项占比，命中全部搜索词的结果排在前面
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	n := float64(post.Docs)
+	for _, term := range terms {
+		list := post.Postings[term]
+		if len(list) == 0 {
+			continue
+		}
+		df := float64(len(list))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, w := range list {
+			scores[id] += idf * w * (searchK1 + 1) / (w + searchK1)
+			matched[id]++
+		}
+	}
+	ranked := make([]string, 0, len(scores))
+	for id := range scores {
+		scores[id] *= float64(matched[id]) / float64(len(terms))
+		ranked = append(ranked, id)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	// 按排名分批加载记录，跳过索引中已不存在的记录
+	hits := []SearchHit{}
+	for start := 0; start < len(ranked) && len(hits) < limit; start += limit {
+		batch := ranked[start:min(start+limit, len(ranked))]
+		records, err := src.get(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			r, ok := records[id]
+			if !ok {
+				continue
+			}
+			hits = append(hits, SearchHit{
+				ID:         r.ID,
+				Title:      r.Title,
+				Date:       r.Date,
+				Score:      math.Round(scores[id]*1000) / 1000,
+				Highlights: r.highlights(terms),
+			})
+			if len(hits) == limit {
+				break
+			}
+		}
+	}
+	return hits, nil
+}
+
+// 高亮片段的长度（字符数）、命中位置之前保留的上下文长度以及每条结果的最大片段数
+const (
+	snippetLength    = 60
+	snippetContext   = 20
+	maxSnippetPerHit = 3
+)
+
+// highlights 为命中搜索词的字段生成片段，字段顺序与权重顺序一致
+func (r searchRecord) highlights(terms []string) []SearchHighlight {
+	out := []SearchHighlight{}
+	seen := make(map[string]bool)
+	for _, f := range r.Fields {
+		snippet, ok := highlightSnippet(f.Text, terms)
+		if !ok || seen[f.Name+"\x00"+snippet] {
+			continue
+		}
+		seen[f.Name+"\x00"+snippet] = true
+		out = append(out, SearchHighlight{Field: f.Name, Snippet: snippet})
+		if len(out) == maxSnippetPerHit {
+			break
+		}
+	}
+	return out
+}
+
+// highlightSnippet 截取第一个命中位置附近的片段，并用 <mark> 标出片段中所有命中的词；
+// 匹配不区分大小写，文本中没有命中时返回 false
+func highlightSnippet(text string, terms []string) (string, bool) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		tr := []rune(term)
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if string(lower[i:i+len(tr)]) != term {
+				continue
+			}
+			for j := i; j < i+len(tr); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	start := max(0, first-snippetContext)
+	end := min(len(runes), start+snippetLength)
+	start = max(0, end-snippetLength)
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		part := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + part + "</mark>")
+		} else {
+			b.WriteString(part)
+		}
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// Redis 中每个范围的索引键：
+//
+//	search:<type>:<owner>:t:<term>  哈希，文档ID -> 权重
+//	search:<type>:<owner>:d:<id>    哈希，词项 -> 权重，用于更新时移除旧的倒排项
+//	search:<type>:<owner>:docs      集合，范围内的文档ID
+//	search:<type>:<owner>:built     存在时表示索引已建立
+func searchKey(scope SearchScope, part string) string { return "search:" + scope.String() + ":" + part }
+
+// searchIndexScript 用新词项替换文档的倒排项；没有新词项时从索引中移除文档。
+// 倒排键由前缀拼接，只适用于单实例 Redis
+var searchIndexScript = redis.NewScript(`
+for _, term in ipairs(redis.call('HKEYS', KEYS[1])) do
+	redis.call('HDEL', ARGV[1] .. term, ARGV[2])
+end
+redis.call('DEL', KEYS[1])
+if #ARGV < 3 then
+	redis.call('SREM', KEYS[2], ARGV[2])
+	return 0
+end
+for i = 3, #ARGV, 2 do
+	redis.call('HSET', ARGV[1] .. ARGV[i], ARGV[2], ARGV[i + 1])
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('SADD', KEYS[2], ARGV[2])
+return 1
+`)
+
+// indexSearchDoc 更新文档的倒排项；在 MULTI 中使用 EVAL 而不是 EVALSHA，
+// 避免脚本未缓存时整个事务失败
+func indexSearchDoc(ctx context.Context, c redis.Scripter, scope SearchScope, doc SearchDocument) *redis.Cmd {
+	args := []interface{}{searchKey(scope, "t:"), doc.ID}
+	for term, w := range doc.Terms {
+		args = append(args, term, strconv.FormatFloat(w, 'f', -1, 64))
+	}
+	return searchIndexScript.Eval(ctx, c, []string{searchKey(scope, "d:"+doc.ID), searchKey(scope, "docs")}, args...)
+}
+
+// reindexSearchDoc 在记录写入后单独更新索引，失败时清除已建立标记，下次搜索时重建
+func (s *RedisStore) reindexSearchDoc(ctx context.Context, scope SearchScope, doc SearchDocument) {
+	if err := indexSearchDoc(ctx, s.rdb, scope, doc).Err(); err != nil {
+		LogWarn("Failed to update search index %s for %s: %v", scope, doc.ID, err)
+		s.rdb.Del(ctx, searchKey(scope, "built"))
+	}
+}
+
+// SearchPostings 读取范围内指定词项的倒排列表
+func (s *RedisStore) SearchPostings(ctx context.Context, scope SearchScope, terms []string) (*SearchPostings, error) {
+	var (
+		built, docs *redis.IntCmd
+		lists       = make([]*redis.MapStringStringCmd, len(terms))
+	)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		built = pipe.Exists(ctx, searchKey(scope, "built"))
+		docs = pipe.SCard(ctx, searchKey(scope, "docs"))
+		for i, term := range terms {
+			lists[i] = pipe.HGetAll(ctx, searchKey(scope, "t:"+term))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	post := &SearchPostings{
+		Built:    built.Val() > 0,
+		Docs:     int(docs.Val()),
+		Postings: make(map[string]map[string]float64, len(terms)),
+	}
+	for i, term := range terms {
+		list := make(map[string]float64)
+		for id, v := range lists[i].Val() {
+			if w, err := strconv.ParseFloat(v, 64); err == nil {
+				list[id] = w
+			}
+		}
+		post.Postings[term] = list
+	}
+	return post, nil
+}
+
+// ReplaceSearchIndex 在一个事务中移除范围内现有文档并写入 docs。
+// 读取文档集合之后新写入的文档由写入方自行建立索引，不会被这里移除
+func (s *RedisStore) ReplaceSearchIndex(ctx context.Context, scope SearchScope, docs []SearchDocument) error {
+	existing, err := s.rdb.SMembers(ctx, searchKey(scope, "docs")).Result()
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range existing {
+			indexSearchDoc(ctx, pipe, scope, SearchDocument{ID: id})
+		}
+		for _, doc := range docs {
+			indexSearchDoc(ctx, pipe, scope, doc)
+		}
+		pipe.Set(ctx, searchKey(scope, "built"), 1, 0)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,454 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused 已轮换的 refresh token 被再次使用，说明它可能已泄露，会话随之撤销
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// 令牌有效期，可通过配置修改
+var (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Session 登录会话。每次登录创建一个会话，access token 通过 sid 关联到会话，
+// 会话被删除后其 access token 立即失效；refresh token 只保存 SHA256 摘要
+type Session struct {
+	ID          string    `json:"id"`
+	UserID      int       `json:"userId"`
+	Username    string    `json:"username"`
+	TokenHash   string    `json:"tokenHash"`          // 当前 refresh token 的摘要
+	PrevHash    string    `json:"prevHash,omitempty"` // 上一个 refresh token 的摘要，用于发现重放
+	CreatedAt   time.Time `json:"createdAt"`
+	RefreshedAt time.Time `json:"refreshedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	UserAgent   string    `json:"userAgent,omitempty"`  // 登录时的 User-Agent
+	IP          string    `json:"ip,omitempty"`         // 最近一次请求的 IP
+	LastSeenAt  time.Time `json:"lastSeenAt,omitempty"` // 最近一次请求的时间，旧会话为零值
+}
+
+// DeviceInfo 发起登录或请求的客户端信息
+type DeviceInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// maxUserAgentLength 保存的 User-Agent 最大长度
+const maxUserAgentLength = 256
+
+// sessionTouchInterval 最近使用时间的更新间隔，IP 变化时立即更新
+const sessionTouchInterval = time.Minute
+
+// SessionInfo 返回给客户端的会话信息，不包含 refresh token 摘要
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"` // 是否为发起请求的会话
+}
+
+// Info 返回会话的展示信息，currentID 为发起请求的会话
+func (sess *Session) Info(currentID string) *SessionInfo {
+	return &SessionInfo{
+		ID:         sess.ID,
+		Device:     DescribeUserAgent(sess.UserAgent),
+		UserAgent:  sess.UserAgent,
+		IP:         sess.IP,
+		CreatedAt:  sess.CreatedAt,
+		LastSeenAt: sess.lastSeen(),
+		ExpiresAt:  sess.ExpiresAt,
+		Current:    sess.ID == currentID,
+	}
+}
+
+// lastSeen 最近一次使用时间，没有记录的旧会话以最近一次刷新时间代替
+func (sess *Session) lastSeen() time.Time {
+	if sess.LastSeenAt.After(sess.RefreshedAt) {
+		return sess.LastSeenAt
+	}
+	return sess.RefreshedAt
+}
+
+// SessionStore 登录会话存储
+type SessionStore interface {
+	// CreateSession 保存新会话
+	CreateSession(ctx context.Context, sess *Session) error
+	// GetSession 获取会话，不存在或已过期时返回 nil, nil
+	GetSession(ctx context.Context, id string) (*Session, error)
+	// RotateSession 仅当会话当前的 refresh token 摘要仍为 oldHash 时更新为 sess，
+	// 否则返回 ErrInvalidRefreshToken（会话不存在或已被并发轮换）
+	RotateSession(ctx context.Context, sess *Session, oldHash string) error
+	// DeleteSession 删除会话，不存在时不做任何操作
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions 删除用户的全部会话，返回删除数量
+	DeleteUserSessions(ctx context.Context, username string) (int, error)
+	// ListUserSessions 列出用户未过期的会话，按创建时间排序
+	ListUserSessions(ctx context.Context, username string) ([]*Session, error)
+	// TouchSession 更新会话的最近使用时间和 IP，会话已被删除时不做任何操作
+	TouchSession(ctx context.Context, id string, at time.Time, ip string) error
+}
+
+// TokenPair 登录或刷新后返回给客户端的令牌
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // access token 有效秒数
+}
+
+// randomToken 生成 n 字节的随机串，URL 安全编码
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken 令牌的 SHA256 摘要，服务端只保存摘要
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens 为会话签发携带 role 的 access token，并生成新的 refresh token 写入 sess.TokenHash
+func issueTokens(sess *Session, role string) (*TokenPair, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	sess.TokenHash = hashToken(secret)
+	access, err := GenerateToken(sess.UserID, sess.Username, role, sess.ID, AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: sess.ID + "." + secret,
+		ExpiresIn:    int(AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// StartSession 为登录的用户创建会话并签发令牌，会话记录登录客户端的信息
+func StartSession(ctx context.Context, store SessionStore, user *UserRecord, device DeviceInfo) (*TokenPair, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &Session{
+		ID:          id,
+		UserID:      user.ID,
+		Username:    user.Username,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(RefreshTokenTTL),
+		UserAgent:   truncateUserAgent(device.UserAgent),
+		IP:          device.IP,
+		LastSeenAt:  now,
+	}
+	pair, err := issueTokens(sess, user.Role)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CreateSession(ctx, sess); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// RefreshSession 用 refresh token 换取新的令牌，旧的 refresh token 随之失效，会话有效期顺延。
+// 出示上一个已轮换的 refresh token 时撤销整个会话并返回 ErrRefreshTokenReused。
+// 新的 access token 按用户的当前角色签发，用户已注销或被停用时撤销会话并返回 ErrInvalidRefreshToken。
+// 刷新同时更新会话的最近使用时间和 IP
+func RefreshSession(ctx context.Context, store SessionStore, users UserStore, refreshToken string, device DeviceInfo) (*TokenPair, *Session, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	sess, err := store.GetSession(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sess == nil {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	hash := hashToken(secret)
+	if sess.PrevHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(sess.PrevHash)) == 1 {
+		if err := store.DeleteSession(ctx, id); err != nil {
+			return nil, sess, err
+		}
+		return nil, sess, ErrRefreshTokenReused
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(sess.TokenHash)) != 1 {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	user, err := users.GetUser(ctx, sess.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil || user.ID != sess.UserID || user.Disabled {
+		if err := store.DeleteSession(ctx, id); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	sess.PrevHash = sess.TokenHash
+	sess.RefreshedAt = now
+	sess.ExpiresAt = now.Add(RefreshTokenTTL)
+	sess.LastSeenAt = now
+	sess.IP = device.IP
+	pair, err := issueTokens(sess, user.Role)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.RotateSession(ctx, sess, hash); err != nil {
+		return nil, nil, err
+	}
+	return pair, sess, nil
+}
+
+// TouchSessionIfStale 认证通过后更新会话的最近使用时间，距上次更新不足 sessionTouchInterval 且 IP 未变化时跳过
+func TouchSessionIfStale(ctx context.Context, store SessionStore, sess *Session, ip string) {
+	now := time.Now()
+	if now.Sub(sess.lastSeen()) < sessionTouchInterval && ip == sess.IP {
+		return
+	}
+	if err := store.TouchSession(ctx, sess.ID, now, ip); err != nil {
+		LogWarn("Failed to update last use of session %s: %v", sess.ID, err)
+	}
+}
+
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+	// 按字节截断后去掉可能被截断的多字节字符
+	return strings.ToValidUTF8(ua[:maxUserAgentLength], "")
+}
+
+// userAgentBrowsers 和 userAgentSystems 按顺序匹配 User-Agent 中的标识，先匹配到的优先（Edge 的 UA 也包含 Chrome）
+var (
+	userAgentBrowsers = [][2]string{
+		{"MicroMessenger", "微信"}, {"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"}, {"python-requests", "Python"},
+		{"Go-http-client", "Go"}, {"PostmanRuntime", "Postman"},
+	}
+	userAgentSystems = [][2]string{
+		{"Windows", "Windows"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"},
+		{"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	}
+)
+
+// DescribeUserAgent 从 User-Agent 中粗略识别浏览器和操作系统，例如 "Chrome · Windows"，无法识别时返回 "未知设备"
+func DescribeUserAgent(ua string) string {
+	var parts []string
+	for _, rules := range [][][2]string{userAgentBrowsers, userAgentSystems} {
+		for _, r := range rules {
+			if strings.Contains(ua, r[0]) {
+				parts = append(parts, r[1])
+				break
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "未知设备"
+	}
+	return strings.Join(parts, " · ")
+}
+
+func sessionKey(id string) string            { return "session:" + id }
+func userSessionsKey(username string) string { return "user_sessions:" + username }
+
+// CreateSession 保存会话，会话键与用户会话集合的过期时间与最新的会话一致
+func (s *RedisStore) CreateSession(ctx context.Context, sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(sess.ID), data, time.Until(sess.ExpiresAt))
+		pipe.SAdd(ctx, userSessionsKey(sess.Username), sess.ID)
+		pipe.ExpireAt(ctx, userSessionsKey(sess.Username), sess.ExpiresAt)
+		return nil
+	})
+	return err
+}
+
+// GetSession 获取会话
+func (s *RedisStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	data, err := s.rdb.Get(ctx, sessionKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal([]byte(data), &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// RotateSession 在监视会话键的事务中比较摘要后写入
+func (s *RedisStore) RotateSession(ctx context.Context, sess *Session, oldHash string) error {
+	key := sessionKey(sess.ID)
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	err = s.watchRetry(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		var current Session
+		if err := json.Unmarshal([]byte(raw), &current); err != nil {
+			return err
+		}
+		if current.TokenHash != oldHash {
+			return ErrInvalidRefreshToken
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, time.Until(sess.ExpiresAt))
+			pipe.ExpireAt(ctx, userSessionsKey(sess.Username), sess.ExpiresAt)
+			return nil
+		})
+		return err
+	}, key)
+	// 冲突时重新比较摘要，并发刷新时只有一个请求成功，其余按无效令牌处理
+	if err == ErrConcurrentUpdate {
+		return ErrInvalidRefreshToken
+	}
+	return err
+}
+
+// DeleteSession 删除会话
+func (s *RedisStore) DeleteSession(ctx context.Context, id string) error {
+	sess, err := s.GetSession(ctx, id)
+	if err != nil || sess == nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(sess.Username), id)
+		return nil
+	})
+	return err
+}
+
+// DeleteUserSessions 删除用户的全部会话，已过期的会话键不计入数量
+func (s *RedisStore) DeleteUserSessions(ctx context.Context, username string) (int, error) {
+	ids, err := s.rdb.SMembers(ctx, userSessionsKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	var del *redis.IntCmd
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(keys) > 0 {
+			del = pipe.Del(ctx, keys...)
+		}
+		pipe.Del(ctx, userSessionsKey(username))
+		return nil
+	})
+	if err != nil || del == nil {
+		return 0, err
+	}
+	return int(del.Val()), nil
+}
+
+// ListUserSessions 批量读取用户集合中的会话，并从集合中移除已过期的ID
+func (s *RedisStore) ListUserSessions(ctx context.Context, username string) ([]*Session, error) {
+	indexKey := userSessionsKey(username)
+	ids, err := s.rdb.SMembers(ctx, indexKey).Result()
+	if err != nil || len(ids) == 0 {
+		return []*Session{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionKey(id)
+	}
+	vals, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(ids))
+	var expired []interface{}
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+		var sess Session
+		if err := json.Unmarshal([]byte(data), &sess); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &sess)
+	}
+	if len(expired) > 0 {
+		s.rdb.SRem(ctx, indexKey, expired...)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// TouchSession 在监视会话键的事务中写回，不会覆盖并发轮换的 refresh token 摘要
+func (s *RedisStore) TouchSession(ctx context.Context, id string, at time.Time, ip string) error {
+	key := sessionKey(id)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var sess Session
+		if err := json.Unmarshal([]byte(raw), &sess); err != nil {
+			return err
+		}
+		sess.LastSeenAt = at
+		sess.IP = ip
+		data, err := json.Marshal(&sess)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		return err
+	}, key)
+}
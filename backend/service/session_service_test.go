@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// authStatus 以 token 经过 AuthMiddleware 发送请求，返回响应状态码；resource 为空时只接受登录后的 access token
+func authStatus(t *testing.T, stores *Stores, method, resource, token string) int {
+	t.Helper()
+	r := gin.New()
+	r.Handle(method, "/", AuthMiddleware(stores, resource), func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(method, "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRefreshSessionRotation(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+
+	first, err := StartSession(ctx, stores.Sessions, u, DeviceInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	second, sess, err := RefreshSession(ctx, stores.Sessions, stores.Users, first.RefreshToken, DeviceInfo{IP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || sess.IP != "10.0.0.2" {
+		t.Fatalf("refresh did not rotate the token or record the IP: %+v", sess)
+	}
+	// 轮换前签发的 access token 在会话有效期间仍然可用
+	for _, token := range []string{first.AccessToken, second.AccessToken} {
+		if code := authStatus(t, stores, http.MethodGet, "", token); code != http.StatusOK {
+			t.Fatalf("access token of a live session = %d; want 200", code)
+		}
+	}
+
+	// 重放已轮换的 refresh token 撤销整个会话，新的令牌也随之失效
+	if _, _, err := RefreshSession(ctx, stores.Sessions, stores.Users, first.RefreshToken, DeviceInfo{}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("replayed refresh token = %v; want ErrRefreshTokenReused", err)
+	}
+	if got, _ := stores.Sessions.GetSession(ctx, sess.ID); got != nil {
+		t.Fatal("session survived refresh token reuse")
+	}
+	if _, _, err := RefreshSession(ctx, stores.Sessions, stores.Users, second.RefreshToken, DeviceInfo{}); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("current refresh token after reuse = %v; want ErrInvalidRefreshToken", err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "", second.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("access token after reuse = %d; want 401", code)
+	}
+
+	for _, token := range []string{"", "no-dot", sess.ID + ".forged", "missing.secret"} {
+		if _, _, err := RefreshSession(ctx, stores.Sessions, stores.Users, token, DeviceInfo{}); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("RefreshSession(%q) = %v; want ErrInvalidRefreshToken", token, err)
+		}
+	}
+}
+
+func TestAuthMiddlewareRevokedSession(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	start := func() *TokenPair {
+		pair, err := StartSession(ctx, stores.Sessions, u, DeviceInfo{})
+		if err != nil {
+			t.Fatalf("StartSession: %v", err)
+		}
+		return pair
+	}
+
+	pair := start()
+	claims, err := ParseToken(pair.AccessToken)
+	if err != nil || claims.SessionID == "" {
+		t.Fatalf("ParseToken = %+v, %v; want a session id", claims, err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "", pair.AccessToken); code != http.StatusOK {
+		t.Fatalf("live session = %d; want 200", code)
+	}
+	if err := stores.Sessions.DeleteSession(ctx, claims.SessionID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "", pair.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("revoked session = %d; want 401", code)
+	}
+
+	// 登出全部设备
+	a, c := start(), start()
+	if n, err := stores.Sessions.DeleteUserSessions(ctx, "alice"); err != nil || n != 2 {
+		t.Fatalf("DeleteUserSessions = %d, %v; want 2", n, err)
+	}
+	for _, p := range []*TokenPair{a, c} {
+		if code := authStatus(t, stores, http.MethodGet, "", p.AccessToken); code != http.StatusUnauthorized {
+			t.Fatalf("session after logging out everywhere = %d; want 401", code)
+		}
+	}
+
+	// 没有 sid 的 token 不被接受
+	legacy, err := GenerateToken(u.ID, u.Username, u.Role, "", AccessTokenTTL)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if code := authStatus(t, stores, http.MethodGet, "", legacy); code != http.StatusUnauthorized {
+		t.Fatalf("token without a session = %d; want 401", code)
+	}
+}
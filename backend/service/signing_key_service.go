@@ -0,0 +1,243 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"example.com/travel_planner/backend/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrNoSigningKeys 既没有配置 auth.keys 也没有设置 JWT_SECRET，且未允许使用临时密钥
+var ErrNoSigningKeys = errors.New("no jwt signing keys configured: set auth.keys or JWT_SECRET, or enable auth.ephemeralKey for local development")
+
+// SigningKey JWT 签名密钥，通过 token 头部的 kid 区分。private 为 nil 的密钥只用于验证，
+// 轮换时将旧密钥保留为验证密钥，已签发的 token 在过期前仍然有效
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// KeySet 当前的签名密钥和全部可用于验证的密钥
+type KeySet struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+	order   []string // 配置顺序，JWKS 按此顺序输出
+}
+
+// signingKeys 在 InitSigningKeys 之前为进程内随机生成的临时密钥，不存在可以伪造 token 的默认密钥
+var signingKeys = ephemeralKeySet()
+
+func singleKeySet(key *SigningKey) *KeySet {
+	return &KeySet{signing: key, keys: map[string]*SigningKey{key.ID: key}, order: []string{key.ID}}
+}
+
+// ephemeralKeySet 生成只在当前进程内有效的随机 HS256 密钥，重启后已签发的 token 全部失效
+func ephemeralKeySet() *KeySet {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("generate ephemeral jwt key: " + err.Error())
+	}
+	return singleKeySet(&SigningKey{
+		ID:      "ephemeral",
+		Method:  jwt.SigningMethodHS256,
+		private: secret,
+		public:  secret,
+	})
+}
+
+// InitSigningKeys 按配置加载签名密钥。未配置密钥时使用环境变量 JWT_SECRET 作为 HS256 密钥，
+// 两者都没有时返回 ErrNoSigningKeys，只有开启 ephemeralKey 时才使用随机生成的临时密钥；
+// 环境变量 JWT_SIGNING_KEY 可覆盖 signingKey 配置
+func InitSigningKeys(cfg config.AuthConfig) error {
+	specs := cfg.Keys
+	if len(specs) == 0 {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			if !cfg.EphemeralKey {
+				return ErrNoSigningKeys
+			}
+			signingKeys = ephemeralKeySet()
+			LogWarn("No JWT signing keys configured, using a random key that is lost on restart")
+			return nil
+		}
+		specs = []config.JWTKeyConfig{{ID: "env", Algorithm: "HS256", Secret: secret}}
+	}
+	active := cfg.SigningKey
+	if v := os.Getenv("JWT_SIGNING_KEY"); v != "" {
+		active = v
+	}
+
+	ks, err := loadKeySet(specs, active)
+	if err != nil {
+		return err
+	}
+	signingKeys = ks
+	LogInfo("Loaded %d JWT keys, signing with %q (%s)", len(ks.keys), ks.signing.ID, ks.signing.Method.Alg())
+	return nil
+}
+
+// loadKeySet 解析密钥配置；active 为空时使用第一个可以签名的密钥
+func loadKeySet(specs []config.JWTKeyConfig, active string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*SigningKey, len(specs))}
+	for i, spec := range specs {
+		key, err := loadSigningKey(spec)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %d (%q): %w", i, spec.ID, err)
+		}
+		if _, dup := ks.keys[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate jwt key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+		ks.order = append(ks.order, key.ID)
+		if ks.signing == nil && active == "" && key.private != nil {
+			ks.signing = key
+		}
+	}
+	if active != "" {
+		ks.signing = ks.keys[active]
+		if ks.signing == nil {
+			return nil, fmt.Errorf("signing key %q is not configured", active)
+		}
+	}
+	if ks.signing == nil || ks.signing.private == nil {
+		return nil, errors.New("no jwt key with a secret or private key to sign with")
+	}
+	return ks, nil
+}
+
+// loadSigningKey 解析单个密钥：HS256 使用 secret 或 secretEnv 指定的环境变量，
+// RS256 和 EdDSA 从 PEM 文件读取私钥，只配置公钥文件时作为验证密钥
+func loadSigningKey(spec config.JWTKeyConfig) (*SigningKey, error) {
+	if spec.ID == "" {
+		return nil, errors.New("missing id")
+	}
+	key := &SigningKey{ID: spec.ID}
+
+	switch strings.ToUpper(spec.Algorithm) {
+	case "", "HS256":
+		key.Method = jwt.SigningMethodHS256
+		secret := spec.Secret
+		if spec.SecretEnv != "" {
+			secret = os.Getenv(spec.SecretEnv)
+		}
+		if secret == "" {
+			return nil, errors.New("missing secret")
+		}
+		if len(secret) < 32 {
+			LogWarn("JWT key %q: HS256 secret shorter than 32 bytes", spec.ID)
+		}
+		key.private, key.public = []byte(secret), []byte(secret)
+		return key, nil
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+	case "EDDSA":
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", spec.Algorithm)
+	}
+
+	if spec.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(spec.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.Method == jwt.SigningMethodRS256 {
+			priv, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.private, key.public = priv, &priv.PublicKey
+		} else {
+			priv, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.private, key.public = priv, priv.(ed25519.PrivateKey).Public()
+		}
+		return key, nil
+	}
+	if spec.PublicKeyFile == "" {
+		return nil, errors.New("missing privateKeyFile or publicKeyFile")
+	}
+	pem, err := os.ReadFile(spec.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key.Method == jwt.SigningMethodRS256 {
+		key.public, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+	} else {
+		key.public, err = jwt.ParseEdPublicKeyFromPEM(pem)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// verificationKey 按 token 头部的 kid 查找验证密钥，算法必须与密钥一致；
+// 没有 kid 的 token 由当前签名密钥验证
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	key := ks.signing
+	if kid, ok := token.Header["kid"]; ok {
+		id, _ := kid.(string)
+		if key = ks.keys[id]; key == nil {
+			return nil, fmt.Errorf("unknown key id %q", id)
+		}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), key.ID)
+	}
+	return key.public, nil
+}
+
+// JWK 公钥的 JSON Web Key 表示
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA 模数
+	E   string `json:"e,omitempty"`   // RSA 指数
+	Crv string `json:"crv,omitempty"` // OKP 曲线
+	X   string `json:"x,omitempty"`   // Ed25519 公钥
+}
+
+// JWKS JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWKS 返回全部非对称密钥的公钥（包括只用于验证的旧密钥），HS256 密钥不会公开
+func PublicJWKS() JWKS {
+	ks := signingKeys
+	set := JWKS{Keys: []JWK{}}
+	b64 := base64.RawURLEncoding
+	for _, id := range ks.order {
+		key := ks.keys[id]
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64.EncodeToString(pub.N.Bytes())
+			jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/travel_planner/backend/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeyFiles 生成 RSA 和 Ed25519 密钥对并写入 PEM 文件
+type testKeyFiles struct {
+	rsa             *rsa.PrivateKey
+	ed              ed25519.PrivateKey
+	rsaPriv, rsaPub string
+	edPriv, edPub   string
+	rsaPubPEM       []byte // RSA 公钥的 PEM 内容
+}
+
+func newTestKeyFiles(t *testing.T) *testKeyFiles {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, typ string, der []byte) (string, []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path, data
+	}
+	marshal := func(der []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	k := &testKeyFiles{}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	var edPub ed25519.PublicKey
+	if edPub, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	k.rsaPriv, _ = write("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k.rsa))
+	k.rsaPub, k.rsaPubPEM = write("rsa.pub.pem", "PUBLIC KEY", marshal(x509.MarshalPKIXPublicKey(&k.rsa.PublicKey)))
+	k.edPriv, _ = write("ed.pem", "PRIVATE KEY", marshal(x509.MarshalPKCS8PrivateKey(k.ed)))
+	k.edPub, _ = write("ed.pub.pem", "PUBLIC KEY", marshal(x509.MarshalPKIXPublicKey(edPub)))
+	return k
+}
+
+// useSigningKeys 按配置加载签名密钥，测试结束后恢复原来的密钥
+func useSigningKeys(t *testing.T, cfg config.AuthConfig) {
+	t.Helper()
+	saved := signingKeys
+	t.Cleanup(func() { signingKeys = saved })
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SIGNING_KEY", "")
+	if err := InitSigningKeys(cfg); err != nil {
+		t.Fatalf("InitSigningKeys: %v", err)
+	}
+}
+
+// tokenHeader 解码 token 头部
+func tokenHeader(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+	part, _, _ := strings.Cut(token, ".")
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func mustGenerateToken(t *testing.T) string {
+	t.Helper()
+	token, err := GenerateToken(1, "alice", RoleUser, "sid", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	return token
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	k := newTestKeyFiles(t)
+
+	// 轮换前使用 RS256 密钥签名
+	useSigningKeys(t, config.AuthConfig{Keys: []config.JWTKeyConfig{
+		{ID: "old", Algorithm: "RS256", PrivateKeyFile: k.rsaPriv},
+	}})
+	old := mustGenerateToken(t)
+	if h := tokenHeader(t, old); h["kid"] != "old" || h["alg"] != "RS256" {
+		t.Fatalf("token header = %v; want kid old, RS256", h)
+	}
+
+	// 轮换后用新密钥签名，旧密钥只保留公钥用于验证
+	useSigningKeys(t, config.AuthConfig{SigningKey: "new", Keys: []config.JWTKeyConfig{
+		{ID: "old", Algorithm: "RS256", PublicKeyFile: k.rsaPub},
+		{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: k.edPriv},
+	}})
+	current := mustGenerateToken(t)
+	if h := tokenHeader(t, current); h["kid"] != "new" || h["alg"] != "EdDSA" {
+		t.Fatalf("token header after rotation = %v; want kid new, EdDSA", h)
+	}
+	for name, token := range map[string]string{"old": old, "new": current} {
+		claims, err := ParseToken(token)
+		if err != nil || claims.Username != "alice" || claims.SessionID != "sid" {
+			t.Fatalf("ParseToken(%s) = %+v, %v", name, claims, err)
+		}
+	}
+
+	// 旧公钥撤下后，用它签发的 token 不再有效
+	useSigningKeys(t, config.AuthConfig{Keys: []config.JWTKeyConfig{
+		{ID: "new", Algorithm: "EdDSA", PrivateKeyFile: k.edPriv},
+	}})
+	if _, err := ParseToken(old); err == nil {
+		t.Fatal("token signed with a retired key still verifies")
+	}
+	if _, err := ParseToken(current); err != nil {
+		t.Fatalf("ParseToken(current): %v", err)
+	}
+}
+
+func TestParseTokenRejectsKeyMismatch(t *testing.T) {
+	k := newTestKeyFiles(t)
+	useSigningKeys(t, config.AuthConfig{SigningKey: "hs", Keys: []config.JWTKeyConfig{
+		{ID: "hs", Algorithm: "HS256", Secret: strings.Repeat("s", 32)},
+		{ID: "rsa", Algorithm: "RS256", PublicKeyFile: k.rsaPub},
+	}})
+	claims := Claims{
+		UserID:   1,
+		Username: "mallory",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		t.Helper()
+		tok := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			tok.Header["kid"] = kid
+		}
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"unknown kid": sign(jwt.SigningMethodHS256, "missing", []byte(strings.Repeat("s", 32))),
+		// 以公开的 RSA 公钥作为 HMAC 密钥伪造 token
+		"HS256 with an RSA kid":   sign(jwt.SigningMethodHS256, "rsa", k.rsaPubPEM),
+		"RS256 with an HS kid":    sign(jwt.SigningMethodRS256, "hs", otherRSA),
+		"RS256 by another key":    sign(jwt.SigningMethodRS256, "rsa", otherRSA),
+		"no kid, wrong secret":    sign(jwt.SigningMethodHS256, "", []byte(strings.Repeat("x", 32))),
+		"no kid, other method":    sign(jwt.SigningMethodRS256, "", k.rsa),
+		"unsigned":                sign(jwt.SigningMethodNone, "hs", jwt.UnsafeAllowNoneSignatureType),
+		"EdDSA with an RSA kid":   sign(jwt.SigningMethodEdDSA, "rsa", k.ed),
+		"EdDSA with an HS kid":    sign(jwt.SigningMethodEdDSA, "hs", k.ed),
+		"HS256 by another secret": sign(jwt.SigningMethodHS256, "hs", []byte(strings.Repeat("y", 32))),
+	}
+	for name, token := range cases {
+		if c, err := ParseToken(token); err == nil {
+			t.Errorf("%s: ParseToken accepted %+v", name, c)
+		}
+	}
+	// 对照：同一密钥正确签发的 token 可以通过
+	if _, err := ParseToken(sign(jwt.SigningMethodHS256, "hs", []byte(strings.Repeat("s", 32)))); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+}
+
+func TestPublicJWKS(t *testing.T) {
+	k := newTestKeyFiles(t)
+	secret := strings.Repeat("s", 32)
+	useSigningKeys(t, config.AuthConfig{Keys: []config.JWTKeyConfig{
+		{ID: "hs", Algorithm: "HS256", Secret: secret},
+		{ID: "rsa", Algorithm: "RS256", PrivateKeyFile: k.rsaPriv},
+		{ID: "ed", Algorithm: "EdDSA", PrivateKeyFile: k.edPriv},
+		{ID: "ed-old", Algorithm: "EdDSA", PublicKeyFile: k.edPub},
+	}})
+
+	set := PublicJWKS()
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	// 对称密钥不公开，非对称密钥只输出公钥参数
+	var kids []string
+	for _, key := range raw.Keys {
+		kids = append(kids, key["kid"].(string))
+		for member := range key {
+			switch member {
+			case "kty", "kid", "use", "alg", "n", "e", "crv", "x":
+			default:
+				t.Errorf("key %v has non-public member %q", key["kid"], member)
+			}
+		}
+	}
+	if strings.Join(kids, ",") != "rsa,ed,ed-old" {
+		t.Fatalf("JWKS kids = %v; want rsa, ed, ed-old", kids)
+	}
+	if strings.Contains(string(data), secret) || strings.Contains(string(data), base64.RawURLEncoding.EncodeToString([]byte(secret))) {
+		t.Fatal("JWKS contains the HS256 secret")
+	}
+
+	b64 := base64.RawURLEncoding
+	rsaKey, edKey := set.Keys[0], set.Keys[1]
+	if rsaKey.Kty != "RSA" || rsaKey.Alg != "RS256" || rsaKey.N != b64.EncodeToString(k.rsa.N.Bytes()) ||
+		rsaKey.E != b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes()) {
+		t.Errorf("RSA JWK = %+v; want the public modulus and exponent", rsaKey)
+	}
+	if edKey.Kty != "OKP" || edKey.Crv != "Ed25519" || edKey.X != b64.EncodeToString(k.ed.Public().(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 JWK = %+v; want the public key", edKey)
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	k := newTestKeyFiles(t)
+	secret := strings.Repeat("s", 32)
+	cases := map[string]struct {
+		specs  []config.JWTKeyConfig
+		active string
+	}{
+		"duplicate id":   {specs: []config.JWTKeyConfig{{ID: "a", Secret: secret}, {ID: "a", Secret: secret}}},
+		"missing active": {specs: []config.JWTKeyConfig{{ID: "a", Secret: secret}}, active: "b"},
+		"active without a private key": {
+			specs:  []config.JWTKeyConfig{{ID: "a", Secret: secret}, {ID: "pub", Algorithm: "RS256", PublicKeyFile: k.rsaPub}},
+			active: "pub",
+		},
+		"only public keys":      {specs: []config.JWTKeyConfig{{ID: "pub", Algorithm: "RS256", PublicKeyFile: k.rsaPub}}},
+		"unsupported algorithm": {specs: []config.JWTKeyConfig{{ID: "a", Algorithm: "ES256", PrivateKeyFile: k.rsaPriv}}},
+		"wrong key type":        {specs: []config.JWTKeyConfig{{ID: "a", Algorithm: "EdDSA", PrivateKeyFile: k.rsaPriv}}},
+		"missing secret":        {specs: []config.JWTKeyConfig{{ID: "a"}}},
+	}
+	for name, tc := range cases {
+		if _, err := loadKeySet(tc.specs, tc.active); err == nil {
+			t.Errorf("%s: loadKeySet succeeded", name)
+		}
+	}
+
+	t.Setenv("JWT_SECRET", "")
+	if err := InitSigningKeys(config.AuthConfig{}); err != ErrNoSigningKeys {
+		t.Fatalf("InitSigningKeys without keys = %v; want ErrNoSigningKeys", err)
+	}
+}
@@ -0,0 +1,2259 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SQLiteStore 基于嵌入式 SQLite 的存储实现，无需额外的数据库进程
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqliteSchema 按版本顺序排列的建表语句，数据库当前版本记录在 PRAGMA user_version
+var sqliteSchema = []string{
+	// v1: 初始表结构
+	`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		username      TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL
+	);
+
+	CREATE TABLE trips (
+		id            TEXT PRIMARY KEY,
+		user_id       INTEGER NOT NULL,
+		username      TEXT NOT NULL,
+		destination   TEXT NOT NULL DEFAULT '',
+		start_date    TEXT NOT NULL DEFAULT '',
+		end_date      TEXT NOT NULL DEFAULT '',
+		budget        REAL NOT NULL DEFAULT 0,
+		travelers     INTEGER NOT NULL DEFAULT 0,
+		preferences   TEXT NOT NULL DEFAULT 'null',
+		special_needs TEXT NOT NULL DEFAULT '',
+		total_cost    REAL NOT NULL DEFAULT 0,
+		summary       TEXT NOT NULL DEFAULT '',
+		created_at    TEXT NOT NULL,
+		updated_at    TEXT NOT NULL
+	);
+	CREATE INDEX idx_trips_username ON trips(username, created_at);
+
+	CREATE TABLE trip_days (
+		trip_id       TEXT NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+		day_index     INTEGER NOT NULL,
+		day           INTEGER NOT NULL,
+		date          TEXT NOT NULL DEFAULT '',
+		accommodation TEXT NOT NULL DEFAULT '',
+		daily_cost    REAL NOT NULL DEFAULT 0,
+		PRIMARY KEY (trip_id, day_index)
+	);
+
+	CREATE TABLE trip_activities (
+		trip_id     TEXT NOT NULL,
+		day_index   INTEGER NOT NULL,
+		position    INTEGER NOT NULL,
+		time        TEXT NOT NULL DEFAULT '',
+		type        TEXT NOT NULL DEFAULT '',
+		name        TEXT NOT NULL DEFAULT '',
+		location    TEXT NOT NULL DEFAULT '',
+		duration    TEXT NOT NULL DEFAULT '',
+		cost        REAL NOT NULL DEFAULT 0,
+		description TEXT NOT NULL DEFAULT '',
+		tips        TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (trip_id, day_index, position),
+		FOREIGN KEY (trip_id, day_index) REFERENCES trip_days(trip_id, day_index) ON DELETE CASCADE
+	);
+
+	CREATE TABLE favorites (
+		username TEXT NOT NULL,
+		id       TEXT NOT NULL,
+		name     TEXT NOT NULL DEFAULT '',
+		lng      REAL NOT NULL DEFAULT 0,
+		lat      REAL NOT NULL DEFAULT 0,
+		address  TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (username, id)
+	);
+
+	CREATE TABLE favorite_trips (
+		username TEXT NOT NULL,
+		trip_id  TEXT NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+		PRIMARY KEY (username, trip_id)
+	);
+
+	CREATE TABLE expenses (
+		seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+		username   TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		category   TEXT NOT NULL DEFAULT '',
+		amount     REAL NOT NULL DEFAULT 0,
+		currency   TEXT NOT NULL DEFAULT '',
+		note       TEXT NOT NULL DEFAULT '',
+		date       TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX idx_expenses_username ON expenses(username);
+
+	CREATE TABLE diaries (
+		user_id  INTEGER NOT NULL,
+		id       INTEGER NOT NULL,
+		date     TEXT NOT NULL DEFAULT '',
+		title    TEXT NOT NULL DEFAULT '',
+		content  TEXT NOT NULL DEFAULT '',
+		location TEXT NOT NULL DEFAULT '',
+		mood     TEXT NOT NULL DEFAULT '',
+		has_images INTEGER NOT NULL DEFAULT 0, -- 区分 images 为 null 与空数组
+		PRIMARY KEY (user_id, id)
+	);
+
+	CREATE TABLE diary_images (
+		user_id  INTEGER NOT NULL,
+		diary_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		url      TEXT NOT NULL,
+		PRIMARY KEY (user_id, diary_id, position),
+		FOREIGN KEY (user_id, diary_id) REFERENCES diaries(user_id, id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE sequences (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);`,
+
+	// v2: 行程列表排序列及分页索引，保存行程时按 tripSortScore 写入
+	`ALTER TABLE trips ADD COLUMN created_ms INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE trips ADD COLUMN start_day INTEGER NOT NULL DEFAULT 0;
+	UPDATE trips SET
+		created_ms = CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER),
+		start_day = COALESCE(CAST(julianday(start_date) - 2440587.5 AS INTEGER), 0);
+	DROP INDEX idx_trips_username;
+	CREATE INDEX idx_trips_user_created ON trips(username, created_ms, id);
+	CREATE INDEX idx_trips_user_start ON trips(username, start_day, id);
+	CREATE INDEX idx_trips_user_budget ON trips(username, budget, id);`,
+
+	// v3: 回收站
+	`CREATE TABLE trash (
+		username     TEXT NOT NULL,
+		kind         TEXT NOT NULL,
+		id           TEXT NOT NULL,
+		title        TEXT NOT NULL DEFAULT '',
+		record       TEXT NOT NULL,
+		favorited_by TEXT NOT NULL DEFAULT '[]', -- 行程删除前收藏它的用户，恢复时重新关联
+		deleted_at   INTEGER NOT NULL,           -- 毫秒时间戳
+		PRIMARY KEY (username, kind, id)
+	);
+	CREATE INDEX idx_trash_deleted_at ON trash(deleted_at);`,
+
+	// v4: 行程版本历史，plan 为保存时的完整行程 JSON
+	`CREATE TABLE trip_revisions (
+		trip_id    TEXT NOT NULL,
+		number     INTEGER NOT NULL,
+		author     TEXT NOT NULL DEFAULT '',
+		reason     TEXT NOT NULL DEFAULT '',
+		note       TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		plan       TEXT NOT NULL,
+		PRIMARY KEY (trip_id, number)
+	);`,
+
+	// v5: 全文搜索倒排索引，scope 为 SearchScope.String()；
+	// search_scopes 记录已建立索引的范围，升级前的数据在首次搜索时重建
+	`CREATE TABLE search_postings (
+		scope  TEXT NOT NULL,
+		term   TEXT NOT NULL,
+		doc_id TEXT NOT NULL,
+		weight REAL NOT NULL,
+		PRIMARY KEY (scope, term, doc_id)
+	);
+	CREATE INDEX idx_search_postings_doc ON search_postings(scope, doc_id);
+
+	CREATE TABLE search_scopes (
+		scope TEXT PRIMARY KEY
+	);`,
+
+	// v6: 登录会话，时间均为毫秒时间戳
+	`CREATE TABLE sessions (
+		id           TEXT PRIMARY KEY,
+		user_id      INTEGER NOT NULL,
+		username     TEXT NOT NULL,
+		token_hash   TEXT NOT NULL,
+		prev_hash    TEXT NOT NULL DEFAULT '',
+		created_at   INTEGER NOT NULL,
+		refreshed_at INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL
+	);
+	CREATE INDEX idx_sessions_username ON sessions(username);`,
+
+	// v7: 密码重置令牌，每个用户最多一个
+	`CREATE TABLE password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL,
+		username   TEXT NOT NULL UNIQUE,
+		expires_at INTEGER NOT NULL -- 毫秒时间戳
+	);`,
+
+	// v8: 登录失败计数，key 为 user:<用户名> 或 ip:<地址>，时间均为毫秒时间戳
+	`CREATE TABLE login_attempts (
+		key          TEXT PRIMARY KEY,
+		failures     INTEGER NOT NULL,
+		last_failure INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL
+	);`,
+
+	// v9: 用户角色与停用状态
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+	ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;`,
+
+	// v10: 个人访问令牌，scopes 以空格分隔，时间均为毫秒时间戳，last_used_at 为 0 表示从未使用
+	`CREATE TABLE access_tokens (
+		id           TEXT PRIMARY KEY,
+		user_id      INTEGER NOT NULL,
+		username     TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		scopes       TEXT NOT NULL,
+		token_hash   TEXT NOT NULL,
+		created_at   INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX idx_access_tokens_username ON access_tokens(username);`,
+
+	// v11: 单点登录的登录状态和外部身份关联，时间均为毫秒时间戳
+	`CREATE TABLE oidc_logins (
+		state_hash    TEXT PRIMARY KEY,
+		nonce         TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		expires_at    INTEGER NOT NULL
+	);
+
+	CREATE TABLE identities (
+		issuer     TEXT NOT NULL,
+		subject    TEXT NOT NULL,
+		user_id    INTEGER NOT NULL,
+		username   TEXT NOT NULL,
+		email      TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);
+	CREATE INDEX idx_identities_username ON identities(username);`,
+
+	// v12: 会话的客户端信息和最近使用时间，已有会话以最近一次刷新时间作为最近使用时间
+	`ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN last_seen_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE sessions SET last_seen_at = refreshed_at;`,
+
+	// v13: 两步验证设置和等待两步验证的登录挑战，恢复码为摘要的 JSON 数组
+	`CREATE TABLE two_factor (
+		username       TEXT PRIMARY KEY,
+		user_id        INTEGER NOT NULL,
+		secret         TEXT NOT NULL,
+		enabled        INTEGER NOT NULL DEFAULT 0,
+		recovery_codes TEXT NOT NULL DEFAULT '[]',
+		last_step      INTEGER NOT NULL DEFAULT 0,
+		created_at     INTEGER NOT NULL,
+		enabled_at     INTEGER
+	);
+
+	CREATE TABLE login_challenges (
+		token_hash TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL,
+		username   TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_login_challenges_username ON login_challenges(username);`,
+
+	// v14: 后台任务，请求为 TripPlanRequest 的 JSON；未结束的任务 finished_at 为 NULL
+	`CREATE TABLE jobs (
+		id               TEXT PRIMARY KEY,
+		type             TEXT NOT NULL,
+		user_id          INTEGER NOT NULL,
+		username         TEXT NOT NULL,
+		status           TEXT NOT NULL,
+		request          TEXT NOT NULL,
+		trip_id          TEXT NOT NULL DEFAULT '',
+		error            TEXT NOT NULL DEFAULT '',
+		attempts         INTEGER NOT NULL DEFAULT 0,
+		cancel_requested INTEGER NOT NULL DEFAULT 0,
+		created_at       INTEGER NOT NULL,
+		started_at       INTEGER,
+		finished_at      INTEGER
+	);
+	CREATE INDEX idx_jobs_username ON jobs(username, created_at);
+	CREATE INDEX idx_jobs_finished_at ON jobs(finished_at);`,
+
+	// v15: 任务成功后行程校验仍未解决的问题，为 ItineraryIssue 列表的 JSON
+	`ALTER TABLE jobs ADD COLUMN warnings TEXT NOT NULL DEFAULT '[]';`,
+
+	// v16: 已登录用户发起的外部身份关联，普通登录时 link_user_id 为 0
+	`ALTER TABLE oidc_logins ADD COLUMN link_user_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE oidc_logins ADD COLUMN link_username TEXT NOT NULL DEFAULT '';`,
+
+	// v17: 发起登录的浏览器 cookie 中绑定值的摘要，升级前未完成的登录无法再完成
+	`ALTER TABLE oidc_logins ADD COLUMN binding_hash TEXT NOT NULL DEFAULT '';`,
+}
+
+// NewSQLiteStore 打开（必要时创建）SQLite 数据库并升级表结构
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL", path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 同一时间只允许一个写事务，使用单连接避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db}
+	if err := s.migrateSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate sqlite schema: %w", err)
+	}
+	return s, nil
+}
+
+// Close 关闭数据库
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrateSchema 执行尚未应用的建表语句
+func (s *SQLiteStore) migrateSchema(ctx context.Context) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for v := version; v < len(sqliteSchema); v++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteSchema[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema v%d: %w", v+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", v+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withTx 在事务中执行 fn，fn 返回错误时回滚
+func (s *SQLiteStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer 是 *sql.DB 与 *sql.Tx 的公共查询接口
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// nextSequence 递增并返回命名计数器的值
+func (s *SQLiteStore) nextSequence(ctx context.Context, name string) (int64, error) {
+	var v int64
+	err := s.db.QueryRowContext(ctx, `INSERT INTO sequences (name, value) VALUES (?, 1)
+		ON CONFLICT(name) DO UPDATE SET value = value + 1 RETURNING value`, name).Scan(&v)
+	return v, err
+}
+
+func isUniqueViolation(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.ExtendedCode == sqlite3.ErrConstraintUnique || se.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// userColumns 读取用户记录的列，与 scanUser 对应
+const userColumns = "id, username, password_hash, role, disabled"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*UserRecord, error) {
+	u := UserRecord{SchemaVersion: CurrentSchemaVersion(KindUser)}
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Disabled); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUser 获取用户
+func (s *SQLiteStore) GetUser(ctx context.Context, username string) (*UserRecord, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// ListUsers 列出全部用户，按ID排序
+func (s *SQLiteStore) ListUsers(ctx context.Context) ([]*UserRecord, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*UserRecord
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// UpdateUser 在事务中读取、修改并写回用户记录
+func (s *SQLiteStore) UpdateUser(ctx context.Context, username string, fn func(u *UserRecord) error) (*UserRecord, error) {
+	var u *UserRecord
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = ?", username))
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		id := u.ID
+		if err := fn(u); err != nil {
+			return err
+		}
+		u.ID, u.Username = id, username
+		_, err = tx.ExecContext(ctx, "UPDATE users SET password_hash = ?, role = ?, disabled = ? WHERE id = ?",
+			u.PasswordHash, u.Role, u.Disabled, u.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// CreateUser 创建新用户
+func (s *SQLiteStore) CreateUser(ctx context.Context, username, password string) (*UserRecord, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, "INSERT INTO users (username, password_hash) VALUES (?, ?)", username, string(hash))
+	if isUniqueViolation(err) {
+		return nil, ErrUserExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &UserRecord{
+		ID:            int(id),
+		Username:      username,
+		PasswordHash:  string(hash),
+		Role:          RoleUser,
+		SchemaVersion: CurrentSchemaVersion(KindUser),
+	}, nil
+}
+
+// SetPassword 更新用户的密码哈希
+func (s *SQLiteStore) SetPassword(ctx context.Context, username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE username = ?", string(hash), username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// sqliteAccountData 注销账户时按顺序删除的数据，where 中的参数依次为用户名、用户ID
+// 以及行程、日记、花费的搜索范围；count 为删除前统计数量的表达式，为空时不计入报告。
+// 版本历史和其他用户的收藏需要在删除行程之前处理；每日行程、活动和日记图片由外键级联删除
+var sqliteAccountData = []struct {
+	category string
+	table    string
+	where    string
+	count    string
+}{
+	{DeletedTripRevisions, "trip_revisions", `trip_id IN (SELECT id FROM trips WHERE username = ?1)
+		OR trip_id IN (SELECT id FROM trash WHERE username = ?1 AND kind = 'trip')`, "COUNT(*)"},
+	{DeletedFavoritedByOthers, "favorite_trips", "username <> ?1 AND trip_id IN (SELECT id FROM trips WHERE username = ?1)", "COUNT(*)"},
+	{DeletedFavoriteTrips, "favorite_trips", "username = ?1", "COUNT(*)"},
+	{DeletedTrips, "trips", "username = ?1", "COUNT(*)"},
+	{DeletedFavorites, "favorites", "username = ?1", "COUNT(*)"},
+	{DeletedExpenses, "expenses", "username = ?1", "COUNT(*)"},
+	{DeletedDiaries, "diaries", "user_id = ?2", "COUNT(*)"},
+	{DeletedTrash, "trash", "username = ?1", "COUNT(*)"},
+	{DeletedSearchIndex, "search_postings", "scope IN (?3, ?4, ?5)", "COUNT(DISTINCT scope || ':' || doc_id)"},
+	{DeletedSearchIndex, "search_scopes", "scope IN (?3, ?4, ?5)", ""},
+	{DeletedSessions, "sessions", "username = ?1", "COUNT(*)"},
+	{DeletedAccessTokens, "access_tokens", "username = ?1", "COUNT(*)"},
+	{DeletedIdentities, "identities", "username = ?1", "COUNT(*)"},
+	{DeletedTwoFactor, "two_factor", "username = ?1", "COUNT(*)"},
+	{"", "login_challenges", "username = ?1", ""},
+	{DeletedJobs, "jobs", "username = ?1", "COUNT(*)"},
+	{"", "password_resets", "username = ?1", ""},
+	{"", "login_attempts", "key = 'user:' || ?1", ""},
+	{DeletedUser, "users", "username = ?1", "COUNT(*)"},
+}
+
+// DeleteUser 在一个事务中删除用户及其全部数据，提交后逐表复查
+func (s *SQLiteStore) DeleteUser(ctx context.Context, username string) (*AccountDeletionReport, error) {
+	user, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	report := newAccountDeletionReport(user)
+	args := []interface{}{username, user.ID}
+	for _, scope := range userSearchScopes(user) {
+		args = append(args, scope.String())
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, data := range sqliteAccountData {
+			if data.count != "" {
+				var n int
+				err := tx.QueryRowContext(ctx, "SELECT "+data.count+" FROM "+data.table+" WHERE "+data.where, args...).Scan(&n)
+				if err != nil {
+					return fmt.Errorf("count %s: %w", data.table, err)
+				}
+				report.Removed[data.category] += n
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+data.table+" WHERE "+data.where, args...); err != nil {
+				return fmt.Errorf("delete %s: %w", data.table, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []string
+	for _, data := range sqliteAccountData {
+		var n int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+data.table+" WHERE "+data.where, args...).Scan(&n); err != nil {
+			return report, err
+		}
+		if n > 0 {
+			remaining = append(remaining, fmt.Sprintf("%s: %d rows", data.table, n))
+		}
+	}
+	report.verified(remaining)
+	return report, nil
+}
+
+// SaveTripPlan 保存行程计划（整体替换每日行程和活动）并追加版本记录
+func (s *SQLiteStore) SaveTripPlan(ctx context.Context, plan *TripPlan, rev TripRevisionInfo) error {
+	plan.UpdatedAt = time.Now()
+	if plan.CreatedAt.IsZero() {
+		plan.CreatedAt = plan.UpdatedAt
+	}
+	plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var current int
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(number), 0) FROM trip_revisions WHERE trip_id = ?",
+			plan.ID).Scan(&current); err != nil {
+			return err
+		}
+		if rev.ExpectedRevision > 0 {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM trips WHERE id = ?)", plan.ID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists || current != rev.ExpectedRevision {
+				return ErrConcurrentUpdate
+			}
+		}
+		plan.Revision = current + 1
+		rec, err := newRevisionRecord(plan, rev)
+		if err != nil {
+			return err
+		}
+		if err := writeTrip(ctx, tx, plan); err != nil {
+			return err
+		}
+		if err := writeSearchDoc(ctx, tx, tripSearchScope(plan.Username), tripSearchRecord(plan).document()); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO trip_revisions (trip_id, number, author, reason, note, created_at, plan)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			plan.ID, plan.Revision, rec.Author, string(rec.Reason), rec.Note, rec.CreatedAt.Format(time.RFC3339Nano), string(rec.Plan))
+		return err
+	})
+}
+
+// writeTrip 在事务中写入行程，整体替换每日行程和活动
+func writeTrip(ctx context.Context, tx *sql.Tx, plan *TripPlan) error {
+	prefs, err := json.Marshal(plan.Request.Preferences)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO trips (id, user_id, username, destination, start_date, end_date,
+			budget, travelers, preferences, special_needs, total_cost, summary, created_at, updated_at, created_ms, start_day)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			user_id = excluded.user_id, username = excluded.username,
+			destination = excluded.destination, start_date = excluded.start_date, end_date = excluded.end_date,
+			budget = excluded.budget, travelers = excluded.travelers, preferences = excluded.preferences,
+			special_needs = excluded.special_needs, total_cost = excluded.total_cost, summary = excluded.summary,
+			created_at = excluded.created_at, updated_at = excluded.updated_at,
+			created_ms = excluded.created_ms, start_day = excluded.start_day`,
+		plan.ID, plan.UserID, plan.Username, plan.Request.Destination, plan.Request.StartDate, plan.Request.EndDate,
+		plan.Request.Budget, plan.Request.Travelers, string(prefs), plan.Request.SpecialNeeds,
+		plan.TotalCost, plan.Summary, plan.CreatedAt.Format(time.RFC3339Nano), plan.UpdatedAt.Format(time.RFC3339Nano),
+		int64(tripSortScore(plan, TripSortCreatedAt)), int64(tripSortScore(plan, TripSortStartDate)))
+	if err != nil {
+		return err
+	}
+
+	// 每日行程删除后活动通过外键级联删除
+	if _, err := tx.ExecContext(ctx, "DELETE FROM trip_days WHERE trip_id = ?", plan.ID); err != nil {
+		return err
+	}
+	for i, day := range plan.Itinerary {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO trip_days (trip_id, day_index, day, date, accommodation, daily_cost)
+			VALUES (?, ?, ?, ?, ?, ?)`, plan.ID, i, day.Day, day.Date, day.Accommodation, day.DailyCost); err != nil {
+			return err
+		}
+		for j, a := range day.Activities {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO trip_activities (trip_id, day_index, position, time, type, name,
+				location, duration, cost, description, tips) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				plan.ID, i, j, a.Time, a.Type, a.Name, a.Location, a.Duration, a.Cost, a.Description, a.Tips); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readTrips 在只读事务中加载行程，保证行程、每日行程和活动来自同一快照
+func (s *SQLiteStore) readTrips(ctx context.Context, where string, args ...interface{}) ([]*TripPlan, error) {
+	var trips []*TripPlan
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		trips, err = queryTrips(ctx, tx, where, args...)
+		return err
+	})
+	return trips, err
+}
+
+// queryTrips 按条件加载行程及其每日行程和活动，where 中使用别名 t 引用 trips 表
+func queryTrips(ctx context.Context, q queryer, where string, args ...interface{}) ([]*TripPlan, error) {
+	rows, err := q.QueryContext(ctx, `SELECT t.id, t.user_id, t.username, t.destination, t.start_date, t.end_date,
+			t.budget, t.travelers, t.preferences, t.special_needs, t.total_cost, t.summary, t.created_at, t.updated_at,
+			(SELECT COALESCE(MAX(r.number), 0) FROM trip_revisions r WHERE r.trip_id = t.id)
+		FROM trips t WHERE `+where+` ORDER BY t.created_at, t.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]*TripPlan, 0)
+	byID := make(map[string]*TripPlan)
+	for rows.Next() {
+		var (
+			p                    = TripPlan{SchemaVersion: CurrentSchemaVersion(KindTrip)}
+			prefs                string
+			createdAt, updatedAt string
+		)
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Username, &p.Request.Destination, &p.Request.StartDate, &p.Request.EndDate,
+			&p.Request.Budget, &p.Request.Travelers, &prefs, &p.Request.SpecialNeeds, &p.TotalCost, &p.Summary,
+			&createdAt, &updatedAt, &p.Revision); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		json.Unmarshal([]byte(prefs), &p.Request.Preferences)
+		p.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		p.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+		trips = append(trips, &p)
+		byID[p.ID] = &p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(trips) == 0 {
+		return trips, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT d.trip_id, d.day, d.date, d.accommodation, d.daily_cost
+		FROM trip_days d JOIN trips t ON t.id = d.trip_id WHERE `+where+` ORDER BY d.trip_id, d.day_index`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			tripID string
+			day    DayItinerary
+		)
+		if err := rows.Scan(&tripID, &day.Day, &day.Date, &day.Accommodation, &day.DailyCost); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		day.Activities = []Activity{}
+		byID[tripID].Itinerary = append(byID[tripID].Itinerary, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT a.trip_id, a.day_index, a.time, a.type, a.name, a.location, a.duration,
+			a.cost, a.description, a.tips
+		FROM trip_activities a JOIN trips t ON t.id = a.trip_id WHERE `+where+` ORDER BY a.trip_id, a.day_index, a.position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			tripID   string
+			dayIndex int
+			a        Activity
+		)
+		if err := rows.Scan(&tripID, &dayIndex, &a.Time, &a.Type, &a.Name, &a.Location, &a.Duration,
+			&a.Cost, &a.Description, &a.Tips); err != nil {
+			return nil, err
+		}
+		day := &byID[tripID].Itinerary[dayIndex]
+		day.Activities = append(day.Activities, a)
+	}
+	return trips, rows.Err()
+}
+
+// GetTripPlan 获取行程计划
+func (s *SQLiteStore) GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error) {
+	trips, err := s.readTrips(ctx, "t.id = ?", tripID)
+	if err != nil {
+		return nil, err
+	}
+	if len(trips) == 0 {
+		return nil, nil
+	}
+	return trips[0], nil
+}
+
+// GetUserTrips 获取用户的所有行程
+func (s *SQLiteStore) GetUserTrips(ctx context.Context, username string) ([]*TripPlan, error) {
+	return s.readTrips(ctx, "t.username = ?", username)
+}
+
+// tripSortColumns 排序字段对应的列，均有 (username, 列, id) 索引
+var tripSortColumns = map[string]string{
+	TripSortCreatedAt: "created_ms",
+	TripSortStartDate: "start_day",
+	TripSortBudget:    "budget",
+}
+
+// ListUserTrips 按条件分页查询用户行程：先按索引取出一页ID，再在同一事务中加载完整行程
+func (s *SQLiteStore) ListUserTrips(ctx context.Context, username string, q TripQuery) (*TripPage, error) {
+	cur, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	col, dir, cmp := tripSortColumns[q.SortBy], "ASC", ">"
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	where, args := "username = ?", []interface{}{username}
+	if q.Destination != "" {
+		where += " AND instr(lower(destination), lower(?)) > 0"
+		args = append(args, q.Destination)
+	}
+	if q.From != "" {
+		where += " AND end_date >= ?"
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		where += " AND start_date <= ?"
+		args = append(args, q.To)
+	}
+	if cur != nil {
+		where += fmt.Sprintf(" AND (%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", col, cmp)
+		args = append(args, cur.Score, cur.Score, cur.ID)
+	}
+	args = append(args, q.Limit+1)
+
+	pager := &tripPager{q: &q}
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, %[1]s FROM trips WHERE %[2]s ORDER BY %[1]s %[3]s, id %[3]s LIMIT ?",
+			col, where, dir), args...)
+		if err != nil {
+			return err
+		}
+		var (
+			ids    []string
+			scores []float64
+		)
+		for rows.Next() {
+			var (
+				id    string
+				score float64
+			)
+			if err := rows.Scan(&id, &score); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			scores = append(scores, score)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		idArgs := make([]interface{}, len(ids))
+		for i, id := range ids {
+			idArgs[i] = id
+		}
+		trips, err := queryTrips(ctx, tx, "t.id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", idArgs...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]*TripPlan, len(trips))
+		for _, t := range trips {
+			byID[t.ID] = t
+		}
+		for i, id := range ids {
+			if t, ok := byID[id]; ok {
+				pager.add(t, scores[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pager.page(), nil
+}
+
+// DeleteTripPlan 将行程移入回收站，每日行程、活动和收藏记录级联删除，
+// 收藏过该行程的用户记录在回收站条目中，恢复时重新关联
+func (s *SQLiteStore) DeleteTripPlan(ctx context.Context, tripID, username string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		trips, err := queryTrips(ctx, tx, "t.id = ? AND t.username = ?", tripID, username)
+		if err != nil || len(trips) == 0 {
+			return err
+		}
+		item, err := tripTrashItem(trips[0])
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, "SELECT username FROM favorite_trips WHERE trip_id = ?", tripID)
+		if err != nil {
+			return err
+		}
+		favoritedBy := []string{}
+		for rows.Next() {
+			var u string
+			if err := rows.Scan(&u); err != nil {
+				rows.Close()
+				return err
+			}
+			favoritedBy = append(favoritedBy, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := putTrash(ctx, tx, username, item, favoritedBy); err != nil {
+			return err
+		}
+		if err := writeSearchDoc(ctx, tx, tripSearchScope(username), SearchDocument{ID: tripID}); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM trips WHERE id = ?", tripID)
+		return err
+	})
+}
+
+// ListTripRevisions 列出行程的全部版本
+func (s *SQLiteStore) ListTripRevisions(ctx context.Context, tripID string) ([]*TripRevision, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT number, author, reason, note, created_at FROM trip_revisions
+		WHERE trip_id = ? ORDER BY number DESC`, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revs := []*TripRevision{}
+	for rows.Next() {
+		rev := TripRevision{TripID: tripID}
+		var createdAt string
+		if err := rows.Scan(&rev.Number, &rev.Author, &rev.Reason, &rev.Note, &createdAt); err != nil {
+			return nil, err
+		}
+		rev.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		revs = append(revs, &rev)
+	}
+	return revs, rows.Err()
+}
+
+// GetTripRevision 获取行程的指定版本
+func (s *SQLiteStore) GetTripRevision(ctx context.Context, tripID string, number int) (*TripRevision, error) {
+	var (
+		rec       tripRevisionRecord
+		createdAt string
+		plan      string
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT author, reason, note, created_at, plan FROM trip_revisions
+		WHERE trip_id = ? AND number = ?`, tripID, number).Scan(&rec.Author, &rec.Reason, &rec.Note, &createdAt, &plan)
+	if err == sql.ErrNoRows {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	rec.Plan = json.RawMessage(plan)
+	return rec.revision(tripID, number, true)
+}
+
+// GenerateTripID 生成唯一行程ID
+func (s *SQLiteStore) GenerateTripID(ctx context.Context) (string, error) {
+	id, err := s.nextSequence(ctx, "trip")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("trip_%d_%d", id, time.Now().Unix()), nil
+}
+
+// GetUserFavorites 获取用户的收藏夹
+func (s *SQLiteStore) GetUserFavorites(ctx context.Context, username string) ([]Favorite, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, lng, lat, address FROM favorites WHERE username = ? ORDER BY rowid", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	favorites := []Favorite{}
+	for rows.Next() {
+		var f Favorite
+		if err := rows.Scan(&f.ID, &f.Name, &f.Lng, &f.Lat, &f.Address); err != nil {
+			return nil, err
+		}
+		favorites = append(favorites, f)
+	}
+	return favorites, rows.Err()
+}
+
+// AddFavorite 添加收藏
+func (s *SQLiteStore) AddFavorite(ctx context.Context, username string, favorite Favorite) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO favorites (username, id, name, lng, lat, address) VALUES (?, ?, ?, ?, ?, ?)",
+		username, favorite.ID, favorite.Name, favorite.Lng, favorite.Lat, favorite.Address)
+	if isUniqueViolation(err) {
+		return ErrFavoriteExists
+	}
+	return err
+}
+
+// ReplaceFavorite 原地覆盖收藏，不存在时添加，保留原有的排列顺序
+func (s *SQLiteStore) ReplaceFavorite(ctx context.Context, username string, favorite Favorite) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO favorites (username, id, name, lng, lat, address) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(username, id) DO UPDATE SET
+			name = excluded.name, lng = excluded.lng, lat = excluded.lat, address = excluded.address`,
+		username, favorite.ID, favorite.Name, favorite.Lng, favorite.Lat, favorite.Address)
+	return err
+}
+
+// RemoveFavorite 将收藏移入回收站
+func (s *SQLiteStore) RemoveFavorite(ctx context.Context, username, favoriteID string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		f := Favorite{ID: favoriteID}
+		err := tx.QueryRowContext(ctx, "SELECT name, lng, lat, address FROM favorites WHERE username = ? AND id = ?",
+			username, favoriteID).Scan(&f.Name, &f.Lng, &f.Lat, &f.Address)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item, err := favoriteTrashItem(&f)
+		if err != nil {
+			return err
+		}
+		if err := putTrash(ctx, tx, username, item, nil); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM favorites WHERE username = ? AND id = ?", username, favoriteID)
+		return err
+	})
+}
+
+// GetUserFavoriteTrips 获取用户收藏的行程列表
+func (s *SQLiteStore) GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, error) {
+	return s.readTrips(ctx, "t.id IN (SELECT trip_id FROM favorite_trips WHERE username = ?)", username)
+}
+
+// AddFavoriteTrip 添加行程到收藏
+func (s *SQLiteStore) AddFavoriteTrip(ctx context.Context, username, tripID string) error {
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO favorite_trips (username, trip_id)
+		SELECT ?, id FROM trips WHERE id = ?`, username, tripID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	// 未插入：行程不存在或已收藏
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM trips WHERE id = ?)", tripID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTripNotFound
+	}
+	return nil
+}
+
+// RemoveFavoriteTrip 从收藏中移除行程
+func (s *SQLiteStore) RemoveFavoriteTrip(ctx context.Context, username, tripID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM favorite_trips WHERE username = ? AND trip_id = ?", username, tripID)
+	return err
+}
+
+// IsTripFavorited 检查行程是否已收藏
+func (s *SQLiteStore) IsTripFavorited(ctx context.Context, username, tripID string) (bool, error) {
+	var ok bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM favorite_trips WHERE username = ? AND trip_id = ?)",
+		username, tripID).Scan(&ok)
+	return ok, err
+}
+
+// SaveExpense 将单条记录追加到用户的 expense 列表
+func (s *SQLiteStore) SaveExpense(ctx context.Context, username string, rec *ExpenseRecord) error {
+	rec.SchemaVersion = CurrentSchemaVersion(KindExpense)
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO expenses (username, id, category, amount, currency, note, date, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			username, rec.ID, rec.Category, rec.Amount, rec.Currency, rec.Note, rec.Date, rec.CreatedAt); err != nil {
+			return err
+		}
+		return writeSearchDoc(ctx, tx, expenseSearchScope(username), expenseSearchRecord(rec).document())
+	})
+}
+
+// GetExpenses 返回用户的所有 expense 记录
+func (s *SQLiteStore) GetExpenses(ctx context.Context, username string) ([]*ExpenseRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, category, amount, currency, note, date, created_at
+		FROM expenses WHERE username = ? ORDER BY seq`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*ExpenseRecord, 0)
+	for rows.Next() {
+		e := ExpenseRecord{SchemaVersion: CurrentSchemaVersion(KindExpense)}
+		if err := rows.Scan(&e.ID, &e.Category, &e.Amount, &e.Currency, &e.Note, &e.Date, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, &e)
+	}
+	return res, rows.Err()
+}
+
+// GenerateExpenseID 生成唯一 expense ID
+func (s *SQLiteStore) GenerateExpenseID(ctx context.Context) (string, error) {
+	id, err := s.nextSequence(ctx, "expense")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("exp_%d_%d", id, time.Now().Unix()), nil
+}
+
+// insertDiaryImages 写入日记图片，调用方负责先清理旧记录
+func insertDiaryImages(ctx context.Context, tx *sql.Tx, userID, diaryID int64, images []string) error {
+	for i, url := range images {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO diary_images (user_id, diary_id, position, url) VALUES (?, ?, ?, ?)",
+			userID, diaryID, i, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertDiary 写入日记、图片及搜索索引
+func insertDiary(ctx context.Context, tx *sql.Tx, diary *DiaryEntry) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO diaries (user_id, id, date, title, content, location, mood, has_images)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, diary.UserID, diary.ID, diary.Date, diary.Title, diary.Content,
+		diary.Location, diary.Mood, diary.Images != nil); err != nil {
+		return err
+	}
+	if err := insertDiaryImages(ctx, tx, diary.UserID, diary.ID, diary.Images); err != nil {
+		return err
+	}
+	return writeSearchDoc(ctx, tx, diarySearchScope(diary.UserID), diarySearchRecord(diary).document())
+}
+
+// CreateDiary 创建日记
+func (s *SQLiteStore) CreateDiary(ctx context.Context, diary *DiaryEntry) (int64, error) {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// 与 Redis 实现一样使用毫秒时间戳作为ID，冲突时顺延
+		id := time.Now().UnixNano() / 1e6
+		var maxID int64
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM diaries WHERE user_id = ?", diary.UserID).Scan(&maxID); err != nil {
+			return err
+		}
+		if id <= maxID {
+			id = maxID + 1
+		}
+		diary.ID = id
+		diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
+		return insertDiary(ctx, tx, diary)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return diary.ID, nil
+}
+
+// queryDiaries 按条件加载日记及图片，按ID倒序
+func queryDiaries(ctx context.Context, q queryer, where string, args ...interface{}) ([]DiaryEntry, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id, user_id, date, title, content, location, mood, has_images
+		FROM diaries WHERE `+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var diaries []DiaryEntry
+	index := make(map[int64]int)
+	for rows.Next() {
+		var (
+			d         = DiaryEntry{SchemaVersion: CurrentSchemaVersion(KindDiary)}
+			hasImages bool
+		)
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Date, &d.Title, &d.Content, &d.Location, &d.Mood, &hasImages); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if hasImages {
+			d.Images = []string{}
+		}
+		index[d.ID] = len(diaries)
+		diaries = append(diaries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(diaries) == 0 {
+		return diaries, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT diary_id, url FROM diary_images
+		WHERE (user_id, diary_id) IN (SELECT user_id, id FROM diaries WHERE `+where+`) ORDER BY diary_id, position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			diaryID int64
+			url     string
+		)
+		if err := rows.Scan(&diaryID, &url); err != nil {
+			return nil, err
+		}
+		d := &diaries[index[diaryID]]
+		d.Images = append(d.Images, url)
+	}
+	return diaries, rows.Err()
+}
+
+// GetUserDiaries 获取用户的所有日记
+func (s *SQLiteStore) GetUserDiaries(ctx context.Context, userID int64) ([]DiaryEntry, error) {
+	return queryDiaries(ctx, s.db, "user_id = ?", userID)
+}
+
+// GetDiary 获取单条日记
+func (s *SQLiteStore) GetDiary(ctx context.Context, idStr string, userID int64) (*DiaryEntry, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, ErrDiaryNotFound
+	}
+	diaries, err := queryDiaries(ctx, s.db, "user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(diaries) == 0 {
+		return nil, ErrDiaryNotFound
+	}
+	return &diaries[0], nil
+}
+
+// UpdateDiary 更新日记
+func (s *SQLiteStore) UpdateDiary(ctx context.Context, idStr string, userID int64, updated *DiaryEntry) error {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return ErrDiaryNotFound
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		diaries, err := queryDiaries(ctx, tx, "user_id = ? AND id = ?", userID, id)
+		if err != nil {
+			return err
+		}
+		if len(diaries) == 0 {
+			return ErrDiaryNotFound
+		}
+		diary := diaries[0]
+		applyDiaryUpdate(&diary, updated)
+
+		if _, err := tx.ExecContext(ctx, `UPDATE diaries SET date = ?, title = ?, content = ?, location = ?, mood = ?, has_images = ?
+			WHERE user_id = ? AND id = ?`, diary.Date, diary.Title, diary.Content, diary.Location, diary.Mood,
+			diary.Images != nil, userID, id); err != nil {
+			return err
+		}
+		if err := writeSearchDoc(ctx, tx, diarySearchScope(userID), diarySearchRecord(&diary).document()); err != nil {
+			return err
+		}
+		if updated.Images == nil {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM diary_images WHERE user_id = ? AND diary_id = ?", userID, id); err != nil {
+			return err
+		}
+		return insertDiaryImages(ctx, tx, userID, id, diary.Images)
+	})
+}
+
+// DeleteDiary 将日记移入回收站，图片记录级联删除
+func (s *SQLiteStore) DeleteDiary(ctx context.Context, idStr string, userID int64, username string) error {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		diaries, err := queryDiaries(ctx, tx, "user_id = ? AND id = ?", userID, id)
+		if err != nil || len(diaries) == 0 {
+			return err
+		}
+		item, err := diaryTrashItem(&diaries[0])
+		if err != nil {
+			return err
+		}
+		if err := putTrash(ctx, tx, username, item, nil); err != nil {
+			return err
+		}
+		if err := writeSearchDoc(ctx, tx, diarySearchScope(userID), SearchDocument{ID: item.ID}); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM diaries WHERE user_id = ? AND id = ?", userID, id)
+		return err
+	})
+}
+
+// putTrash 写入回收站条目，同一记录再次删除时覆盖
+func putTrash(ctx context.Context, tx *sql.Tx, username string, item *TrashItem, favoritedBy []string) error {
+	if favoritedBy == nil {
+		favoritedBy = []string{}
+	}
+	fav, err := json.Marshal(favoritedBy)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO trash (username, kind, id, title, record, favorited_by, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(username, kind, id) DO UPDATE SET
+			title = excluded.title, record = excluded.record,
+			favorited_by = excluded.favorited_by, deleted_at = excluded.deleted_at`,
+		username, string(item.Kind), item.ID, item.Title, string(item.Record), string(fav), item.DeletedAt.UnixMilli())
+	return err
+}
+
+// ListTrash 列出用户回收站中的条目
+func (s *SQLiteStore) ListTrash(ctx context.Context, username string) ([]*TrashItem, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT kind, id, title, record, deleted_at FROM trash
+		WHERE username = ? ORDER BY deleted_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*TrashItem{}
+	for rows.Next() {
+		var (
+			item      TrashItem
+			record    string
+			deletedAt int64
+		)
+		if err := rows.Scan(&item.Kind, &item.ID, &item.Title, &record, &deletedAt); err != nil {
+			return nil, err
+		}
+		item.Record = json.RawMessage(record)
+		item.DeletedAt = time.UnixMilli(deletedAt)
+		items = append(items, item.withExpiry())
+	}
+	return items, rows.Err()
+}
+
+// RestoreTrash 恢复回收站条目
+func (s *SQLiteStore) RestoreTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var record, favoritedBy string
+		err := tx.QueryRowContext(ctx, "SELECT record, favorited_by FROM trash WHERE username = ? AND kind = ? AND id = ?",
+			username, string(kind), id).Scan(&record, &favoritedBy)
+		if err == sql.ErrNoRows {
+			return ErrTrashItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case TrashTrip:
+			var plan TripPlan
+			if _, _, err := decodeRecord(KindTrip, []byte(record), &plan); err != nil {
+				return err
+			}
+			var exists bool
+			if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM trips WHERE id = ?)", plan.ID).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return ErrRestoreConflict
+			}
+			plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+			if err := writeTrip(ctx, tx, &plan); err != nil {
+				return err
+			}
+			if err := writeSearchDoc(ctx, tx, tripSearchScope(username), tripSearchRecord(&plan).document()); err != nil {
+				return err
+			}
+			var users []string
+			json.Unmarshal([]byte(favoritedBy), &users)
+			for _, u := range users {
+				if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO favorite_trips (username, trip_id) VALUES (?, ?)", u, plan.ID); err != nil {
+					return err
+				}
+			}
+
+		case TrashDiary:
+			var diary DiaryEntry
+			if _, _, err := decodeRecord(KindDiary, []byte(record), &diary); err != nil {
+				return err
+			}
+			err := insertDiary(ctx, tx, &diary)
+			if isUniqueViolation(err) {
+				return ErrRestoreConflict
+			}
+			if err != nil {
+				return err
+			}
+
+		case TrashFavorite:
+			var f Favorite
+			if err := json.Unmarshal([]byte(record), &f); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO favorites (username, id, name, lng, lat, address) VALUES (?, ?, ?, ?, ?, ?)",
+				username, f.ID, f.Name, f.Lng, f.Lat, f.Address)
+			if isUniqueViolation(err) {
+				return ErrRestoreConflict
+			}
+			if err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unknown trash kind %q", kind)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM trash WHERE username = ? AND kind = ? AND id = ?", username, string(kind), id)
+		return err
+	})
+}
+
+// orphanRevisionsSQL 删除回收站中满足条件的行程条目对应的版本历史，行程已恢复或ID被重新占用时保留
+const orphanRevisionsSQL = `DELETE FROM trip_revisions WHERE trip_id IN (
+		SELECT id FROM trash WHERE kind = 'trip' AND %s) AND trip_id NOT IN (SELECT id FROM trips)`
+
+// PurgeTrash 永久删除回收站条目
+func (s *SQLiteStore) PurgeTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if kind == TrashTrip {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(orphanRevisionsSQL, "username = ? AND id = ?"), username, id); err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM trash WHERE username = ? AND kind = ? AND id = ?", username, string(kind), id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrTrashItemNotFound
+		}
+		return nil
+	})
+}
+
+// PurgeExpiredTrash 永久删除过期的回收站条目
+func (s *SQLiteStore) PurgeExpiredTrash(ctx context.Context, before time.Time) (int, error) {
+	var n int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(orphanRevisionsSQL, "deleted_at < ?"), before.UnixMilli()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM trash WHERE deleted_at < ?", before.UnixMilli())
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// MigrateRecords SQLite 以关系表存储记录，表结构在打开数据库时按 user_version 升级，
+// 这里只统计各表的记录数
+func (s *SQLiteStore) MigrateRecords(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := newMigrationReport("sqlite", dryRun)
+	tables := map[RecordKind]string{
+		KindUser:    "users",
+		KindTrip:    "trips",
+		KindExpense: "expenses",
+		KindDiary:   "diaries",
+	}
+	for kind, table := range tables {
+		var n int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			return report, err
+		}
+		report.Kinds[kind].Scanned = n
+		report.Kinds[kind].Current = n
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return report, err
+	}
+	report.Notes = append(report.Notes, fmt.Sprintf("relational schema at version %d of %d", version, len(sqliteSchema)))
+	return report, nil
+}
+
+// sqliteIntegrityChecks SQLite 一致性检查项：query 查出有问题的记录，fix 以相同条件删除
+var sqliteIntegrityChecks = []struct {
+	kind   IntegrityIssueKind
+	where  string
+	detail string
+	query  string
+	fix    string
+}{
+	{IssueOrphan, "trips", "owner does not exist",
+		"SELECT id FROM trips WHERE username NOT IN (SELECT username FROM users)",
+		"DELETE FROM trips WHERE username NOT IN (SELECT username FROM users)"},
+	{IssueOrphan, "favorites", "owner does not exist",
+		"SELECT username || '/' || id FROM favorites WHERE username NOT IN (SELECT username FROM users)",
+		"DELETE FROM favorites WHERE username NOT IN (SELECT username FROM users)"},
+	{IssueOrphan, "expenses", "owner does not exist",
+		"SELECT username || '/' || id FROM expenses WHERE username NOT IN (SELECT username FROM users)",
+		"DELETE FROM expenses WHERE username NOT IN (SELECT username FROM users)"},
+	{IssueOrphan, "diaries", "owner does not exist",
+		"SELECT user_id || '/' || id FROM diaries WHERE user_id NOT IN (SELECT id FROM users)",
+		"DELETE FROM diaries WHERE user_id NOT IN (SELECT id FROM users)"},
+	{IssueOrphan, "trash", "owner does not exist",
+		"SELECT username || '/' || kind || ':' || id FROM trash WHERE username NOT IN (SELECT username FROM users)",
+		"DELETE FROM trash WHERE username NOT IN (SELECT username FROM users)"},
+	{IssueDangling, "favorite_trips", "favorited by a user who does not exist or trip does not exist",
+		`SELECT username || '/' || trip_id FROM favorite_trips WHERE username NOT IN (SELECT username FROM users)
+			OR trip_id NOT IN (SELECT id FROM trips)`,
+		`DELETE FROM favorite_trips WHERE username NOT IN (SELECT username FROM users)
+			OR trip_id NOT IN (SELECT id FROM trips)`},
+	{IssueOrphan, "trip_revisions", "trip does not exist",
+		`SELECT DISTINCT trip_id FROM trip_revisions WHERE trip_id NOT IN (SELECT id FROM trips)
+			AND trip_id NOT IN (SELECT id FROM trash WHERE kind = 'trip')`,
+		`DELETE FROM trip_revisions WHERE trip_id NOT IN (SELECT id FROM trips)
+			AND trip_id NOT IN (SELECT id FROM trash WHERE kind = 'trip')`},
+}
+
+// CheckIntegrity 检查关系表之间的引用一致性，整个检查在一个事务中进行；
+// 每日行程、活动和日记图片由外键级联维护，这里不再检查
+func (s *SQLiteStore) CheckIntegrity(ctx context.Context, repair bool) (*IntegrityReport, error) {
+	start := time.Now()
+	report := newIntegrityReport("sqlite", repair)
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"users", "trips", "favorites", "favorite_trips", "expenses", "diaries", "trash", "trip_revisions"} {
+			var n int
+			if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+				return err
+			}
+			report.Scanned[table] = n
+		}
+		for _, check := range sqliteIntegrityChecks {
+			refs, err := queryStrings(ctx, tx, check.query)
+			if err != nil {
+				return fmt.Errorf("check %s: %w", check.where, err)
+			}
+			if len(refs) == 0 {
+				continue
+			}
+			// 同一检查项的记录由一条语句一起删除
+			var (
+				fixed  bool
+				fixErr error
+			)
+			fix := func() (bool, error) {
+				if !fixed {
+					_, fixErr = tx.ExecContext(ctx, check.fix)
+					fixed = true
+				}
+				return true, fixErr
+			}
+			for _, ref := range refs {
+				report.add(check.kind, check.where, ref, check.detail, "delete", fix)
+			}
+		}
+		return nil
+	})
+	report.Duration = time.Since(start)
+	return report, err
+}
+
+// queryStrings 执行只返回一列文本的查询
+func queryStrings(ctx context.Context, q queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// writeSearchDoc 在事务中替换文档的倒排项，Terms 为空时只删除
+func writeSearchDoc(ctx context.Context, tx *sql.Tx, scope SearchScope, doc SearchDocument) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM search_postings WHERE scope = ? AND doc_id = ?", scope.String(), doc.ID); err != nil {
+		return err
+	}
+	for term, w := range doc.Terms {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO search_postings (scope, term, doc_id, weight) VALUES (?, ?, ?, ?)",
+			scope.String(), term, doc.ID, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchPostings 读取范围内指定词项的倒排列表
+func (s *SQLiteStore) SearchPostings(ctx context.Context, scope SearchScope, terms []string) (*SearchPostings, error) {
+	post := &SearchPostings{Postings: make(map[string]map[string]float64, len(terms))}
+	args := []interface{}{scope.String()}
+	for _, term := range terms {
+		post.Postings[term] = make(map[string]float64)
+		args = append(args, term)
+	}
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM search_scopes WHERE scope = ?),
+		(SELECT COUNT(DISTINCT doc_id) FROM search_postings WHERE scope = ?)`, scope.String(), scope.String()).
+		Scan(&post.Built, &post.Docs)
+	if err != nil || len(terms) == 0 {
+		return post, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT term, doc_id, weight FROM search_postings
+		WHERE scope = ? AND term IN (?`+strings.Repeat(", ?", len(terms)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			term, id string
+			w        float64
+		)
+		if err := rows.Scan(&term, &id, &w); err != nil {
+			return nil, err
+		}
+		post.Postings[term][id] = w
+	}
+	return post, rows.Err()
+}
+
+// ReplaceSearchIndex 在一个事务中整体替换范围内的索引
+func (s *SQLiteStore) ReplaceSearchIndex(ctx context.Context, scope SearchScope, docs []SearchDocument) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM search_postings WHERE scope = ?", scope.String()); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := writeSearchDoc(ctx, tx, scope, doc); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO search_scopes (scope) VALUES (?)", scope.String())
+		return err
+	})
+}
+
+// CreateSession 保存会话，同时清理该用户已过期的会话
+func (s *SQLiteStore) CreateSession(ctx context.Context, sess *Session) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE username = ? AND expires_at <= ?",
+			sess.Username, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO sessions
+			(id, user_id, username, token_hash, prev_hash, created_at, refreshed_at, expires_at, user_agent, ip, last_seen_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			sess.ID, sess.UserID, sess.Username, sess.TokenHash, sess.PrevHash,
+			sess.CreatedAt.UnixMilli(), sess.RefreshedAt.UnixMilli(), sess.ExpiresAt.UnixMilli(),
+			sess.UserAgent, sess.IP, sess.LastSeenAt.UnixMilli())
+		return err
+	})
+}
+
+const sessionColumns = `id, user_id, username, token_hash, prev_hash, created_at, refreshed_at, expires_at,
+	user_agent, ip, last_seen_at`
+
+// scanSession 按 sessionColumns 的顺序读取一行
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	var (
+		sess                                          Session
+		createdAt, refreshedAt, expiresAt, lastSeenAt int64
+	)
+	err := row.Scan(&sess.ID, &sess.UserID, &sess.Username, &sess.TokenHash, &sess.PrevHash,
+		&createdAt, &refreshedAt, &expiresAt, &sess.UserAgent, &sess.IP, &lastSeenAt)
+	if err != nil {
+		return nil, err
+	}
+	sess.CreatedAt = time.UnixMilli(createdAt)
+	sess.RefreshedAt = time.UnixMilli(refreshedAt)
+	sess.ExpiresAt = time.UnixMilli(expiresAt)
+	sess.LastSeenAt = time.UnixMilli(lastSeenAt)
+	return &sess, nil
+}
+
+// GetSession 获取未过期的会话
+func (s *SQLiteStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	sess, err := scanSession(s.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ? AND expires_at > ?",
+		id, time.Now().UnixMilli()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sess, err
+}
+
+// RotateSession 以 refresh token 摘要为条件更新会话
+func (s *SQLiteStore) RotateSession(ctx context.Context, sess *Session, oldHash string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE sessions SET token_hash = ?, prev_hash = ?, refreshed_at = ?, expires_at = ?,
+		ip = ?, last_seen_at = ?
+		WHERE id = ? AND token_hash = ? AND expires_at > ?`,
+		sess.TokenHash, sess.PrevHash, sess.RefreshedAt.UnixMilli(), sess.ExpiresAt.UnixMilli(),
+		sess.IP, sess.LastSeenAt.UnixMilli(),
+		sess.ID, oldHash, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// ListUserSessions 列出用户未过期的会话
+func (s *SQLiteStore) ListUserSessions(ctx context.Context, username string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sessionColumns+` FROM sessions
+		WHERE username = ? AND expires_at > ? ORDER BY created_at, id`, username, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession 更新会话的最近使用时间和 IP
+func (s *SQLiteStore) TouchSession(ctx context.Context, id string, at time.Time, ip string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", at.UnixMilli(), ip, id)
+	return err
+}
+
+// DeleteSession 删除会话
+func (s *SQLiteStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// DeleteUserSessions 删除用户的全部会话，已过期的会话不计入数量
+func (s *SQLiteStore) DeleteUserSessions(ctx context.Context, username string) (int, error) {
+	var n int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE username = ? AND expires_at > ?",
+			username, time.Now().UnixMilli()).Scan(&n)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE username = ?", username)
+		return err
+	})
+	return n, err
+}
+
+// CreatePasswordReset 保存重置令牌，替换该用户之前的令牌
+func (s *SQLiteStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO password_resets (token_hash, user_id, username, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			token_hash = excluded.token_hash, user_id = excluded.user_id, expires_at = excluded.expires_at`,
+		reset.TokenHash, reset.UserID, reset.Username, reset.ExpiresAt.UnixMilli())
+	return err
+}
+
+// GetPasswordReset 读取未过期的令牌
+func (s *SQLiteStore) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	reset := PasswordReset{TokenHash: tokenHash}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT user_id, username, expires_at FROM password_resets WHERE token_hash = ? AND expires_at > ?",
+		tokenHash, time.Now().UnixMilli()).Scan(&reset.UserID, &reset.Username, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reset.ExpiresAt = time.UnixMilli(expiresAt)
+	return &reset, nil
+}
+
+// ConsumePasswordReset 以 DELETE ... RETURNING 取出令牌，并发请求中只有一个能取到
+func (s *SQLiteStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	reset := PasswordReset{TokenHash: tokenHash}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "DELETE FROM password_resets WHERE token_hash = ? RETURNING user_id, username, expires_at",
+		tokenHash).Scan(&reset.UserID, &reset.Username, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reset.ExpiresAt = time.UnixMilli(expiresAt)
+	if !reset.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &reset, nil
+}
+
+// RecordLoginFailure 失败次数加一，已过期的记录从一重新计数
+func (s *SQLiteStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (*LoginAttempts, error) {
+	a := &LoginAttempts{Key: key, LastFailure: time.UnixMilli(at.UnixMilli())}
+	err := s.db.QueryRowContext(ctx, `INSERT INTO login_attempts (key, failures, last_failure, expires_at)
+		VALUES (?1, 1, ?2, ?3)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN expires_at <= ?2 THEN 1 ELSE failures + 1 END,
+			last_failure = ?2, expires_at = ?3
+		RETURNING failures`, key, at.UnixMilli(), at.Add(ttl).UnixMilli()).Scan(&a.Failures)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetLoginAttempts 获取未过期的失败记录
+func (s *SQLiteStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	a := &LoginAttempts{Key: key}
+	var last int64
+	err := s.db.QueryRowContext(ctx, "SELECT failures, last_failure FROM login_attempts WHERE key = ? AND expires_at > ?",
+		key, time.Now().UnixMilli()).Scan(&a.Failures, &last)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.LastFailure = time.UnixMilli(last)
+	return a, nil
+}
+
+// ClearLoginAttempts 删除失败记录
+func (s *SQLiteStore) ClearLoginAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = ?", key)
+	return err
+}
+
+// ListLoginAttempts 列出未过期的失败记录，同时清理已过期的记录
+func (s *SQLiteStore) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	now := time.Now().UnixMilli()
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE expires_at <= ?", now); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT key, failures, last_failure FROM login_attempts ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*LoginAttempts
+	for rows.Next() {
+		var (
+			a    LoginAttempts
+			last int64
+		)
+		if err := rows.Scan(&a.Key, &a.Failures, &last); err != nil {
+			return nil, err
+		}
+		a.LastFailure = time.UnixMilli(last)
+		out = append(out, &a)
+	}
+	return out, rows.Err()
+}
+
+// accessTokenColumns 读取个人访问令牌的列，与 scanAccessToken 对应
+const accessTokenColumns = "id, user_id, username, name, scopes, token_hash, created_at, expires_at, last_used_at"
+
+func scanAccessToken(row interface{ Scan(...interface{}) error }) (*AccessToken, error) {
+	var (
+		t                             AccessToken
+		scopes                        string
+		createdAt, expiresAt, lastUse int64
+	)
+	err := row.Scan(&t.ID, &t.UserID, &t.Username, &t.Name, &scopes, &t.TokenHash, &createdAt, &expiresAt, &lastUse)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	t.CreatedAt = time.UnixMilli(createdAt)
+	t.ExpiresAt = time.UnixMilli(expiresAt)
+	if lastUse > 0 {
+		at := time.UnixMilli(lastUse)
+		t.LastUsedAt = &at
+	}
+	return &t, nil
+}
+
+// CreateAccessToken 保存令牌，同时清理该用户已过期的令牌
+func (s *SQLiteStore) CreateAccessToken(ctx context.Context, t *AccessToken) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM access_tokens WHERE username = ? AND expires_at <= ?",
+			t.Username, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO access_tokens ("+accessTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)",
+			t.ID, t.UserID, t.Username, t.Name, strings.Join(t.Scopes, " "), t.TokenHash,
+			t.CreatedAt.UnixMilli(), t.ExpiresAt.UnixMilli())
+		return err
+	})
+}
+
+// GetAccessToken 获取未过期的令牌
+func (s *SQLiteStore) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	t, err := scanAccessToken(s.db.QueryRowContext(ctx, "SELECT "+accessTokenColumns+" FROM access_tokens WHERE id = ? AND expires_at > ?",
+		id, time.Now().UnixMilli()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// ListAccessTokens 列出用户未过期的令牌
+func (s *SQLiteStore) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+accessTokenColumns+" FROM access_tokens WHERE username = ? AND expires_at > ? ORDER BY created_at",
+		username, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*AccessToken{}
+	for rows.Next() {
+		t, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAccessToken 删除用户的令牌
+func (s *SQLiteStore) DeleteAccessToken(ctx context.Context, username, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE id = ? AND username = ? AND expires_at > ?",
+		id, username, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAccessTokenNotFound
+	}
+	return nil
+}
+
+// TouchAccessToken 更新最近使用时间
+func (s *SQLiteStore) TouchAccessToken(ctx context.Context, id string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE access_tokens SET last_used_at = ? WHERE id = ?", at.UnixMilli(), id)
+	return err
+}
+
+// CreateOIDCLogin 保存登录状态，同时清理已过期的状态
+func (s *SQLiteStore) CreateOIDCLogin(ctx context.Context, login *OIDCLogin) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM oidc_logins WHERE expires_at <= ?", time.Now().UnixMilli()); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO oidc_logins (state_hash, binding_hash, nonce, code_verifier, link_user_id, link_username, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			login.StateHash, login.BindingHash, login.Nonce, login.CodeVerifier, login.LinkUserID, login.LinkUsername, login.ExpiresAt.UnixMilli())
+		return err
+	})
+}
+
+// ConsumeOIDCLogin 以 DELETE ... RETURNING 取出绑定值一致的登录状态，并发请求中只有一个能取到
+func (s *SQLiteStore) ConsumeOIDCLogin(ctx context.Context, stateHash, bindingHash string) (*OIDCLogin, error) {
+	login := OIDCLogin{StateHash: stateHash, BindingHash: bindingHash}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, `DELETE FROM oidc_logins WHERE state_hash = ? AND binding_hash = ?
+		RETURNING nonce, code_verifier, link_user_id, link_username, expires_at`,
+		stateHash, bindingHash).Scan(&login.Nonce, &login.CodeVerifier, &login.LinkUserID, &login.LinkUsername, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	login.ExpiresAt = time.UnixMilli(expiresAt)
+	if !login.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &login, nil
+}
+
+// GetIdentity 获取外部身份的关联
+func (s *SQLiteStore) GetIdentity(ctx context.Context, issuer, subject string) (*ExternalIdentity, error) {
+	identity := ExternalIdentity{Issuer: issuer, Subject: subject}
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT user_id, username, email, created_at FROM identities WHERE issuer = ? AND subject = ?",
+		issuer, subject).Scan(&identity.UserID, &identity.Username, &identity.Email, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	identity.CreatedAt = time.UnixMilli(createdAt)
+	return &identity, nil
+}
+
+// CreateIdentity 关联外部身份，主键冲突时返回 ErrIdentityExists
+func (s *SQLiteStore) CreateIdentity(ctx context.Context, identity *ExternalIdentity) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO identities (issuer, subject, user_id, username, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		identity.Issuer, identity.Subject, identity.UserID, identity.Username, identity.Email, identity.CreatedAt.UnixMilli())
+	if isUniqueViolation(err) {
+		return ErrIdentityExists
+	}
+	return err
+}
+
+// HasUserIdentity 用户是否关联了外部身份
+func (s *SQLiteStore) HasUserIdentity(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM identities WHERE username = ?)", username).Scan(&exists)
+	return exists, err
+}
+
+const twoFactorColumns = "username, user_id, secret, enabled, recovery_codes, last_step, created_at, enabled_at"
+
+// scanTwoFactor 按 twoFactorColumns 的顺序读取一行
+func scanTwoFactor(row interface{ Scan(...interface{}) error }) (*TwoFactor, error) {
+	var (
+		tf        TwoFactor
+		codes     string
+		createdAt int64
+		enabledAt sql.NullInt64
+	)
+	err := row.Scan(&tf.Username, &tf.UserID, &tf.Secret, &tf.Enabled, &codes, &tf.LastStep, &createdAt, &enabledAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(codes), &tf.RecoveryCodes); err != nil {
+		return nil, err
+	}
+	tf.CreatedAt = time.UnixMilli(createdAt)
+	if enabledAt.Valid {
+		at := time.UnixMilli(enabledAt.Int64)
+		tf.EnabledAt = &at
+	}
+	return &tf, nil
+}
+
+// GetTwoFactor 获取两步验证设置
+func (s *SQLiteStore) GetTwoFactor(ctx context.Context, username string) (*TwoFactor, error) {
+	tf, err := scanTwoFactor(s.db.QueryRowContext(ctx, "SELECT "+twoFactorColumns+" FROM two_factor WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return tf, err
+}
+
+// CreateTwoFactor 插入或替换尚未启用的设置，已启用的行不会被更新
+func (s *SQLiteStore) CreateTwoFactor(ctx context.Context, tf *TwoFactor) error {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO two_factor (username, user_id, secret, enabled, recovery_codes, last_step, created_at)
+		VALUES (?, ?, ?, 0, '[]', 0, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			user_id = excluded.user_id, secret = excluded.secret, recovery_codes = '[]',
+			last_step = 0, created_at = excluded.created_at, enabled_at = NULL
+		WHERE two_factor.enabled = 0`,
+		tf.Username, tf.UserID, tf.Secret, tf.CreatedAt.UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// UpdateTwoFactor 在事务中读取、修改并写回设置
+func (s *SQLiteStore) UpdateTwoFactor(ctx context.Context, username string, fn func(tf *TwoFactor) error) (*TwoFactor, error) {
+	var tf *TwoFactor
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		tf, err = scanTwoFactor(tx.QueryRowContext(ctx, "SELECT "+twoFactorColumns+" FROM two_factor WHERE username = ?", username))
+		if err == sql.ErrNoRows {
+			return ErrTwoFactorNotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(tf); err != nil {
+			return err
+		}
+		codes, err := json.Marshal(tf.RecoveryCodes)
+		if err != nil {
+			return err
+		}
+		var enabledAt interface{}
+		if tf.EnabledAt != nil {
+			enabledAt = tf.EnabledAt.UnixMilli()
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE two_factor SET enabled = ?, recovery_codes = ?, last_step = ?, enabled_at = ?
+			WHERE username = ?`, tf.Enabled, string(codes), tf.LastStep, enabledAt, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// DeleteTwoFactor 删除两步验证设置
+func (s *SQLiteStore) DeleteTwoFactor(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM two_factor WHERE username = ?", username)
+	return err
+}
+
+// CreateLoginChallenge 保存登录挑战，同时清理已过期的挑战
+func (s *SQLiteStore) CreateLoginChallenge(ctx context.Context, ch *LoginChallenge) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM login_challenges WHERE expires_at <= ?", time.Now().UnixMilli()); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO login_challenges (token_hash, user_id, username, expires_at) VALUES (?, ?, ?, ?)",
+			ch.TokenHash, ch.UserID, ch.Username, ch.ExpiresAt.UnixMilli())
+		return err
+	})
+}
+
+// GetLoginChallenge 获取未过期的登录挑战
+func (s *SQLiteStore) GetLoginChallenge(ctx context.Context, tokenHash string) (*LoginChallenge, error) {
+	ch := LoginChallenge{TokenHash: tokenHash}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, "SELECT user_id, username, expires_at FROM login_challenges WHERE token_hash = ? AND expires_at > ?",
+		tokenHash, time.Now().UnixMilli()).Scan(&ch.UserID, &ch.Username, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ch.ExpiresAt = time.UnixMilli(expiresAt)
+	return &ch, nil
+}
+
+// DeleteLoginChallenge 删除登录挑战
+func (s *SQLiteStore) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_challenges WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+const jobColumns = "id, type, user_id, username, status, request, trip_id, error, warnings, attempts, cancel_requested, created_at, started_at, finished_at"
+
+// scanJob 按 jobColumns 的顺序读取一行
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var (
+		job        Job
+		request    string
+		warnings   string
+		createdAt  int64
+		startedAt  sql.NullInt64
+		finishedAt sql.NullInt64
+	)
+	err := row.Scan(&job.ID, &job.Type, &job.UserID, &job.Username, &job.Status, &request, &job.TripID, &job.Error,
+		&warnings, &job.Attempts, &job.CancelRequested, &createdAt, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(request), &job.Request); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(warnings), &job.Warnings); err != nil {
+		return nil, err
+	}
+	job.CreatedAt = time.UnixMilli(createdAt)
+	if startedAt.Valid {
+		at := time.UnixMilli(startedAt.Int64)
+		job.StartedAt = &at
+	}
+	if finishedAt.Valid {
+		at := time.UnixMilli(finishedAt.Int64)
+		job.FinishedAt = &at
+	}
+	return &job, nil
+}
+
+// queryJobs 查询并读取多个任务
+func (s *SQLiteStore) queryJobs(ctx context.Context, query string, args ...interface{}) ([]*Job, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// nullableMilli 可空的毫秒时间戳
+func nullableMilli(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+// jobWarnings 任务警告列表的 JSON，nil 时为空数组
+func jobWarnings(job *Job) (string, error) {
+	if job.Warnings == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(job.Warnings)
+	return string(data), err
+}
+
+// jobRetentionCutoff 结束时间早于该时间戳的任务已超过保留时长
+func jobRetentionCutoff() int64 {
+	return time.Now().Add(-JobRetention).UnixMilli()
+}
+
+// CreateJob 保存任务，同时清理超过保留时长的任务
+func (s *SQLiteStore) CreateJob(ctx context.Context, job *Job) error {
+	request, err := json.Marshal(job.Request)
+	if err != nil {
+		return err
+	}
+	warnings, err := jobWarnings(job)
+	if err != nil {
+		return err
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM jobs WHERE finished_at <= ?", jobRetentionCutoff()); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO jobs ("+jobColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			job.ID, job.Type, job.UserID, job.Username, string(job.Status), string(request), job.TripID, job.Error, warnings,
+			job.Attempts, job.CancelRequested, job.CreatedAt.UnixMilli(), nullableMilli(job.StartedAt), nullableMilli(job.FinishedAt))
+		return err
+	})
+}
+
+// GetJob 获取保留期内的任务
+func (s *SQLiteStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	job, err := scanJob(s.db.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM jobs WHERE id = ? AND (finished_at IS NULL OR finished_at > ?)",
+		id, jobRetentionCutoff()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// UpdateJob 在事务中读取、修改并写回任务
+func (s *SQLiteStore) UpdateJob(ctx context.Context, id string, fn func(job *Job) error) (*Job, error) {
+	var job *Job
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		job, err = scanJob(tx.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM jobs WHERE id = ? AND (finished_at IS NULL OR finished_at > ?)",
+			id, jobRetentionCutoff()))
+		if err == sql.ErrNoRows {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(job); err != nil {
+			return err
+		}
+		warnings, err := jobWarnings(job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE jobs SET status = ?, trip_id = ?, error = ?, warnings = ?, attempts = ?, cancel_requested = ?,
+			started_at = ?, finished_at = ? WHERE id = ?`,
+			string(job.Status), job.TripID, job.Error, warnings, job.Attempts, job.CancelRequested,
+			nullableMilli(job.StartedAt), nullableMilli(job.FinishedAt), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ListUserJobs 列出用户保留期内的任务
+func (s *SQLiteStore) ListUserJobs(ctx context.Context, username string) ([]*Job, error) {
+	return s.queryJobs(ctx, "SELECT "+jobColumns+` FROM jobs WHERE username = ? AND (finished_at IS NULL OR finished_at > ?)
+		ORDER BY created_at DESC`, username, jobRetentionCutoff())
+}
+
+// ListActiveJobs 列出排队和执行中的任务
+func (s *SQLiteStore) ListActiveJobs(ctx context.Context) ([]*Job, error) {
+	return s.queryJobs(ctx, "SELECT "+jobColumns+" FROM jobs WHERE finished_at IS NULL ORDER BY created_at")
+}
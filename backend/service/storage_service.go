@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserExists     = errors.New("user exists")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrTripNotFound   = errors.New("trip not found")
+	ErrFavoriteExists = errors.New("favorite already exists")
+	ErrDiaryNotFound  = errors.New("diary not found")
+
+	ErrConcurrentUpdate = errors.New("record was modified concurrently")
+	ErrInvalidTripQuery = errors.New("invalid trip query")
+
+	ErrTrashItemNotFound = errors.New("trash item not found")
+	ErrRestoreConflict   = errors.New("a record with the same id already exists")
+
+	ErrRevisionNotFound = errors.New("trip revision not found")
+)
+
+// UserStore 用户存储
+type UserStore interface {
+	// GetUser 获取用户，不存在时返回 nil, nil
+	GetUser(ctx context.Context, username string) (*UserRecord, error)
+	// CreateUser 创建新用户，用户名已存在时返回 ErrUserExists
+	CreateUser(ctx context.Context, username, password string) (*UserRecord, error)
+	// SetPassword 更新用户密码，用户不存在时返回 ErrUserNotFound
+	SetPassword(ctx context.Context, username, password string) error
+	// UpdateUser 原子地读取并修改用户记录（ID 和用户名不能修改），返回修改后的记录；
+	// 用户不存在时返回 ErrUserNotFound，fn 返回错误时不做修改并原样返回该错误
+	UpdateUser(ctx context.Context, username string, fn func(u *UserRecord) error) (*UserRecord, error)
+	// ListUsers 列出全部用户，按ID排序
+	ListUsers(ctx context.Context) ([]*UserRecord, error)
+	// DeleteUser 删除用户及其全部数据（包括登录会话）并复查，用户不存在时返回 ErrUserNotFound
+	DeleteUser(ctx context.Context, username string) (*AccountDeletionReport, error)
+}
+
+// LookupUser 按登录时输入的用户名查找用户，不存在时返回 nil, nil。先按输入原样查找，
+// 兼容用户名规范化之前注册的账户，找不到时再按 NormalizeUsername 的规范形式查找
+func LookupUser(ctx context.Context, users UserStore, username string) (*UserRecord, error) {
+	u, err := users.GetUser(ctx, username)
+	if err != nil || u != nil {
+		return u, err
+	}
+	if normalized := NormalizeUsername(username); normalized != username {
+		return users.GetUser(ctx, normalized)
+	}
+	return nil, nil
+}
+
+// TripStore 行程存储
+type TripStore interface {
+	// SaveTripPlan 保存行程，并在同一事务中将保存后的内容记录为新版本
+	SaveTripPlan(ctx context.Context, plan *TripPlan, rev TripRevisionInfo) error
+	// GetTripPlan 获取行程，不存在时返回 nil, nil
+	GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error)
+	GetUserTrips(ctx context.Context, username string) ([]*TripPlan, error)
+	// ListUserTrips 按条件分页查询用户行程，参数或游标无效时返回 ErrInvalidTripQuery
+	ListUserTrips(ctx context.Context, username string, q TripQuery) (*TripPage, error)
+	// DeleteTripPlan 将用户的行程移入回收站
+	DeleteTripPlan(ctx context.Context, tripID, username string) error
+	GenerateTripID(ctx context.Context) (string, error)
+
+	// ListTripRevisions 列出行程的全部版本（不含行程内容），按版本号倒序
+	ListTripRevisions(ctx context.Context, tripID string) ([]*TripRevision, error)
+	// GetTripRevision 获取行程的指定版本，不存在时返回 ErrRevisionNotFound
+	GetTripRevision(ctx context.Context, tripID string, number int) (*TripRevision, error)
+}
+
+// FavoriteStore 景点收藏与行程收藏存储
+type FavoriteStore interface {
+	GetUserFavorites(ctx context.Context, username string) ([]Favorite, error)
+	// AddFavorite 添加收藏，重复添加时返回 ErrFavoriteExists
+	AddFavorite(ctx context.Context, username string, favorite Favorite) error
+	// ReplaceFavorite 原地覆盖同ID的收藏，不存在时添加，不会产生回收站条目
+	ReplaceFavorite(ctx context.Context, username string, favorite Favorite) error
+	// RemoveFavorite 将收藏移入回收站
+	RemoveFavorite(ctx context.Context, username, favoriteID string) error
+
+	GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, error)
+	// AddFavoriteTrip 收藏行程，行程不存在时返回 ErrTripNotFound
+	AddFavoriteTrip(ctx context.Context, username, tripID string) error
+	RemoveFavoriteTrip(ctx context.Context, username, tripID string) error
+	IsTripFavorited(ctx context.Context, username, tripID string) (bool, error)
+}
+
+// ExpenseStore 花费记录存储
+type ExpenseStore interface {
+	SaveExpense(ctx context.Context, username string, rec *ExpenseRecord) error
+	GetExpenses(ctx context.Context, username string) ([]*ExpenseRecord, error)
+	GenerateExpenseID(ctx context.Context) (string, error)
+}
+
+// DiaryStore 旅行日记存储
+type DiaryStore interface {
+	CreateDiary(ctx context.Context, diary *DiaryEntry) (int64, error)
+	// GetUserDiaries 获取用户的所有日记，按时间倒序
+	GetUserDiaries(ctx context.Context, userID int64) ([]DiaryEntry, error)
+	// GetDiary 获取单条日记，不存在时返回 ErrDiaryNotFound
+	GetDiary(ctx context.Context, idStr string, userID int64) (*DiaryEntry, error)
+	// UpdateDiary 更新日记，不存在时返回 ErrDiaryNotFound，并发修改冲突时返回 ErrConcurrentUpdate
+	UpdateDiary(ctx context.Context, idStr string, userID int64, updated *DiaryEntry) error
+	// DeleteDiary 将日记移入 username 的回收站
+	DeleteDiary(ctx context.Context, idStr string, userID int64, username string) error
+}
+
+// TrashStore 回收站存储，删除的行程、日记和景点收藏在恢复或过期清理前保留在这里
+type TrashStore interface {
+	// ListTrash 列出用户回收站中的条目，按删除时间倒序
+	ListTrash(ctx context.Context, username string) ([]*TrashItem, error)
+	// RestoreTrash 恢复条目，条目不存在时返回 ErrTrashItemNotFound，
+	// 已存在同ID的记录时返回 ErrRestoreConflict
+	RestoreTrash(ctx context.Context, username string, kind TrashKind, id string) error
+	// PurgeTrash 永久删除条目（行程同时删除版本历史），条目不存在时返回 ErrTrashItemNotFound
+	PurgeTrash(ctx context.Context, username string, kind TrashKind, id string) error
+	// PurgeExpiredTrash 永久删除所有用户在 before 之前删除的条目，返回删除数量
+	PurgeExpiredTrash(ctx context.Context, before time.Time) (int, error)
+}
+
+// Backend 同时实现全部存储接口的存储后端
+type Backend interface {
+	UserStore
+	TripStore
+	FavoriteStore
+	ExpenseStore
+	DiaryStore
+	TrashStore
+	Migrator
+	IntegrityChecker
+	SearchIndex
+	SessionStore
+	PasswordResetStore
+	LoginAttemptStore
+	AccessTokenStore
+	IdentityStore
+	TwoFactorStore
+	JobStore
+}
+
+// Stores 注入到处理器中的存储集合
+type Stores struct {
+	Users          UserStore
+	Trips          TripStore
+	Favorites      FavoriteStore
+	Expenses       ExpenseStore
+	Diaries        DiaryStore
+	Trash          TrashStore
+	Search         SearchIndex
+	Sessions       SessionStore
+	PasswordResets PasswordResetStore
+	LoginAttempts  LoginAttemptStore
+	AccessTokens   AccessTokenStore
+	Identities     IdentityStore
+	TwoFactor      TwoFactorStore
+	Jobs           JobStore
+}
+
+// NewStores 使用同一个后端构建存储集合
+func NewStores(b Backend) *Stores {
+	return &Stores{
+		Users:          b,
+		Trips:          b,
+		Favorites:      b,
+		Expenses:       b,
+		Diaries:        b,
+		Trash:          b,
+		Search:         b,
+		Sessions:       b,
+		PasswordResets: b,
+		LoginAttempts:  b,
+		AccessTokens:   b,
+		Identities:     b,
+		TwoFactor:      b,
+		Jobs:           b,
+	}
+}
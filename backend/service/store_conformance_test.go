@@ -0,0 +1,662 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newRedisTestStore 连接到测试专用的 miniredis 实例
+func newRedisTestStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	s := NewRedisStore(m.Addr(), "", 0)
+	t.Cleanup(func() { s.rdb.Close() })
+	return s, m
+}
+
+// newSQLiteTestStore 在临时目录中创建 SQLite 数据库
+func newSQLiteTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open sqlite store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Backend { return NewMemoryStore() })
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Backend { return newSQLiteTestStore(t) })
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Backend {
+		s, _ := newRedisTestStore(t)
+		return s
+	})
+}
+
+// runStoreConformance 对存储后端运行接口文档约定的行为检查，每个用例使用新建的后端
+func runStoreConformance(t *testing.T, newBackend func(t *testing.T) Backend) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, b Backend)
+	}{
+		{"CreateUserDuplicate", testCreateUserDuplicate},
+		{"MissingRecords", testMissingRecords},
+		{"UpdateUser", testUpdateUser},
+		{"TripRevisionConflict", testTripRevisionConflict},
+		{"Favorites", testFavorites},
+		{"TripPagination", testTripPagination},
+		{"InvalidTripQuery", testInvalidTripQuery},
+		{"TrashRestore", testTrashRestore},
+		{"TrashRestoreConflict", testTrashRestoreConflict},
+		{"TrashPurge", testTrashPurge},
+		{"PurgeExpiredTrash", testPurgeExpiredTrash},
+		{"PasswordReset", testPasswordReset},
+		{"Identities", testIdentities},
+		{"SearchPostings", testSearchPostings},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			tc.run(t, ctx, newBackend(t))
+		})
+	}
+}
+
+// mustCreateUser 创建测试用户
+func mustCreateUser(t *testing.T, ctx context.Context, b Backend, username string) *UserRecord {
+	t.Helper()
+	u, err := b.CreateUser(ctx, username, "hash")
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", username, err)
+	}
+	return u
+}
+
+// mustSaveTrip 为用户保存一个新行程
+func mustSaveTrip(t *testing.T, ctx context.Context, b Backend, u *UserRecord, id string, budget float64, createdAt time.Time) *TripPlan {
+	t.Helper()
+	plan := &TripPlan{
+		ID:       id,
+		UserID:   u.ID,
+		Username: u.Username,
+		Request: TripPlanRequest{
+			Destination: "北京",
+			StartDate:   "2026-11-01",
+			EndDate:     "2026-11-02",
+			Budget:      budget,
+			Travelers:   1,
+		},
+		Itinerary: []DayItinerary{{Day: 1, Date: "2026-11-01", Activities: []Activity{{Name: "故宫", Cost: 60}}, DailyCost: 60}},
+		TotalCost: 60,
+		Summary:   "summary " + id,
+		CreatedAt: createdAt,
+	}
+	if err := b.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionGenerated}); err != nil {
+		t.Fatalf("SaveTripPlan(%q): %v", id, err)
+	}
+	return plan
+}
+
+func testCreateUserDuplicate(t *testing.T, ctx context.Context, b Backend) {
+	first := mustCreateUser(t, ctx, b, "alice")
+	if _, err := b.CreateUser(ctx, "alice", "other"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("duplicate CreateUser: got %v, want ErrUserExists", err)
+	}
+	u, err := b.GetUser(ctx, "alice")
+	if err != nil || u == nil {
+		t.Fatalf("GetUser: %v, %v", u, err)
+	}
+	if u.ID != first.ID || u.PasswordHash != first.PasswordHash {
+		t.Fatalf("duplicate CreateUser changed the user: %+v", u)
+	}
+	users, err := b.ListUsers(ctx)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers: %d users, %v", len(users), err)
+	}
+}
+
+func testMissingRecords(t *testing.T, ctx context.Context, b Backend) {
+	if u, err := b.GetUser(ctx, "nobody"); u != nil || err != nil {
+		t.Errorf("GetUser(missing) = %v, %v; want nil, nil", u, err)
+	}
+	if p, err := b.GetTripPlan(ctx, "missing"); p != nil || err != nil {
+		t.Errorf("GetTripPlan(missing) = %v, %v; want nil, nil", p, err)
+	}
+	if err := b.SetPassword(ctx, "nobody", "hash"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("SetPassword(missing) = %v; want ErrUserNotFound", err)
+	}
+	if _, err := b.DeleteUser(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("DeleteUser(missing) = %v; want ErrUserNotFound", err)
+	}
+	if _, err := b.GetTripRevision(ctx, "missing", 1); !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("GetTripRevision(missing) = %v; want ErrRevisionNotFound", err)
+	}
+	if _, err := b.GetDiary(ctx, "12345", 1); !errors.Is(err, ErrDiaryNotFound) {
+		t.Errorf("GetDiary(missing) = %v; want ErrDiaryNotFound", err)
+	}
+	if err := b.UpdateDiary(ctx, "12345", 1, &DiaryEntry{Title: "x"}); !errors.Is(err, ErrDiaryNotFound) {
+		t.Errorf("UpdateDiary(missing) = %v; want ErrDiaryNotFound", err)
+	}
+	if err := b.RestoreTrash(ctx, "nobody", TrashTrip, "missing"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("RestoreTrash(missing) = %v; want ErrTrashItemNotFound", err)
+	}
+	if err := b.PurgeTrash(ctx, "nobody", TrashTrip, "missing"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("PurgeTrash(missing) = %v; want ErrTrashItemNotFound", err)
+	}
+	if j, err := b.GetJob(ctx, "missing"); j != nil || err != nil {
+		t.Errorf("GetJob(missing) = %v, %v; want nil, nil", j, err)
+	}
+	if _, err := b.UpdateJob(ctx, "missing", func(*Job) error { return nil }); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("UpdateJob(missing) = %v; want ErrJobNotFound", err)
+	}
+}
+
+func testUpdateUser(t *testing.T, ctx context.Context, b Backend) {
+	mustCreateUser(t, ctx, b, "alice")
+	if _, err := b.UpdateUser(ctx, "nobody", func(*UserRecord) error { return nil }); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("UpdateUser(missing) = %v; want ErrUserNotFound", err)
+	}
+
+	errStop := errors.New("stop")
+	_, err := b.UpdateUser(ctx, "alice", func(u *UserRecord) error {
+		u.Role = RoleAdmin
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("UpdateUser with failing fn = %v; want the fn error", err)
+	}
+	if u, _ := b.GetUser(ctx, "alice"); u.Role == RoleAdmin {
+		t.Fatal("UpdateUser wrote the record although fn failed")
+	}
+
+	updated, err := b.UpdateUser(ctx, "alice", func(u *UserRecord) error {
+		u.Role = RoleAdmin
+		return nil
+	})
+	if err != nil || updated.Role != RoleAdmin {
+		t.Fatalf("UpdateUser = %+v, %v", updated, err)
+	}
+	if u, _ := b.GetUser(ctx, "alice"); u.Role != RoleAdmin {
+		t.Fatalf("role after UpdateUser = %q; want %q", u.Role, RoleAdmin)
+	}
+}
+
+func testTripRevisionConflict(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	saved := mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	if saved.Revision != 1 {
+		t.Fatalf("revision after first save = %d; want 1", saved.Revision)
+	}
+
+	first, _ := b.GetTripPlan(ctx, "trip1")
+	second, _ := b.GetTripPlan(ctx, "trip1")
+	if first.Revision != 1 {
+		t.Fatalf("GetTripPlan revision = %d; want 1", first.Revision)
+	}
+	first.Summary = "first edit"
+	if err := b.SaveTripPlan(ctx, first, TripRevisionInfo{Reason: RevisionEdited, ExpectedRevision: first.Revision}); err != nil {
+		t.Fatalf("first edit: %v", err)
+	}
+	second.Summary = "second edit"
+	err := b.SaveTripPlan(ctx, second, TripRevisionInfo{Reason: RevisionEdited, ExpectedRevision: second.Revision})
+	if !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("stale edit = %v; want ErrConcurrentUpdate", err)
+	}
+
+	got, _ := b.GetTripPlan(ctx, "trip1")
+	if got.Summary != "first edit" || got.Revision != 2 {
+		t.Fatalf("after stale edit: summary %q revision %d; want %q, 2", got.Summary, got.Revision, "first edit")
+	}
+	revs, err := b.ListTripRevisions(ctx, "trip1")
+	if err != nil || len(revs) != 2 || revs[0].Number != 2 {
+		t.Fatalf("ListTripRevisions = %d revisions (%v); want 2, newest first", len(revs), err)
+	}
+
+	// 指定期望版本时行程必须存在，已删除的行程不会被写回
+	if err := b.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	err = b.SaveTripPlan(ctx, got, TripRevisionInfo{Reason: RevisionEdited, ExpectedRevision: got.Revision})
+	if !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("edit of deleted trip = %v; want ErrConcurrentUpdate", err)
+	}
+	if p, _ := b.GetTripPlan(ctx, "trip1"); p != nil {
+		t.Fatal("edit of deleted trip recreated it")
+	}
+}
+
+func testFavorites(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	fav := Favorite{ID: "poi1", Name: "故宫", Lng: 116.39, Lat: 39.91}
+	if err := b.AddFavorite(ctx, "alice", fav); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	if err := b.AddFavorite(ctx, "alice", fav); !errors.Is(err, ErrFavoriteExists) {
+		t.Fatalf("duplicate AddFavorite = %v; want ErrFavoriteExists", err)
+	}
+	// 覆盖收藏不进入回收站，也不改变收藏夹中的顺序
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi2", Name: "天坛"}); err != nil {
+		t.Fatalf("AddFavorite(poi2): %v", err)
+	}
+	if err := b.ReplaceFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "故宫博物院"}); err != nil {
+		t.Fatalf("ReplaceFavorite: %v", err)
+	}
+	if err := b.ReplaceFavorite(ctx, "alice", Favorite{ID: "poi3", Name: "颐和园"}); err != nil {
+		t.Fatalf("ReplaceFavorite(new): %v", err)
+	}
+	favs, err := b.GetUserFavorites(ctx, "alice")
+	if err != nil || len(favs) != 3 || favs[0].ID != "poi1" || favs[0].Name != "故宫博物院" || favs[1].ID != "poi2" || favs[2].ID != "poi3" {
+		t.Fatalf("GetUserFavorites after replace = %+v, %v", favs, err)
+	}
+	if items, _ := b.ListTrash(ctx, "alice"); len(items) != 0 {
+		t.Fatalf("ReplaceFavorite left %d trash items", len(items))
+	}
+	if err := b.AddFavoriteTrip(ctx, "alice", "missing"); !errors.Is(err, ErrTripNotFound) {
+		t.Fatalf("AddFavoriteTrip(missing) = %v; want ErrTripNotFound", err)
+	}
+	mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	if err := b.AddFavoriteTrip(ctx, "alice", "trip1"); err != nil {
+		t.Fatalf("AddFavoriteTrip: %v", err)
+	}
+	if ok, err := b.IsTripFavorited(ctx, "alice", "trip1"); !ok || err != nil {
+		t.Fatalf("IsTripFavorited = %v, %v", ok, err)
+	}
+}
+
+func testTripPagination(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	other := mustCreateUser(t, ctx, b, "bob")
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 预算有重复，检查排序值相同时按ID稳定翻页
+	budgets := []float64{300, 100, 200, 100, 500}
+	for i, budget := range budgets {
+		mustSaveTrip(t, ctx, b, u, fmt.Sprintf("trip%d", i), budget, base.Add(time.Duration(i)*time.Hour))
+	}
+	mustSaveTrip(t, ctx, b, other, "bobtrip", 50, base)
+
+	pages := func(q TripQuery) []string {
+		t.Helper()
+		var ids []string
+		for n := 0; ; n++ {
+			if n > len(budgets) {
+				t.Fatalf("pagination did not terminate for %+v", q)
+			}
+			page, err := b.ListUserTrips(ctx, "alice", q)
+			if err != nil {
+				t.Fatalf("ListUserTrips(%+v): %v", q, err)
+			}
+			if len(page.Trips) > q.Limit {
+				t.Fatalf("page has %d trips; limit %d", len(page.Trips), q.Limit)
+			}
+			for _, trip := range page.Trips {
+				ids = append(ids, trip.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+
+	tests := []struct {
+		q    TripQuery
+		want []string
+	}{
+		{TripQuery{Limit: 2}, []string{"trip0", "trip1", "trip2", "trip3", "trip4"}},
+		{TripQuery{Limit: 2, Desc: true}, []string{"trip4", "trip3", "trip2", "trip1", "trip0"}},
+		{TripQuery{Limit: 2, SortBy: TripSortBudget}, []string{"trip1", "trip3", "trip2", "trip0", "trip4"}},
+		{TripQuery{Limit: 3, SortBy: TripSortBudget, Desc: true}, []string{"trip4", "trip0", "trip2", "trip3", "trip1"}},
+		{TripQuery{Limit: 5}, []string{"trip0", "trip1", "trip2", "trip3", "trip4"}},
+	}
+	for _, tt := range tests {
+		got := pages(tt.q)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("pages(%+v) = %v; want %v", tt.q, got, tt.want)
+		}
+	}
+
+	// 翻页过程中删除下一页的行程，后续页面不重复也不跳过其余行程
+	page, err := b.ListUserTrips(ctx, "alice", TripQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListUserTrips: %v", err)
+	}
+	if err := b.DeleteTripPlan(ctx, "trip2", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	rest := pages(TripQuery{Limit: 2, Cursor: page.NextCursor})
+	if want := []string{"trip3", "trip4"}; fmt.Sprint(rest) != fmt.Sprint(want) {
+		t.Errorf("pages after delete = %v; want %v", rest, want)
+	}
+}
+
+func testInvalidTripQuery(t *testing.T, ctx context.Context, b Backend) {
+	mustCreateUser(t, ctx, b, "alice")
+	for _, q := range []TripQuery{
+		{SortBy: "title"},
+		{Cursor: "not-a-cursor"},
+		{From: "2026-13-01"},
+	} {
+		if _, err := b.ListUserTrips(ctx, "alice", q); !errors.Is(err, ErrInvalidTripQuery) {
+			t.Errorf("ListUserTrips(%+v) = %v; want ErrInvalidTripQuery", q, err)
+		}
+	}
+	// 游标只能用于生成它的排序方式
+	u, _ := b.GetUser(ctx, "alice")
+	for i := 0; i < 3; i++ {
+		mustSaveTrip(t, ctx, b, u, "trip"+strconv.Itoa(i), float64(i), time.Now())
+	}
+	page, err := b.ListUserTrips(ctx, "alice", TripQuery{Limit: 1})
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("first page: %v, cursor %q", err, page.NextCursor)
+	}
+	q := TripQuery{Limit: 1, SortBy: TripSortBudget, Cursor: page.NextCursor}
+	if _, err := b.ListUserTrips(ctx, "alice", q); !errors.Is(err, ErrInvalidTripQuery) {
+		t.Errorf("cursor with another sort field = %v; want ErrInvalidTripQuery", err)
+	}
+}
+
+func testTrashRestore(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	if err := b.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	if p, _ := b.GetTripPlan(ctx, "trip1"); p != nil {
+		t.Fatal("deleted trip is still readable")
+	}
+	items, err := b.ListTrash(ctx, "alice")
+	if err != nil || len(items) != 1 || items[0].Kind != TrashTrip || items[0].ID != "trip1" {
+		t.Fatalf("ListTrash = %+v, %v; want the deleted trip", items, err)
+	}
+	if other, _ := b.ListTrash(ctx, "bob"); len(other) != 0 {
+		t.Fatalf("trash of another user has %d items", len(other))
+	}
+	if err := b.RestoreTrash(ctx, "bob", TrashTrip, "trip1"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("RestoreTrash by another user = %v; want ErrTrashItemNotFound", err)
+	}
+
+	if err := b.RestoreTrash(ctx, "alice", TrashTrip, "trip1"); err != nil {
+		t.Fatalf("RestoreTrash: %v", err)
+	}
+	p, err := b.GetTripPlan(ctx, "trip1")
+	if err != nil || p == nil || p.Summary != "summary trip1" {
+		t.Fatalf("restored trip = %+v, %v", p, err)
+	}
+	if revs, _ := b.ListTripRevisions(ctx, "trip1"); len(revs) != 1 {
+		t.Fatalf("restored trip has %d revisions; want 1", len(revs))
+	}
+	page, err := b.ListUserTrips(ctx, "alice", TripQuery{})
+	if err != nil || len(page.Trips) != 1 {
+		t.Fatalf("restored trip missing from ListUserTrips: %d, %v", len(page.Trips), err)
+	}
+	if items, _ := b.ListTrash(ctx, "alice"); len(items) != 0 {
+		t.Fatalf("trash has %d items after restore", len(items))
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashTrip, "trip1"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("second RestoreTrash = %v; want ErrTrashItemNotFound", err)
+	}
+
+	// 日记和景点收藏
+	diaryID, err := b.CreateDiary(ctx, &DiaryEntry{UserID: int64(u.ID), Date: "2026-11-01", Title: "日记", Content: "内容"})
+	if err != nil {
+		t.Fatalf("CreateDiary: %v", err)
+	}
+	idStr := strconv.FormatInt(diaryID, 10)
+	if err := b.DeleteDiary(ctx, idStr, int64(u.ID), "alice"); err != nil {
+		t.Fatalf("DeleteDiary: %v", err)
+	}
+	if _, err := b.GetDiary(ctx, idStr, int64(u.ID)); !errors.Is(err, ErrDiaryNotFound) {
+		t.Fatalf("GetDiary after delete = %v; want ErrDiaryNotFound", err)
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashDiary, idStr); err != nil {
+		t.Fatalf("RestoreTrash(diary): %v", err)
+	}
+	if d, err := b.GetDiary(ctx, idStr, int64(u.ID)); err != nil || d.Title != "日记" {
+		t.Fatalf("restored diary = %+v, %v", d, err)
+	}
+
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "故宫"}); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	if err := b.RemoveFavorite(ctx, "alice", "poi1"); err != nil {
+		t.Fatalf("RemoveFavorite: %v", err)
+	}
+	if favs, _ := b.GetUserFavorites(ctx, "alice"); len(favs) != 0 {
+		t.Fatalf("%d favorites after remove", len(favs))
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashFavorite, "poi1"); err != nil {
+		t.Fatalf("RestoreTrash(favorite): %v", err)
+	}
+	if favs, _ := b.GetUserFavorites(ctx, "alice"); len(favs) != 1 || favs[0].Name != "故宫" {
+		t.Fatalf("favorites after restore = %+v", favs)
+	}
+}
+
+func testTrashRestoreConflict(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	if err := b.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	mustSaveTrip(t, ctx, b, u, "trip1", 2000, time.Now())
+
+	if err := b.RestoreTrash(ctx, "alice", TrashTrip, "trip1"); !errors.Is(err, ErrRestoreConflict) {
+		t.Fatalf("RestoreTrash over an existing trip = %v; want ErrRestoreConflict", err)
+	}
+	if p, _ := b.GetTripPlan(ctx, "trip1"); p == nil || p.Request.Budget != 2000 {
+		t.Fatalf("conflicting restore overwrote the current trip: %+v", p)
+	}
+	if items, _ := b.ListTrash(ctx, "alice"); len(items) != 1 {
+		t.Fatalf("trash has %d items after a failed restore; want 1", len(items))
+	}
+
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "旧"}); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	if err := b.RemoveFavorite(ctx, "alice", "poi1"); err != nil {
+		t.Fatalf("RemoveFavorite: %v", err)
+	}
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "新"}); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashFavorite, "poi1"); !errors.Is(err, ErrRestoreConflict) {
+		t.Fatalf("RestoreTrash over an existing favorite = %v; want ErrRestoreConflict", err)
+	}
+}
+
+func testTrashPurge(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	if err := b.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	if revs, _ := b.ListTripRevisions(ctx, "trip1"); len(revs) != 1 {
+		t.Fatalf("trip in trash has %d revisions; want them kept", len(revs))
+	}
+	if err := b.PurgeTrash(ctx, "alice", TrashTrip, "trip1"); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if items, _ := b.ListTrash(ctx, "alice"); len(items) != 0 {
+		t.Fatalf("trash has %d items after purge", len(items))
+	}
+	if revs, _ := b.ListTripRevisions(ctx, "trip1"); len(revs) != 0 {
+		t.Fatalf("purged trip still has %d revisions", len(revs))
+	}
+	if err := b.PurgeTrash(ctx, "alice", TrashTrip, "trip1"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("second PurgeTrash = %v; want ErrTrashItemNotFound", err)
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashTrip, "trip1"); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("RestoreTrash after purge = %v; want ErrTrashItemNotFound", err)
+	}
+}
+
+func testPurgeExpiredTrash(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	bob := mustCreateUser(t, ctx, b, "bob")
+	mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	mustSaveTrip(t, ctx, b, bob, "trip2", 1000, time.Now())
+	if err := b.AddFavorite(ctx, "alice", Favorite{ID: "poi1", Name: "故宫"}); err != nil {
+		t.Fatalf("AddFavorite: %v", err)
+	}
+	for _, del := range []error{
+		b.DeleteTripPlan(ctx, "trip1", "alice"),
+		b.DeleteTripPlan(ctx, "trip2", "bob"),
+		b.RemoveFavorite(ctx, "alice", "poi1"),
+	} {
+		if del != nil {
+			t.Fatalf("delete: %v", del)
+		}
+	}
+
+	n, err := b.PurgeExpiredTrash(ctx, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Fatalf("PurgeExpiredTrash(before deletions) = %d, %v; want 0", n, err)
+	}
+	n, err = b.PurgeExpiredTrash(ctx, time.Now().Add(time.Minute))
+	if err != nil || n != 3 {
+		t.Fatalf("PurgeExpiredTrash = %d, %v; want 3", n, err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if items, _ := b.ListTrash(ctx, name); len(items) != 0 {
+			t.Errorf("%s has %d trash items after purge", name, len(items))
+		}
+	}
+	if revs, _ := b.ListTripRevisions(ctx, "trip1"); len(revs) != 0 {
+		t.Errorf("expired trip still has %d revisions", len(revs))
+	}
+}
+
+func testPasswordReset(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	reset := &PasswordReset{TokenHash: "h1", UserID: u.ID, Username: u.Username, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := b.CreatePasswordReset(ctx, reset); err != nil {
+		t.Fatalf("CreatePasswordReset: %v", err)
+	}
+	// 查看令牌不会使用它
+	for i := 0; i < 2; i++ {
+		got, err := b.GetPasswordReset(ctx, "h1")
+		if err != nil || got == nil || got.Username != "alice" || got.UserID != u.ID {
+			t.Fatalf("GetPasswordReset = %+v, %v", got, err)
+		}
+	}
+	if got, err := b.GetPasswordReset(ctx, "missing"); got != nil || err != nil {
+		t.Fatalf("GetPasswordReset(missing) = %+v, %v; want nil, nil", got, err)
+	}
+	if got, err := b.ConsumePasswordReset(ctx, "h1"); err != nil || got == nil {
+		t.Fatalf("ConsumePasswordReset = %+v, %v", got, err)
+	}
+	if got, _ := b.GetPasswordReset(ctx, "h1"); got != nil {
+		t.Fatal("used token is still readable")
+	}
+	if got, _ := b.ConsumePasswordReset(ctx, "h1"); got != nil {
+		t.Fatal("token was used twice")
+	}
+}
+
+func testIdentities(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	mustCreateUser(t, ctx, b, "bob")
+	if linked, err := b.HasUserIdentity(ctx, "alice"); err != nil || linked {
+		t.Fatalf("HasUserIdentity before link = %v, %v; want false", linked, err)
+	}
+	identity := &ExternalIdentity{Issuer: "https://idp", Subject: "s1", UserID: u.ID, Username: u.Username, CreatedAt: time.Now()}
+	if err := b.CreateIdentity(ctx, identity); err != nil {
+		t.Fatalf("CreateIdentity: %v", err)
+	}
+	if err := b.CreateIdentity(ctx, identity); !errors.Is(err, ErrIdentityExists) {
+		t.Fatalf("CreateIdentity(duplicate) = %v; want ErrIdentityExists", err)
+	}
+	if linked, err := b.HasUserIdentity(ctx, "alice"); err != nil || !linked {
+		t.Fatalf("HasUserIdentity after link = %v, %v; want true", linked, err)
+	}
+	if linked, _ := b.HasUserIdentity(ctx, "bob"); linked {
+		t.Fatal("bob has alice's identity")
+	}
+	// 注销账户一并删除关联
+	if _, err := b.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if linked, _ := b.HasUserIdentity(ctx, "alice"); linked {
+		t.Fatal("identity survived account deletion")
+	}
+	if got, _ := b.GetIdentity(ctx, "https://idp", "s1"); got != nil {
+		t.Fatalf("GetIdentity after deletion = %+v", got)
+	}
+}
+
+func testSearchPostings(t *testing.T, ctx context.Context, b Backend) {
+	u := mustCreateUser(t, ctx, b, "alice")
+	scope := tripSearchScope("alice")
+	// 首次搜索时建立索引，之后由写入维护
+	if err := b.ReplaceSearchIndex(ctx, scope, nil); err != nil {
+		t.Fatalf("ReplaceSearchIndex: %v", err)
+	}
+	postings := func(terms ...string) *SearchPostings {
+		t.Helper()
+		post, err := b.SearchPostings(ctx, scope, terms)
+		if err != nil || !post.Built {
+			t.Fatalf("SearchPostings(%v) = %+v, %v; want a built index", terms, post, err)
+		}
+		return post
+	}
+
+	plan := mustSaveTrip(t, ctx, b, u, "trip1", 1000, time.Now())
+	post := postings("harbor", "lakeside")
+	if _, ok := post.Postings["harbor"]["trip1"]; ok || post.Docs != 1 {
+		t.Fatalf("postings after save = %+v; want 1 doc without harbor", post)
+	}
+
+	plan.Summary = "harbor walk"
+	if err := b.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionEdited, ExpectedRevision: plan.Revision}); err != nil {
+		t.Fatalf("SaveTripPlan: %v", err)
+	}
+	post = postings("harbor")
+	if _, ok := post.Postings["harbor"]["trip1"]; !ok {
+		t.Fatalf("postings after edit = %+v; want trip1 under harbor", post)
+	}
+	plan.Summary = "lakeside walk"
+	if err := b.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionEdited, ExpectedRevision: plan.Revision}); err != nil {
+		t.Fatalf("SaveTripPlan: %v", err)
+	}
+	post = postings("harbor", "lakeside", "walk")
+	if _, ok := post.Postings["harbor"]["trip1"]; ok {
+		t.Fatal("edited trip is still indexed under a removed term")
+	}
+	if _, ok := post.Postings["lakeside"]["trip1"]; !ok {
+		t.Fatalf("postings after second edit = %+v; want trip1 under lakeside", post)
+	}
+	if _, ok := post.Postings["walk"]["trip1"]; !ok || post.Docs != 1 {
+		t.Fatalf("postings after second edit = %+v; want trip1 under walk, 1 doc", post)
+	}
+
+	// 删除到回收站后不再命中，恢复后重新命中
+	if err := b.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	post = postings("lakeside")
+	if len(post.Postings["lakeside"]) != 0 || post.Docs != 0 {
+		t.Fatalf("postings after delete = %+v; want empty", post)
+	}
+	if err := b.RestoreTrash(ctx, "alice", TrashTrip, "trip1"); err != nil {
+		t.Fatalf("RestoreTrash: %v", err)
+	}
+	post = postings("lakeside")
+	if _, ok := post.Postings["lakeside"]["trip1"]; !ok || post.Docs != 1 {
+		t.Fatalf("postings after restore = %+v; want trip1 under lakeside", post)
+	}
+}
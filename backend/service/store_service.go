@@ -3,43 +3,76 @@ package service
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var rdb *redis.Client
+// RedisStore 基于 Redis 的存储实现
+type RedisStore struct {
+	rdb *redis.Client
+}
 
-// InitRedis 初始化 Redis 客户端
-func InitRedis(addr, password string, db int) error {
-	rdb = redis.NewClient(&redis.Options{
+// NewRedisStore 创建 Redis 存储，连接在首次使用时建立
+func NewRedisStore(addr, password string, db int) *RedisStore {
+	return &RedisStore{rdb: redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
-	})
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	})}
+}
+
+// Ping 检查 Redis 连接
+func (s *RedisStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	return rdb.Ping(ctx).Err()
+	return s.rdb.Ping(ctx).Err()
+}
+
+// casSetScript 仅当键的当前值未被修改时写入新值，用于惰性迁移写回
+var casSetScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('SET', KEYS[1], ARGV[2])
+end
+return false
+`)
+
+// casSet 当键的值仍为 old 时写入 value，返回是否写入
+func (s *RedisStore) casSet(ctx context.Context, key, old string, value []byte) (bool, error) {
+	err := casSetScript.Run(ctx, s.rdb, []string{key}, old, value).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// writeBack 将惰性升级后的记录写回，若期间记录已被其他请求修改则放弃
+func (s *RedisStore) writeBack(ctx context.Context, key, old string, upgraded []byte) {
+	if _, err := s.casSet(ctx, key, old, upgraded); err != nil {
+		LogWarn("Failed to write back migrated record %s: %v", key, err)
+	}
 }
 
 // UserRecord 存储在 Redis 的用户结构
 type UserRecord struct {
-	ID           int    `json:"id"`
-	Username     string `json:"username"`
-	PasswordHash string `json:"passwordHash"`
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	PasswordHash  string `json:"passwordHash"`
+	Role          string `json:"role"`               // RoleUser 或 RoleAdmin
+	Disabled      bool   `json:"disabled,omitempty"` // 被管理员停用的账户不能登录
+	SchemaVersion int    `json:"schemaVersion"`
 }
 
 func userKey(username string) string { return "user:" + username }
 
 // GetUser 获取用户
-func GetUser(ctx context.Context, username string) (*UserRecord, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
-	}
-	val, err := rdb.Get(ctx, userKey(username)).Result()
+func (s *RedisStore) GetUser(ctx context.Context, username string) (*UserRecord, error) {
+	val, err := s.rdb.Get(ctx, userKey(username)).Result()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -47,47 +80,133 @@ func GetUser(ctx context.Context, username string) (*UserRecord, error) {
 		return nil, err
 	}
 	var u UserRecord
-	if err := json.Unmarshal([]byte(val), &u); err != nil {
+	data, upgraded, err := decodeRecord(KindUser, []byte(val), &u)
+	if err != nil {
 		return nil, err
 	}
+	if upgraded {
+		s.writeBack(ctx, userKey(username), val, data)
+	}
 	return &u, nil
 }
 
 // CreateUser 创建新用户
-func CreateUser(ctx context.Context, username, password string) (*UserRecord, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
-	}
-	exists, err := rdb.Exists(ctx, userKey(username)).Result()
+func (s *RedisStore) CreateUser(ctx context.Context, username, password string) (*UserRecord, error) {
+	exists, err := s.rdb.Exists(ctx, userKey(username)).Result()
 	if err != nil {
 		return nil, err
 	}
 	if exists > 0 {
-		return nil, errors.New("user exists")
+		return nil, ErrUserExists
 	}
-	id, err := rdb.Incr(ctx, "user:next_id").Result()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	// 先分配ID再以 SET NX 写入：并发注册同名用户时只有一个成功，
+	// 失败或中途崩溃只会在ID序列中留下空洞，不会产生重复用户
+	id, err := s.rdb.Incr(ctx, "user:next_id").Result()
 	if err != nil {
 		return nil, err
 	}
 	u := &UserRecord{
-		ID:           int(id),
-		Username:     username,
-		PasswordHash: string(hash),
+		ID:            int(id),
+		Username:      username,
+		PasswordHash:  string(hash),
+		Role:          RoleUser,
+		SchemaVersion: CurrentSchemaVersion(KindUser),
 	}
 	b, err := json.Marshal(u)
 	if err != nil {
 		return nil, err
 	}
-	if err := rdb.Set(ctx, userKey(username), b, 0).Err(); err != nil {
+	ok, err := s.rdb.SetNX(ctx, userKey(username), b, 0).Result()
+	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, ErrUserExists
+	}
 	return u, nil
 }
 
+// SetPassword 更新用户的密码哈希
+func (s *RedisStore) SetPassword(ctx context.Context, username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = s.UpdateUser(ctx, username, func(u *UserRecord) error {
+		u.PasswordHash = string(hash)
+		return nil
+	})
+	return err
+}
+
+// UpdateUser 在监视用户键的事务中读取、修改并写回用户记录
+func (s *RedisStore) UpdateUser(ctx context.Context, username string, fn func(u *UserRecord) error) (*UserRecord, error) {
+	key := userKey(username)
+	var u UserRecord
+	err := s.watchRetry(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		u = UserRecord{}
+		if _, _, err := decodeRecord(KindUser, []byte(val), &u); err != nil {
+			return err
+		}
+		id := u.ID
+		if err := fn(&u); err != nil {
+			return err
+		}
+		u.ID, u.Username = id, username
+		u.SchemaVersion = CurrentSchemaVersion(KindUser)
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers 扫描全部用户记录，按ID排序
+func (s *RedisStore) ListUsers(ctx context.Context) ([]*UserRecord, error) {
+	var users []*UserRecord
+	err := s.scanKeys(ctx, userKey("*"), func(key string) error {
+		// user:next_id 计数器和 user:<id>:diaries 日记索引也以 user: 开头
+		if strings.HasSuffix(key, ":next_id") {
+			return nil
+		}
+		typ, err := s.rdb.Type(ctx, key).Result()
+		if err != nil || typ != "string" {
+			return err
+		}
+		u, err := s.GetUser(ctx, strings.TrimPrefix(key, userKey("")))
+		if err != nil {
+			LogWarn("Skipping unreadable user %s: %v", key, err)
+			return nil
+		}
+		if u != nil {
+			users = append(users, u)
+		}
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, err
+}
+
 // VerifyPassword 校验密码
 func VerifyPassword(plain, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)) == nil
@@ -136,6 +255,10 @@ type TripPlan struct {
 	Summary   string          `json:"summary"`
 	CreatedAt time.Time       `json:"createdAt"`
 	UpdatedAt time.Time       `json:"updatedAt"`
+	// Revision 最新版本号，由存储在保存和读取时填写，编辑时作为 TripRevisionInfo.ExpectedRevision 传回
+	Revision int `json:"revision"`
+
+	SchemaVersion int `json:"schemaVersion"`
 }
 
 // MarshalJSON 自定义 JSON 序列化，将 Request 中的字段提升到顶层
@@ -157,34 +280,79 @@ func (t *TripPlan) MarshalJSON() ([]byte, error) {
 func tripKey(tripID string) string        { return "trip:" + tripID }
 func userTripsKey(username string) string { return "user_trips:" + username }
 
-// SaveTripPlan 保存行程计划
-func SaveTripPlan(ctx context.Context, plan *TripPlan) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
-	}
+// userTripIndexKey 用户行程按某个排序字段的有序集合索引，成员为行程ID，分数为 tripSortScore
+func userTripIndexKey(sortBy, username string) string {
+	return "user_trips_by:" + sortBy + ":" + username
+}
+
+var tripSortFields = []string{TripSortCreatedAt, TripSortStartDate, TripSortBudget}
+
+// SaveTripPlan 保存行程计划。在监视版本列表的乐观事务中读取当前版本号，
+// 指定了 ExpectedRevision 时行程必须存在且版本号一致
+func (s *RedisStore) SaveTripPlan(ctx context.Context, plan *TripPlan, rev TripRevisionInfo) error {
 	plan.UpdatedAt = time.Now()
 	if plan.CreatedAt.IsZero() {
 		plan.CreatedAt = plan.UpdatedAt
 	}
-	data, err := json.Marshal(plan)
-	if err != nil {
-		return err
-	}
-	if err := rdb.Set(ctx, tripKey(plan.ID), data, 0).Err(); err != nil {
-		return err
-	}
-	if err := rdb.SAdd(ctx, userTripsKey(plan.Username), plan.ID).Err(); err != nil {
+	plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+	doc := tripSearchRecord(plan).document()
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		current, err := tx.LLen(ctx, tripRevisionsKey(plan.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if rev.ExpectedRevision > 0 {
+			exists, err := tx.Exists(ctx, tripKey(plan.ID)).Result()
+			if err != nil {
+				return err
+			}
+			if exists == 0 || int(current) != rev.ExpectedRevision {
+				return ErrConcurrentUpdate
+			}
+		}
+		plan.Revision = int(current) + 1
+		data, err := json.Marshal(plan)
+		if err != nil {
+			return err
+		}
+		rec, err := newRevisionRecord(plan, rev)
+		if err != nil {
+			return err
+		}
+		recData, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		// 行程数据、版本历史、用户索引与搜索索引在同一个 MULTI/EXEC 事务中写入
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, tripKey(plan.ID), data, 0)
+			pipe.RPush(ctx, tripRevisionsKey(plan.ID), recData)
+			pipe.SAdd(ctx, userTripsKey(plan.Username), plan.ID)
+			for _, field := range tripSortFields {
+				pipe.ZAdd(ctx, userTripIndexKey(field, plan.Username), redis.Z{Score: tripSortScore(plan, field), Member: plan.ID})
+			}
+			indexSearchDoc(ctx, pipe, tripSearchScope(plan.Username), doc)
+			return nil
+		})
 		return err
-	}
-	return nil
+	}, tripKey(plan.ID), tripRevisionsKey(plan.ID))
 }
 
-// GetTripPlan 获取行程计划
-func GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
+// GetTripPlan 获取行程计划，行程和版本数在同一个事务中读取
+func (s *RedisStore) GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error) {
+	var (
+		get  *redis.StringCmd
+		revs *redis.IntCmd
+	)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, tripKey(tripID))
+		revs = pipe.LLen(ctx, tripRevisionsKey(tripID))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
-	data, err := rdb.Get(ctx, tripKey(tripID)).Result()
+	data, err := get.Result()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -192,54 +360,249 @@ func GetTripPlan(ctx context.Context, tripID string) (*TripPlan, error) {
 		return nil, err
 	}
 	var plan TripPlan
-	if err := json.Unmarshal([]byte(data), &plan); err != nil {
+	upgradedData, upgraded, err := decodeRecord(KindTrip, []byte(data), &plan)
+	if err != nil {
 		return nil, err
 	}
+	if upgraded {
+		s.writeBack(ctx, tripKey(tripID), data, upgradedData)
+	}
+	// 早于版本号字段保存的行程以版本列表长度为准
+	plan.Revision = int(revs.Val())
 	return &plan, nil
 }
 
-// GetUserTrips 获取用户的所有行程
-func GetUserTrips(ctx context.Context, username string) ([]*TripPlan, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
+// loadTrips 使用 MGET 批量加载行程，结果与 ids 一一对应，不存在的行程为 nil
+func (s *RedisStore) loadTrips(ctx context.Context, ids []string) ([]*TripPlan, error) {
+	if len(ids) == 0 {
+		return nil, nil
 	}
-	tripIDs, err := rdb.SMembers(ctx, userTripsKey(username)).Result()
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = tripKey(id)
+	}
+	vals, err := s.rdb.MGet(ctx, keys...).Result()
 	if err != nil {
 		return nil, err
 	}
-	trips := make([]*TripPlan, 0, len(tripIDs))
-	for _, id := range tripIDs {
-		trip, err := GetTripPlan(ctx, id)
+	trips := make([]*TripPlan, len(ids))
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var plan TripPlan
+		upgradedData, upgraded, err := decodeRecord(KindTrip, []byte(data), &plan)
 		if err != nil {
+			LogWarn("Skipping unreadable trip %s: %v", ids[i], err)
 			continue
 		}
+		if upgraded {
+			s.writeBack(ctx, keys[i], data, upgradedData)
+		}
+		trips[i] = &plan
+	}
+	return trips, nil
+}
+
+// GetUserTrips 获取用户的所有行程，按创建时间排序
+func (s *RedisStore) GetUserTrips(ctx context.Context, username string) ([]*TripPlan, error) {
+	tripIDs, err := s.rdb.SMembers(ctx, userTripsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := s.loadTrips(ctx, tripIDs)
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]*TripPlan, 0, len(loaded))
+	for _, trip := range loaded {
 		if trip != nil {
 			trips = append(trips, trip)
 		}
 	}
+	sort.Slice(trips, func(i, j int) bool {
+		if !trips[i].CreatedAt.Equal(trips[j].CreatedAt) {
+			return trips[i].CreatedAt.Before(trips[j].CreatedAt)
+		}
+		return trips[i].ID < trips[j].ID
+	})
 	return trips, nil
 }
 
-// DeleteTripPlan 删除行程计划
-func DeleteTripPlan(ctx context.Context, tripID, username string) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
+// ensureTripIndexes 索引与行程集合数量不一致时（旧数据或中断的写入）重建用户的排序索引，返回是否重建
+func (s *RedisStore) ensureTripIndexes(ctx context.Context, username string, dryRun bool) (bool, error) {
+	var setCard, idxCard *redis.IntCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		setCard = pipe.SCard(ctx, userTripsKey(username))
+		idxCard = pipe.ZCard(ctx, userTripIndexKey(TripSortCreatedAt, username))
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	if err := rdb.SRem(ctx, userTripsKey(username), tripID).Err(); err != nil {
-		return err
+	if setCard.Val() == idxCard.Val() {
+		return false, nil
 	}
-	if err := rdb.Del(ctx, tripKey(tripID)).Err(); err != nil {
-		return err
+	if dryRun {
+		return true, nil
 	}
-	return nil
+
+	ids, err := s.rdb.SMembers(ctx, userTripsKey(username)).Result()
+	if err != nil {
+		return false, err
+	}
+	trips, err := s.loadTrips(ctx, ids)
+	if err != nil {
+		return false, err
+	}
+	// 只增删差异成员而不是先清空，避免与并发的保存或删除相互覆盖
+	members := make(map[string]bool, len(ids))
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, trip := range trips {
+			if trip == nil {
+				continue
+			}
+			members[trip.ID] = true
+			for _, field := range tripSortFields {
+				pipe.ZAdd(ctx, userTripIndexKey(field, username), redis.Z{Score: tripSortScore(trip, field), Member: trip.ID})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	indexed, err := s.rdb.ZRange(ctx, userTripIndexKey(TripSortCreatedAt, username), 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, id := range indexed {
+		if !members[id] {
+			s.unindexTrip(ctx, username, id)
+		}
+	}
+	return true, nil
 }
 
-// GenerateTripID 生成唯一行程ID
-func GenerateTripID(ctx context.Context) (string, error) {
-	if rdb == nil {
-		return "", errors.New("redis not initialized")
+// unindexTrip 从排序索引中移除已不存在的行程
+func (s *RedisStore) unindexTrip(ctx context.Context, username, tripID string) {
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, field := range tripSortFields {
+			pipe.ZRem(ctx, userTripIndexKey(field, username), tripID)
+		}
+		return nil
+	})
+	if err != nil {
+		LogWarn("Failed to remove stale trip %s from index of %s: %v", tripID, username, err)
+	}
+}
+
+// tripIndexBatch 分页时每次从有序集合中读取的成员数
+const tripIndexBatch = 100
+
+// ListUserTrips 按条件分页查询用户行程：沿有序集合索引从游标处开始按批读取ID，
+// 每批使用一次 MGET 加载并过滤，直到取满一页
+func (s *RedisStore) ListUserTrips(ctx context.Context, username string, q TripQuery) (*TripPage, error) {
+	cur, err := q.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.ensureTripIndexes(ctx, username, false); err != nil {
+		return nil, err
 	}
-	id, err := rdb.Incr(ctx, "trip:next_id").Result()
+
+	key := userTripIndexKey(q.SortBy, username)
+	rng := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: tripIndexBatch}
+	if cur != nil {
+		bound := strconv.FormatFloat(cur.Score, 'f', -1, 64)
+		if q.Desc {
+			rng.Max = bound
+		} else {
+			rng.Min = bound
+		}
+	}
+
+	// 悬空的索引项在扫描结束后再移除：扫描期间删除成员会使按 Offset 读取的下一批跳过行程
+	var stale []string
+	pager := &tripPager{q: &q}
+	for !pager.full() {
+		var entries []redis.Z
+		if q.Desc {
+			entries, err = s.rdb.ZRevRangeByScoreWithScores(ctx, key, rng).Result()
+		} else {
+			entries, err = s.rdb.ZRangeByScoreWithScores(ctx, key, rng).Result()
+		}
+		if err != nil {
+			return nil, err
+		}
+		rng.Offset += int64(len(entries))
+
+		ids := make([]string, 0, len(entries))
+		scores := make([]float64, 0, len(entries))
+		for _, z := range entries {
+			id, _ := z.Member.(string)
+			if cur.afterCursor(z.Score, id) {
+				ids = append(ids, id)
+				scores = append(scores, z.Score)
+			}
+		}
+		trips, err := s.loadTrips(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, trip := range trips {
+			if trip == nil {
+				stale = append(stale, ids[i])
+				continue
+			}
+			if q.matches(trip) && pager.add(trip, scores[i]) {
+				break
+			}
+		}
+		if len(entries) < tripIndexBatch {
+			break
+		}
+	}
+	for _, id := range stale {
+		s.unindexTrip(ctx, username, id)
+	}
+	return pager.page(), nil
+}
+
+// DeleteTripPlan 将行程移入回收站，行程不存在或不属于该用户时不做任何操作
+func (s *RedisStore) DeleteTripPlan(ctx context.Context, tripID, username string) error {
+	key := tripKey(tripID)
+	return s.moveToTrash(ctx, username, key, func(tx *redis.Tx) (*TrashItem, error) {
+		data, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, []byte(data), &plan); err != nil {
+			return nil, err
+		}
+		if plan.Username != username {
+			return nil, nil
+		}
+		return tripTrashItem(&plan)
+	}, func(pipe redis.Pipeliner) {
+		// 收藏集合中的ID保留，恢复后收藏随之恢复；行程在回收站期间收藏列表会跳过它
+		pipe.SRem(ctx, userTripsKey(username), tripID)
+		for _, field := range tripSortFields {
+			pipe.ZRem(ctx, userTripIndexKey(field, username), tripID)
+		}
+		indexSearchDoc(ctx, pipe, tripSearchScope(username), SearchDocument{ID: tripID})
+		pipe.Del(ctx, key)
+	})
+}
+
+// GenerateTripID 生成唯一行程ID
+func (s *RedisStore) GenerateTripID(ctx context.Context) (string, error) {
+	id, err := s.rdb.Incr(ctx, "trip:next_id").Result()
 	if err != nil {
 		return "", err
 	}
@@ -255,68 +618,162 @@ type Favorite struct {
 	Address string  `json:"address"`
 }
 
-func userFavoritesKey(username string) string { return "user_favorites:" + username }
+// legacyFavoritesKey 旧版本以整个 JSON 数组保存收藏夹，读改写存在并发丢失更新
+func legacyFavoritesKey(username string) string { return "user_favorites:" + username }
 
-// GetUserFavorites 获取用户的收藏夹
-func GetUserFavorites(ctx context.Context, username string) ([]Favorite, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
+// userFavoritePlacesKey 收藏夹哈希，字段为收藏ID，值为 favoriteEntry JSON
+func userFavoritePlacesKey(username string) string { return "user_favorite_places:" + username }
+
+// favoriteEntry 哈希中保存的收藏项，AddedAt 用于保持添加顺序
+type favoriteEntry struct {
+	Favorite
+	AddedAt int64 `json:"addedAt"`
+}
+
+// migrateLegacyFavorites 将旧版 JSON 数组收藏夹迁移到哈希，返回迁移的条目数；
+// 使用 WATCH 乐观事务，迁移期间旧键被修改则重试
+func (s *RedisStore) migrateLegacyFavorites(ctx context.Context, username string) (int, error) {
+	oldKey, newKey := legacyFavoritesKey(username), userFavoritePlacesKey(username)
+	migrated := 0
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, oldKey).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var favorites []Favorite
+		if err := json.Unmarshal([]byte(data), &favorites); err != nil {
+			return fmt.Errorf("decode legacy favorites of %s: %w", username, err)
+		}
+		fields := make(map[string][]byte, len(favorites))
+		for i, f := range favorites {
+			b, err := json.Marshal(favoriteEntry{Favorite: f, AddedAt: int64(i)})
+			if err != nil {
+				return err
+			}
+			fields[f.ID] = b
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for id, b := range fields {
+				pipe.HSetNX(ctx, newKey, id, b)
+			}
+			pipe.Del(ctx, oldKey)
+			return nil
+		})
+		if err == nil {
+			migrated = len(fields)
+		}
+		return err
 	}
-	data, err := rdb.Get(ctx, userFavoritesKey(username)).Result()
-	if err == redis.Nil {
-		return []Favorite{}, nil
+	for attempt := 0; attempt < 3; attempt++ {
+		err := s.rdb.Watch(ctx, txf, oldKey)
+		if err != redis.TxFailedErr {
+			return migrated, err
+		}
 	}
-	if err != nil {
+	return 0, redis.TxFailedErr
+}
+
+// GetUserFavorites 获取用户的收藏夹
+func (s *RedisStore) GetUserFavorites(ctx context.Context, username string) ([]Favorite, error) {
+	if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
 		return nil, err
 	}
-	var favorites []Favorite
-	if err := json.Unmarshal([]byte(data), &favorites); err != nil {
+	vals, err := s.rdb.HVals(ctx, userFavoritePlacesKey(username)).Result()
+	if err != nil {
 		return nil, err
 	}
+	entries := make([]favoriteEntry, 0, len(vals))
+	for _, v := range vals {
+		var e favoriteEntry
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			LogWarn("Skipping unreadable favorite of user %s: %v", username, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].AddedAt < entries[j].AddedAt })
+
+	favorites := make([]Favorite, 0, len(entries))
+	for _, e := range entries {
+		favorites = append(favorites, e.Favorite)
+	}
 	return favorites, nil
 }
 
-// SaveUserFavorites 保存用户的收藏夹
-func SaveUserFavorites(ctx context.Context, username string, favorites []Favorite) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
+// AddFavorite 添加收藏，HSETNX 保证同一ID只会被添加一次
+func (s *RedisStore) AddFavorite(ctx context.Context, username string, favorite Favorite) error {
+	if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
+		return err
 	}
-	data, err := json.Marshal(favorites)
+	b, err := json.Marshal(favoriteEntry{Favorite: favorite, AddedAt: time.Now().UnixNano()})
 	if err != nil {
 		return err
 	}
-	return rdb.Set(ctx, userFavoritesKey(username), data, 0).Err()
-}
-
-// AddFavorite 添加收藏
-func AddFavorite(ctx context.Context, username string, favorite Favorite) error {
-	favorites, err := GetUserFavorites(ctx, username)
+	added, err := s.rdb.HSetNX(ctx, userFavoritePlacesKey(username), favorite.ID, b).Result()
 	if err != nil {
 		return err
 	}
-	// 检查是否已存在
-	for _, f := range favorites {
-		if f.ID == favorite.ID {
-			return errors.New("favorite already exists")
-		}
+	if !added {
+		return ErrFavoriteExists
 	}
-	favorites = append(favorites, favorite)
-	return SaveUserFavorites(ctx, username, favorites)
+	return nil
 }
 
-// RemoveFavorite 删除收藏
-func RemoveFavorite(ctx context.Context, username, favoriteID string) error {
-	favorites, err := GetUserFavorites(ctx, username)
-	if err != nil {
+// ReplaceFavorite 原地覆盖收藏，不存在时添加；保留原添加时间，收藏夹中的顺序不变
+func (s *RedisStore) ReplaceFavorite(ctx context.Context, username string, favorite Favorite) error {
+	if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
 		return err
 	}
-	newFavorites := make([]Favorite, 0, len(favorites))
-	for _, f := range favorites {
-		if f.ID != favoriteID {
-			newFavorites = append(newFavorites, f)
+	key := userFavoritePlacesKey(username)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		entry := favoriteEntry{Favorite: favorite, AddedAt: time.Now().UnixNano()}
+		data, err := tx.HGet(ctx, key, favorite.ID).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var old favoriteEntry
+			if json.Unmarshal([]byte(data), &old) == nil {
+				entry.AddedAt = old.AddedAt
+			}
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
 		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, favorite.ID, b)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// RemoveFavorite 将收藏移入回收站
+func (s *RedisStore) RemoveFavorite(ctx context.Context, username, favoriteID string) error {
+	if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
+		return err
 	}
-	return SaveUserFavorites(ctx, username, newFavorites)
+	key := userFavoritePlacesKey(username)
+	return s.moveToTrash(ctx, username, key, func(tx *redis.Tx) (*TrashItem, error) {
+		data, err := tx.HGet(ctx, key, favoriteID).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e favoriteEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, err
+		}
+		return favoriteTrashItem(&e.Favorite)
+	}, func(pipe redis.Pipeliner) {
+		pipe.HDel(ctx, key, favoriteID)
+	})
 }
 
 // ==================== 行程收藏功能 ====================
@@ -324,24 +781,20 @@ func RemoveFavorite(ctx context.Context, username, favoriteID string) error {
 func userFavoriteTripIDsKey(username string) string { return "user_favorite_trips:" + username }
 
 // GetUserFavoriteTrips 获取用户收藏的行程列表
-func GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, error) {
-	if rdb == nil {
-		return nil, errors.New("redis not initialized")
-	}
-
+func (s *RedisStore) GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, error) {
 	// 获取收藏的行程 ID 列表
-	tripIDs, err := rdb.SMembers(ctx, userFavoriteTripIDsKey(username)).Result()
+	tripIDs, err := s.rdb.SMembers(ctx, userFavoriteTripIDsKey(username)).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	// 获取每个行程的详细信息
-	trips := make([]*TripPlan, 0, len(tripIDs))
-	for _, id := range tripIDs {
-		trip, err := GetTripPlan(ctx, id)
-		if err != nil {
-			continue // 忽略获取失败的行程
-		}
+	// 批量获取行程详细信息，忽略已删除的行程
+	loaded, err := s.loadTrips(ctx, tripIDs)
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]*TripPlan, 0, len(loaded))
+	for _, trip := range loaded {
 		if trip != nil {
 			trips = append(trips, trip)
 		}
@@ -351,36 +804,143 @@ func GetUserFavoriteTrips(ctx context.Context, username string) ([]*TripPlan, er
 }
 
 // AddFavoriteTrip 添加行程到收藏
-func AddFavoriteTrip(ctx context.Context, username, tripID string) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
-	}
-
+func (s *RedisStore) AddFavoriteTrip(ctx context.Context, username, tripID string) error {
 	// 检查行程是否存在
-	trip, err := GetTripPlan(ctx, tripID)
+	trip, err := s.GetTripPlan(ctx, tripID)
 	if err != nil {
 		return err
 	}
 	if trip == nil {
-		return errors.New("trip not found")
+		return ErrTripNotFound
 	}
 
 	// 添加到收藏集合
-	return rdb.SAdd(ctx, userFavoriteTripIDsKey(username), tripID).Err()
+	return s.rdb.SAdd(ctx, userFavoriteTripIDsKey(username), tripID).Err()
 }
 
 // RemoveFavoriteTrip 从收藏中移除行程
-func RemoveFavoriteTrip(ctx context.Context, username, tripID string) error {
-	if rdb == nil {
-		return errors.New("redis not initialized")
-	}
-	return rdb.SRem(ctx, userFavoriteTripIDsKey(username), tripID).Err()
+func (s *RedisStore) RemoveFavoriteTrip(ctx context.Context, username, tripID string) error {
+	return s.rdb.SRem(ctx, userFavoriteTripIDsKey(username), tripID).Err()
 }
 
 // IsTripFavorited 检查行程是否已收藏
-func IsTripFavorited(ctx context.Context, username, tripID string) (bool, error) {
-	if rdb == nil {
-		return false, errors.New("redis not initialized")
+func (s *RedisStore) IsTripFavorited(ctx context.Context, username, tripID string) (bool, error) {
+	return s.rdb.SIsMember(ctx, userFavoriteTripIDsKey(username), tripID).Result()
+}
+
+// scanKeys 遍历匹配 pattern 的所有键
+func (s *RedisStore) scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	iter := s.rdb.Scan(ctx, 0, pattern, 200).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// MigrateRecords 扫描全部 JSON 记录并升级到当前版本
+func (s *RedisStore) MigrateRecords(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := newMigrationReport("redis", dryRun)
+
+	stringRecords := []struct {
+		pattern string
+		kind    RecordKind
+		counter string
+	}{
+		{"user:*", KindUser, "user:next_id"},
+		{"trip:*", KindTrip, "trip:next_id"},
+		{"diary:*", KindDiary, ""},
+	}
+	for _, sr := range stringRecords {
+		err := s.scanKeys(ctx, sr.pattern, func(key string) error {
+			if key == sr.counter {
+				return nil
+			}
+			// user:<id>:diaries 等索引键也匹配 user:*，只处理字符串类型
+			typ, err := s.rdb.Type(ctx, key).Result()
+			if err != nil || typ != "string" {
+				return err
+			}
+			raw, err := s.rdb.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			migrateOne(report, sr.kind, key, raw, func(data []byte) (bool, error) {
+				return s.casSet(ctx, key, raw, data)
+			})
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	err := s.scanKeys(ctx, "user_expenses:*", func(key string) error {
+		vals, err := s.rdb.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for i, raw := range vals {
+			index, raw := int64(i), raw
+			migrateOne(report, KindExpense, fmt.Sprintf("%s[%d]", key, i), raw, func(data []byte) (bool, error) {
+				return s.casListSet(ctx, key, index, raw, data)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// 旧版 JSON 数组收藏夹迁移为哈希
+	legacy, items := 0, 0
+	err = s.scanKeys(ctx, legacyFavoritesKey("*"), func(key string) error {
+		legacy++
+		if dryRun {
+			data, err := s.rdb.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			var favorites []Favorite
+			if json.Unmarshal([]byte(data), &favorites) == nil {
+				items += len(favorites)
+			}
+			return nil
+		}
+		n, err := s.migrateLegacyFavorites(ctx, strings.TrimPrefix(key, legacyFavoritesKey("")))
+		items += n
+		return err
+	})
+	if legacy > 0 {
+		verb := "converted"
+		if dryRun {
+			verb = "to convert"
+		}
+		report.Notes = append(report.Notes, fmt.Sprintf("%d legacy favorite arrays (%d items) %s to hashes", legacy, items, verb))
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// 补建行程排序索引
+	rebuilt := 0
+	err = s.scanKeys(ctx, userTripsKey("*"), func(key string) error {
+		ok, err := s.ensureTripIndexes(ctx, strings.TrimPrefix(key, userTripsKey("")), dryRun)
+		if ok {
+			rebuilt++
+		}
+		return err
+	})
+	if rebuilt > 0 {
+		verb := "rebuilt"
+		if dryRun {
+			verb = "to rebuild"
+		}
+		report.Notes = append(report.Notes, fmt.Sprintf("%d users' trip sort indexes %s", rebuilt, verb))
 	}
-	return rdb.SIsMember(ctx, userFavoriteTripIDsKey(username), tripID).Result()
+	return report, err
 }
@@ -0,0 +1,464 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultHook 在命令或事务发送到 Redis 之前调用 before，返回错误时不发送，模拟执行到一半时连接中断
+type faultHook struct {
+	before func(ctx context.Context, cmds []redis.Cmder) error
+}
+
+func (h *faultHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *faultHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.before(ctx, []redis.Cmder{cmd}); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *faultHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.before(ctx, cmds); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// hasCmd 命令列表中是否包含 name 命令
+func hasCmd(cmds []redis.Cmder, name string) bool {
+	for _, cmd := range cmds {
+		if strings.EqualFold(cmd.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newFaultyRedisStore 返回注入了故障钩子的存储，以及一个不经过钩子、模拟其他实例的客户端
+func newFaultyRedisStore(t *testing.T, before func(ctx context.Context, cmds []redis.Cmder) error) (*RedisStore, *redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	s, m := newRedisTestStore(t)
+	s.rdb.AddHook(&faultHook{before: func(ctx context.Context, cmds []redis.Cmder) error {
+		if before == nil {
+			return nil
+		}
+		return before(ctx, cmds)
+	}})
+	other := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { other.Close() })
+	return s, other, m
+}
+
+func testTripPlan(id, username string) *TripPlan {
+	return &TripPlan{
+		ID:        id,
+		UserID:    1,
+		Username:  username,
+		Request:   TripPlanRequest{Destination: "北京", StartDate: "2026-11-01", EndDate: "2026-11-01", Budget: 1000, Travelers: 1},
+		Itinerary: []DayItinerary{{Day: 1, Date: "2026-11-01", Activities: []Activity{{Name: "故宫", Cost: 60}}, DailyCost: 60}},
+		TotalCost: 60,
+		Summary:   "summary",
+	}
+}
+
+// tripTraces 列出行程在各个 key 中留下的数据
+func tripTraces(t *testing.T, ctx context.Context, rdb *redis.Client, id, username string) []string {
+	t.Helper()
+	var traces []string
+	if n, _ := rdb.Exists(ctx, tripKey(id)).Result(); n > 0 {
+		traces = append(traces, tripKey(id))
+	}
+	if n, _ := rdb.LLen(ctx, tripRevisionsKey(id)).Result(); n > 0 {
+		traces = append(traces, fmt.Sprintf("%s (%d)", tripRevisionsKey(id), n))
+	}
+	if ok, _ := rdb.SIsMember(ctx, userTripsKey(username), id).Result(); ok {
+		traces = append(traces, userTripsKey(username))
+	}
+	for _, field := range tripSortFields {
+		if _, err := rdb.ZScore(ctx, userTripIndexKey(field, username), id).Result(); err == nil {
+			traces = append(traces, userTripIndexKey(field, username))
+		}
+	}
+	return traces
+}
+
+func TestRedisSaveTripPlanInterrupted(t *testing.T) {
+	faults := []struct {
+		name string
+		when func(cmds []redis.Cmder) bool
+	}{
+		{"reading current revision", func(cmds []redis.Cmder) bool { return hasCmd(cmds, "llen") }},
+		{"before EXEC", func(cmds []redis.Cmder) bool { return hasCmd(cmds, "exec") }},
+	}
+	for _, f := range faults {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			fail := true
+			s, _, _ := newFaultyRedisStore(t, func(ctx context.Context, cmds []redis.Cmder) error {
+				if fail && f.when(cmds) {
+					return errInjected
+				}
+				return nil
+			})
+
+			err := s.SaveTripPlan(ctx, testTripPlan("trip1", "alice"), TripRevisionInfo{Reason: RevisionGenerated})
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("SaveTripPlan = %v; want the injected failure", err)
+			}
+			if traces := tripTraces(t, ctx, s.rdb, "trip1", "alice"); len(traces) > 0 {
+				t.Fatalf("interrupted save left %v", traces)
+			}
+			page, err := s.ListUserTrips(ctx, "alice", TripQuery{})
+			if err != nil || len(page.Trips) != 0 {
+				t.Fatalf("ListUserTrips after interrupted save = %d trips, %v", len(page.Trips), err)
+			}
+
+			// 重试后行程、版本和索引全部写入
+			fail = false
+			plan := testTripPlan("trip1", "alice")
+			if err := s.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionGenerated}); err != nil {
+				t.Fatalf("retried SaveTripPlan: %v", err)
+			}
+			if traces := tripTraces(t, ctx, s.rdb, "trip1", "alice"); len(traces) != 3+len(tripSortFields) {
+				t.Fatalf("saved trip is missing from some keys, found only %v", traces)
+			}
+			if plan.Revision != 1 {
+				t.Fatalf("revision after retry = %d; want 1", plan.Revision)
+			}
+		})
+	}
+}
+
+func TestRedisSaveTripPlanConcurrentUpdate(t *testing.T) {
+	ctx := context.Background()
+	conflicts := 0
+	var other *redis.Client
+	s, other, _ := newFaultyRedisStore(t, func(ctx context.Context, cmds []redis.Cmder) error {
+		if hasCmd(cmds, "exec") && conflicts > 0 {
+			// 其他实例在读取版本号之后、EXEC 之前修改了行程
+			conflicts--
+			return other.Set(ctx, tripKey("trip1"), `{"id":"trip1","summary":"other"}`, 0).Err()
+		}
+		return nil
+	})
+
+	conflicts = 10
+	err := s.SaveTripPlan(ctx, testTripPlan("trip1", "alice"), TripRevisionInfo{Reason: RevisionGenerated})
+	if !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("SaveTripPlan under constant contention = %v; want ErrConcurrentUpdate", err)
+	}
+	if conflicts != 7 {
+		t.Fatalf("SaveTripPlan made %d attempts; want 3", 10-conflicts)
+	}
+	traces := tripTraces(t, ctx, s.rdb, "trip1", "alice")
+	if len(traces) != 1 || traces[0] != tripKey("trip1") {
+		t.Fatalf("aborted save left %v; want only the concurrent writer's trip", traces)
+	}
+	if data, _ := s.rdb.Get(ctx, tripKey("trip1")).Result(); !strings.Contains(data, "other") {
+		t.Fatalf("aborted save overwrote the concurrent write: %s", data)
+	}
+
+	// 只冲突一次时重试成功
+	conflicts = 1
+	plan := testTripPlan("trip1", "alice")
+	if err := s.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionGenerated}); err != nil {
+		t.Fatalf("SaveTripPlan after one conflict: %v", err)
+	}
+	got, err := s.GetTripPlan(ctx, "trip1")
+	if err != nil || got.Summary != "summary" || got.Revision != 1 {
+		t.Fatalf("GetTripPlan = %+v, %v", got, err)
+	}
+}
+
+func TestRedisCreateUserInterrupted(t *testing.T) {
+	ctx := context.Background()
+	var (
+		fail     bool
+		register bool
+		other    *redis.Client
+	)
+	s, other, _ := newFaultyRedisStore(t, func(ctx context.Context, cmds []redis.Cmder) error {
+		// 分配ID之后、SET NX 写入用户之前
+		if !hasCmd(cmds, "setnx") {
+			return nil
+		}
+		if fail {
+			return errInjected
+		}
+		if register {
+			register = false
+			return other.Set(ctx, userKey("carol"), `{"id":99,"username":"carol","passwordHash":"other"}`, 0).Err()
+		}
+		return nil
+	})
+
+	fail = true
+	if _, err := s.CreateUser(ctx, "alice", "pw"); !errors.Is(err, errInjected) {
+		t.Fatalf("CreateUser = %v; want the injected failure", err)
+	}
+	if u, err := s.GetUser(ctx, "alice"); u != nil || err != nil {
+		t.Fatalf("interrupted CreateUser left a user: %+v, %v", u, err)
+	}
+	fail = false
+	u, err := s.CreateUser(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("CreateUser after interruption: %v", err)
+	}
+	if u.ID != 2 {
+		t.Fatalf("user ID = %d; want 2 (the interrupted attempt leaves a gap, not a user)", u.ID)
+	}
+
+	// 并发注册同名用户：在本次分配ID之后另一个实例先写入
+	register = true
+	if _, err := s.CreateUser(ctx, "carol", "pw"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("racing CreateUser = %v; want ErrUserExists", err)
+	}
+	got, _ := s.GetUser(ctx, "carol")
+	if got == nil || got.ID != 99 {
+		t.Fatalf("racing CreateUser overwrote the other registration: %+v", got)
+	}
+	users, err := s.ListUsers(ctx)
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, u := range users {
+		if seen[u.Username] {
+			t.Fatalf("duplicate username %q in %+v", u.Username, users)
+		}
+		seen[u.Username] = true
+	}
+}
+
+func TestRedisCreateDiaryInterrupted(t *testing.T) {
+	ctx := context.Background()
+	var (
+		fail    bool
+		collide bool
+		other   *redis.Client
+	)
+	s, other, _ := newFaultyRedisStore(t, func(ctx context.Context, cmds []redis.Cmder) error {
+		if !hasCmd(cmds, "evalsha") && !hasCmd(cmds, "eval") {
+			return nil
+		}
+		if fail {
+			return errInjected
+		}
+		if collide {
+			// 同一毫秒内另一个请求占用了这个ID
+			collide = false
+			key := cmds[0].Args()[3].(string)
+			return other.Set(ctx, key, `{"id":0,"title":"other"}`, 0).Err()
+		}
+		return nil
+	})
+	diary := func() *DiaryEntry {
+		return &DiaryEntry{UserID: 1, Date: "2026-11-01", Title: "日记", Content: "内容"}
+	}
+
+	fail = true
+	if _, err := s.CreateDiary(ctx, diary()); !errors.Is(err, errInjected) {
+		t.Fatalf("CreateDiary = %v; want the injected failure", err)
+	}
+	if keys, _ := s.rdb.Keys(ctx, "diary:*").Result(); len(keys) != 0 {
+		t.Fatalf("interrupted CreateDiary left %v", keys)
+	}
+	if n, _ := s.rdb.ZCard(ctx, "user:1:diaries").Result(); n != 0 {
+		t.Fatalf("interrupted CreateDiary left %d index entries", n)
+	}
+
+	fail, collide = false, true
+	id, err := s.CreateDiary(ctx, diary())
+	if err != nil {
+		t.Fatalf("CreateDiary after collision: %v", err)
+	}
+	ids, _ := s.rdb.ZRange(ctx, "user:1:diaries", 0, -1).Result()
+	if len(ids) != 1 || ids[0] != fmt.Sprint(id) {
+		t.Fatalf("diary index = %v; want only %d", ids, id)
+	}
+	d, err := s.GetDiary(ctx, fmt.Sprint(id), 1)
+	if err != nil || d.Title != "日记" {
+		t.Fatalf("GetDiary(%d) = %+v, %v", id, d, err)
+	}
+}
+
+func TestRedisDeleteTripConcurrentUpdate(t *testing.T) {
+	ctx := context.Background()
+	contend := false
+	var other *redis.Client
+	s, other, _ := newFaultyRedisStore(t, func(ctx context.Context, cmds []redis.Cmder) error {
+		if contend && hasCmd(cmds, "exec") {
+			return other.Set(ctx, tripKey("trip1"), `{"id":"trip1","username":"alice","summary":"other"}`, 0).Err()
+		}
+		return nil
+	})
+	if err := s.SaveTripPlan(ctx, testTripPlan("trip1", "alice"), TripRevisionInfo{Reason: RevisionGenerated}); err != nil {
+		t.Fatalf("SaveTripPlan: %v", err)
+	}
+
+	contend = true
+	if err := s.DeleteTripPlan(ctx, "trip1", "alice"); !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("DeleteTripPlan under contention = %v; want ErrConcurrentUpdate", err)
+	}
+	contend = false
+	if items, _ := s.ListTrash(ctx, "alice"); len(items) != 0 {
+		t.Fatalf("aborted delete put %d items into the trash", len(items))
+	}
+	if p, _ := s.GetTripPlan(ctx, "trip1"); p == nil {
+		t.Fatal("aborted delete removed the trip")
+	}
+	if err := s.DeleteTripPlan(ctx, "trip1", "alice"); err != nil {
+		t.Fatalf("DeleteTripPlan: %v", err)
+	}
+	if items, _ := s.ListTrash(ctx, "alice"); len(items) != 1 {
+		t.Fatalf("trash has %d items after delete; want 1", len(items))
+	}
+	if traces := tripTraces(t, ctx, s.rdb, "trip1", "alice"); len(traces) != 1 {
+		t.Fatalf("deleted trip left %v; want only its revisions", traces)
+	}
+}
+
+func TestRedisMigrateRecordsDryRun(t *testing.T) {
+	s, m := newRedisTestStore(t)
+	ctx := context.Background()
+	// 升级前写入的旧记录：没有 schemaVersion、角色和 request，金额为字符串，收藏夹为 JSON 数组，行程没有排序索引
+	m.Set(userKey("alice"), `{"id":1,"username":"alice","passwordHash":"hash"}`)
+	m.Set(tripKey("legacy"), `{"id":"legacy","userId":1,"username":"alice","destination":"杭州","startDate":"2026-05-01","endDate":"2026-05-02"}`)
+	m.SAdd(userTripsKey("alice"), "legacy")
+	m.RPush(expenseListKey("alice"), `{"id":"e1","amount":"12.5","createdAt":"2026-05-01T10:00:00Z"}`)
+	m.Set(legacyFavoritesKey("alice"), `[{"id":"poi1","name":"西湖"}]`)
+
+	before := m.Dump()
+	report, err := s.MigrateRecords(ctx, true)
+	if err != nil {
+		t.Fatalf("MigrateRecords(dry run): %v", err)
+	}
+	if !report.DryRun {
+		t.Fatal("report is not marked as a dry run")
+	}
+	for _, kind := range []RecordKind{KindUser, KindTrip, KindExpense} {
+		if kr := report.Kinds[kind]; kr.Upgraded != 1 || kr.FromVersions[0] != 1 || kr.Failed != 0 {
+			t.Errorf("dry run %s = %+v; want 1 record to upgrade from v0", kind, kr)
+		}
+	}
+	if len(report.Notes) != 2 {
+		t.Errorf("dry run notes = %q; want the favorites conversion and index rebuild", report.Notes)
+	}
+	if after := m.Dump(); after != before {
+		t.Fatalf("dry run changed the data:\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+
+	report, err = s.MigrateRecords(ctx, false)
+	if err != nil {
+		t.Fatalf("MigrateRecords: %v", err)
+	}
+	if kr := report.Kinds[KindTrip]; kr.Upgraded != 1 {
+		t.Fatalf("applied trip migration = %+v; want 1 upgraded", kr)
+	}
+	plan, err := s.GetTripPlan(ctx, "legacy")
+	if err != nil || plan == nil || plan.Request.Destination != "杭州" {
+		t.Fatalf("migrated trip = %+v, %v", plan, err)
+	}
+	if u, _ := s.GetUser(ctx, "alice"); u == nil || u.Role != RoleUser {
+		t.Fatalf("migrated user = %+v; want role %q", u, RoleUser)
+	}
+	if m.Exists(legacyFavoritesKey("alice")) {
+		t.Fatal("legacy favorites array was not converted")
+	}
+	// 再次检查时没有需要升级的记录
+	report, err = s.MigrateRecords(ctx, true)
+	if err != nil {
+		t.Fatalf("MigrateRecords after apply: %v", err)
+	}
+	for kind, kr := range report.Kinds {
+		if kr.Upgraded != 0 || kr.Failed != 0 {
+			t.Errorf("%s after apply = %+v; want all current", kind, kr)
+		}
+	}
+	if len(report.Notes) != 0 {
+		t.Errorf("notes after apply = %q; want none", report.Notes)
+	}
+}
+
+func TestRedisDeleteUserLegacyFavorites(t *testing.T) {
+	s, m := newRedisTestStore(t)
+	ctx := context.Background()
+	mustCreateUser(t, ctx, s, "alice")
+	mustCreateUser(t, ctx, s, "bob")
+	// 从未迁移的旧版收藏夹：字符串中保存的 JSON 数组，另有一项已在哈希中
+	m.Set(legacyFavoritesKey("alice"), `[{"id":"poi1","name":"西湖"},{"id":"poi2","name":"灵隐寺"}]`)
+	m.HSet(userFavoritePlacesKey("alice"), "poi3", `{"id":"poi3","name":"断桥","addedAt":5}`)
+	m.Set(legacyFavoritesKey("bob"), `[{"id":"poi1","name":"西湖"}]`)
+
+	report, err := s.DeleteUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if n := report.Removed[DeletedFavorites]; n != 3 {
+		t.Fatalf("removed %d favorites; want 3", n)
+	}
+	for _, key := range []string{userKey("alice"), legacyFavoritesKey("alice"), userFavoritePlacesKey("alice")} {
+		if m.Exists(key) {
+			t.Errorf("%s kept after DeleteUser", key)
+		}
+	}
+	if favorites, err := s.GetUserFavorites(ctx, "bob"); err != nil || len(favorites) != 1 {
+		t.Fatalf("bob's favorites = %+v, %v; want them kept", favorites, err)
+	}
+}
+
+func TestRedisListUserTripsDanglingIndex(t *testing.T) {
+	s, m := newRedisTestStore(t)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, s, "alice")
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < tripIndexBatch+10; i++ {
+		mustSaveTrip(t, ctx, s, u, fmt.Sprintf("trip%03d", i), 100, base.Add(time.Duration(i)*time.Minute))
+	}
+	// 行程记录已不存在、索引仍保留的成员，排在第一批的最前面
+	ghosts := []string{"ghost1", "ghost2", "ghost3", "ghost4", "ghost5"}
+	for _, id := range ghosts {
+		m.SAdd(userTripsKey("alice"), id)
+		for _, field := range tripSortFields {
+			m.ZAdd(userTripIndexKey(field, "alice"), 0, id)
+		}
+	}
+
+	page, err := s.ListUserTrips(ctx, "alice", TripQuery{Limit: MaxTripPageSize})
+	if err != nil {
+		t.Fatalf("ListUserTrips: %v", err)
+	}
+	if len(page.Trips) != MaxTripPageSize || page.NextCursor == "" {
+		t.Fatalf("page has %d trips, next cursor %q; want a full page", len(page.Trips), page.NextCursor)
+	}
+	for i, trip := range page.Trips {
+		if want := fmt.Sprintf("trip%03d", i); trip.ID != want {
+			t.Fatalf("trip %d = %s; want %s without skipping live trips", i, trip.ID, want)
+		}
+	}
+	// 扫描结束后移除悬空的索引项
+	for _, id := range ghosts {
+		if members, _ := m.ZMembers(userTripIndexKey(TripSortCreatedAt, "alice")); strings.Contains(strings.Join(members, ","), id) {
+			t.Fatalf("%s kept in the index", id)
+		}
+	}
+}
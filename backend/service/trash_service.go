@@ -0,0 +1,378 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TrashKind 回收站条目类型
+type TrashKind string
+
+const (
+	TrashTrip     TrashKind = "trip"
+	TrashDiary    TrashKind = "diary"
+	TrashFavorite TrashKind = "favorite"
+)
+
+// ParseTrashKind 校验回收站条目类型
+func ParseTrashKind(s string) (TrashKind, bool) {
+	switch k := TrashKind(s); k {
+	case TrashTrip, TrashDiary, TrashFavorite:
+		return k, true
+	}
+	return "", false
+}
+
+// TrashItem 回收站条目，同一记录再次删除时覆盖旧条目
+type TrashItem struct {
+	Kind      TrashKind       `json:"kind"`
+	ID        string          `json:"id"` // 原记录ID
+	Title     string          `json:"title"`
+	DeletedAt time.Time       `json:"deletedAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Record    json.RawMessage `json:"record"` // 删除时的完整记录，恢复时按记录类型迁移到当前版本
+}
+
+// TrashRetention 回收站条目的保留时长，过期后由后台任务永久删除
+var TrashRetention = 30 * 24 * time.Hour
+
+// newTrashItem 为将被删除的记录生成回收站条目
+func newTrashItem(kind TrashKind, id, title string, record interface{}) (*TrashItem, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &TrashItem{
+		Kind:      kind,
+		ID:        id,
+		Title:     title,
+		DeletedAt: now,
+		ExpiresAt: now.Add(TrashRetention),
+		Record:    data,
+	}, nil
+}
+
+func tripTrashItem(plan *TripPlan) (*TrashItem, error) {
+	return newTrashItem(TrashTrip, plan.ID, plan.Request.Destination, plan)
+}
+
+func diaryTrashItem(diary *DiaryEntry) (*TrashItem, error) {
+	title := diary.Title
+	if title == "" {
+		title = diary.Date
+	}
+	return newTrashItem(TrashDiary, strconv.FormatInt(diary.ID, 10), title, diary)
+}
+
+func favoriteTrashItem(f *Favorite) (*TrashItem, error) {
+	return newTrashItem(TrashFavorite, f.ID, f.Name, f)
+}
+
+// withExpiry 按当前保留时长计算过期时间，保留时长修改后对已有条目同样生效
+func (t *TrashItem) withExpiry() *TrashItem {
+	t.ExpiresAt = t.DeletedAt.Add(TrashRetention)
+	return t
+}
+
+// StartTrashPurger 启动后台任务，每隔 interval 永久删除超过保留时长的回收站条目，ctx 取消后退出
+func StartTrashPurger(ctx context.Context, store TrashStore, interval time.Duration) {
+	purge := func() {
+		n, err := store.PurgeExpiredTrash(ctx, time.Now().Add(-TrashRetention))
+		if err != nil {
+			LogError("Failed to purge expired trash: %v", err)
+			return
+		}
+		if n > 0 {
+			LogInfo("Purged %d expired trash items", n)
+		}
+	}
+	go func() {
+		purge()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purge()
+			}
+		}
+	}()
+}
+
+// ==================== Redis 回收站 ====================
+
+func userTrashKey(username string) string { return "user_trash:" + username }
+
+// trashByTimeKey 全部用户回收站条目按删除时间排序的索引，供过期清理使用
+const trashByTimeKey = "trash_by_time"
+
+func trashField(kind TrashKind, id string) string { return string(kind) + ":" + id }
+
+// trashMember 删除时间索引中的成员，编码用户名和条目以便清理时定位
+func trashMember(username string, kind TrashKind, id string) string {
+	b, _ := json.Marshal([]string{username, string(kind), id})
+	return string(b)
+}
+
+// watchRetry 执行 WATCH 乐观事务，被监视的键被并发修改时重试
+func (s *RedisStore) watchRetry(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		err := s.rdb.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrConcurrentUpdate
+}
+
+// moveToTrash 在监视 key 的乐观事务中将记录移入回收站：load 读取记录并生成条目，
+// 记录不存在时返回 nil；remove 在同一 MULTI 中删除原记录
+func (s *RedisStore) moveToTrash(ctx context.Context, username, key string,
+	load func(tx *redis.Tx) (*TrashItem, error), remove func(pipe redis.Pipeliner)) error {
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		item, err := load(tx)
+		if err != nil || item == nil {
+			return err
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			remove(pipe)
+			pipe.HSet(ctx, userTrashKey(username), trashField(item.Kind, item.ID), data)
+			pipe.ZAdd(ctx, trashByTimeKey, redis.Z{
+				Score:  float64(item.DeletedAt.UnixMilli()),
+				Member: trashMember(username, item.Kind, item.ID),
+			})
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// ListTrash 列出用户回收站中的条目
+func (s *RedisStore) ListTrash(ctx context.Context, username string) ([]*TrashItem, error) {
+	vals, err := s.rdb.HVals(ctx, userTrashKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*TrashItem, 0, len(vals))
+	for _, v := range vals {
+		var item TrashItem
+		if err := json.Unmarshal([]byte(v), &item); err != nil {
+			LogWarn("Skipping unreadable trash item of user %s: %v", username, err)
+			continue
+		}
+		items = append(items, item.withExpiry())
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// sortTrash 按删除时间倒序排列
+func sortTrash(items []*TrashItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+}
+
+// RestoreTrash 恢复回收站条目
+func (s *RedisStore) RestoreTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	if kind == TrashFavorite {
+		if _, err := s.migrateLegacyFavorites(ctx, username); err != nil {
+			return err
+		}
+	}
+	trashKey, field := userTrashKey(username), trashField(kind, id)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		data, err := tx.HGet(ctx, trashKey, field).Result()
+		if err == redis.Nil {
+			return ErrTrashItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var item TrashItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return err
+		}
+		restore, err := s.restoreOps(ctx, tx, username, &item)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			restore(pipe)
+			pipe.HDel(ctx, trashKey, field)
+			pipe.ZRem(ctx, trashByTimeKey, trashMember(username, kind, id))
+			return nil
+		})
+		return err
+	}, trashKey)
+}
+
+// restoreOps 确认原记录位置为空并加入监视，返回写回原记录及其索引的命令
+func (s *RedisStore) restoreOps(ctx context.Context, tx *redis.Tx, username string, item *TrashItem) (func(pipe redis.Pipeliner), error) {
+	switch item.Kind {
+	case TrashTrip:
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, item.Record, &plan); err != nil {
+			return nil, err
+		}
+		plan.SchemaVersion = CurrentSchemaVersion(KindTrip)
+		data, err := json.Marshal(&plan)
+		if err != nil {
+			return nil, err
+		}
+		key := tripKey(plan.ID)
+		if err := watchAbsent(ctx, tx, key); err != nil {
+			return nil, err
+		}
+		doc := tripSearchRecord(&plan).document()
+		return func(pipe redis.Pipeliner) {
+			pipe.Set(ctx, key, data, 0)
+			pipe.SAdd(ctx, userTripsKey(username), plan.ID)
+			for _, field := range tripSortFields {
+				pipe.ZAdd(ctx, userTripIndexKey(field, username), redis.Z{Score: tripSortScore(&plan, field), Member: plan.ID})
+			}
+			indexSearchDoc(ctx, pipe, tripSearchScope(username), doc)
+		}, nil
+
+	case TrashDiary:
+		var diary DiaryEntry
+		if _, _, err := decodeRecord(KindDiary, item.Record, &diary); err != nil {
+			return nil, err
+		}
+		diary.SchemaVersion = CurrentSchemaVersion(KindDiary)
+		data, err := json.Marshal(diary)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("diary:%d:%d", diary.UserID, diary.ID)
+		if err := watchAbsent(ctx, tx, key); err != nil {
+			return nil, err
+		}
+		doc := diarySearchRecord(&diary).document()
+		return func(pipe redis.Pipeliner) {
+			pipe.Set(ctx, key, data, 0)
+			pipe.ZAdd(ctx, fmt.Sprintf("user:%d:diaries", diary.UserID), redis.Z{
+				Score:  float64(diary.ID),
+				Member: strconv.FormatInt(diary.ID, 10),
+			})
+			indexSearchDoc(ctx, pipe, diarySearchScope(diary.UserID), doc)
+		}, nil
+
+	case TrashFavorite:
+		var f Favorite
+		if err := json.Unmarshal(item.Record, &f); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(favoriteEntry{Favorite: f, AddedAt: time.Now().UnixNano()})
+		if err != nil {
+			return nil, err
+		}
+		key := userFavoritePlacesKey(username)
+		if err := tx.Watch(ctx, key).Err(); err != nil {
+			return nil, err
+		}
+		exists, err := tx.HExists(ctx, key, f.ID).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, ErrRestoreConflict
+		}
+		return func(pipe redis.Pipeliner) {
+			pipe.HSet(ctx, key, f.ID, data)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown trash kind %q", item.Kind)
+}
+
+// watchAbsent 监视 key 并确认其不存在，否则返回 ErrRestoreConflict
+func watchAbsent(ctx context.Context, tx *redis.Tx, key string) error {
+	if err := tx.Watch(ctx, key).Err(); err != nil {
+		return err
+	}
+	n, err := tx.Exists(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrRestoreConflict
+	}
+	return nil
+}
+
+// PurgeTrash 永久删除回收站条目
+func (s *RedisStore) PurgeTrash(ctx context.Context, username string, kind TrashKind, id string) error {
+	var removed *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(ctx, userTrashKey(username), trashField(kind, id))
+		pipe.ZRem(ctx, trashByTimeKey, trashMember(username, kind, id))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed.Val() == 0 {
+		return ErrTrashItemNotFound
+	}
+	if kind == TrashTrip {
+		return s.dropOrphanRevisions(ctx, id)
+	}
+	return nil
+}
+
+// purgeTrashScript 条目的删除时间仍早于截止时间时才删除，避免清掉清理期间被再次删除的新条目
+var purgeTrashScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) < tonumber(ARGV[3]) then
+	redis.call('HDEL', KEYS[2], ARGV[2])
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// PurgeExpiredTrash 永久删除过期的回收站条目
+func (s *RedisStore) PurgeExpiredTrash(ctx context.Context, before time.Time) (int, error) {
+	cutoff := before.UnixMilli()
+	purged := 0
+	for {
+		members, err := s.rdb.ZRangeByScore(ctx, trashByTimeKey, &redis.ZRangeBy{
+			Min: "-inf", Max: "(" + strconv.FormatInt(cutoff, 10), Count: 200,
+		}).Result()
+		if err != nil {
+			return purged, err
+		}
+		if len(members) == 0 {
+			return purged, nil
+		}
+		for _, m := range members {
+			var parts []string
+			if err := json.Unmarshal([]byte(m), &parts); err != nil || len(parts) != 3 {
+				s.rdb.ZRem(ctx, trashByTimeKey, m)
+				continue
+			}
+			username, kind, id := parts[0], TrashKind(parts[1]), parts[2]
+			n, err := purgeTrashScript.Run(ctx, s.rdb, []string{trashByTimeKey, userTrashKey(username)}, m, trashField(kind, id), cutoff).Int()
+			if err != nil {
+				return purged, err
+			}
+			if n > 0 && kind == TrashTrip {
+				if err := s.dropOrphanRevisions(ctx, id); err != nil {
+					return purged, err
+				}
+			}
+			purged += n
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 行程列表排序字段
+const (
+	TripSortCreatedAt = "createdAt"
+	TripSortStartDate = "startDate"
+	TripSortBudget    = "budget"
+)
+
+// 行程列表分页大小
+const (
+	DefaultTripPageSize = 20
+	MaxTripPageSize     = 100
+)
+
+// TripQuery 行程列表查询条件
+type TripQuery struct {
+	SortBy      string // createdAt（默认）、startDate 或 budget
+	Desc        bool
+	Cursor      string // 上一页返回的 NextCursor，为空表示第一页
+	Limit       int
+	Destination string // 目的地包含该关键字（不区分大小写）
+	From        string // 与 [From, To] 日期区间有交集的行程，格式 2006-01-02
+	To          string
+}
+
+// TripPage 一页行程
+type TripPage struct {
+	Trips      []*TripPlan `json:"trips"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// tripCursor 键集分页游标，记录上一页最后一条的排序值和ID；
+// 排序值相同时按ID排序，保证翻页过程中有新增或删除时结果依然稳定
+type tripCursor struct {
+	SortBy string  `json:"by"`
+	Desc   bool    `json:"desc,omitempty"`
+	Score  float64 `json:"s"`
+	ID     string  `json:"id"`
+}
+
+func (c *tripCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// normalize 补全默认值、校验参数并解析游标，第一页返回的游标为 nil
+func (q *TripQuery) normalize() (*tripCursor, error) {
+	switch q.SortBy {
+	case "":
+		q.SortBy = TripSortCreatedAt
+	case TripSortCreatedAt, TripSortStartDate, TripSortBudget:
+	default:
+		return nil, fmt.Errorf("%w: unknown sort field %q", ErrInvalidTripQuery, q.SortBy)
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultTripPageSize
+	}
+	if q.Limit > MaxTripPageSize {
+		q.Limit = MaxTripPageSize
+	}
+	for _, d := range []string{q.From, q.To} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return nil, fmt.Errorf("%w: invalid date %q", ErrInvalidTripQuery, d)
+		}
+	}
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidTripQuery)
+	}
+	var cur tripCursor
+	if err := json.Unmarshal(b, &cur); err != nil || cur.ID == "" {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidTripQuery)
+	}
+	if cur.SortBy != q.SortBy || cur.Desc != q.Desc {
+		return nil, fmt.Errorf("%w: cursor was issued for a different sort order", ErrInvalidTripQuery)
+	}
+	return &cur, nil
+}
+
+// matches 判断行程是否满足目的地和日期区间过滤条件
+func (q *TripQuery) matches(plan *TripPlan) bool {
+	if q.Destination != "" && !strings.Contains(strings.ToLower(plan.Request.Destination), strings.ToLower(q.Destination)) {
+		return false
+	}
+	if q.From != "" && plan.Request.EndDate < q.From {
+		return false
+	}
+	if q.To != "" && plan.Request.StartDate > q.To {
+		return false
+	}
+	return true
+}
+
+// tripSortScore 返回行程在指定排序字段上的排序值，各后端的索引均使用该值
+func tripSortScore(plan *TripPlan, sortBy string) float64 {
+	switch sortBy {
+	case TripSortStartDate:
+		return startDayScore(plan.Request.StartDate)
+	case TripSortBudget:
+		return plan.Request.Budget
+	default:
+		return float64(plan.CreatedAt.UnixMilli())
+	}
+}
+
+// startDayScore 出发日期距 1970-01-01 的天数，日期无法解析时为 0
+func startDayScore(date string) float64 {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0
+	}
+	return float64(t.Unix() / 86400)
+}
+
+// afterCursor 判断排序值为 score 的行程是否位于游标之后
+func (c *tripCursor) afterCursor(score float64, id string) bool {
+	if c == nil {
+		return true
+	}
+	if c.Desc {
+		return score < c.Score || (score == c.Score && id < c.ID)
+	}
+	return score > c.Score || (score == c.Score && id > c.ID)
+}
+
+// tripPager 按排序顺序收集一页行程，多取一条用于判断是否还有下一页
+type tripPager struct {
+	q      *TripQuery
+	trips  []*TripPlan
+	scores []float64
+}
+
+// add 追加一条已按顺序排列、位于游标之后且满足过滤条件的行程，返回本页是否已取满
+func (p *tripPager) add(plan *TripPlan, score float64) bool {
+	p.trips = append(p.trips, plan)
+	p.scores = append(p.scores, score)
+	return p.full()
+}
+
+func (p *tripPager) full() bool { return len(p.trips) > p.q.Limit }
+
+// page 生成结果页，取满时以本页最后一条生成下一页游标
+func (p *tripPager) page() *TripPage {
+	if !p.full() {
+		return &TripPage{Trips: append(make([]*TripPlan, 0, len(p.trips)), p.trips...)}
+	}
+	last := p.q.Limit - 1
+	next := &tripCursor{SortBy: p.q.SortBy, Desc: p.q.Desc, Score: p.scores[last], ID: p.trips[last].ID}
+	return &TripPage{Trips: p.trips[:p.q.Limit], NextCursor: next.encode()}
+}
+
+// ListAllUserTrips 按条件返回用户的全部行程，按 MaxTripPageSize 逐页读取直到最后一页
+func ListAllUserTrips(ctx context.Context, store TripStore, username string, q TripQuery) ([]*TripPlan, error) {
+	q.Limit = MaxTripPageSize
+	q.Cursor = ""
+	trips := []*TripPlan{}
+	for {
+		page, err := store.ListUserTrips(ctx, username, q)
+		if err != nil {
+			return nil, err
+		}
+		trips = append(trips, page.Trips...)
+		if page.NextCursor == "" {
+			return trips, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevisionReason 行程版本的产生原因
+type RevisionReason string
+
+const (
+	RevisionGenerated   RevisionReason = "generated"   // 首次由大模型生成
+	RevisionEdited      RevisionReason = "edited"      // 用户手动编辑
+	RevisionRegenerated RevisionReason = "regenerated" // 按原请求重新生成
+	RevisionReverted    RevisionReason = "reverted"    // 恢复到历史版本
+	RevisionImported    RevisionReason = "imported"    // 从账户归档导入
+)
+
+// TripRevisionInfo 保存行程时记录的版本说明
+type TripRevisionInfo struct {
+	Author string // 为空时使用行程所属用户
+	Reason RevisionReason
+	Note   string
+	// ExpectedRevision 大于 0 时，行程必须存在且最新版本号等于它才写入，否则返回 ErrConcurrentUpdate；
+	// 基于已读取内容修改行程时传入读取时的 Revision，避免覆盖并发的修改
+	ExpectedRevision int
+}
+
+// TripRevision 行程的一个历史版本，Number 从 1 开始按保存顺序递增
+type TripRevision struct {
+	TripID    string         `json:"tripId"`
+	Number    int            `json:"number"`
+	Author    string         `json:"author"`
+	Reason    RevisionReason `json:"reason"`
+	Note      string         `json:"note,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Plan      *TripPlan      `json:"plan,omitempty"` // 列表接口中不返回
+}
+
+// tripRevisionRecord 存储中的版本记录，Plan 按行程记录版本迁移后再解码
+type tripRevisionRecord struct {
+	Author    string          `json:"author"`
+	Reason    RevisionReason  `json:"reason"`
+	Note      string          `json:"note,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Plan      json.RawMessage `json:"plan"`
+}
+
+// newRevisionRecord 为刚写入的行程生成版本记录，plan 的时间戳和版本号需已由 SaveTripPlan 填好
+func newRevisionRecord(plan *TripPlan, info TripRevisionInfo) (*tripRevisionRecord, error) {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	if info.Author == "" {
+		info.Author = plan.Username
+	}
+	return &tripRevisionRecord{
+		Author:    info.Author,
+		Reason:    info.Reason,
+		Note:      info.Note,
+		CreatedAt: plan.UpdatedAt,
+		Plan:      data,
+	}, nil
+}
+
+// revision 转换为接口返回的版本，withPlan 为 false 时只返回元数据
+func (r *tripRevisionRecord) revision(tripID string, number int, withPlan bool) (*TripRevision, error) {
+	rev := &TripRevision{
+		TripID:    tripID,
+		Number:    number,
+		Author:    r.Author,
+		Reason:    r.Reason,
+		Note:      r.Note,
+		CreatedAt: r.CreatedAt,
+	}
+	if withPlan {
+		var plan TripPlan
+		if _, _, err := decodeRecord(KindTrip, r.Plan, &plan); err != nil {
+			return nil, fmt.Errorf("decode revision %d of trip %s: %w", number, tripID, err)
+		}
+		rev.Plan = &plan
+	}
+	return rev, nil
+}
+
+// ParseRevisionNumber 解析版本号参数，版本号从 1 开始
+func ParseRevisionNumber(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// RevertTripPlan 将行程内容恢复为指定版本，并作为新版本保存；
+// 行程ID、所属用户和创建时间保持为当前值，期间行程被修改时返回 ErrConcurrentUpdate
+func RevertTripPlan(ctx context.Context, store TripStore, current *TripPlan, number int, author string) (*TripPlan, error) {
+	rev, err := store.GetTripRevision(ctx, current.ID, number)
+	if err != nil {
+		return nil, err
+	}
+	plan := rev.Plan
+	plan.ID = current.ID
+	plan.UserID = current.UserID
+	plan.Username = current.Username
+	plan.CreatedAt = current.CreatedAt
+	info := TripRevisionInfo{Author: author, Reason: RevisionReverted, Note: fmt.Sprintf("恢复到版本 %d", number),
+		ExpectedRevision: current.Revision}
+	if err := store.SaveTripPlan(ctx, plan, info); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// ==================== 版本差异 ====================
+
+// DiffStatus 每日行程或活动在两个版本间的变化
+type DiffStatus string
+
+const (
+	DiffAdded    DiffStatus = "added"
+	DiffRemoved  DiffStatus = "removed"
+	DiffModified DiffStatus = "modified"
+)
+
+// FieldChange 单个字段的变化
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// ActivityDiff 活动的变化，新增和删除时 Changes 为空，分别只有 To 或 From
+type ActivityDiff struct {
+	Status  DiffStatus    `json:"status"`
+	Name    string        `json:"name"`
+	From    *Activity     `json:"from,omitempty"`
+	To      *Activity     `json:"to,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// DayDiff 单日行程的变化，按天数（day）对应
+type DayDiff struct {
+	Day        int            `json:"day"`
+	Status     DiffStatus     `json:"status"`
+	Changes    []FieldChange  `json:"changes,omitempty"`
+	Activities []ActivityDiff `json:"activities,omitempty"`
+}
+
+// TripDiff 两个行程版本之间的差异，只包含有变化的字段、日期和活动
+type TripDiff struct {
+	TripID  string        `json:"tripId"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+	Days    []DayDiff     `json:"days"`
+}
+
+// fieldDiff 收集字段变化
+type fieldDiff []FieldChange
+
+func (d *fieldDiff) add(field string, from, to interface{}) {
+	if from != to {
+		*d = append(*d, FieldChange{Field: field, From: from, To: to})
+	}
+}
+
+// DiffTripPlans 比较两个行程版本：顶层字段逐个比较；每日行程按天数对应；
+// 同一天内的活动按名称对应（同名活动按出现顺序依次对应），活动顺序变化不计入差异
+func DiffTripPlans(from, to *TripPlan) *TripDiff {
+	var changes fieldDiff
+	changes.add("destination", from.Request.Destination, to.Request.Destination)
+	changes.add("startDate", from.Request.StartDate, to.Request.StartDate)
+	changes.add("endDate", from.Request.EndDate, to.Request.EndDate)
+	changes.add("budget", from.Request.Budget, to.Request.Budget)
+	changes.add("travelers", from.Request.Travelers, to.Request.Travelers)
+	changes.add("preferences", strings.Join(from.Request.Preferences, ","), strings.Join(to.Request.Preferences, ","))
+	changes.add("specialNeeds", from.Request.SpecialNeeds, to.Request.SpecialNeeds)
+	changes.add("totalCost", from.TotalCost, to.TotalCost)
+	changes.add("summary", from.Summary, to.Summary)
+
+	diff := &TripDiff{TripID: to.ID, Changes: []FieldChange(changes), Days: []DayDiff{}}
+	if diff.Changes == nil {
+		diff.Changes = []FieldChange{}
+	}
+
+	oldDays := make(map[int]*DayItinerary, len(from.Itinerary))
+	for i := range from.Itinerary {
+		oldDays[dayNumber(from.Itinerary, i)] = &from.Itinerary[i]
+	}
+	seen := make(map[int]bool, len(to.Itinerary))
+	for i := range to.Itinerary {
+		n := dayNumber(to.Itinerary, i)
+		seen[n] = true
+		day := &to.Itinerary[i]
+		old, ok := oldDays[n]
+		if !ok {
+			diff.Days = append(diff.Days, DayDiff{Day: n, Status: DiffAdded, Activities: activityDiffs(nil, day.Activities)})
+			continue
+		}
+		if d, changed := diffDay(n, old, day); changed {
+			diff.Days = append(diff.Days, d)
+		}
+	}
+	for i := range from.Itinerary {
+		n := dayNumber(from.Itinerary, i)
+		if !seen[n] {
+			diff.Days = append(diff.Days, DayDiff{Day: n, Status: DiffRemoved, Activities: activityDiffs(from.Itinerary[i].Activities, nil)})
+		}
+	}
+	return diff
+}
+
+// dayNumber 每日行程的天数，缺失时按位置推断
+func dayNumber(days []DayItinerary, i int) int {
+	if days[i].Day > 0 {
+		return days[i].Day
+	}
+	return i + 1
+}
+
+func diffDay(n int, from, to *DayItinerary) (DayDiff, bool) {
+	var changes fieldDiff
+	changes.add("date", from.Date, to.Date)
+	changes.add("accommodation", from.Accommodation, to.Accommodation)
+	changes.add("dailyCost", from.DailyCost, to.DailyCost)
+	acts := activityDiffs(from.Activities, to.Activities)
+	if len(changes) == 0 && len(acts) == 0 {
+		return DayDiff{}, false
+	}
+	return DayDiff{Day: n, Status: DiffModified, Changes: changes, Activities: acts}, true
+}
+
+// activityDiffs 按名称对应活动，结果按新版本中的顺序排列，删除的活动排在最后
+func activityDiffs(from, to []Activity) []ActivityDiff {
+	byName := make(map[string][]int, len(from))
+	for i, a := range from {
+		byName[a.Name] = append(byName[a.Name], i)
+	}
+	matched := make([]bool, len(from))
+	var diffs []ActivityDiff
+	for i := range to {
+		a := &to[i]
+		if idx := byName[a.Name]; len(idx) > 0 {
+			byName[a.Name] = idx[1:]
+			matched[idx[0]] = true
+			old := &from[idx[0]]
+			if changes := diffActivity(old, a); len(changes) > 0 {
+				diffs = append(diffs, ActivityDiff{Status: DiffModified, Name: a.Name, From: old, To: a, Changes: changes})
+			}
+			continue
+		}
+		diffs = append(diffs, ActivityDiff{Status: DiffAdded, Name: a.Name, To: a})
+	}
+	for i := range from {
+		if !matched[i] {
+			diffs = append(diffs, ActivityDiff{Status: DiffRemoved, Name: from[i].Name, From: &from[i]})
+		}
+	}
+	return diffs
+}
+
+func diffActivity(from, to *Activity) []FieldChange {
+	var changes fieldDiff
+	changes.add("time", from.Time, to.Time)
+	changes.add("type", from.Type, to.Type)
+	changes.add("location", from.Location, to.Location)
+	changes.add("duration", from.Duration, to.Duration)
+	changes.add("cost", from.Cost, to.Cost)
+	changes.add("description", from.Description, to.Description)
+	changes.add("tips", from.Tips, to.Tips)
+	return changes
+}
+
+// ==================== Redis 行程版本 ====================
+
+// tripRevisionsKey 行程版本列表，第 n 个元素（从 0 开始）为版本 n+1
+func tripRevisionsKey(tripID string) string { return "trip_revisions:" + tripID }
+
+// ListTripRevisions 列出行程的全部版本（不含行程内容），按版本号倒序
+func (s *RedisStore) ListTripRevisions(ctx context.Context, tripID string) ([]*TripRevision, error) {
+	vals, err := s.rdb.LRange(ctx, tripRevisionsKey(tripID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]*TripRevision, 0, len(vals))
+	for i := len(vals) - 1; i >= 0; i-- {
+		var rec tripRevisionRecord
+		if err := json.Unmarshal([]byte(vals[i]), &rec); err != nil {
+			LogWarn("Skipping unreadable revision %d of trip %s: %v", i+1, tripID, err)
+			continue
+		}
+		rev, _ := rec.revision(tripID, i+1, false)
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+// GetTripRevision 获取行程的指定版本
+func (s *RedisStore) GetTripRevision(ctx context.Context, tripID string, number int) (*TripRevision, error) {
+	if number <= 0 {
+		return nil, ErrRevisionNotFound
+	}
+	val, err := s.rdb.LIndex(ctx, tripRevisionsKey(tripID), int64(number-1)).Result()
+	if err == redis.Nil {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec tripRevisionRecord
+	if err := json.Unmarshal([]byte(val), &rec); err != nil {
+		return nil, err
+	}
+	return rec.revision(tripID, number, true)
+}
+
+// dropOrphanRevisions 行程已被永久删除时清除其版本历史
+func (s *RedisStore) dropOrphanRevisions(ctx context.Context, tripID string) error {
+	key := tripKey(tripID)
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, tripRevisionsKey(tripID))
+			return nil
+		})
+		return err
+	}, key)
+}
@@ -6,28 +6,92 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-// GenerateTripPlan builds prompt and delegates to AI client
-func GenerateTripPlan(ctx context.Context, req *TripPlanRequest) (*TripPlan, error) {
-	prompt := buildPrompt(req)
+// GenerateTripPlan builds prompt and delegates to AI client, then validates the
+// returned itinerary and re-prompts the model with any violations it cannot fix
+func GenerateTripPlan(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+	return generateValidated(ctx, req, func(prompt string) (string, error) {
+		// 调用大模型
+		return CallModel(ctx, prompt)
+	}, nil)
+}
 
-	// 调用大模型
-	content, err := CallModel(ctx, prompt)
-	if err != nil {
-		return nil, fmt.Errorf("call model: %w", err)
+// SaveNewTrip 为新生成的行程分配ID并保存到用户名下
+func SaveNewTrip(ctx context.Context, trips TripStore, plan *TripPlan, user *UserRecord) error {
+	if plan.ID == "" {
+		id, err := trips.GenerateTripID(ctx)
+		if err != nil {
+			return err
+		}
+		plan.ID = id
 	}
+	plan.UserID = user.ID
+	plan.Username = user.Username
+	return trips.SaveTripPlan(ctx, plan, TripRevisionInfo{Reason: RevisionGenerated})
+}
 
+// TripStreamEvents 流式生成行程时的回调，任一回调返回错误时中止生成
+type TripStreamEvents struct {
+	// OnProgress 每收到一段模型输出时调用，received 为累计收到的字符数，days 为已解析出的天数
+	OnProgress func(received, days int) error
+	// OnDay 每解析出完整的一天行程时调用，天序号、日期和费用已按 NormalizeTripPlan 的规则修正；
+	// 重新生成时会从第 1 天开始再次调用。最终保存的是问题最少的一次结果，以它为准
+	OnDay func(day DayItinerary) error
+	// OnRepair 行程校验不通过、带着问题重新生成前调用，attempt 为已完成的生成次数
+	OnRepair func(attempt int, issues []ItineraryIssue) error
+}
+
+// GenerateTripPlanStream 以流式模式调用大模型，边接收边解析 itinerary 中已完整输出的每一天，
+// 全部输出后按与 GenerateTripPlan 相同的方式校验并在需要时重新生成
+func GenerateTripPlanStream(ctx context.Context, req *TripPlanRequest, events TripStreamEvents) (*TripPlan, *ItineraryReport, error) {
+	return generateValidated(ctx, req, func(prompt string) (string, error) {
+		return StreamModel(ctx, prompt, tripStreamReceiver(req, events))
+	}, events.OnRepair)
+}
+
+// tripStreamReceiver 返回一次流式调用的输出回调，通过 events 报告进度和已完整输出的每一天
+func tripStreamReceiver(req *TripPlanRequest, events TripStreamEvents) func(delta string) error {
+	var scanner itineraryScanner
+	start, _, datesOK := tripDateRange(req)
+	received, index, days := 0, 0, 0
+	return func(delta string) error {
+		received += utf8.RuneCountInString(delta)
+		for _, raw := range scanner.Write(delta) {
+			// index 为该天在 itinerary 中的位置，解析失败的元素同样占一个位置
+			i := index
+			index++
+			var day DayItinerary
+			if err := json.Unmarshal(raw, &day); err != nil {
+				// 单日解析失败不影响最终结果，整体解析时会再报告错误
+				LogWarn("Failed to parse streamed itinerary day: %v", err)
+				continue
+			}
+			normalizeDay(&day, i, start, datesOK)
+			days++
+			if events.OnDay != nil {
+				if err := events.OnDay(day); err != nil {
+					return err
+				}
+			}
+		}
+		if events.OnProgress != nil {
+			return events.OnProgress(received, days)
+		}
+		return nil
+	}
+}
+
+// parseTripPlan 解析模型返回的行程 JSON 并补充必要字段
+func parseTripPlan(content string, req *TripPlanRequest) (*TripPlan, error) {
 	// 尝试解析返回的 JSON
 	var plan TripPlan
 	if err := json.Unmarshal([]byte(content), &plan); err != nil {
 		return nil, fmt.Errorf("parse plan: %w (raw: %s)", err, content[:min(len(content), 200)])
 	}
 
-	// 补充必要字段
-	if plan.ID == "" {
-		plan.ID, _ = GenerateTripID(ctx)
-	}
+	// 补充必要字段（ID 由调用方通过 TripStore 分配）
 	if plan.CreatedAt.IsZero() {
 		plan.CreatedAt = time.Now()
 	}
@@ -39,6 +103,78 @@ func GenerateTripPlan(ctx context.Context, req *TripPlanRequest) (*TripPlan, err
 	return &plan, nil
 }
 
+// itineraryScanner 增量扫描模型输出的行程 JSON，在顶层 itinerary 数组中的每个元素输出完整后返回它。
+// 只跟踪字符串、转义和嵌套深度，不校验 JSON 的其余部分
+type itineraryScanner struct {
+	depth    int
+	inString bool
+	escaped  bool
+	// key 为顶层对象中最近一个字符串，数组开始时据此判断是否为 itinerary
+	key     strings.Builder
+	inKey   bool
+	lastKey string
+	inArray bool
+	// item 为当前正在接收的数组元素
+	item []byte
+}
+
+// Write 追加一段输出，返回其中完整结束的 itinerary 元素
+func (s *itineraryScanner) Write(chunk string) [][]byte {
+	var done [][]byte
+	for i := 0; i < len(chunk); i++ {
+		ch := chunk[i]
+		if s.item != nil {
+			s.item = append(s.item, ch)
+		}
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case ch == '\\':
+				s.escaped = true
+			case ch == '"':
+				s.inString = false
+				if s.inKey {
+					s.inKey = false
+					s.lastKey = s.key.String()
+				}
+			}
+			if s.inKey {
+				s.key.WriteByte(ch)
+			}
+			continue
+		}
+
+		switch ch {
+		case '"':
+			s.inString = true
+			if s.depth == 1 {
+				s.inKey = true
+				s.key.Reset()
+			}
+		case '{', '[':
+			s.depth++
+			if ch == '[' && s.depth == 2 && s.lastKey == "itinerary" {
+				s.inArray = true
+			} else if ch == '{' && s.depth == 3 && s.inArray {
+				s.item = []byte{ch}
+			}
+		case '}', ']':
+			if s.depth == 3 && s.item != nil {
+				done = append(done, s.item)
+				s.item = nil
+			}
+			if s.depth == 2 {
+				s.inArray = false
+			}
+			if s.depth > 0 {
+				s.depth--
+			}
+		}
+	}
+	return done
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -46,10 +182,15 @@ func min(a, b int) int {
 	return b
 }
 
-func buildPrompt(req *TripPlanRequest) string {
+// DayCount 返回请求的行程天数（含首尾两天）
+func (req *TripPlanRequest) DayCount() int {
 	startDate, _ := time.Parse("2006-01-02", req.StartDate)
 	endDate, _ := time.Parse("2006-01-02", req.EndDate)
-	days := int(endDate.Sub(startDate).Hours()/24) + 1
+	return int(endDate.Sub(startDate).Hours()/24) + 1
+}
+
+func buildPrompt(req *TripPlanRequest) string {
+	days := req.DayCount()
 
 	prefsStr := "无特定偏好"
 	if len(req.Preferences) > 0 {
@@ -74,8 +215,10 @@ func buildPrompt(req *TripPlanRequest) string {
 1. 严格按JSON格式输出，不要其他文字
 2. 每天安排3-5个活动
 3. 活动时间合理，预留交通时间
-4. 费用分配合理，不超预算
-5. 提供实用建议
+4. itinerary 恰好包含%d天，day 从1开始连续编号，date 从 %s 起逐日递增
+5. 住宿、交通等费用也作为活动列出，每天的 dailyCost 等于当天活动 cost 之和
+6. totalCost 等于各天 dailyCost 之和，且不超过预算
+7. 提供实用建议
 
 JSON格式：
 {
@@ -108,6 +251,7 @@ JSON格式：
 		req.StartDate, req.EndDate, days,
 		req.Budget, req.Travelers,
 		prefsStr, specialStr,
+		days, req.StartDate,
 		req.StartDate,
 		req.Budget)
 }
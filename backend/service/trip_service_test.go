@@ -0,0 +1,161 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// scanChunks 依次写入各段输出，返回扫描出的全部元素
+func scanChunks(chunks []string) []string {
+	var s itineraryScanner
+	var got []string
+	for _, chunk := range chunks {
+		for _, item := range s.Write(chunk) {
+			got = append(got, string(item))
+		}
+	}
+	return got
+}
+
+func TestItineraryScanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "single chunk",
+			chunks: []string{`{"itinerary":[{"day":1},{"day":2}]}`},
+			want:   []string{`{"day":1}`, `{"day":2}`},
+		},
+		{
+			name:   "chunks split mid-string",
+			chunks: []string{`{"itin`, `erary":[{"day":1,"title":"Lou`, `vre"},{"da`, `y":2,"title":"Or`, `say"}]}`},
+			want:   []string{`{"day":1,"title":"Louvre"}`, `{"day":2,"title":"Orsay"}`},
+		},
+		{
+			name:   "chunk split after a backslash",
+			chunks: []string{`{"itinerary":[{"note":"a\`, `"}]\`, `\"},{"day":2}]}`},
+			want:   []string{`{"note":"a\"}]\\"}`, `{"day":2}`},
+		},
+		{
+			name:   "escaped quotes and braces inside strings",
+			chunks: []string{`{"summary":"say \"itinerary\": [{","itinerary":[{"note":"}]\"{[","tip":"\\"},{"day":2}]}`},
+			want:   []string{`{"note":"}]\"{[","tip":"\\"}`, `{"day":2}`},
+		},
+		{
+			name:   "nested arrays",
+			chunks: []string{`{"itinerary":[{"day":1,"activities":[{"tags":["a",["b"]]},[]]},{"day":2,"activities":[]}]}`},
+			want:   []string{`{"day":1,"activities":[{"tags":["a",["b"]]},[]]}`, `{"day":2,"activities":[]}`},
+		},
+		{
+			name:   "other arrays are ignored",
+			chunks: []string{`{"tips":[{"a":1}],"meta":{"itinerary":[{"b":2}]},"itinerary":[{"day":1}],"after":[{"c":3}]}`},
+			want:   []string{`{"day":1}`},
+		},
+		{
+			name:   "string value named itinerary",
+			chunks: []string{`{"title":"itinerary","days":[{"day":1}]}`},
+			want:   nil,
+		},
+		{
+			name:   "incomplete element",
+			chunks: []string{`{"itinerary":[{"day":1},{"day":2,"title":"unfinished`},
+			want:   []string{`{"day":1}`},
+		},
+	}
+	for _, tt := range tests {
+		got := scanChunks(tt.chunks)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") || len(got) != len(tt.want) {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+		// 逐字节写入得到相同结果
+		each := strings.Split(strings.Join(tt.chunks, ""), "")
+		if single := scanChunks(each); strings.Join(single, "\n") != strings.Join(got, "\n") || len(single) != len(got) {
+			t.Errorf("%s byte by byte: got %q; want %q", tt.name, single, got)
+		}
+	}
+}
+
+func TestItineraryScannerEmitsOnCompletion(t *testing.T) {
+	doc := `{"itinerary":[{"day":1,"activities":[{"name":"}"}]},{"day":2,"note":"\"}"}],"tips":[]}`
+	want := []string{`{"day":1,"activities":[{"name":"}"}]}`, `{"day":2,"note":"\"}"}`}
+
+	// 每个元素恰好在其右括号写入时返回一次
+	var s itineraryScanner
+	var got []string
+	for i := 0; i < len(doc); i++ {
+		items := s.Write(doc[i : i+1])
+		if len(items) > 1 {
+			t.Fatalf("byte %d returned %d items; want at most 1", i, len(items))
+		}
+		if len(items) == 0 {
+			continue
+		}
+		item := string(items[0])
+		if n := len(got); n >= len(want) || item != want[n] {
+			t.Fatalf("byte %d returned %q; want the next element of %q", i, item, want)
+		}
+		if !strings.HasSuffix(doc[:i+1], item) {
+			t.Fatalf("%q returned at byte %d; want it as soon as its closing brace is written", item, i)
+		}
+		got = append(got, item)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d items; want %d", len(got), len(want))
+	}
+	// 完整输出后继续写入不会再次返回
+	if items := s.Write(" "); len(items) != 0 {
+		t.Fatalf("Write after the document = %q; want nothing", items)
+	}
+}
+
+func TestTripStreamReceiverNormalizesDays(t *testing.T) {
+	var days []DayItinerary
+	var progress []int
+	receive := tripStreamReceiver(&testValidationRequest, TripStreamEvents{
+		OnDay: func(day DayItinerary) error {
+			days = append(days, day)
+			return nil
+		},
+		OnProgress: func(received, n int) error {
+			progress = append(progress, n)
+			return nil
+		},
+	})
+	// 序号、日期和每日费用有误；无法解析的第二个元素同样占一个位置
+	chunks := []string{
+		`{"itinerary":[{"day":3,"date":"2026-12-01","activities":[{"name":"故宫","cost":-5},{"name":"景山","cost":10}],"dailyCost":99},`,
+		`{"day":"bad"},{"day":7,"date":"2026-11-03","act`,
+		`ivities":[{"name":"颐和园","cost":30}],"dailyCost":30}]}`,
+	}
+	for _, chunk := range chunks {
+		if err := receive(chunk); err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+	}
+
+	want := []struct {
+		day   int
+		date  string
+		daily float64
+	}{
+		{1, "2026-11-01", 10},
+		{3, "2026-11-03", 30},
+	}
+	if len(days) != len(want) {
+		t.Fatalf("got %d days; want %d", len(days), len(want))
+	}
+	for i, w := range want {
+		if d := days[i]; d.Day != w.day || d.Date != w.date || d.DailyCost != w.daily {
+			t.Errorf("day %d = %d %s %v; want %d %s %v", i, d.Day, d.Date, d.DailyCost, w.day, w.date, w.daily)
+		}
+	}
+	if days[0].Activities[0].Cost != 0 {
+		t.Errorf("negative cost streamed as %v; want 0", days[0].Activities[0].Cost)
+	}
+	if fmt.Sprint(progress) != "[1 1 2]" {
+		t.Errorf("progress days = %v; want [1 1 2]", progress)
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxItineraryRepairs 生成的行程仍有问题时带着问题重新生成的最多次数，为 0 时不重试
+var MaxItineraryRepairs = 2
+
+// minRepairWindow 距离 context 截止时间不足该时长时不再重试，保留已生成的行程
+const minRepairWindow = 30 * time.Second
+
+// costTolerance 费用比较的容差，避免浮点误差被当作问题
+const costTolerance = 0.01
+
+// 行程问题代码
+const (
+	// 可以自动修正的问题
+	IssueDayNumber    = "day_number"    // day 不是从 1 开始的连续序号
+	IssueDate         = "date"          // date 与出发日期推算的日期不一致
+	IssueNegativeCost = "negative_cost" // 活动费用为负数
+	IssueDailyCost    = "daily_cost"    // dailyCost 不等于当天活动费用之和
+	IssueTotalCost    = "total_cost"    // totalCost 不等于各天 dailyCost 之和
+
+	// 需要模型重新生成的问题
+	IssueInvalidJSON = "invalid_json" // 输出不是合法的行程 JSON
+	IssueDayCount    = "day_count"    // 天数与出发、返回日期不符
+	IssueOverBudget  = "over_budget"  // 总费用超出预算
+	IssueEmptyDay    = "empty_day"    // 某天没有安排活动
+
+	// 重新生成也无法解决、只作为警告返回的问题
+	IssueInvalidDates = "invalid_dates" // 请求的出发或返回日期无效，无法校验日期和天数
+)
+
+// ItineraryIssue 生成的行程中的一个问题，Day 为 0 表示整个行程的问题
+type ItineraryIssue struct {
+	Code    string `json:"code"`
+	Day     int    `json:"day,omitempty"`
+	Message string `json:"message"`
+}
+
+// ItineraryReport 行程校验结果
+type ItineraryReport struct {
+	Attempts int              `json:"attempts"` // 调用模型的次数
+	Fixed    []ItineraryIssue `json:"fixed"`    // 已自动修正的问题
+	Warnings []ItineraryIssue `json:"warnings"` // 重试后仍然存在的问题
+}
+
+// tripDateRange 解析请求的出发日期和天数，日期无效时 ok 为 false
+func tripDateRange(req *TripPlanRequest) (start time.Time, days int, ok bool) {
+	start, err := time.Parse("2006-01-02", req.StartDate)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	end, err := time.Parse("2006-01-02", req.EndDate)
+	if err != nil || end.Before(start) {
+		return time.Time{}, 0, false
+	}
+	return start, int(end.Sub(start).Hours()/24) + 1, true
+}
+
+// ValidateTripDates 校验行程请求的出发和返回日期：格式为 YYYY-MM-DD，返回日期不早于出发日期
+func ValidateTripDates(startDate, endDate string) []FieldError {
+	var errs []FieldError
+	start, startErr := time.Parse("2006-01-02", startDate)
+	if startErr != nil {
+		errs = append(errs, FieldError{Field: "startDate", Code: CodeInvalidFormat, Message: "出发日期格式应为 YYYY-MM-DD"})
+	}
+	end, endErr := time.Parse("2006-01-02", endDate)
+	if endErr != nil {
+		errs = append(errs, FieldError{Field: "endDate", Code: CodeInvalidFormat, Message: "返回日期格式应为 YYYY-MM-DD"})
+	}
+	if startErr == nil && endErr == nil && end.Before(start) {
+		errs = append(errs, FieldError{Field: "endDate", Code: CodeInvalidRange, Message: "返回日期不能早于出发日期"})
+	}
+	return errs
+}
+
+// formatCost 去掉多余小数位的金额
+func formatCost(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// normalizeDay 修正 itinerary 中第 index 个（从 0 开始）单日行程的天序号、日期、负数费用和每日费用，
+// 返回修正过的问题；datesOK 为 false 时不修正日期
+func normalizeDay(day *DayItinerary, index int, start time.Time, datesOK bool) (fixed []ItineraryIssue) {
+	if day.Day != index+1 {
+		fixed = append(fixed, ItineraryIssue{Code: IssueDayNumber, Day: index + 1,
+			Message: fmt.Sprintf("第 %d 天的序号为 %d，已改为 %d", index+1, day.Day, index+1)})
+		day.Day = index + 1
+	}
+	if datesOK {
+		want := start.AddDate(0, 0, index).Format("2006-01-02")
+		if day.Date != want {
+			fixed = append(fixed, ItineraryIssue{Code: IssueDate, Day: day.Day,
+				Message: fmt.Sprintf("第 %d 天的日期为 %q，已改为 %s", day.Day, day.Date, want)})
+			day.Date = want
+		}
+	}
+
+	sum := 0.0
+	for j := range day.Activities {
+		a := &day.Activities[j]
+		if a.Cost < 0 {
+			fixed = append(fixed, ItineraryIssue{Code: IssueNegativeCost, Day: day.Day,
+				Message: fmt.Sprintf("第 %d 天活动“%s”的费用为负数，已改为 0", day.Day, a.Name)})
+			a.Cost = 0
+		}
+		sum += a.Cost
+	}
+	if math.Abs(day.DailyCost-sum) > costTolerance {
+		fixed = append(fixed, ItineraryIssue{Code: IssueDailyCost, Day: day.Day,
+			Message: fmt.Sprintf("第 %d 天的 dailyCost 为 %s 元，与活动费用之和 %s 元不符，已改为活动费用之和",
+				day.Day, formatCost(day.DailyCost), formatCost(sum))})
+		day.DailyCost = sum
+	}
+	return fixed
+}
+
+// NormalizeTripPlan 修正行程中可以推算出正确值的问题：天序号、日期、负数费用、每日费用和总费用，
+// 返回修正过的问题和无法自动修正的问题；其中除 invalid_dates 外都需要重新生成
+func NormalizeTripPlan(plan *TripPlan, req *TripPlanRequest) (fixed, violations []ItineraryIssue) {
+	start, days, datesOK := tripDateRange(req)
+
+	total := 0.0
+	for i := range plan.Itinerary {
+		day := &plan.Itinerary[i]
+		fixed = append(fixed, normalizeDay(day, i, start, datesOK)...)
+		total += day.DailyCost
+
+		if len(day.Activities) == 0 {
+			violations = append(violations, ItineraryIssue{Code: IssueEmptyDay, Day: day.Day,
+				Message: fmt.Sprintf("第 %d 天（%s）没有安排任何活动", day.Day, day.Date)})
+		}
+	}
+	if math.Abs(plan.TotalCost-total) > costTolerance {
+		fixed = append(fixed, ItineraryIssue{Code: IssueTotalCost,
+			Message: fmt.Sprintf("totalCost 为 %s 元，与各天 dailyCost 之和 %s 元不符，已改为各天之和",
+				formatCost(plan.TotalCost), formatCost(total))})
+		plan.TotalCost = total
+	}
+
+	if !datesOK {
+		// 新请求在接口中已校验日期，这里是无法修正的旧数据，不要求模型重新生成
+		violations = append(violations, ItineraryIssue{Code: IssueInvalidDates,
+			Message: fmt.Sprintf("出发日期 %q 或返回日期 %q 无效，未校验行程日期和天数", req.StartDate, req.EndDate)})
+	} else if len(plan.Itinerary) != days {
+		violations = append(violations, ItineraryIssue{Code: IssueDayCount,
+			Message: fmt.Sprintf("行程共 %d 天，但 %s 至 %s 应为 %d 天，itinerary 必须恰好包含 %d 天",
+				len(plan.Itinerary), req.StartDate, req.EndDate, days, days)})
+	}
+	if req.Budget > 0 && plan.TotalCost > req.Budget+costTolerance {
+		violations = append(violations, ItineraryIssue{Code: IssueOverBudget,
+			Message: fmt.Sprintf("总费用 %s 元超出预算 %s 元，需要减少 %s 元",
+				formatCost(plan.TotalCost), formatCost(req.Budget), formatCost(plan.TotalCost-req.Budget))})
+	}
+	return fixed, violations
+}
+
+// generateValidated 用 call 调用模型生成行程，修正可修正的问题；仍有问题时把问题和上一次的输出附在提示词后
+// 重新生成，最多重试 MaxItineraryRepairs 次。重试失败或次数用尽时返回问题最少的一次结果，
+// 剩余问题记入报告的 Warnings；一次有效结果都没有时返回错误。onRepair 在每次重试前调用，可为 nil
+func generateValidated(ctx context.Context, req *TripPlanRequest, call func(prompt string) (string, error),
+	onRepair func(attempt int, issues []ItineraryIssue) error) (*TripPlan, *ItineraryReport, error) {
+	basePrompt := buildPrompt(req)
+	prompt := basePrompt
+
+	var (
+		best       *TripPlan
+		bestReport *ItineraryReport
+		lastErr    error
+		attempts   int
+	)
+	for {
+		attempts++
+		content, err := call(prompt)
+		if err != nil {
+			if best == nil {
+				return nil, nil, fmt.Errorf("call model: %w", err)
+			}
+			LogWarn("Itinerary repair attempt %d failed, keeping previous plan: %v", attempts-1, err)
+			break
+		}
+
+		var issues []ItineraryIssue
+		plan, err := parseTripPlan(content, req)
+		if err != nil {
+			lastErr = err
+			issues = []ItineraryIssue{{Code: IssueInvalidJSON, Message: "输出不是合法的行程 JSON：" + err.Error()}}
+		} else {
+			fixed, violations := NormalizeTripPlan(plan, req)
+			if best == nil || len(violations) <= len(bestReport.Warnings) {
+				best, bestReport = plan, &ItineraryReport{Fixed: fixed, Warnings: violations}
+			}
+			issues = violations
+		}
+		if !needsRepair(issues) || attempts > MaxItineraryRepairs {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < minRepairWindow {
+			LogWarn("Skipping itinerary repair, only %v left before deadline", time.Until(deadline).Round(time.Second))
+			break
+		}
+		if onRepair != nil {
+			if err := onRepair(attempts, issues); err != nil {
+				return nil, nil, err
+			}
+		}
+		prompt = buildRepairPrompt(basePrompt, content, issues)
+	}
+	if best == nil {
+		return nil, nil, lastErr
+	}
+
+	bestReport.Attempts = attempts
+	if bestReport.Fixed == nil {
+		bestReport.Fixed = []ItineraryIssue{}
+	}
+	if bestReport.Warnings == nil {
+		bestReport.Warnings = []ItineraryIssue{}
+	}
+	return best, bestReport, nil
+}
+
+// needsRepair 是否有重新生成可能解决的问题
+func needsRepair(issues []ItineraryIssue) bool {
+	for _, issue := range issues {
+		if issue.Code != IssueInvalidDates {
+			return true
+		}
+	}
+	return false
+}
+
+// buildRepairPrompt 在原提示词后附上上一次的输出和其中的问题，要求模型修正后重新输出
+func buildRepairPrompt(basePrompt, previous string, issues []ItineraryIssue) string {
+	var b strings.Builder
+	b.WriteString(basePrompt)
+	b.WriteString("\n\n你上一次输出的行程如下：\n")
+	b.WriteString(previous)
+	b.WriteString("\n\n其中存在以下问题：\n")
+	for i, issue := range issues {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, issue.Message)
+	}
+	b.WriteString("\n请修正以上全部问题，其余内容尽量保持不变，严格按JSON格式重新输出完整的行程计划：")
+	return b.String()
+}
@@ -0,0 +1,448 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueCodes 取出行程问题的代码
+func issueCodes(issues []ItineraryIssue) []string {
+	codes := make([]string, len(issues))
+	for i, issue := range issues {
+		codes[i] = issue.Code
+	}
+	return codes
+}
+
+func sameIssues(got []ItineraryIssue, want []string) bool {
+	return strings.Join(issueCodes(got), ",") == strings.Join(want, ",")
+}
+
+var testValidationRequest = TripPlanRequest{Destination: "北京", StartDate: "2026-11-01", EndDate: "2026-11-03", Budget: 1000, Travelers: 1}
+
+// testValidPlan 三天、每天一项活动、费用一致且不超预算的行程
+func testValidPlan() *TripPlan {
+	plan := &TripPlan{Summary: "valid"}
+	for i, cost := range []float64{100, 200, 300} {
+		plan.Itinerary = append(plan.Itinerary, DayItinerary{
+			Day:        i + 1,
+			Date:       time.Date(2026, 11, 1+i, 0, 0, 0, 0, time.UTC).Format("2006-01-02"),
+			Activities: []Activity{{Name: "活动", Cost: cost}},
+			DailyCost:  cost,
+		})
+		plan.TotalCost += cost
+	}
+	return plan
+}
+
+func TestNormalizeTripPlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        TripPlanRequest
+		mutate     func(p *TripPlan)
+		fixed      []string
+		violations []string
+	}{
+		{name: "valid plan", mutate: func(p *TripPlan) {}},
+		{
+			name:   "day numbers",
+			mutate: func(p *TripPlan) { p.Itinerary[0].Day = 0; p.Itinerary[1].Day = 3; p.Itinerary[2].Day = 2 },
+			fixed:  []string{IssueDayNumber, IssueDayNumber, IssueDayNumber},
+		},
+		{
+			name:   "dates",
+			mutate: func(p *TripPlan) { p.Itinerary[1].Date = "2026-11-05"; p.Itinerary[2].Date = "" },
+			fixed:  []string{IssueDate, IssueDate},
+		},
+		{
+			// 无法校验日期和天数时不修正日期，以警告说明
+			name: "reversed request dates",
+			req:  TripPlanRequest{StartDate: "2026-11-03", EndDate: "2026-11-01", Budget: 1000},
+			mutate: func(p *TripPlan) {
+				p.Itinerary[1].Date = "2026-11-05"
+				p.Itinerary = p.Itinerary[:2]
+				p.TotalCost = 300
+			},
+			violations: []string{IssueInvalidDates},
+		},
+		{
+			name:       "unparseable request dates",
+			req:        TripPlanRequest{StartDate: "11/01/2026", EndDate: "2026-11-03", Budget: 1000},
+			mutate:     func(p *TripPlan) { p.Itinerary[0].Date = "" },
+			violations: []string{IssueInvalidDates},
+		},
+		{
+			name:       "invalid request dates with other issues",
+			req:        TripPlanRequest{StartDate: "2026-11-01", EndDate: "2026-13-01", Budget: 500},
+			mutate:     func(p *TripPlan) {},
+			violations: []string{IssueInvalidDates, IssueOverBudget},
+		},
+		{
+			name: "negative cost",
+			mutate: func(p *TripPlan) {
+				p.Itinerary[1].Activities[0].Cost = -200
+				p.Itinerary[1].DailyCost = -200
+				p.TotalCost = 200
+			},
+			fixed: []string{IssueNegativeCost, IssueDailyCost, IssueTotalCost},
+		},
+		{
+			name:   "daily cost",
+			mutate: func(p *TripPlan) { p.Itinerary[0].DailyCost = 999 },
+			fixed:  []string{IssueDailyCost},
+		},
+		{
+			name:   "total cost",
+			mutate: func(p *TripPlan) { p.TotalCost = 1 },
+			fixed:  []string{IssueTotalCost},
+		},
+		{
+			name:   "within tolerance",
+			mutate: func(p *TripPlan) { p.Itinerary[0].DailyCost += 0.005 },
+		},
+		{
+			name:       "too few days",
+			mutate:     func(p *TripPlan) { p.Itinerary = p.Itinerary[:2]; p.TotalCost = 300 },
+			violations: []string{IssueDayCount},
+		},
+		{
+			name: "too many days",
+			mutate: func(p *TripPlan) {
+				p.Itinerary = append(p.Itinerary, DayItinerary{Day: 4, Date: "2026-11-04", Activities: []Activity{{Name: "活动"}}})
+			},
+			violations: []string{IssueDayCount},
+		},
+		{
+			name:       "empty day",
+			mutate:     func(p *TripPlan) { p.Itinerary[1].Activities = nil; p.Itinerary[1].DailyCost = 0; p.TotalCost = 400 },
+			violations: []string{IssueEmptyDay},
+		},
+		{
+			name: "over budget",
+			mutate: func(p *TripPlan) {
+				p.Itinerary[2].Activities[0].Cost = 800.5
+				p.Itinerary[2].DailyCost = 800.5
+				p.TotalCost = 1100.5
+			},
+			violations: []string{IssueOverBudget},
+		},
+		{
+			name: "exactly on budget",
+			mutate: func(p *TripPlan) {
+				p.Itinerary[2].Activities[0].Cost = 700
+				p.Itinerary[2].DailyCost = 700
+				p.TotalCost = 1000
+			},
+		},
+		{
+			name: "no budget",
+			req:  TripPlanRequest{StartDate: "2026-11-01", EndDate: "2026-11-03"},
+			mutate: func(p *TripPlan) {
+				p.Itinerary[2].Activities[0].Cost = 5000
+				p.Itinerary[2].DailyCost = 5000
+				p.TotalCost = 5300
+			},
+		},
+		{
+			// 先修正费用再检查预算：修正后的总费用超出预算
+			name:       "over budget after fixing the total",
+			mutate:     func(p *TripPlan) { p.Itinerary[2].Activities[0].Cost = 900; p.TotalCost = 600 },
+			fixed:      []string{IssueDailyCost, IssueTotalCost},
+			violations: []string{IssueOverBudget},
+		},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		if req.StartDate == "" {
+			req = testValidationRequest
+		}
+		plan := testValidPlan()
+		tt.mutate(plan)
+		fixed, violations := NormalizeTripPlan(plan, &req)
+		if !sameIssues(fixed, tt.fixed) || !sameIssues(violations, tt.violations) {
+			t.Errorf("%s: NormalizeTripPlan = %v, %v; want %v, %v", tt.name, issueCodes(fixed), issueCodes(violations), tt.fixed, tt.violations)
+			continue
+		}
+
+		// 修正后序号连续、日期与出发日期一致、费用之间一致
+		start, _, datesOK := tripDateRange(&req)
+		total := 0.0
+		for i, day := range plan.Itinerary {
+			if day.Day != i+1 {
+				t.Errorf("%s: day %d numbered %d", tt.name, i+1, day.Day)
+			}
+			if want := start.AddDate(0, 0, i).Format("2006-01-02"); datesOK && day.Date != want {
+				t.Errorf("%s: day %d date = %q; want %q", tt.name, i+1, day.Date, want)
+			}
+			sum := 0.0
+			for _, a := range day.Activities {
+				if a.Cost < 0 {
+					t.Errorf("%s: day %d has a negative cost %v", tt.name, i+1, a.Cost)
+				}
+				sum += a.Cost
+			}
+			if math.Abs(day.DailyCost-sum) > costTolerance {
+				t.Errorf("%s: day %d dailyCost = %v; want %v", tt.name, i+1, day.DailyCost, sum)
+			}
+			total += day.DailyCost
+		}
+		if math.Abs(plan.TotalCost-total) > costTolerance {
+			t.Errorf("%s: totalCost = %v; want %v", tt.name, plan.TotalCost, total)
+		}
+	}
+}
+
+// testModelOutput 模型输出的行程 JSON
+func testModelOutput(t *testing.T, plan *TripPlan) string {
+	t.Helper()
+	content, err := json.Marshal(map[string]interface{}{"itinerary": plan.Itinerary, "totalCost": plan.TotalCost, "summary": plan.Summary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// overBudgetPlan 超出预算的行程；dropDay 时少一天，另有一个 day_count 问题
+func overBudgetPlan(summary string, dropDay bool) *TripPlan {
+	plan := testValidPlan()
+	plan.Summary = summary
+	plan.Itinerary[2].Activities[0].Cost = 900
+	plan.Itinerary[2].DailyCost = 900
+	plan.TotalCost = 1200
+	if dropDay {
+		plan.Itinerary = plan.Itinerary[:2]
+		plan.Itinerary[1].Activities[0].Cost = 1000
+		plan.Itinerary[1].DailyCost = 1000
+		plan.TotalCost = 1100
+	}
+	return plan
+}
+
+// stubModel 依次返回 outputs 中的输出，用完后重复最后一个，并记录收到的提示词
+type stubModel struct {
+	outputs []string
+	errs    map[int]error
+	prompts []string
+}
+
+func (m *stubModel) call(prompt string) (string, error) {
+	m.prompts = append(m.prompts, prompt)
+	n := len(m.prompts) - 1
+	if err := m.errs[n]; err != nil {
+		return "", err
+	}
+	return m.outputs[min(n, len(m.outputs)-1)], nil
+}
+
+// setMaxItineraryRepairs 在测试期间替换重试次数
+func setMaxItineraryRepairs(t *testing.T, n int) {
+	saved := MaxItineraryRepairs
+	MaxItineraryRepairs = n
+	t.Cleanup(func() { MaxItineraryRepairs = saved })
+}
+
+func TestGenerateValidatedRepairLimit(t *testing.T) {
+	bad := testModelOutput(t, overBudgetPlan("bad", false))
+	for _, repairs := range []int{0, 1, 2, 3} {
+		setMaxItineraryRepairs(t, repairs)
+		m := &stubModel{outputs: []string{bad}}
+		var repaired []int
+		plan, report, err := generateValidated(context.Background(), &testValidationRequest, m.call, func(attempt int, issues []ItineraryIssue) error {
+			repaired = append(repaired, attempt)
+			return nil
+		})
+		if err != nil || plan == nil {
+			t.Fatalf("repairs %d: generateValidated = %v, %v", repairs, plan, err)
+		}
+		if len(m.prompts) != repairs+1 || report.Attempts != repairs+1 || len(repaired) != repairs {
+			t.Errorf("repairs %d: %d calls, %d attempts, %d repairs; want %d calls", repairs, len(m.prompts), report.Attempts, len(repaired), repairs+1)
+		}
+		if !sameIssues(report.Warnings, []string{IssueOverBudget}) {
+			t.Errorf("repairs %d: warnings = %v; want over_budget", repairs, issueCodes(report.Warnings))
+		}
+		// 重试的提示词附上上一次的输出和问题
+		for _, prompt := range m.prompts[1:] {
+			if !strings.Contains(prompt, bad) || !strings.Contains(prompt, report.Warnings[0].Message) {
+				t.Errorf("repairs %d: repair prompt lacks the previous output or its issues", repairs)
+			}
+		}
+	}
+
+	// 没有问题时不重试
+	setMaxItineraryRepairs(t, 2)
+	m := &stubModel{outputs: []string{testModelOutput(t, testValidPlan())}}
+	if _, report, err := generateValidated(context.Background(), &testValidationRequest, m.call, nil); err != nil || len(m.prompts) != 1 || report.Attempts != 1 || len(report.Warnings) != 0 {
+		t.Fatalf("valid plan = %+v, %v after %d calls; want one call without warnings", report, err, len(m.prompts))
+	}
+}
+
+func TestGenerateValidatedDeadline(t *testing.T) {
+	setMaxItineraryRepairs(t, 2)
+	bad := testModelOutput(t, overBudgetPlan("bad", false))
+	tests := []struct {
+		timeout time.Duration
+		calls   int
+	}{
+		{minRepairWindow / 2, 1},
+		{minRepairWindow - time.Second, 1},
+		{minRepairWindow * 2, 3},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		m := &stubModel{outputs: []string{bad}}
+		plan, report, err := generateValidated(ctx, &testValidationRequest, m.call, nil)
+		cancel()
+		if err != nil || plan == nil || len(m.prompts) != tt.calls || report.Attempts != tt.calls {
+			t.Errorf("timeout %v: %d calls, %+v, %v; want %d calls", tt.timeout, len(m.prompts), report, err, tt.calls)
+			continue
+		}
+		// 截止时间不足时保留已生成的行程，问题记入警告
+		if !sameIssues(report.Warnings, []string{IssueOverBudget}) {
+			t.Errorf("timeout %v: warnings = %v; want over_budget", tt.timeout, issueCodes(report.Warnings))
+		}
+	}
+}
+
+func TestGenerateValidatedKeepsFewestIssues(t *testing.T) {
+	setMaxItineraryRepairs(t, 3)
+	twoIssues := testModelOutput(t, overBudgetPlan("two issues", true))
+	oneIssue := testModelOutput(t, overBudgetPlan("one issue", false))
+	tests := []struct {
+		name     string
+		outputs  []string
+		errs     map[int]error
+		summary  string
+		warnings []string
+		attempts int
+	}{
+		{
+			name:     "later plan with fewer issues",
+			outputs:  []string{twoIssues, oneIssue, twoIssues, "not json"},
+			summary:  "one issue",
+			warnings: []string{IssueOverBudget},
+			attempts: 4,
+		},
+		{
+			name:     "earlier plan with fewer issues",
+			outputs:  []string{oneIssue, twoIssues, "not json", twoIssues},
+			summary:  "one issue",
+			warnings: []string{IssueOverBudget},
+			attempts: 4,
+		},
+		{
+			name:     "invalid JSON first",
+			outputs:  []string{"not json", twoIssues, "{", "[]"},
+			summary:  "two issues",
+			warnings: []string{IssueDayCount, IssueOverBudget},
+			attempts: 4,
+		},
+		{
+			name:     "repair ends when a plan is valid",
+			outputs:  []string{twoIssues, testModelOutput(t, testValidPlan()), oneIssue},
+			summary:  "valid",
+			warnings: []string{},
+			attempts: 2,
+		},
+		{
+			// 重试调用失败时保留之前的结果
+			name:     "repair call fails",
+			outputs:  []string{twoIssues, oneIssue},
+			errs:     map[int]error{1: errors.New("upstream unavailable")},
+			summary:  "two issues",
+			warnings: []string{IssueDayCount, IssueOverBudget},
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		m := &stubModel{outputs: tt.outputs, errs: tt.errs}
+		plan, report, err := generateValidated(context.Background(), &testValidationRequest, m.call, nil)
+		if err != nil {
+			t.Errorf("%s: generateValidated: %v", tt.name, err)
+			continue
+		}
+		if plan.Summary != tt.summary || !sameIssues(report.Warnings, tt.warnings) || report.Attempts != tt.attempts {
+			t.Errorf("%s: got %q with warnings %v after %d attempts; want %q with %v after %d",
+				tt.name, plan.Summary, issueCodes(report.Warnings), report.Attempts, tt.summary, tt.warnings, tt.attempts)
+		}
+	}
+
+	// 一次有效结果都没有时返回错误
+	m := &stubModel{outputs: []string{"not json"}}
+	if plan, _, err := generateValidated(context.Background(), &testValidationRequest, m.call, nil); err == nil || plan != nil {
+		t.Fatalf("only invalid output = %v, %v; want an error", plan, err)
+	}
+	m = &stubModel{outputs: []string{twoIssues}, errs: map[int]error{0: errors.New("upstream unavailable")}}
+	if _, _, err := generateValidated(context.Background(), &testValidationRequest, m.call, nil); err == nil {
+		t.Fatal("failed first call returned no error")
+	}
+}
+
+func TestJobRunnerWarningsFromValidation(t *testing.T) {
+	setMaxItineraryRepairs(t, 1)
+	// 总费用可以自动修正，超出预算需要重试；重试后仍超出预算
+	plan := testGeneratedPlan(&testJobRequest)
+	plan.Itinerary[0].Activities[0].Cost = 1500
+	out := testModelOutput(t, plan)
+	m := &stubModel{outputs: []string{out}}
+	r, stores, u := newTestJobRunner(t, func(ctx context.Context, req *TripPlanRequest) (*TripPlan, *ItineraryReport, error) {
+		return generateValidated(ctx, req, m.call, nil)
+	})
+	job, err := r.EnqueueTripPlan(context.Background(), u, &testJobRequest)
+	if err != nil {
+		t.Fatalf("EnqueueTripPlan: %v", err)
+	}
+	j := waitJob(t, stores, job.ID, finished)
+	if j.Status != JobSucceeded || j.TripID == "" {
+		t.Fatalf("job = %+v; want succeeded with a trip", j)
+	}
+	if len(m.prompts) != 2 || !sameIssues(j.Warnings, []string{IssueOverBudget}) {
+		t.Fatalf("job warnings = %v after %d calls; want only over_budget after 2", issueCodes(j.Warnings), len(m.prompts))
+	}
+	if p, _ := stores.Trips.GetTripPlan(context.Background(), j.TripID); p == nil || p.TotalCost != 1500 {
+		t.Fatalf("saved trip = %+v; want the normalized plan", p)
+	}
+}
+
+func TestGenerateValidatedInvalidDates(t *testing.T) {
+	setMaxItineraryRepairs(t, 2)
+	req := testValidationRequest
+	req.StartDate, req.EndDate = "2026-11-03", "2026-11-01"
+
+	// 重新生成无法解决无效的请求日期：不重试，作为警告返回
+	m := &stubModel{outputs: []string{testModelOutput(t, testValidPlan())}}
+	_, report, err := generateValidated(context.Background(), &req, m.call, nil)
+	if err != nil || len(m.prompts) != 1 || !sameIssues(report.Warnings, []string{IssueInvalidDates}) {
+		t.Fatalf("invalid dates = %+v, %v after %d calls; want one call with an invalid_dates warning", report, err, len(m.prompts))
+	}
+
+	// 同时有其他问题时仍然重试
+	m = &stubModel{outputs: []string{testModelOutput(t, overBudgetPlan("bad", false))}}
+	_, report, err = generateValidated(context.Background(), &req, m.call, nil)
+	if err != nil || len(m.prompts) != 3 || !sameIssues(report.Warnings, []string{IssueInvalidDates, IssueOverBudget}) {
+		t.Fatalf("invalid dates and over budget = %+v, %v after %d calls; want 3 calls", report, err, len(m.prompts))
+	}
+}
+
+func TestValidateTripDates(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"2026-11-01", "2026-11-03", nil},
+		{"2026-11-01", "2026-11-01", nil},
+		{"2026-11-03", "2026-11-01", []string{CodeInvalidRange}},
+		{"11/01/2026", "2026-11-03", []string{CodeInvalidFormat}},
+		{"2026-11-01", "2026-02-30", []string{CodeInvalidFormat}},
+		{"", "", []string{CodeInvalidFormat, CodeInvalidFormat}},
+	}
+	for _, tt := range tests {
+		if got := ValidateTripDates(tt.start, tt.end); !sameCodes(got, tt.want) {
+			t.Errorf("ValidateTripDates(%q, %q) = %v; want %v", tt.start, tt.end, fieldCodes(got), tt.want)
+		}
+	}
+}
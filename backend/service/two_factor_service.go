@@ -0,0 +1,471 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrTwoFactorNotEnabled   = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrInvalidTwoFactorCode  = errors.New("invalid two-factor code")
+	ErrInvalidLoginChallenge = errors.New("invalid or expired login challenge")
+)
+
+// TOTPIssuer 身份验证器应用中显示的服务名称，可通过配置修改
+var TOTPIssuer = "AI Travel Planner"
+
+// LoginChallengeTTL 密码验证通过后输入两步验证码的时限
+var LoginChallengeTTL = 5 * time.Minute
+
+// TOTP 参数与大多数身份验证器应用的默认值一致（RFC 6238，HMAC-SHA1）
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // 前后各容忍一个时间步，应对时钟偏差
+
+	recoveryCodeCount    = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789" // 去掉易混淆的 i l o 0 1
+)
+
+// TwoFactor 用户的两步验证设置。开始设置后 Enabled 为 false，用验证码确认后才启用
+type TwoFactor struct {
+	UserID        int        `json:"userId"`
+	Username      string     `json:"username"`
+	Secret        string     `json:"secret"`        // base32 编码的 TOTP 密钥
+	Enabled       bool       `json:"enabled"`       // 是否已确认启用
+	RecoveryCodes []string   `json:"recoveryCodes"` // 未使用的恢复码的 SHA256 摘要
+	LastStep      int64      `json:"lastStep"`      // 最近一次通过验证的时间步，同一验证码不能重复使用
+	CreatedAt     time.Time  `json:"createdAt"`
+	EnabledAt     *time.Time `json:"enabledAt,omitempty"`
+}
+
+// LoginChallenge 密码验证通过、等待两步验证的登录，只保存令牌的 SHA256 摘要
+type LoginChallenge struct {
+	TokenHash string    `json:"tokenHash"`
+	UserID    int       `json:"userId"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// TwoFactorStore 两步验证设置与登录挑战存储
+type TwoFactorStore interface {
+	// GetTwoFactor 获取用户的两步验证设置，不存在时返回 nil, nil
+	GetTwoFactor(ctx context.Context, username string) (*TwoFactor, error)
+	// CreateTwoFactor 保存尚未启用的设置，替换之前未完成的设置；已启用时返回 ErrTwoFactorEnabled
+	CreateTwoFactor(ctx context.Context, tf *TwoFactor) error
+	// UpdateTwoFactor 原子地读取、修改并写回设置，fn 返回错误时不写入；不存在时返回 ErrTwoFactorNotEnabled
+	UpdateTwoFactor(ctx context.Context, username string, fn func(tf *TwoFactor) error) (*TwoFactor, error)
+	// DeleteTwoFactor 删除用户的两步验证设置，不存在时不做任何操作
+	DeleteTwoFactor(ctx context.Context, username string) error
+	// CreateLoginChallenge 保存登录挑战
+	CreateLoginChallenge(ctx context.Context, ch *LoginChallenge) error
+	// GetLoginChallenge 获取登录挑战，不存在或已过期时返回 nil, nil
+	GetLoginChallenge(ctx context.Context, tokenHash string) (*LoginChallenge, error)
+	// DeleteLoginChallenge 删除登录挑战
+	DeleteLoginChallenge(ctx context.Context, tokenHash string) error
+}
+
+// TwoFactorSetup 开始设置时返回给客户端的密钥，uri 可生成二维码供身份验证器应用扫描
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUrl"`
+}
+
+// TwoFactorStatus 两步验证状态
+type TwoFactorStatus struct {
+	Enabled                bool       `json:"enabled"`
+	EnabledAt              *time.Time `json:"enabledAt,omitempty"`
+	RecoveryCodesRemaining int        `json:"recoveryCodesRemaining"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode 计算密钥在指定时间步的验证码
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// matchTOTP 在容忍的时间步范围内查找与 code 匹配且晚于 lastStep 的时间步
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI 身份验证器应用使用的 otpauth:// 地址
+func provisioningURI(secret, username string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(TOTPIssuer) + ":" + url.PathEscape(username)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// generateRecoveryCodes 生成一组恢复码，返回明文和摘要
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	// 每个字符单独均匀抽取；直接对随机字节取模会因 256 不能被字母表长度整除而偏向前面的字符
+	alphabetLen := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := range codes {
+		var b strings.Builder
+		for j := 0; j < 10; j++ {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			n, err := rand.Int(rand.Reader, alphabetLen)
+			if err != nil {
+				return nil, nil, err
+			}
+			b.WriteByte(recoveryCodeAlphabet[n.Int64()])
+		}
+		codes[i] = b.String()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode 忽略大小写、空格和连字符
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// GetTwoFactorStatus 查询用户的两步验证状态
+func GetTwoFactorStatus(ctx context.Context, store TwoFactorStore, username string) (*TwoFactorStatus, error) {
+	tf, err := store.GetTwoFactor(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil || !tf.Enabled {
+		return &TwoFactorStatus{}, nil
+	}
+	return &TwoFactorStatus{Enabled: true, EnabledAt: tf.EnabledAt, RecoveryCodesRemaining: len(tf.RecoveryCodes)}, nil
+}
+
+// TwoFactorEnabled 判断用户是否已启用两步验证
+func TwoFactorEnabled(ctx context.Context, store TwoFactorStore, username string) (bool, error) {
+	tf, err := store.GetTwoFactor(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return tf != nil && tf.Enabled, nil
+}
+
+// BeginTwoFactorSetup 生成新的 TOTP 密钥，等待用户用验证码确认；已启用时返回 ErrTwoFactorEnabled
+func BeginTwoFactorSetup(ctx context.Context, store TwoFactorStore, user *UserRecord) (*TwoFactorSetup, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	tf := &TwoFactor{
+		UserID:        user.ID,
+		Username:      user.Username,
+		Secret:        totpEncoding.EncodeToString(key),
+		RecoveryCodes: []string{},
+		CreatedAt:     time.Now(),
+	}
+	if err := store.CreateTwoFactor(ctx, tf); err != nil {
+		return nil, err
+	}
+	return &TwoFactorSetup{Secret: tf.Secret, URI: provisioningURI(tf.Secret, user.Username)}, nil
+}
+
+// EnableTwoFactor 用身份验证器应用生成的验证码确认设置并启用两步验证，返回只展示这一次的恢复码。
+// 尚未开始设置时返回 ErrTwoFactorNotEnabled，验证码错误时返回 ErrInvalidTwoFactorCode
+func EnableTwoFactor(ctx context.Context, store TwoFactorStore, username, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.UpdateTwoFactor(ctx, username, func(tf *TwoFactor) error {
+		if tf.Enabled {
+			return ErrTwoFactorEnabled
+		}
+		step, ok := matchTOTP(tf.Secret, strings.TrimSpace(code), tf.LastStep, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+		now := time.Now()
+		tf.Enabled = true
+		tf.EnabledAt = &now
+		tf.LastStep = step
+		tf.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactor 校验验证码或恢复码，恢复码使用后作废，TOTP 验证码在有效期内也不能重复使用。
+// 返回是否使用了恢复码；未启用时返回 ErrTwoFactorNotEnabled，校验失败时返回 ErrInvalidTwoFactorCode
+func VerifyTwoFactor(ctx context.Context, store TwoFactorStore, username, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	recovery := false
+	_, err := store.UpdateTwoFactor(ctx, username, func(tf *TwoFactor) error {
+		if !tf.Enabled {
+			return ErrTwoFactorNotEnabled
+		}
+		if step, ok := matchTOTP(tf.Secret, code, tf.LastStep, time.Now()); ok {
+			tf.LastStep = step
+			return nil
+		}
+		hash := hashToken(normalizeRecoveryCode(code))
+		for i, h := range tf.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				tf.RecoveryCodes = append(tf.RecoveryCodes[:i:i], tf.RecoveryCodes[i+1:]...)
+				recovery = true
+				return nil
+			}
+		}
+		return ErrInvalidTwoFactorCode
+	})
+	return recovery, err
+}
+
+// RegenerateRecoveryCodes 校验验证码后生成新的恢复码，之前的恢复码全部作废
+func RegenerateRecoveryCodes(ctx context.Context, store TwoFactorStore, username, code string) ([]string, error) {
+	if _, err := VerifyTwoFactor(ctx, store, username, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.UpdateTwoFactor(ctx, username, func(tf *TwoFactor) error {
+		if !tf.Enabled {
+			return ErrTwoFactorNotEnabled
+		}
+		tf.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor 校验验证码或恢复码后关闭两步验证
+func DisableTwoFactor(ctx context.Context, store TwoFactorStore, username, code string) error {
+	if _, err := VerifyTwoFactor(ctx, store, username, code); err != nil {
+		return err
+	}
+	return store.DeleteTwoFactor(ctx, username)
+}
+
+// CreateLoginChallenge 为密码验证通过的用户创建登录挑战，返回只展示这一次的挑战令牌
+func CreateLoginChallenge(ctx context.Context, store TwoFactorStore, user *UserRecord) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ch := &LoginChallenge{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		Username:  user.Username,
+		ExpiresAt: time.Now().Add(LoginChallengeTTL),
+	}
+	if err := store.CreateLoginChallenge(ctx, ch); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupLoginChallenge 查找登录挑战，不存在或已过期时返回 ErrInvalidLoginChallenge
+func LookupLoginChallenge(ctx context.Context, store TwoFactorStore, token string) (*LoginChallenge, error) {
+	ch, err := store.GetLoginChallenge(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, ErrInvalidLoginChallenge
+	}
+	return ch, nil
+}
+
+// CompleteLoginChallenge 校验两步验证码，成功后删除挑战并返回用户；验证码错误时挑战仍然有效，
+// 返回 ErrInvalidTwoFactorCode。用户已注销或已关闭两步验证时删除挑战并返回 ErrInvalidLoginChallenge
+func CompleteLoginChallenge(ctx context.Context, stores *Stores, ch *LoginChallenge, code string) (*UserRecord, bool, error) {
+	user, err := stores.Users.GetUser(ctx, ch.Username)
+	if err != nil {
+		return nil, false, err
+	}
+	recovery := false
+	if user != nil && user.ID == ch.UserID {
+		recovery, err = VerifyTwoFactor(ctx, stores.TwoFactor, ch.Username, code)
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			return nil, false, err
+		}
+		if err != nil && !errors.Is(err, ErrTwoFactorNotEnabled) {
+			return nil, false, err
+		}
+	}
+	if delErr := stores.TwoFactor.DeleteLoginChallenge(ctx, ch.TokenHash); delErr != nil {
+		return nil, false, delErr
+	}
+	if user == nil || user.ID != ch.UserID || err != nil {
+		return nil, false, ErrInvalidLoginChallenge
+	}
+	return user, recovery, nil
+}
+
+func twoFactorKey(username string) string  { return "two_factor:" + username }
+func loginChallengeKey(hash string) string { return "login_challenge:" + hash }
+
+// GetTwoFactor 获取两步验证设置
+func (s *RedisStore) GetTwoFactor(ctx context.Context, username string) (*TwoFactor, error) {
+	data, err := s.rdb.Get(ctx, twoFactorKey(username)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tf TwoFactor
+	if err := json.Unmarshal([]byte(data), &tf); err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// CreateTwoFactor 在监视设置键的事务中确认尚未启用后写入
+func (s *RedisStore) CreateTwoFactor(ctx context.Context, tf *TwoFactor) error {
+	key := twoFactorKey(tf.Username)
+	data, err := json.Marshal(tf)
+	if err != nil {
+		return err
+	}
+	return s.watchRetry(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var current TwoFactor
+			if err := json.Unmarshal([]byte(raw), &current); err != nil {
+				return err
+			}
+			if current.Enabled {
+				return ErrTwoFactorEnabled
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// UpdateTwoFactor 在监视设置键的事务中修改，并发校验同一验证码时只有一个成功
+func (s *RedisStore) UpdateTwoFactor(ctx context.Context, username string, fn func(tf *TwoFactor) error) (*TwoFactor, error) {
+	key := twoFactorKey(username)
+	var tf *TwoFactor
+	err := s.watchRetry(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrTwoFactorNotEnabled
+		}
+		if err != nil {
+			return err
+		}
+		tf = &TwoFactor{}
+		if err := json.Unmarshal([]byte(raw), tf); err != nil {
+			return err
+		}
+		if err := fn(tf); err != nil {
+			return err
+		}
+		data, err := json.Marshal(tf)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// DeleteTwoFactor 删除两步验证设置
+func (s *RedisStore) DeleteTwoFactor(ctx context.Context, username string) error {
+	return s.rdb.Del(ctx, twoFactorKey(username)).Err()
+}
+
+// CreateLoginChallenge 保存登录挑战，过期后自动删除
+func (s *RedisStore) CreateLoginChallenge(ctx context.Context, ch *LoginChallenge) error {
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, loginChallengeKey(ch.TokenHash), data, time.Until(ch.ExpiresAt)).Err()
+}
+
+// GetLoginChallenge 获取登录挑战
+func (s *RedisStore) GetLoginChallenge(ctx context.Context, tokenHash string) (*LoginChallenge, error) {
+	data, err := s.rdb.Get(ctx, loginChallengeKey(tokenHash)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ch LoginChallenge
+	if err := json.Unmarshal([]byte(data), &ch); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// DeleteLoginChallenge 删除登录挑战
+func (s *RedisStore) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	return s.rdb.Del(ctx, loginChallengeKey(tokenHash)).Err()
+}
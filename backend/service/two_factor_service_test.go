@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 附录 B 的 SHA-1 测试向量，验证码取 8 位结果的后 6 位
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		offset int64
+		ok     bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		step, ok := matchTOTP(secret, totpCode(key, current+tt.offset), 0, now)
+		if ok != tt.ok || (ok && step != current+tt.offset) {
+			t.Errorf("code of step %+d = %d, %t; want %t", tt.offset, step, ok, tt.ok)
+		}
+	}
+
+	// 不晚于 lastStep 的时间步不再接受，同一验证码不能重复使用
+	for _, offset := range []int64{-1, 0} {
+		code := totpCode(key, current+offset)
+		if _, ok := matchTOTP(secret, code, current+offset, now); ok {
+			t.Errorf("code of step %+d accepted at its own lastStep", offset)
+		}
+		if _, ok := matchTOTP(secret, code, current+1, now); ok {
+			t.Errorf("code of step %+d accepted after a later step was used", offset)
+		}
+	}
+	if step, ok := matchTOTP(secret, totpCode(key, current+1), current, now); !ok || step != current+1 {
+		t.Errorf("code of the next step after lastStep = %d, %t; want accepted", step, ok)
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := matchTOTP(secret, code, 0, now); ok {
+			t.Errorf("matchTOTP(%q) accepted", code)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", totpCode(key, current), 0, now); ok {
+		t.Error("matchTOTP accepted an invalid secret")
+	}
+}
+
+// enableTestTwoFactor 开始设置并以当前验证码启用两步验证，返回密钥和恢复码
+func enableTestTwoFactor(t *testing.T, store TwoFactorStore, u *UserRecord) ([]byte, []string) {
+	t.Helper()
+	ctx := context.Background()
+	setup, err := BeginTwoFactorSetup(ctx, store, u)
+	if err != nil {
+		t.Fatalf("BeginTwoFactorSetup: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(setup.Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	codes, err := EnableTwoFactor(ctx, store, u.Username, totpCode(key, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("EnableTwoFactor: %v", err)
+	}
+	return key, codes
+}
+
+// lastStep 最近一次通过验证的时间步；以它为基准而不是当前时间，测试跨过时间步边界时也不受影响
+func lastStep(t *testing.T, store TwoFactorStore, username string) int64 {
+	t.Helper()
+	tf, err := store.GetTwoFactor(context.Background(), username)
+	if err != nil || tf == nil {
+		t.Fatalf("GetTwoFactor = %+v, %v", tf, err)
+	}
+	return tf.LastStep
+}
+
+func TestVerifyTwoFactorRejectsReusedCode(t *testing.T) {
+	b := NewMemoryStore()
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	key, _ := enableTestTwoFactor(t, b, u)
+	current := lastStep(t, b, "alice")
+
+	// 启用时使用的验证码已记入 LastStep
+	if _, err := VerifyTwoFactor(ctx, b, "alice", totpCode(key, current)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("code used to enable = %v; want ErrInvalidTwoFactorCode", err)
+	}
+	next := totpCode(key, current+1)
+	if recovery, err := VerifyTwoFactor(ctx, b, "alice", " "+next+" "); err != nil || recovery {
+		t.Fatalf("next code = %t, %v; want accepted as a TOTP code", recovery, err)
+	}
+	if step := lastStep(t, b, "alice"); step != current+1 {
+		t.Fatalf("LastStep = %d; want %d", step, current+1)
+	}
+	for _, code := range []string{next, totpCode(key, current), totpCode(key, current-1)} {
+		if _, err := VerifyTwoFactor(ctx, b, "alice", code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("code at or below LastStep = %v; want ErrInvalidTwoFactorCode", err)
+		}
+	}
+	if _, err := VerifyTwoFactor(ctx, b, "bob", next); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Fatalf("user without two-factor = %v; want ErrTwoFactorNotEnabled", err)
+	}
+}
+
+func TestRecoveryCodesSingleUse(t *testing.T) {
+	b := NewMemoryStore()
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	_, codes := enableTestTwoFactor(t, b, u)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes; want %d", len(codes), recoveryCodeCount)
+	}
+
+	// 输入时忽略大小写、空格和连字符
+	variants := func(code string) []string {
+		return []string{
+			code,
+			strings.ToUpper(code),
+			strings.ReplaceAll(code, "-", ""),
+			strings.ReplaceAll(code, "-", " "),
+		}
+	}
+	for i, code := range codes {
+		if got := normalizeRecoveryCode(code); len(got) != 10 || strings.ContainsAny(got, "- ") {
+			t.Fatalf("normalizeRecoveryCode(%q) = %q", code, got)
+		}
+		forms := variants(code)
+		use := forms[i%len(forms)]
+		if recovery, err := VerifyTwoFactor(ctx, b, "alice", use); err != nil || !recovery {
+			t.Fatalf("recovery code %q = %t, %v; want accepted", use, recovery, err)
+		}
+		for _, again := range forms {
+			if _, err := VerifyTwoFactor(ctx, b, "alice", again); !errors.Is(err, ErrInvalidTwoFactorCode) {
+				t.Fatalf("reused recovery code %q = %v; want ErrInvalidTwoFactorCode", again, err)
+			}
+		}
+		if status, _ := GetTwoFactorStatus(ctx, b, "alice"); status.RecoveryCodesRemaining != len(codes)-i-1 {
+			t.Fatalf("%d recovery codes remaining; want %d", status.RecoveryCodesRemaining, len(codes)-i-1)
+		}
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	b := NewMemoryStore()
+	stores := NewStores(b)
+	ctx := context.Background()
+	u := mustCreateUser(t, ctx, b, "alice")
+	key, _ := enableTestTwoFactor(t, b, u)
+	current := lastStep(t, b, "alice")
+
+	token, err := CreateLoginChallenge(ctx, b, u)
+	if err != nil {
+		t.Fatalf("CreateLoginChallenge: %v", err)
+	}
+	ch, err := LookupLoginChallenge(ctx, b, token)
+	if err != nil || ch.Username != "alice" {
+		t.Fatalf("LookupLoginChallenge = %+v, %v", ch, err)
+	}
+	// 验证码错误时挑战仍然有效
+	if _, _, err := CompleteLoginChallenge(ctx, stores, ch, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("wrong code = %v; want ErrInvalidTwoFactorCode", err)
+	}
+	got, recovery, err := CompleteLoginChallenge(ctx, stores, ch, totpCode(key, current+1))
+	if err != nil || recovery || got.ID != u.ID {
+		t.Fatalf("CompleteLoginChallenge = %+v, %t, %v; want alice", got, recovery, err)
+	}
+	// 挑战只能使用一次
+	if _, err := LookupLoginChallenge(ctx, b, token); !errors.Is(err, ErrInvalidLoginChallenge) {
+		t.Fatalf("used challenge = %v; want ErrInvalidLoginChallenge", err)
+	}
+	if _, err := LookupLoginChallenge(ctx, b, "forged"); !errors.Is(err, ErrInvalidLoginChallenge) {
+		t.Fatalf("unknown challenge = %v; want ErrInvalidLoginChallenge", err)
+	}
+
+	// 过期的挑战
+	saved := LoginChallengeTTL
+	LoginChallengeTTL = -time.Second
+	t.Cleanup(func() { LoginChallengeTTL = saved })
+	expired, err := CreateLoginChallenge(ctx, b, u)
+	if err != nil {
+		t.Fatalf("CreateLoginChallenge: %v", err)
+	}
+	if _, err := LookupLoginChallenge(ctx, b, expired); !errors.Is(err, ErrInvalidLoginChallenge) {
+		t.Fatalf("expired challenge = %v; want ErrInvalidLoginChallenge", err)
+	}
+	LoginChallengeTTL = saved
+
+	// 关闭两步验证后挑战作废
+	token, _ = CreateLoginChallenge(ctx, b, u)
+	ch, _ = LookupLoginChallenge(ctx, b, token)
+	if err := b.DeleteTwoFactor(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteTwoFactor: %v", err)
+	}
+	if _, _, err := CompleteLoginChallenge(ctx, stores, ch, totpCode(key, current-1)); !errors.Is(err, ErrInvalidLoginChallenge) {
+		t.Fatalf("challenge after disabling two-factor = %v; want ErrInvalidLoginChallenge", err)
+	}
+	if _, err := LookupLoginChallenge(ctx, b, token); !errors.Is(err, ErrInvalidLoginChallenge) {
+		t.Fatalf("challenge kept after disabling two-factor = %v; want ErrInvalidLoginChallenge", err)
+	}
+}